@@ -0,0 +1,165 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// A worker configured by flags, running until it is signalled
+
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/signal"
+    "strings"
+    "syscall"
+    "time"
+
+    "../../mapreduce"
+)
+
+// The log levels of -log, lowest first
+var levels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+// A logger dropping the lines below its level
+type levelLogger struct {
+    logger *mapreduce.StdLogger
+    level  int
+}
+
+func (l *levelLogger) Debugf(format string, args ...interface{}) {
+    if l.level <= 0 {
+        l.logger.Debugf(format, args...)
+    }
+}
+
+func (l *levelLogger) Infof(format string, args ...interface{}) {
+    if l.level <= 1 {
+        l.logger.Infof(format, args...)
+    }
+}
+
+func (l *levelLogger) Warnf(format string, args ...interface{}) {
+    if l.level <= 2 {
+        l.logger.Warnf(format, args...)
+    }
+}
+
+func (l *levelLogger) Errorf(format string, args ...interface{}) {
+    l.logger.Errorf(format, args...)
+}
+
+// Print the error and exit with status 1
+func fail(format string, args ...interface{}) {
+    fmt.Fprintf(os.Stderr, "mrworker: "+format+"\n", args...)
+    os.Exit(1)
+}
+
+func main() {
+    masterAddr := flag.String("master", "", "the host:port of master, or its port on this host")
+    standbyAddr := flag.String("standby", "", "the host:port of the standby master, empty if there is none")
+    masterFile := flag.String("master-file", "", "the file holding the address of master instead of -master, read again when it changes")
+    masterSRV := flag.String("master-srv", "", "the DNS SRV name to look master up by instead of -master, e.g. _mapreduce._tcp.example.com")
+    port := flag.Int64("port", 0, "the port the worker listens on, 0 for a free one")
+    listen := flag.String("listen", "", "the host:port to listen on instead of every interface and -port")
+    advertise := flag.String("advertise", "", "the host:port master and other workers reach the worker at, default the host master sees it at")
+    host := flag.String("host", "", "the host the worker runs on, matched against input locations")
+    slots := flag.Int("slots", 1, "the number of tasks run at the same time")
+    dir := flag.String("dir", "", "the directory to run in, where intermediate files, caches and plugins go and relative input paths are read from")
+    pluginPath := flag.String("plugin", "", "the plugin with the map and reduce functions, default the one of master")
+    level := flag.String("log", "info", "the lowest level logged: debug, info, warn or error")
+    exitOnLost := flag.Bool("exit-on-lost-master", false, "exit once master cannot be reached, instead of reconnecting")
+    tlsCert := flag.String("tls-cert", "", "the certificate to serve and dial over TLS with, empty for plain TCP")
+    tlsKey := flag.String("tls-key", "", "the key of -tls-cert")
+    tlsCA := flag.String("tls-ca", "", "the CA that signs master and the other workers")
+    secretFile := flag.String("secret-file", "", "the file holding the secret of master, empty if it has none")
+    wire := flag.String("wire", mapreduce.WIRE_GOB, "the codec rpcs are encoded with, gob or jsonrpc, as master uses")
+    grace := flag.Duration("grace", 10*time.Second, "how long running tasks may take to finish on SIGINT or SIGTERM")
+    flag.Parse()
+
+    if *masterAddr == "" && *masterFile == "" && *masterSRV == "" {
+        flag.Usage()
+        fail("one of -master, -master-file and -master-srv is required")
+    }
+    if _, ok := levels[*level]; !ok {
+        fail("unknown log level %q", *level)
+    }
+    if *dir != "" {
+        if err := os.MkdirAll(*dir, 0755); err != nil {
+            fail("%v", err)
+        }
+        if err := os.Chdir(*dir); err != nil {
+            fail("%v", err)
+        }
+    }
+
+    // Without -plugin, the functions come with the plugin of master
+    worker := mapreduce.MakeWorker(*port, *masterAddr, nil, nil)
+    logger := mapreduce.NewStdLogger()
+    logger.Debug = *level == "debug"
+    worker.Logger = &levelLogger{logger: logger, level: levels[*level]}
+    worker.Slots = *slots
+    worker.Host = *host
+    worker.StandbyAddr = *standbyAddr
+    worker.ListenAddr = *listen
+    worker.AdvertiseAddr = *advertise
+    switch *wire {
+    case mapreduce.WIRE_GOB:
+    case mapreduce.WIRE_JSON:
+        worker.Codec = mapreduce.JSONCodec()
+    default:
+        fail("unknown wire codec %q", *wire)
+    }
+    switch {
+    case *masterFile != "":
+        worker.Resolver = mapreduce.FileResolver(*masterFile)
+    case *masterSRV != "":
+        worker.Resolver = mapreduce.SRVResolver("", "", *masterSRV)
+    }
+    if *exitOnLost {
+        worker.LostMaster = mapreduce.LOST_MASTER_EXIT
+    }
+    if *tlsCert != "" || *tlsKey != "" || *tlsCA != "" {
+        config, err := mapreduce.LoadTLSConfig(*tlsCert, *tlsKey, *tlsCA)
+        if err != nil {
+            fail("%v", err)
+        }
+        worker.TLS = config
+    }
+    if *secretFile != "" {
+        // Read from a file, so the secret does not show in the process list
+        data, err := ioutil.ReadFile(*secretFile)
+        if err != nil {
+            fail("%v", err)
+        }
+        worker.Secret = strings.TrimSpace(string(data))
+        if worker.Secret == "" {
+            fail("empty secret in %v", *secretFile)
+        }
+    }
+    if *pluginPath != "" {
+        if err := worker.LoadPlugin(*pluginPath); err != nil {
+            fail("%v", err)
+        }
+    }
+
+    // Installed first, so a signal while registering still shuts down cleanly
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+    if err := worker.StartWorker(); err != nil {
+        fail("%v", err)
+    }
+    worker.Logger.Infof("Worker %v listening on port %v, master at %v",
+        worker.Id(), worker.Port(), worker.MasterAddr())
+
+    // Shut down on SIGINT or SIGTERM, exit 1 if master is lost for good
+    select {
+    case sig := <-signals:
+        worker.Logger.Infof("Got %v, shut down", sig)
+        ctx, cancel := context.WithTimeout(context.Background(), *grace)
+        defer cancel()
+        worker.Shutdown(ctx)
+    case <-worker.Done():
+        fail("master lost")
+    }
+}
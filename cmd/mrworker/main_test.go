@@ -0,0 +1,177 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests running the mrworker binary against a master in the test
+
+package main
+
+import (
+    "bytes"
+    "context"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "syscall"
+    "testing"
+    "time"
+
+    "../../mapreduce"
+)
+
+// The mrworker binary and the word count plugin, built once by TestMain
+var binary, wcPlugin string
+
+func TestMain(m *testing.M) {
+    dir, err := ioutil.TempDir("", "mrworker")
+    if err != nil {
+        panic(err)
+    }
+    binary = filepath.Join(dir, "mrworker")
+    wcPlugin = filepath.Join(dir, "wc.so")
+    build := func(args ...string) {
+        cmd := exec.Command("go", append([]string{"build"}, args...)...)
+        cmd.Env = append(os.Environ(), "GO111MODULE=off")
+        if out, err := cmd.CombinedOutput(); err != nil {
+            os.RemoveAll(dir)
+            panic(string(out))
+        }
+    }
+    build("-o", binary, ".")
+    build("-buildmode=plugin", "-o", wcPlugin, "./testdata/wc")
+    code := m.Run()
+    os.RemoveAll(dir)
+    os.Exit(code)
+}
+
+type quietLogger struct{}
+
+func (quietLogger) Debugf(format string, args ...interface{}) {}
+func (quietLogger) Infof(format string, args ...interface{})  {}
+func (quietLogger) Warnf(format string, args ...interface{})  {}
+func (quietLogger) Errorf(format string, args ...interface{}) {}
+
+// Run a word count master of contents with options, shut down once the test ends
+func startMaster(t *testing.T, contents []string,
+    options ...mapreduce.Option) (*mapreduce.Master, string) {
+    t.Helper()
+    var files []string
+    inputs := t.TempDir()
+    for idx, content := range contents {
+        file := filepath.Join(inputs, "input-"+string(rune('a'+idx)))
+        if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+            t.Fatal(err)
+        }
+        files = append(files, file)
+    }
+    output := t.TempDir()
+    options = append([]mapreduce.Option{
+        mapreduce.WithOutputDir(output),
+        mapreduce.WithMapDir(t.TempDir()),
+        mapreduce.WithPlugin(wcPlugin),
+        mapreduce.WithLogger(quietLogger{}),
+        mapreduce.WithHeartbeatInterval(50 * time.Millisecond),
+    }, options...)
+    master, err := mapreduce.MakeMaster(files, 1, 0, options...)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := master.RunMaster(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        defer cancel()
+        master.Shutdown(ctx)
+    })
+    return master, output
+}
+
+// Start the binary with args, its stderr goes to the returned buffer
+func startBinary(t *testing.T, args ...string) (*exec.Cmd, *bytes.Buffer) {
+    t.Helper()
+    cmd := exec.Command(binary, args...)
+    stderr := &bytes.Buffer{}
+    cmd.Stderr = stderr
+    if err := cmd.Start(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { cmd.Process.Kill() })
+    return cmd, stderr
+}
+
+// Wait for cmd to exit, failing the test after timeout
+// Return its exit code
+func waitExit(t *testing.T, cmd *exec.Cmd, timeout time.Duration) int {
+    t.Helper()
+    done := make(chan error, 1)
+    go func() { done <- cmd.Wait() }()
+    select {
+    case err := <-done:
+        if exit, ok := err.(*exec.ExitError); ok {
+            return exit.ExitCode()
+        } else if err != nil {
+            t.Fatal(err)
+        }
+        return 0
+    case <-time.After(timeout):
+        t.Fatalf("mrworker still running after %v", timeout)
+        return -1
+    }
+}
+
+func TestRunsJobWithPluginOfMaster(t *testing.T) {
+    master, output := startMaster(t, []string{"a b a", "b c"})
+    cmd, stderr := startBinary(t, "-master", master.Addr().String(), "-dir", t.TempDir(),
+        "-slots", "2", "-log", "warn")
+
+    ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+    defer cancel()
+    if err := master.Wait(ctx); err != nil {
+        t.Fatalf("job: %v\n%s", err, stderr)
+    }
+    data, err := ioutil.ReadFile(filepath.Join(output, mapreduce.ROP+"-0"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := string(data); got != "a 2\nb 2\nc 1\n" {
+        t.Errorf("output %q, want the word counts", got)
+    }
+
+    // SIGTERM shuts it down cleanly
+    cmd.Process.Signal(syscall.SIGTERM)
+    if code := waitExit(t, cmd, 10*time.Second); code != 0 {
+        t.Fatalf("exit %v on SIGTERM\n%s", code, stderr)
+    }
+}
+
+func TestExitsWhenRegistrationIsRejected(t *testing.T) {
+    master, _ := startMaster(t, []string{"a"}, mapreduce.WithSecret("right"))
+    secret := filepath.Join(t.TempDir(), "secret")
+    if err := ioutil.WriteFile(secret, []byte("wrong\n"), 0600); err != nil {
+        t.Fatal(err)
+    }
+    cmd, stderr := startBinary(t, "-master", master.Addr().String(), "-secret-file", secret,
+        "-dir", t.TempDir())
+
+    if code := waitExit(t, cmd, 10*time.Second); code != 1 {
+        t.Fatalf("exit %v when rejected, want 1\n%s", code, stderr)
+    }
+    if !strings.Contains(stderr.String(), "mrworker: ") || !strings.Contains(stderr.String(), "secret") {
+        t.Errorf("no reason printed: %q", stderr)
+    }
+}
+
+func TestExitsOnBadFlags(t *testing.T) {
+    for name, args := range map[string][]string{
+        "no master": {"-slots", "1"},
+        "bad level": {"-master", "1234", "-log", "loud"},
+        "bad wire":  {"-master", "1234", "-wire", "xml"},
+    } {
+        t.Run(name, func(t *testing.T) {
+            cmd, stderr := startBinary(t, args...)
+            if code := waitExit(t, cmd, 10*time.Second); code != 1 {
+                t.Fatalf("exit %v, want 1\n%s", code, stderr)
+            }
+        })
+    }
+}
@@ -0,0 +1,23 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// The word count plugin the tests of mrworker run
+
+package main
+
+import (
+    "strconv"
+    "strings"
+
+    "../../../../mapreduce"
+)
+
+func Map(file, content string) []mapreduce.KeyValue {
+    var kvs []mapreduce.KeyValue
+    for _, word := range strings.Fields(content) {
+        kvs = append(kvs, mapreduce.KeyValue{Key: word, Value: "1"})
+    }
+    return kvs
+}
+
+func Reduce(key string, values []string) string {
+    return strconv.Itoa(len(values))
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
-    "math/rand"
+    "context"
+    "log"
+    "os"
+    "os/signal"
+    "strconv"
     "strings"
+    "syscall"
     "time"
 
     "../mapreduce"
@@ -16,8 +21,8 @@ func mapFunc(key, value string) []mapreduce.KeyValue {
     return kv
 }
 
-func mockReduce(key string, values []string) string {
-    return "hello world"
+func reduceFunc(key string, values []string) string {
+    return strconv.Itoa(len(values))
 }
 
 func main() {
@@ -28,18 +33,68 @@ func main() {
         "dataset/d4.txt",
         "dataset/d5.txt",
     }
-    rand.Seed(int64(time.Now().Second()))
-    var PORT int64 = int64(rand.Int()%1000 + 8000)
+    // Port 0 lets the OS pick free ports, so runs never collide
+    master, err := mapreduce.MakeMaster(files, 3, 0)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if err := master.RunMaster(); err != nil {
+        log.Fatal(err)
+    }
+
+    var workers []*mapreduce.Worker
+    for i := 0; i < 3; i++ {
+        worker := mapreduce.MakeWorker(0, master.Addr().String(), mapFunc, reduceFunc)
+        if err := worker.StartWorker(); err != nil {
+            log.Fatal(err)
+        }
+        workers = append(workers, worker)
+    }
 
-    master := mapreduce.MakeMaster(files, 3, PORT)
-    master.RunMaster()
+    // Shut workers and master down on SIGTERM
+    // Running tasks get 5 seconds to finish before they are requeued
+    term := make(chan os.Signal, 1)
+    signal.Notify(term, syscall.SIGTERM)
+    go func() {
+        <-term
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        for _, worker := range workers {
+            worker.Shutdown(ctx)
+        }
+        master.Shutdown(ctx)
+        os.Exit(1)
+    }()
 
-    w1 := mapreduce.MakeWorker(PORT-1000, PORT, mapFunc, mockReduce)
-    w1.StartWorker()
-    w2 := mapreduce.MakeWorker(PORT-1100, PORT, mapFunc, mockReduce)
-    w2.StartWorker()
-    w3 := mapreduce.MakeWorker(PORT-1200, PORT, mapFunc, mockReduce)
-    w3.StartWorker()
+    // Dump the state of master to stderr on SIGUSR1
+    dump := make(chan os.Signal, 1)
+    signal.Notify(dump, syscall.SIGUSR1)
+    go func() {
+        for range dump {
+            os.Stderr.WriteString(master.DumpState())
+        }
+    }()
+
+    // Print a progress line every second while the job runs
+    go func() {
+        for range time.Tick(time.Second) {
+            p := master.Progress()
+            eta := "unknown"
+            if p.EstimatedRemaining != mapreduce.ETA_UNKNOWN {
+                eta = p.EstimatedRemaining.Round(time.Second).String()
+            }
+            log.Printf("map %v done %v running, reduce %v done %v running, %.0f%%, eta %v",
+                p.MapFinished, p.MapProcessing,
+                p.ReduceFinished, p.ReduceProcessing, p.Percentage, eta)
+        }
+    }()
+
+    if err := master.Wait(context.Background()); err != nil {
+        log.Fatal(err)
+    }
 
-    mapreduce.WaitUntil(master.MapFinished)
+    // Give workers time to clean up the intermediate files
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    master.Shutdown(ctx)
 }
@@ -0,0 +1,83 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// The host:port addresses master and workers reach each other at
+
+package mapreduce
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Return the address of a peer on host listening on port
+// IPv6 literals are bracketed, e.g. "[::1]:7000"
+func joinAddr(host string, port int64) string {
+	return net.JoinHostPort(host, strconv.FormatInt(port, 10))
+}
+
+// Return addr as a host:port to dial
+// A bare port or ":port" names this host, e.g. "7000" is "localhost:7000"
+// Return error if addr has no valid port
+func parseAddr(addr string) (string, error) {
+	host, portText := "", addr
+	if strings.Contains(addr, ":") {
+		var err error
+		if host, portText, err = net.SplitHostPort(addr); err != nil {
+			return "", fmt.Errorf("bad address %q: %v", addr, err)
+		}
+	}
+	port, err := strconv.ParseInt(portText, 10, 64)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", fmt.Errorf("bad address %q: invalid port", addr)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return joinAddr(host, port), nil
+}
+
+// Return the port of addr, 0 if it has none
+func addrPort(addr string) int64 {
+	_, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	port, _ := strconv.ParseInt(portText, 10, 64)
+	return port
+}
+
+// Return the address a peer that registered with addr is reached at
+// Which is addr unless its host is empty or unspecified, e.g. the ":7000" or
+// "[::]:7000" of a worker listening on every interface
+// The host is then the one the rpc came from, observed by the server codec
+// Or this host if the transport observes none
+func reachableAddr(addr, observed string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return addr
+	}
+	host = "localhost"
+	if observedHost, _, err := net.SplitHostPort(observed); err == nil {
+		host = observedHost
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Arguments that keep the address of the peer that sent them
+// Set by the server codec once they are decoded, see reachableAddr
+type peerObserved interface {
+	setPeerAddr(addr string)
+}
+
+func (args *RegisterSend) setPeerAddr(addr string) {
+	args.peer = addr
+}
+
+// Return the address master reaches the worker registering at
+func (args *RegisterSend) reachableAddr() string {
+	return reachableAddr(args.Addr, args.peer)
+}
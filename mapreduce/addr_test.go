@@ -0,0 +1,164 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of the addresses masters and workers listen on and report
+
+package mapreduce
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMasterReportsPortItGot(t *testing.T) {
+	master := startMaster(t, writeInputs(t, "a"), 1, WithListenAddr("127.0.0.1:0"))
+	addr, ok := master.Addr().(*net.TCPAddr)
+	if !ok || !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("master listens on %v, want 127.0.0.1", master.Addr())
+	}
+	if port := master.Port(); port == 0 || port != int64(addr.Port) {
+		t.Fatalf("master reports port %v, listens on %v", port, addr.Port)
+	}
+}
+
+func TestWorkerRegistersPortItGot(t *testing.T) {
+	master := startMaster(t, writeInputs(t, "a"), 1)
+	worker := startWorker(t, master, func(worker *Worker) { worker.ListenAddr = "127.0.0.1:0" })
+	port := worker.Port()
+	if port == 0 {
+		t.Fatal("worker reports port 0")
+	}
+	waitFor(t, 5*time.Second, "the worker registered", func() bool { return hasWorkers(master) })
+
+	// Master reaches the worker at the port it got, not the one it was made with
+	master.mu.Lock()
+	registered, ok := master.workers[worker.Id()]
+	master.mu.Unlock()
+	if !ok {
+		t.Fatalf("worker %v not registered", worker.Id())
+	}
+	if got := addrPort(registered.addr); got != port {
+		t.Fatalf("worker registered at %v, listens on port %v", registered.addr, port)
+	}
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParallelJobsOnPortZero(t *testing.T) {
+	for i := 0; i < 8; i++ {
+		contents := []string{"a b " + strconv.Itoa(i), "b c"}
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Parallel()
+			master := startMaster(t, writeInputs(t, contents...), 2)
+			startWorker(t, master, nil)
+			if err := waitJob(t, master, 10*time.Second); err != nil {
+				t.Fatal(err)
+			}
+			checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+		})
+	}
+}
+
+func TestBadListenAddrRefused(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "localhost:1:2"} {
+		if _, err := MakeMaster(writeInputs(t, "a"), 1, 0, WithListenAddr(addr)); err == nil {
+			t.Errorf("master made to listen on %q", addr)
+		}
+	}
+}
+
+func TestAddrInUseTold(t *testing.T) {
+	_, listener, err := CreateServerAddr(CallService{}, "127.0.0.1:0", "first", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, _, err = CreateServerAddr(CallService{}, listener.Addr().String(), "second", nil)
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("listen on a port in use: %v, want EADDRINUSE", err)
+	}
+}
+
+// Take a free port of localhost until the test closes the listener
+func takePort(t *testing.T) net.Listener {
+	t.Helper()
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { taken.Close() })
+	return taken
+}
+
+func TestRunMasterOnPortInUse(t *testing.T) {
+	taken := takePort(t)
+	addr := taken.Addr().String()
+	master, err := MakeMaster(writeInputs(t, "a"), 1, 0, testOptions(t, WithListenAddr(addr))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = master.RunMaster()
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		if err == nil {
+			shutdownMaster(master)
+		}
+		t.Fatalf("RunMaster on a port in use: %v, want EADDRINUSE", err)
+	}
+	// It runs once the port is freed
+	taken.Close()
+	if err := master.RunMaster(); err != nil {
+		t.Fatalf("RunMaster on the freed port: %v", err)
+	}
+	defer shutdownMaster(master)
+	if got := master.Addr().String(); got != addr {
+		t.Fatalf("master listens on %v, want %v", got, addr)
+	}
+	startWorker(t, master, nil)
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartWorkerOnPortInUse(t *testing.T) {
+	master := startMaster(t, writeInputs(t, "a"), 1)
+	taken := takePort(t)
+	worker := MakeWorker(0, master.Addr().String(), wcMap, wcReduce)
+	worker.Logger = quietLogger{}
+	worker.ListenAddr = taken.Addr().String()
+
+	err := worker.StartWorker()
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		if err == nil {
+			shutdownWorker(worker)
+		}
+		t.Fatalf("StartWorker on a port in use: %v, want EADDRINUSE", err)
+	}
+	taken.Close()
+	if err := worker.StartWorker(); err != nil {
+		t.Fatalf("StartWorker on the freed port: %v", err)
+	}
+	defer shutdownWorker(worker)
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPortFreedOnShutdown(t *testing.T) {
+	port := freePort(t)
+	addr := "127.0.0.1:" + strconv.FormatInt(port, 10)
+	for i := 0; i < 2; i++ {
+		master, err := MakeMaster(writeInputs(t, "a"), 1, 0, testOptions(t, WithListenAddr(addr))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The second master listens right after the first is shut down
+		if err := master.RunMaster(); err != nil {
+			t.Fatalf("master %v: %v", i, err)
+		}
+		shutdownMaster(master)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Authenticating workers with a shared secret and per-worker session tokens
+
+package mapreduce
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// The return type of an rpc presenting a wrong or missing secret or token
+const AUTH = "AUTH"
+
+// Returned by the rpcs of a worker given a wrong or missing token
+// So an rpc from a peer that is not its master is refused
+var ErrAuth = errors.New("mapreduce: authentication failed")
+
+// The random bytes of a session token
+const TOKEN_BYTES = 32
+
+// Return a new random session token in hex
+func newToken() string {
+	b := make([]byte, TOKEN_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Return true if got equals want, in time independent of where they differ
+func tokenMatch(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// Require workers to present secret to register, see WithSecret
+// Return true if no secret is set
+func (master *Master) checkSecret(secret string) bool {
+	return master.config.Secret == "" || tokenMatch(secret, master.config.Secret)
+}
+
+// Return true if token is the session token of the registered worker
+// Or no secret is set, so workers are issued no token
+// Must be called with lock held
+func (master *Master) checkToken(workerId int64, token string) bool {
+	if master.config.Secret == "" {
+		return true
+	}
+	registry, ok := master.workers[workerId]
+	return ok && registry.token != "" && tokenMatch(token, registry.token)
+}
+
+// Wrap an http handler so it requires the secret once one is set, see WithSecret
+// Sent as a bearer token, e.g. curl -H "Authorization: Bearer $SECRET"
+func (master *Master) requireSecret(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if master.config.Secret != "" && (!ok || !tokenMatch(secret, master.config.Secret)) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, AUTH, http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Return the session token master sends the worker with its rpcs
+// Empty if the worker is unknown
+// Must be called with lock held
+func (master *Master) workerToken(workerId int64) string {
+	if registry, ok := master.workers[workerId]; ok {
+		return registry.token
+	}
+	return ""
+}
+
+// Require workers to present secret on registration
+// Master then issues each a session token, which every later rpc of the worker
+// Must carry, and which master sends with its own rpcs to the worker
+// Workers must be given the same secret, see Worker.Secret
+// The secret and tokens are sent in the clear unless TLS is used, see WithTLS
+func WithSecret(secret string) Option {
+	return func(config *MasterConfig) error {
+		if secret == "" {
+			return errors.New("WithSecret: empty secret")
+		}
+		config.Secret = secret
+		return nil
+	}
+}
+
+// Return the session token master issued the worker, empty before it registers
+func (worker *Worker) sessionToken() string {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	return worker.token
+}
+
+// Mark a registration in flight, whose reply carries a new session token
+// Return the func to call once the token is stored, or the call failed
+func (worker *Worker) beginRegistration() func() {
+	done := make(chan struct{})
+	worker.mu.Lock()
+	worker.registering = done
+	worker.mu.Unlock()
+	return func() {
+		worker.mu.Lock()
+		if worker.registering == done {
+			worker.registering = nil
+		}
+		worker.mu.Unlock()
+		close(done)
+	}
+}
+
+// Return ErrAuth unless token is the one master issued the worker
+// Or the worker has no secret
+// Master may dispatch to the worker before the reply to its registration arrives
+// So a token that does not match yet is checked again once that reply is stored
+// Checked before anything else, so a rogue master cannot even advance the term
+func (worker *Worker) checkToken(token string) error {
+	if worker.Secret == "" {
+		return nil
+	}
+	worker.mu.Lock()
+	expected, registering := worker.token, worker.registering
+	worker.mu.Unlock()
+	if registering != nil && (expected == "" || !tokenMatch(token, expected)) {
+		<-registering
+		expected = worker.sessionToken()
+	}
+	if expected == "" || !tokenMatch(token, expected) {
+		return ErrAuth
+	}
+	return nil
+}
+
+// Return ErrAuth unless secret is that of the worker, for rpcs between workers
+func (worker *Worker) checkSecret(secret string) error {
+	if worker.Secret != "" && !tokenMatch(secret, worker.Secret) {
+		return ErrAuth
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of authenticating workers with a shared secret and session tokens
+
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Register a worker presenting secret, return the reply with its id and token
+func registerSecret(t *testing.T, master *Master, secret string) RegisterReply {
+	t.Helper()
+	fakePort++
+	reply := RegisterReply{}
+	err := master.RegisterWorker(&RegisterSend{
+		Version:      PROTOCOL_VERSION,
+		Addr:         joinAddr("localhost", int64(fakePort)),
+		Slots:        1,
+		Capabilities: Capabilities{Codecs: []string{CODEC_JSON}, Shuffle: true},
+		Secret:       secret,
+	}, &reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestRegistrationNeedsSecret(t *testing.T) {
+	master := makeMaster(t, writeInputs(t, "a"), 1, WithSecret("right"))
+	for _, secret := range []string{"", "wrong", "righ", "right "} {
+		if reply := registerSecret(t, master, secret); reply.Err != AUTH {
+			t.Errorf("secret %q registered with %v", secret, reply.Err)
+		}
+	}
+	master.mu.Lock()
+	registered := len(master.workers)
+	master.mu.Unlock()
+	if registered != 0 {
+		t.Fatalf("%v workers registered with a wrong secret", registered)
+	}
+
+	first, second := registerSecret(t, master, "right"), registerSecret(t, master, "right")
+	if first.Err != OK || second.Err != OK {
+		t.Fatalf("right secret refused: %v, %v", first.Err, second.Err)
+	}
+	if first.Token == "" || first.Token == second.Token {
+		t.Fatalf("tokens %q and %q, want one of its own for each worker", first.Token, second.Token)
+	}
+}
+
+func TestRpcsOfWorkerNeedItsToken(t *testing.T) {
+	master := makeMaster(t, writeInputs(t, "a"), 1, WithSecret("right"))
+	worker, other := registerSecret(t, master, "right"), registerSecret(t, master, "right")
+	assignMap(master, worker.WorkerId)
+
+	for name, token := range map[string]string{
+		"missing":              "",
+		"wrong":                "0123",
+		"of another worker":    other.Token,
+		"secret of the job":    "right",
+		"with a trailing byte": worker.Token + "0",
+	} {
+		t.Run(name, func(t *testing.T) {
+			heartbeat := HeartbeatReply{}
+			master.Heartbeat(&HeartbeatSend{WorkerId: worker.WorkerId, Token: token}, &heartbeat)
+			if heartbeat.Err != AUTH {
+				t.Errorf("heartbeat got %v", heartbeat.Err)
+			}
+			finished := GeneralReply{}
+			master.TaskFinished(&TaskFinishedSend{JobId: DEFAULT_JOB, TaskType: MAP,
+				WorkerId: worker.WorkerId, Token: token, PartitionBytes: make([]int64, 1)}, &finished)
+			if finished.Err != AUTH {
+				t.Errorf("task finished got %v", finished.Err)
+			}
+			failed := GeneralReply{}
+			master.TaskFailed(&TaskFailedSend{JobId: DEFAULT_JOB, TaskType: MAP,
+				WorkerId: worker.WorkerId, Token: token}, &failed)
+			if failed.Err != AUTH {
+				t.Errorf("task failed got %v", failed.Err)
+			}
+			err := master.RequestTask(&RequestTaskSend{WorkerId: worker.WorkerId, Token: token},
+				&RequestTaskReply{})
+			if err == nil || !strings.Contains(err.Error(), AUTH) {
+				t.Errorf("request task got %v", err)
+			}
+			deregistered := GeneralReply{}
+			master.DeregisterWorker(&DeregisterSend{WorkerId: worker.WorkerId, Token: token},
+				&deregistered)
+			if deregistered.Err != AUTH {
+				t.Errorf("deregister got %v", deregistered.Err)
+			}
+		})
+	}
+
+	// Nothing refused changed the attempt, which its token still finishes
+	reply := GeneralReply{}
+	master.TaskFinished(&TaskFinishedSend{JobId: DEFAULT_JOB, TaskType: MAP,
+		WorkerId: worker.WorkerId, Token: worker.Token, PartitionBytes: make([]int64, 1)}, &reply)
+	if reply.Err != OK {
+		t.Fatalf("task finished with the token got %v", reply.Err)
+	}
+}
+
+func TestJobWithSecret(t *testing.T) {
+	contents := []string{"a b a", "c"}
+	master := startMaster(t, writeInputs(t, contents...), 1, WithSecret("right"))
+	startWorker(t, master, func(worker *Worker) { worker.Secret = "right" })
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+}
+
+func TestWorkerRefusesRogueMaster(t *testing.T) {
+	master := startMaster(t, writeInputs(t, "a"), 1, WithSecret("right"))
+	worker := startWorker(t, master, func(worker *Worker) {
+		worker.Secret = "right"
+		worker.MapContext = func(ctx context.Context, file, content string) []KeyValue {
+			<-ctx.Done()
+			return nil
+		}
+	})
+	attempt := TaskAttempt{DEFAULT_JOB, 0, MAP, 0}
+	waitFor(t, 5*time.Second, "the attempt to start", func() bool {
+		worker.mu.Lock()
+		defer worker.mu.Unlock()
+		return len(worker.tasks) == 1
+	})
+
+	addr := worker.listener.Addr().String()
+	for _, token := range []string{"", "right", "0123"} {
+		err := Call(context.Background(), addr, "Worker.KillTask",
+			&KillTaskSend{Attempt: attempt, Token: token}, &GeneralReply{})
+		if err == nil || !strings.Contains(err.Error(), ErrAuth.Error()) {
+			t.Errorf("kill with token %q got %v", token, err)
+		}
+		err = Call(context.Background(), addr, "Worker.StartMap",
+			&MapStartSend{JobId: DEFAULT_JOB, TaskId: 0, AttemptId: 7, Token: token}, &StartReply{})
+		if err == nil || !strings.Contains(err.Error(), ErrAuth.Error()) {
+			t.Errorf("start with token %q got %v", token, err)
+		}
+	}
+	if worker.isKilled(attempt) {
+		t.Fatal("attempt killed by a rogue master")
+	}
+}
+
+func TestDispatchBeforeRegistrationReplyAccepted(t *testing.T) {
+	contents := []string{"a b a", "c"}
+	logger := &recordLogger{}
+	master := startMaster(t, writeInputs(t, contents...), 1, WithSecret("right"),
+		WithLogger(logger))
+	// The reply to the registration reaches the worker only after a dispatch did
+	dispatched := make(chan struct{})
+	var once sync.Once
+	startWorker(t, master, func(worker *Worker) {
+		worker.Secret = "right"
+		worker.Interceptors = []Interceptor{{
+			Call: func(ctx context.Context, info *RPCInfo, next func(ctx context.Context) error) error {
+				err := next(ctx)
+				if info.Method == "Master.RegisterWorker" {
+					select {
+					case <-dispatched:
+						// Time for a start refused at once to be replied to
+						time.Sleep(50 * time.Millisecond)
+					case <-time.After(5 * time.Second):
+					}
+				}
+				return err
+			},
+			Receive: func(info *RPCInfo) error {
+				if info.Method == "Worker.StartMap" {
+					once.Do(func() { close(dispatched) })
+				}
+				return nil
+			},
+		}}
+	})
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+	if logger.contains("dispatch map task") {
+		t.Fatal("a start sent before the registration reply arrived was refused")
+	}
+}
+
+func TestRpcsOfClientNeedSecret(t *testing.T) {
+	master := startMaster(t, writeInputs(t, "a"), 1, WithSecret("right"))
+	files := writeInputs(t, "b")
+
+	for _, secret := range []string{"", "wrong", "right "} {
+		submitted := SubmitJobReply{}
+		if err := callMaster(t, master, "Master.SubmitJob",
+			&JobSpec{InputFiles: files, NReduce: 1, Secret: secret}, &submitted); err != nil ||
+			submitted.Err != AUTH {
+			t.Errorf("submit with secret %q got %v, %v", secret, submitted.Err, err)
+		}
+		status := JobStatus{}
+		if err := callMaster(t, master, "Master.GetJobStatus",
+			&JobStatusSend{JobId: DEFAULT_JOB, Secret: secret}, &status); err != nil ||
+			status.Err != AUTH || status.Progress.MapPending != 0 {
+			t.Errorf("job status with secret %q got %+v, %v", secret, status, err)
+		}
+		waited := WaitDoneReply{}
+		if err := callMaster(t, master, "Master.WaitDone",
+			&WaitDoneSend{JobId: DEFAULT_JOB, Secret: secret}, &waited); err != nil ||
+			waited.Err != AUTH || waited.Incarnation != 0 {
+			t.Errorf("wait with secret %q got %+v, %v", secret, waited, err)
+		}
+		dump := StateDumpReply{}
+		if err := callMaster(t, master, "Master.StateDump",
+			&StateDumpSend{Secret: secret}, &dump); err != nil || dump.Err != AUTH || dump.Dump != "" {
+			t.Errorf("dump with secret %q got %v, %v", secret, dump.Err, err)
+		}
+		for _, rpc := range []string{"Master.PauseJob", "Master.ResumeJob", "Master.AbortJob"} {
+			reply := GeneralReply{}
+			if err := callMaster(t, master, rpc, &JobControlSend{Secret: secret}, &reply); err != nil ||
+				reply.Err != AUTH {
+				t.Errorf("%v with secret %q got %v, %v", rpc, secret, reply.Err, err)
+			}
+		}
+	}
+
+	addr := master.Addr().String()
+	if _, err := GetJobStatus(addr, DEFAULT_JOB); !errors.Is(err, ErrAuth) {
+		t.Errorf("GetJobStatus without the secret got %v", err)
+	}
+	if err := WaitForJob(addr, DEFAULT_JOB, 10*time.Millisecond, time.Second); !errors.Is(err, ErrAuth) {
+		t.Errorf("WaitForJob without the secret got %v", err)
+	}
+	master.mu.Lock()
+	job := master.jobs[DEFAULT_JOB]
+	paused, aborted, jobs := job.paused, job.aborted, len(master.jobs)
+	master.mu.Unlock()
+	if paused || aborted || jobs != 1 {
+		t.Fatalf("paused %v, aborted %v, %v jobs after refused rpcs", paused, aborted, jobs)
+	}
+
+	// The right secret is let through
+	submitted := SubmitJobReply{}
+	if err := callMaster(t, master, "Master.SubmitJob",
+		&JobSpec{InputFiles: files, NReduce: 1, Secret: "right"}, &submitted); err != nil ||
+		submitted.Err != OK {
+		t.Fatalf("submit with the secret got %v, %v", submitted.Err, err)
+	}
+	if status, err := GetJobStatusWithSecret(addr, submitted.JobId, "right"); err != nil ||
+		status.JobId != submitted.JobId {
+		t.Fatalf("GetJobStatusWithSecret got %+v, %v", status, err)
+	}
+	if err := WaitForJobWithSecret(addr, submitted.JobId, "right", 10*time.Millisecond,
+		50*time.Millisecond); err != ErrWaitTimeout {
+		t.Fatalf("WaitForJobWithSecret got %v, want the job still running", err)
+	}
+	dump := StateDumpReply{}
+	if err := callMaster(t, master, "Master.StateDump", &StateDumpSend{Secret: "right"}, &dump); err != nil ||
+		dump.Err != OK || dump.Dump == "" {
+		t.Fatalf("dump with the secret got %v, %v", dump.Err, err)
+	}
+	reply := GeneralReply{}
+	if err := callMaster(t, master, "Master.PauseJob", &JobControlSend{Secret: "right"}, &reply); err != nil ||
+		reply.Err != OK {
+		t.Fatalf("pause with the secret got %v, %v", reply.Err, err)
+	}
+	master.mu.Lock()
+	paused = job.paused
+	master.mu.Unlock()
+	if !paused {
+		t.Fatal("pause with the secret did not pause")
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Scaling the number of workers with the tasks waiting to run
+
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The default time between two scaling decisions
+const AUTOSCALE_COOLDOWN = 30 * time.Second
+
+// Launched workers that do not register within LAUNCH_TIMEOUT
+// Are no longer expected, so more can be launched in their place
+const LAUNCH_TIMEOUT = time.Minute
+
+// Starts and stops workers for the autoscaler of master
+// Both are called without the lock of master held
+type WorkerLauncher interface {
+	// Start n more workers, which register with master on their own
+	Launch(n int) error
+	// Stop an idle worker master no longer assigns tasks to
+	// The worker is expected to deregister, see Worker.Shutdown
+	Terminate(worker LaunchedWorker) error
+}
+
+// A worker the autoscaler asks its launcher to terminate
+type LaunchedWorker struct {
+	Id   int64
+	Host string
+	// The host:port master reaches it at
+	Addr string
+}
+
+// How the autoscaler sizes the workers of master
+type AutoscalePolicy struct {
+	// The bounds of the number of live workers
+	// Which are neither failed, blacklisted nor retiring
+	MinWorkers int
+	MaxWorkers int
+	// The tasks of runnable phases, pending or processing, a worker is sized for
+	// 0 means one task per worker
+	TasksPerWorker int
+	// The time between two scaling decisions, 0 means AUTOSCALE_COOLDOWN
+	Cooldown time.Duration
+	// A worker idle for IdleTimeout once no task is pending is terminated
+	// Down to MinWorkers, 0 never terminates workers
+	IdleTimeout time.Duration
+}
+
+// The state of the scaling loop
+type autoscaler struct {
+	// The workers launched and not registered yet
+	// And the time of the last launch
+	launching  int
+	launchedAt time.Time
+	// The time of the last scaling decision
+	lastAction time.Time
+}
+
+// Size the workers of master with launcher by policy
+func WithAutoscaling(launcher WorkerLauncher, policy AutoscalePolicy) Option {
+	return func(config *MasterConfig) error {
+		if launcher == nil {
+			return errors.New("WithAutoscaling: nil launcher")
+		}
+		if policy.MaxWorkers < 1 {
+			return errors.New("WithAutoscaling: max workers must be positive")
+		}
+		if policy.MinWorkers < 0 || policy.MinWorkers > policy.MaxWorkers {
+			return fmt.Errorf("WithAutoscaling: min workers must be within [0, %v]",
+				policy.MaxWorkers)
+		}
+		if policy.TasksPerWorker < 0 || policy.Cooldown < 0 || policy.IdleTimeout < 0 {
+			return errors.New("WithAutoscaling: tasks per worker, cooldown and idle timeout must not be negative")
+		}
+		if policy.TasksPerWorker == 0 {
+			policy.TasksPerWorker = 1
+		}
+		if policy.Cooldown == 0 {
+			policy.Cooldown = AUTOSCALE_COOLDOWN
+		}
+		config.Launcher = launcher
+		config.Autoscale = policy
+		return nil
+	}
+}
+
+// Periodically launch workers while tasks wait and no worker has a free slot
+// And terminate idle workers once no task is pending
+// At most one decision is made per cooldown
+func (master *Master) checkAutoscale() {
+	for master.isActive() {
+		master.mu.Lock()
+		launch, retire := master.scaleDecision()
+		master.mu.Unlock()
+
+		if launch > 0 {
+			if err := master.config.Launcher.Launch(launch); err != nil {
+				master.config.Logger.Errorf("Autoscale: launch %v workers: %v", launch, err)
+				master.mu.Lock()
+				master.scaler.launching -= launch
+				master.mu.Unlock()
+			}
+		}
+		for _, worker := range retire {
+			if err := master.config.Launcher.Terminate(worker); err != nil {
+				master.config.Logger.Errorf("Autoscale: terminate worker %v: %v", worker.Id, err)
+				master.mu.Lock()
+				if registry, ok := master.workers[worker.Id]; ok {
+					registry.retiring = false
+					master.signalChange()
+				}
+				master.mu.Unlock()
+			}
+		}
+
+		time.Sleep(master.config.SchedulerTick)
+	}
+}
+
+// Return the number of workers to launch, and the idle workers to terminate
+// Workers to terminate are marked retiring, so they are assigned no task
+// Must be called with lock held
+func (master *Master) scaleDecision() (int, []LaunchedWorker) {
+	policy := master.config.Autoscale
+	scaler := &master.scaler
+	now := time.Now()
+	if scaler.launching > 0 && now.Sub(scaler.launchedAt) > LAUNCH_TIMEOUT {
+		master.config.Logger.Warnf("Autoscale: %v launched workers never registered",
+			scaler.launching)
+		scaler.launching = 0
+	}
+	if master.paused || master.halted() || now.Sub(scaler.lastAction) < policy.Cooldown {
+		return 0, nil
+	}
+
+	pending, processing := master.runnableTasks()
+	live, free := 0, false
+	for _, registry := range master.workers {
+		if registry.retiring ||
+			(registry.status != AVAILABLE && registry.status != RUNNING) {
+			continue
+		}
+		live++
+		free = free || registry.status == AVAILABLE
+	}
+
+	desired := (pending + processing + policy.TasksPerWorker - 1) / policy.TasksPerWorker
+	if desired < policy.MinWorkers {
+		desired = policy.MinWorkers
+	}
+	if desired > policy.MaxWorkers {
+		desired = policy.MaxWorkers
+	}
+
+	// Scale up only while tasks wait for a slot, or below the minimum
+	expected := live + scaler.launching
+	if expected < desired && ((pending > 0 && !free) || expected < policy.MinWorkers) {
+		n := desired - expected
+		master.config.Logger.Infof("Autoscale: %v tasks pending, %v processing on %v workers, launch %v",
+			pending, processing, live, n)
+		scaler.launching += n
+		scaler.launchedAt = now
+		scaler.lastAction = now
+		return n, nil
+	}
+
+	if policy.IdleTimeout == 0 || pending > 0 || scaler.launching > 0 {
+		return 0, nil
+	}
+	var retire []LaunchedWorker
+	for _, id := range master.workerOrder {
+		if live <= desired {
+			break
+		}
+		registry := master.workers[id]
+		if registry.retiring || registry.status != AVAILABLE || len(registry.tasks) > 0 ||
+			now.Sub(registry.idleSince) < policy.IdleTimeout {
+			continue
+		}
+		registry.retiring = true
+		retire = append(retire, LaunchedWorker{Id: id, Host: registry.host, Addr: registry.addr})
+		live--
+	}
+	if len(retire) > 0 {
+		master.config.Logger.Infof("Autoscale: no task pending, terminate %v idle workers",
+			len(retire))
+		scaler.lastAction = now
+	}
+	return 0, retire
+}
+
+// Return the number of pending and processing tasks
+// In the phase each unfinished job is running
+// Must be called with lock held
+func (master *Master) runnableTasks() (int, int) {
+	pending, processing := 0, 0
+	for id := JobId(0); id < master.nextJobId; id++ {
+		job := master.jobs[id]
+		if job.done() {
+			continue
+		}
+		statuses := job.mapStatus
+		if job.phaseFinished(MAP) {
+			statuses = job.reduceStatus
+		}
+		for _, status := range statuses {
+			switch status {
+			case UNPROCESSED:
+				// A paused job waits for no worker
+				if !job.paused {
+					pending++
+				}
+			case PROCESSING:
+				processing++
+			}
+		}
+	}
+	return pending, processing
+}
+
+// Note a newly registered worker, which may be one the autoscaler launched
+// Must be called with lock held
+func (master *Master) noteRegistered() {
+	if master.scaler.launching > 0 {
+		master.scaler.launching--
+	}
+}
+
+// A launcher running each worker as a process on this machine
+// Every worker is started as Path with Args, followed by
+// -master and the address of master, and -port and a port of its own
+// Counting up from FirstPort, as understood by cmd/mrworker
+type LocalLauncher struct {
+	Path       string
+	Args       []string
+	MasterAddr string
+	FirstPort  int64
+
+	mu sync.Mutex
+	// The port the next worker listens on
+	nextPort int64
+	// The running processes by the port of their worker
+	processes map[int64]*localProcess
+}
+
+// A worker process, and a channel closed once it exits
+type localProcess struct {
+	cmd    *exec.Cmd
+	exited chan struct{}
+}
+
+// Start n worker processes, with the output of each going to ours
+func (launcher *LocalLauncher) Launch(n int) error {
+	launcher.mu.Lock()
+	defer launcher.mu.Unlock()
+
+	if launcher.processes == nil {
+		launcher.processes = make(map[int64]*localProcess)
+		launcher.nextPort = launcher.FirstPort
+	}
+	for i := 0; i < n; i++ {
+		port := launcher.nextPort
+		launcher.nextPort++
+		args := append(append([]string{}, launcher.Args...),
+			"-master", launcher.MasterAddr,
+			"-port", strconv.FormatInt(port, 10))
+		cmd := exec.Command(launcher.Path, args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("cannot start worker on port %v: %v", port, err)
+		}
+		process := &localProcess{cmd: cmd, exited: make(chan struct{})}
+		launcher.processes[port] = process
+
+		go func() {
+			cmd.Wait()
+			close(process.exited)
+			launcher.mu.Lock()
+			if launcher.processes[port] == process {
+				delete(launcher.processes, port)
+			}
+			launcher.mu.Unlock()
+		}()
+	}
+	return nil
+}
+
+// Send SIGTERM to the process of worker, which shuts it down and deregisters
+func (launcher *LocalLauncher) Terminate(worker LaunchedWorker) error {
+	launcher.mu.Lock()
+	process, ok := launcher.processes[addrPort(worker.Addr)]
+	launcher.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no process runs worker at %v", worker.Addr)
+	}
+	return process.cmd.Process.Signal(syscall.SIGTERM)
+}
+
+// Send SIGTERM to every running process and wait for them to exit
+func (launcher *LocalLauncher) Stop() {
+	launcher.mu.Lock()
+	var processes []*localProcess
+	for _, process := range launcher.processes {
+		process.cmd.Process.Signal(syscall.SIGTERM)
+		processes = append(processes, process)
+	}
+	launcher.mu.Unlock()
+
+	for _, process := range processes {
+		<-process.exited
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of scaling the workers of master with the tasks waiting to run
+
+package mapreduce
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A launcher recording what the autoscaler asks of it
+// If start is set, Launch calls it for each worker
+type fakeLauncher struct {
+	mu         sync.Mutex
+	launches   []int
+	terminated []int64
+	err        error
+	start      func()
+}
+
+func (launcher *fakeLauncher) Launch(n int) error {
+	launcher.mu.Lock()
+	launcher.launches = append(launcher.launches, n)
+	err, start := launcher.err, launcher.start
+	launcher.mu.Unlock()
+	if err == nil && start != nil {
+		for i := 0; i < n; i++ {
+			start()
+		}
+	}
+	return err
+}
+
+func (launcher *fakeLauncher) Terminate(worker LaunchedWorker) error {
+	launcher.mu.Lock()
+	defer launcher.mu.Unlock()
+	launcher.terminated = append(launcher.terminated, worker.Id)
+	return launcher.err
+}
+
+func (launcher *fakeLauncher) launched() []int {
+	launcher.mu.Lock()
+	defer launcher.mu.Unlock()
+	return append([]int{}, launcher.launches...)
+}
+
+// Make the next scaling decision of master, ignoring the cooldown
+func decideNow(master *Master) (int, []LaunchedWorker) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	master.scaler.lastAction = time.Time{}
+	return master.scaleDecision()
+}
+
+func TestAutoscaleLaunchesForPendingTasks(t *testing.T) {
+	policy := AutoscalePolicy{MaxWorkers: 3, TasksPerWorker: 2, Cooldown: time.Hour}
+	master := makeMaster(t, writeInputs(t, "a", "b", "c", "d", "e"), 1,
+		WithAutoscaling(&fakeLauncher{}, policy))
+
+	// 5 map tasks need 3 workers of 2 tasks
+	master.mu.Lock()
+	launch, _ := master.scaleDecision()
+	master.mu.Unlock()
+	if launch != 3 {
+		t.Fatalf("launch %v workers, want 3", launch)
+	}
+	// Within the cooldown nothing is decided
+	master.mu.Lock()
+	launch, _ = master.scaleDecision()
+	master.mu.Unlock()
+	if launch != 0 {
+		t.Fatalf("launch %v workers within the cooldown", launch)
+	}
+	// The workers launched are expected, so none more is launched for them
+	if launch, _ := decideNow(master); launch != 0 {
+		t.Fatalf("launch %v more workers while 3 are launching", launch)
+	}
+	// Even once they register busy
+	for i := 0; i < 3; i++ {
+		assignMap(master, registerWorker(t, master, 1))
+	}
+	if launch, _ := decideNow(master); launch != 0 {
+		t.Fatalf("launch %v workers beyond the max", launch)
+	}
+}
+
+func TestAutoscaleKeepsWorkersWithFreeSlots(t *testing.T) {
+	policy := AutoscalePolicy{MaxWorkers: 4}
+	master := makeMaster(t, writeInputs(t, "a", "b", "c"), 1,
+		WithAutoscaling(&fakeLauncher{}, policy))
+	registerWorker(t, master, 4)
+	if launch, _ := decideNow(master); launch != 0 {
+		t.Fatalf("launch %v workers while one has free slots", launch)
+	}
+}
+
+func TestAutoscaleLaunchesUpToMinimum(t *testing.T) {
+	policy := AutoscalePolicy{MinWorkers: 2, MaxWorkers: 4}
+	master := makeMaster(t, writeInputs(t, "a"), 1, WithAutoscaling(&fakeLauncher{}, policy))
+	registerWorker(t, master, 4)
+	if launch, _ := decideNow(master); launch != 1 {
+		t.Fatalf("launch %v workers, want 1 up to the minimum", launch)
+	}
+}
+
+func TestAutoscaleTerminatesIdleWorkers(t *testing.T) {
+	policy := AutoscalePolicy{MinWorkers: 1, MaxWorkers: 4, IdleTimeout: time.Minute}
+	master := makeMaster(t, writeInputs(t, "a", "b"), 1, WithAutoscaling(&fakeLauncher{}, policy))
+	busy := registerWorker(t, master, 2)
+	idle := []int64{registerWorker(t, master, 1), registerWorker(t, master, 1)}
+
+	// No worker is terminated while a task is pending
+	assignMap(master, busy)
+	master.mu.Lock()
+	for _, id := range idle {
+		master.workers[id].idleSince = time.Now().Add(-time.Hour)
+	}
+	master.mu.Unlock()
+	if _, retire := decideNow(master); len(retire) != 0 {
+		t.Fatalf("terminate %v while a task is pending", retire)
+	}
+
+	// Once every task runs, idle workers go down to one per task running
+	assignMap(master, busy)
+	_, retire := decideNow(master)
+	if len(retire) != 1 || retire[0].Id != idle[0] {
+		t.Fatalf("terminate %+v, want the first idle worker %v", retire, idle[0])
+	}
+
+	// Retiring workers are assigned nothing, and not terminated twice
+	master.mu.Lock()
+	taskId, _ := master.assignTask(master.jobs[DEFAULT_JOB], idle[0], MAP)
+	master.mu.Unlock()
+	if taskId != -1 {
+		t.Fatalf("assigned task %v to a retiring worker", taskId)
+	}
+	if _, retire := decideNow(master); len(retire) != 0 {
+		t.Fatalf("terminate %+v again", retire)
+	}
+}
+
+func TestAutoscaleRetriesFailedLaunch(t *testing.T) {
+	launcher := &fakeLauncher{err: errors.New("no capacity")}
+	policy := AutoscalePolicy{MaxWorkers: 2, Cooldown: 50 * time.Millisecond}
+	master := startMaster(t, writeInputs(t, "a", "b"), 1, WithAutoscaling(launcher, policy))
+
+	waitFor(t, 5*time.Second, "a launch after the failed one", func() bool {
+		return len(launcher.launched()) >= 2
+	})
+	// Nothing was launched, so the retry asks for every worker again
+	if launches := launcher.launched(); launches[1] != 2 {
+		t.Fatalf("launches %v, want 2 workers each time", launches)
+	}
+	master.mu.Lock()
+	launching := master.scaler.launching
+	master.mu.Unlock()
+	if launching > 2 {
+		t.Fatalf("%v workers expected after failed launches", launching)
+	}
+}
+
+func TestAutoscaleRunsJobFromNoWorker(t *testing.T) {
+	contents := []string{"a b", "b c", "c d", "d e"}
+	var mu sync.Mutex
+	var workers []*Worker
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, worker := range workers {
+			shutdownWorker(worker)
+		}
+	}()
+
+	launcher := &fakeLauncher{}
+	policy := AutoscalePolicy{MaxWorkers: 2, Cooldown: 50 * time.Millisecond}
+	master := startMaster(t, writeInputs(t, contents...), 2, WithAutoscaling(launcher, policy))
+	launcher.mu.Lock()
+	launcher.start = func() {
+		worker := MakeWorker(0, master.Addr().String(), wcMap, wcReduce)
+		worker.Logger = quietLogger{}
+		if err := worker.StartWorker(); err != nil {
+			return
+		}
+		mu.Lock()
+		workers = append(workers, worker)
+		mu.Unlock()
+	}
+	launcher.mu.Unlock()
+
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+	total := 0
+	for _, n := range launcher.launched() {
+		total += n
+	}
+	if total == 0 || total > 2 {
+		t.Fatalf("launched %v workers, want 1 to 2", total)
+	}
+}
+
+func TestLocalLauncherStartsAndTerminatesProcesses(t *testing.T) {
+	// The flags of each worker are the arguments of the script
+	launcher := &LocalLauncher{
+		Path:       "/bin/sh",
+		Args:       []string{"-c", "exec sleep 30", "worker"},
+		MasterAddr: "localhost:1234",
+		FirstPort:  31000,
+	}
+	if err := launcher.Launch(2); err != nil {
+		t.Fatal(err)
+	}
+	defer launcher.Stop()
+
+	launcher.mu.Lock()
+	first, running := launcher.processes[31000], len(launcher.processes)
+	launcher.mu.Unlock()
+	if running != 2 || first == nil {
+		t.Fatalf("%v processes running, want 2 on ports 31000 and 31001", running)
+	}
+	if err := launcher.Terminate(LaunchedWorker{Addr: "localhost:31000"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-first.exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("terminated process still running")
+	}
+	if err := launcher.Terminate(LaunchedWorker{Addr: "localhost:31007"}); err == nil {
+		t.Fatal("terminated a worker no process runs")
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Circuit breakers on the rpcs master sends, so an unreachable worker fails fast
+
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The default transport failures in a row that open the circuit to a worker
+// And how long it stays open before a probe is let through
+const CIRCUIT_FAILURES = 5
+const CIRCUIT_COOLDOWN = 10 * time.Second
+
+// The states of a circuit, reported by Status
+// Calls go through while it is CLOSED, and fail at once while it is OPEN
+// Once the cooldown passes it is HALF_OPEN, and only a probe goes through
+// Which closes it if the worker answers, otherwise opens it again
+const (
+	CIRCUIT_CLOSED    = "CLOSED"
+	CIRCUIT_OPEN      = "OPEN"
+	CIRCUIT_HALF_OPEN = "HALF_OPEN"
+)
+
+// The kind of CallError of a call the circuit breaker did not send
+var ErrCircuitOpen = errors.New("circuit open")
+
+// When the circuit to a worker opens, see WithCircuitBreaker
+type CircuitPolicy struct {
+	// 0 never opens
+	Failures int
+	Cooldown time.Duration
+}
+
+// Return the policy of CIRCUIT_FAILURES and CIRCUIT_COOLDOWN
+func DefaultCircuitPolicy() CircuitPolicy {
+	return CircuitPolicy{Failures: CIRCUIT_FAILURES, Cooldown: CIRCUIT_COOLDOWN}
+}
+
+// The circuits of the peers master calls, keyed by address, with a lock of its own
+// So rpcs failing fast never take the lock of master
+type circuitBreaker struct {
+	mu       sync.Mutex
+	policy   CircuitPolicy
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state string
+	// The transport failures in a row
+	failures int
+	// The time the circuit last opened
+	openedAt time.Time
+}
+
+func newCircuitBreaker(policy CircuitPolicy) *circuitBreaker {
+	return &circuitBreaker{policy: policy, circuits: make(map[string]*circuit)}
+}
+
+// Return true if err shows the call got no answer, the failures the breaker counts
+// An error the method returned shows the worker is up
+func transportFailure(err error) bool {
+	return errors.Is(err, ErrUnreachable) || errors.Is(err, ErrTimeout)
+}
+
+// Return true if a call to addr may be sent at now
+// Once the cooldown of an open circuit passes, the call is its probe
+func (breaker *circuitBreaker) allow(addr string, now time.Time) bool {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	c, ok := breaker.circuits[addr]
+	if !ok || c.state == CIRCUIT_CLOSED {
+		return true
+	}
+	if c.state == CIRCUIT_OPEN && now.Sub(c.openedAt) >= breaker.policy.Cooldown {
+		c.state = CIRCUIT_HALF_OPEN
+		return true
+	}
+	return false
+}
+
+// Count what a call to addr allowed at now came to
+// Return the state the circuit moved to, empty if it stays as it was
+func (breaker *circuitBreaker) record(addr string, err error, now time.Time) string {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	if breaker.policy.Failures == 0 {
+		return ""
+	}
+	c, ok := breaker.circuits[addr]
+	if !transportFailure(err) {
+		if !ok {
+			return ""
+		}
+		if err != nil && !errors.Is(err, ErrRemote) {
+			// E.g. a cancelled call, which shows nothing of the worker
+			// A cancelled probe leaves the circuit open, the next call probes again
+			if c.state == CIRCUIT_HALF_OPEN {
+				c.state = CIRCUIT_OPEN
+			}
+			return ""
+		}
+		delete(breaker.circuits, addr)
+		if c.state == CIRCUIT_CLOSED {
+			return ""
+		}
+		return CIRCUIT_CLOSED
+	}
+
+	if !ok {
+		c = &circuit{state: CIRCUIT_CLOSED}
+		breaker.circuits[addr] = c
+	}
+	c.failures++
+	if c.state == CIRCUIT_HALF_OPEN || (c.state == CIRCUIT_CLOSED && c.failures >= breaker.policy.Failures) {
+		c.state = CIRCUIT_OPEN
+		c.openedAt = now
+		return CIRCUIT_OPEN
+	}
+	return ""
+}
+
+// Return the state of the circuit to addr
+func (breaker *circuitBreaker) state(addr string) string {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	if c, ok := breaker.circuits[addr]; ok {
+		return c.state
+	}
+	return CIRCUIT_CLOSED
+}
+
+// Return the addresses of open circuits whose cooldown passed at now
+func (breaker *circuitBreaker) ripe(now time.Time) []string {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	var result []string
+	for addr, c := range breaker.circuits {
+		if c.state == CIRCUIT_OPEN && now.Sub(c.openedAt) >= breaker.policy.Cooldown {
+			result = append(result, addr)
+		}
+	}
+	return result
+}
+
+// Drop the circuit to addr, e.g. once the worker there is forgotten
+func (breaker *circuitBreaker) forget(addr string) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	delete(breaker.circuits, addr)
+}
+
+// Send the call through the circuit to addr, failing at once while it is open
+// Log the circuit opening or closing
+func (master *Master) breakerCall(addr string, rpcName string, call func() error) error {
+	if !master.breaker.allow(addr, time.Now()) {
+		return &CallError{ErrCircuitOpen, rpcName, addr,
+			errors.New("too many transport failures in a row")}
+	}
+	err := call()
+	switch master.breaker.record(addr, err, time.Now()) {
+	case CIRCUIT_OPEN:
+		master.config.Logger.Warnf("Circuit to %v open for %v: %v", addr,
+			master.config.Circuit.Cooldown, err)
+	case CIRCUIT_CLOSED:
+		master.config.Logger.Infof("Circuit to %v closed", addr)
+	}
+	return err
+}
+
+// Periodically probe the workers whose circuit stayed open for the cooldown
+// So the scheduler assigns them tasks again once they answer
+func (master *Master) checkCircuits() {
+	for master.isActive() {
+		for _, addr := range master.breaker.ripe(time.Now()) {
+			master.call(master.config.ProbeTimeout, addr, "Worker.IsOnline", &struct{}{}, &struct{}{})
+		}
+		time.Sleep(master.config.SchedulerTick)
+	}
+}
+
+// Open the circuit to a worker once policy.Failures calls in a row to it
+// Cannot be sent or time out, see CircuitPolicy
+func WithCircuitBreaker(policy CircuitPolicy) Option {
+	return func(config *MasterConfig) error {
+		if policy.Failures < 0 {
+			return fmt.Errorf("WithCircuitBreaker: failures %v is negative", policy.Failures)
+		}
+		if policy.Failures > 0 && policy.Cooldown <= 0 {
+			return fmt.Errorf("WithCircuitBreaker: cooldown %v is not positive", policy.Cooldown)
+		}
+		config.Circuit = policy
+		return nil
+	}
+}
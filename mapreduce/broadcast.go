@@ -0,0 +1,123 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Sending an rpc to every worker concurrently
+
+package mapreduce
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// The default number of calls a broadcast has in flight at once
+const BROADCAST_PARALLELISM = 16
+
+// The outcome of the call of a broadcast to a worker
+const (
+	BROADCAST_OK          = "OK"
+	BROADCAST_REMOTE      = "REMOTE"
+	BROADCAST_UNREACHABLE = "UNREACHABLE"
+)
+
+// How a broadcast reaches the workers
+type broadcastOptions struct {
+	// The most calls in flight at once, 0 means BROADCAST_PARALLELISM
+	parallelism int
+	// The timeout of each try, 0 means CallTimeout
+	timeout time.Duration
+	// IDEMPOTENT rpcs are retried by DispatchRetry, see callRetry
+	idempotency Idempotency
+	// If all is true, failed workers are called as well
+	all bool
+}
+
+// What a worker made of the call of a broadcast
+type broadcastResult struct {
+	addr  string
+	reply GeneralReply
+	// Nil on success, otherwise a *CallError
+	err error
+}
+
+// Return BROADCAST_OK, BROADCAST_REMOTE if the method of the worker returned an error
+// Or BROADCAST_UNREACHABLE if the worker could not be reached or did not answer
+func (result *broadcastResult) outcome() string {
+	switch {
+	case result.err == nil:
+		return BROADCAST_OK
+	case errors.Is(result.err, ErrRemote):
+		return BROADCAST_REMOTE
+	default:
+		return BROADCAST_UNREACHABLE
+	}
+}
+
+// Call rpcName on the workers concurrently, keyed by worker id
+// The workers are those registered and, unless opts.all is set, not failed
+// args builds the arguments of each from its id and session token
+// With lock held, and a worker it returns nil for is not called
+// Return the result of every worker called, once every call has returned
+// Must be called without lock held
+func (master *Master) broadcast(rpcName string,
+	args func(workerId int64, token string) interface{},
+	opts broadcastOptions) map[int64]*broadcastResult {
+	type target struct {
+		workerId int64
+		args     interface{}
+	}
+	results := make(map[int64]*broadcastResult)
+	var targets []target
+	master.mu.Lock()
+	for _, id := range master.workerOrder {
+		registry := master.workers[id]
+		if !opts.all && registry.status == FAILED {
+			continue
+		}
+		send := args(id, registry.token)
+		if send == nil {
+			continue
+		}
+		targets = append(targets, target{id, send})
+		results[id] = &broadcastResult{addr: registry.addr}
+	}
+	master.mu.Unlock()
+
+	parallelism := opts.parallelism
+	if parallelism <= 0 {
+		parallelism = BROADCAST_PARALLELISM
+	}
+	timeout := opts.timeout
+	if timeout <= 0 {
+		timeout = master.config.CallTimeout
+	}
+
+	// Each call writes only its own result, read once every call has returned
+	slots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		result := results[t.workerId]
+		send := t.args
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if opts.idempotency == IDEMPOTENT {
+				result.err = master.callRetry(timeout, result.addr, rpcName, send, &result.reply)
+			} else {
+				result.err = master.call(timeout, result.addr, rpcName, send, &result.reply)
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// Return the number of results of each outcome
+func countOutcomes(results map[int64]*broadcastResult) map[string]int {
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.outcome()]++
+	}
+	return counts
+}
@@ -0,0 +1,230 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of sending an rpc to every worker concurrently
+
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Workers faked by the transport of master, each answering the way it is set to
+type broadcastPeers struct {
+	Transport
+	mu sync.Mutex
+	// The error kind of the calls to each address, nil answers OK
+	fail map[string]error
+	// How long each call takes, a call that times out is ErrTimeout
+	delay time.Duration
+	// The calls in flight, the most there were, and the args sent to each address
+	inflight, most int
+	sent           map[string][]interface{}
+}
+
+func newBroadcastPeers() *broadcastPeers {
+	return &broadcastPeers{
+		Transport: NewRPCTransport(nil),
+		fail:      map[string]error{},
+		sent:      map[string][]interface{}{},
+	}
+}
+
+func (peers *broadcastPeers) Call(ctx context.Context, addr string, rpcName string,
+	args interface{}, reply interface{}) error {
+	peers.mu.Lock()
+	peers.sent[addr] = append(peers.sent[addr], args)
+	peers.inflight++
+	if peers.inflight > peers.most {
+		peers.most = peers.inflight
+	}
+	kind, delay := peers.fail[addr], peers.delay
+	peers.mu.Unlock()
+	defer func() {
+		peers.mu.Lock()
+		peers.inflight--
+		peers.mu.Unlock()
+	}()
+
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return &CallError{ErrTimeout, rpcName, addr, ctx.Err()}
+	}
+	if kind != nil {
+		return &CallError{kind, rpcName, addr, errors.New("failed")}
+	}
+	reply.(*GeneralReply).Err = OK
+	return nil
+}
+
+// Return the args sent to the worker so far
+func (peers *broadcastPeers) sentTo(master *Master, workerId int64) []interface{} {
+	master.mu.Lock()
+	addr := master.workers[workerId].addr
+	master.mu.Unlock()
+	peers.mu.Lock()
+	defer peers.mu.Unlock()
+	return peers.sent[addr]
+}
+
+// Make a master whose workers are faked by peers, not run
+// Circuits never open, so every call reaches the peers
+func broadcastMaster(t *testing.T, peers *broadcastPeers, options ...Option) *Master {
+	t.Helper()
+	options = append([]Option{WithTransport(peers), WithCircuitBreaker(CircuitPolicy{}),
+		WithDispatchRetry(RetryPolicy{Tries: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond})},
+		options...)
+	return makeMaster(t, writeInputs(t, "a"), 1, options...)
+}
+
+// Set the error kind of the calls to the worker
+func (peers *broadcastPeers) setFail(master *Master, workerId int64, kind error) {
+	master.mu.Lock()
+	addr := master.workers[workerId].addr
+	master.mu.Unlock()
+	peers.mu.Lock()
+	defer peers.mu.Unlock()
+	peers.fail[addr] = kind
+}
+
+// Build the args of a broadcast to the worker, KillTaskSend standing for any
+func tokenArgs(workerId int64, token string) interface{} {
+	return &KillTaskSend{Token: token}
+}
+
+func TestBroadcastAggregatesPartialFailures(t *testing.T) {
+	peers := newBroadcastPeers()
+	master := broadcastMaster(t, peers, WithSecret("right"))
+	ok := registerSecret(t, master, "right").WorkerId
+	remote := registerSecret(t, master, "right").WorkerId
+	unreachable := registerSecret(t, master, "right").WorkerId
+	skipped := registerSecret(t, master, "right").WorkerId
+	peers.setFail(master, remote, ErrRemote)
+	peers.setFail(master, unreachable, ErrUnreachable)
+
+	results := master.broadcast("Worker.KillTask", func(workerId int64, token string) interface{} {
+		if workerId == skipped {
+			return nil
+		}
+		return tokenArgs(workerId, token)
+	}, broadcastOptions{})
+
+	if len(results) != 3 || results[skipped] != nil {
+		t.Fatalf("results of %v workers, want 3 without the one skipped", len(results))
+	}
+	for workerId, want := range map[int64]string{
+		ok:          BROADCAST_OK,
+		remote:      BROADCAST_REMOTE,
+		unreachable: BROADCAST_UNREACHABLE,
+	} {
+		if got := results[workerId].outcome(); got != want {
+			t.Errorf("worker %v came to %v, want %v", workerId, got, want)
+		}
+	}
+	counts := countOutcomes(results)
+	if counts[BROADCAST_OK] != 1 || counts[BROADCAST_REMOTE] != 1 || counts[BROADCAST_UNREACHABLE] != 1 {
+		t.Errorf("counts %v, want one of each", counts)
+	}
+	// Each worker is sent its own token
+	master.mu.Lock()
+	token := master.workers[ok].token
+	master.mu.Unlock()
+	if sent := peers.sentTo(master, ok); len(sent) != 1 || sent[0].(*KillTaskSend).Token != token {
+		t.Errorf("sent %v, want the token of the worker", sent)
+	}
+}
+
+func TestBroadcastTimesOutEachCall(t *testing.T) {
+	peers := newBroadcastPeers()
+	peers.delay = time.Second
+	master := broadcastMaster(t, peers)
+	for i := 0; i < 3; i++ {
+		registerWorker(t, master, 1)
+	}
+	start := time.Now()
+	results := master.broadcast("Worker.KillTask", tokenArgs,
+		broadcastOptions{timeout: 50 * time.Millisecond})
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("broadcast took %v, each call has 50ms", elapsed)
+	}
+	if counts := countOutcomes(results); counts[BROADCAST_UNREACHABLE] != 3 {
+		t.Fatalf("counts %v, want every worker unreachable", counts)
+	}
+}
+
+func TestBroadcastBoundsCallsInFlight(t *testing.T) {
+	peers := newBroadcastPeers()
+	peers.delay = 20 * time.Millisecond
+	master := broadcastMaster(t, peers)
+	for i := 0; i < 10; i++ {
+		registerWorker(t, master, 1)
+	}
+	results := master.broadcast("Worker.KillTask", tokenArgs, broadcastOptions{parallelism: 3})
+	if counts := countOutcomes(results); counts[BROADCAST_OK] != 10 {
+		t.Fatalf("counts %v, want every worker OK", counts)
+	}
+	peers.mu.Lock()
+	defer peers.mu.Unlock()
+	if peers.most != 3 {
+		t.Fatalf("%v calls in flight at most, want 3", peers.most)
+	}
+}
+
+func TestBroadcastSkipsFailedWorkersUnlessAll(t *testing.T) {
+	peers := newBroadcastPeers()
+	master := broadcastMaster(t, peers)
+	live, failed := registerWorker(t, master, 1), registerWorker(t, master, 1)
+	master.mu.Lock()
+	master.workers[failed].status = FAILED
+	master.mu.Unlock()
+
+	results := master.broadcast("Worker.KillTask", tokenArgs, broadcastOptions{})
+	if len(results) != 1 || results[live] == nil {
+		t.Fatalf("called %v workers, want only the live one", len(results))
+	}
+	results = master.broadcast("Worker.KillTask", tokenArgs, broadcastOptions{all: true})
+	if len(results) != 2 {
+		t.Fatalf("called %v workers, want both", len(results))
+	}
+}
+
+func TestBroadcastRetriesOnlyIdempotentRpcs(t *testing.T) {
+	peers := newBroadcastPeers()
+	master := broadcastMaster(t, peers)
+	workerId := registerWorker(t, master, 1)
+	peers.setFail(master, workerId, ErrUnreachable)
+
+	master.broadcast("Worker.CleanupJob", tokenArgs, broadcastOptions{})
+	if sent := len(peers.sentTo(master, workerId)); sent != 1 {
+		t.Fatalf("not idempotent rpc sent %v times, want once", sent)
+	}
+	master.broadcast("Worker.KillTask", tokenArgs, broadcastOptions{idempotency: IDEMPOTENT})
+	if sent := len(peers.sentTo(master, workerId)); sent != 1+3 {
+		t.Fatalf("idempotent rpc sent %v times, want 3", sent-1)
+	}
+}
+
+func TestKillsReachWorkersDespiteOneUnreachable(t *testing.T) {
+	peers := newBroadcastPeers()
+	master := broadcastMaster(t, peers)
+	first, second := registerWorker(t, master, 2), registerWorker(t, master, 1)
+	peers.setFail(master, second, ErrUnreachable)
+	task := func(taskId TaskId) runningTask {
+		return runningTask{jobId: DEFAULT_JOB, taskId: taskId, taskType: MAP}
+	}
+	master.killTasks([]taskKill{{first, task(0)}, {first, task(1)}, {second, task(2)}})
+
+	var killed []TaskId
+	for _, args := range peers.sentTo(master, first) {
+		killed = append(killed, args.(*KillTaskSend).Attempt.TaskId)
+	}
+	if len(killed) != 2 || killed[0] != 0 || killed[1] != 1 {
+		t.Fatalf("killed tasks %v on the first worker, want 0 and 1", killed)
+	}
+	if sent := peers.sentTo(master, second); len(sent) != 3 {
+		t.Fatalf("kill sent %v times to the unreachable worker, want every try", len(sent))
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Side files of jobs handed to workers, which keep them in a local cache
+
+package mapreduce
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The directory workers cache side files in by default
+const CACHE_DIR = "cache"
+
+// The default max bytes of the cache of a worker
+const CACHE_BYTES = 1 << 30
+
+// The max bytes of a side file sent by a single FetchCacheFile
+const CACHE_CHUNK = 1 << 20
+
+// A side file of a job, e.g. a reference dataset, see JobSpec.CacheFiles
+type CacheFile struct {
+	// The path of the file on master, which names it to user functions
+	Path string
+	// The hex SHA-256 of the file when the job is submitted, and its size
+	Sha256 string
+	Size   int64
+}
+
+// The hits and misses of the cache of a worker since it started
+// Sent with heartbeats
+type CacheStats struct {
+	Hits   int
+	Misses int
+	// The bytes not fetched again thanks to hits
+	BytesSaved int64
+}
+
+type FetchCacheFileSend struct {
+	JobId  JobId
+	Path   string
+	Sha256 string
+	Offset int64
+	// The worker fetching, and its session token
+	WorkerId int64
+	Token    string
+}
+
+type FetchCacheFileReply struct {
+	// At most CACHE_CHUNK bytes from Offset, empty past the end
+	// In Encoding, see CompressionPolicy
+	Data     []byte
+	Encoding string
+	Err      Err
+}
+
+// Hash the side files of a job being submitted
+func readCacheFiles(paths []string) ([]CacheFile, error) {
+	var files []CacheFile
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read cache file: %v", err)
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read cache file: %v", err)
+		}
+		files = append(files, CacheFile{Path: path, Sha256: sum, Size: info.Size()})
+	}
+	return files, nil
+}
+
+// rpc used by workers to download a side file of a job chunk by chunk
+// Reply BAD_JOB_ID for an unknown job, and MISSING_OUTPUT for a file the job
+// Does not have with that hash, and AUTH for a worker with a wrong token
+func (master *Master) FetchCacheFile(args *FetchCacheFileSend,
+	reply *FetchCacheFileReply) error {
+	if err := master.enter(); err != nil {
+		return err
+	}
+	defer master.inflight.Done()
+
+	master.mu.Lock()
+	if !master.checkToken(args.WorkerId, args.Token) {
+		master.mu.Unlock()
+		reply.Err = AUTH
+		return nil
+	}
+	job := master.getJob(args.JobId)
+	if job == nil {
+		master.mu.Unlock()
+		reply.Err = BAD_JOB_ID
+		return nil
+	}
+	var file *CacheFile
+	for idx := range job.cacheFiles {
+		if job.cacheFiles[idx].Path == args.Path && job.cacheFiles[idx].Sha256 == args.Sha256 {
+			file = &job.cacheFiles[idx]
+		}
+	}
+	compression := master.compressionFor(job, args.WorkerId)
+	master.mu.Unlock()
+	if file == nil {
+		reply.Err = MISSING_OUTPUT
+		return nil
+	}
+
+	// Read outside the lock, the file never changes once the job is submitted
+	// If it does, workers find the hash does not match
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return fmt.Errorf("FetchCacheFile: %v", err)
+	}
+	defer f.Close()
+	data := make([]byte, CACHE_CHUNK)
+	n, err := f.ReadAt(data, args.Offset)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("FetchCacheFile: %v", err)
+	}
+	reply.Data, reply.Encoding = compression.encode(data[:n])
+	reply.Err = OK
+	return nil
+}
+
+// The side files a worker keeps, named by source and content
+// Least recently used files are removed once they take more than the limit
+// Files used by running attempts are never removed
+type fileCache struct {
+	mu sync.Mutex
+	// Loaded from the directory on first use
+	loaded  bool
+	entries map[string]*cacheEntry
+	size    int64
+	stats   CacheStats
+}
+
+// A file in the cache
+type cacheEntry struct {
+	size int64
+	used time.Time
+	// The number of running attempts using the file
+	pins int
+}
+
+// Return the name of the cached copy of a side file
+// Keyed by source path and content, so a changed file is fetched again
+func cacheName(file CacheFile) string {
+	source := sha256.Sum256([]byte(file.Path))
+	return hex.EncodeToString(source[:8]) + "-" + file.Sha256
+}
+
+// Return the directory and size limit of the cache
+func (worker *Worker) cacheLimits() (string, int64) {
+	dir, limit := worker.CacheDir, worker.CacheBytes
+	if dir == "" {
+		dir = CACHE_DIR
+	}
+	if limit <= 0 {
+		limit = CACHE_BYTES
+	}
+	return dir, limit
+}
+
+// Load the files left in the cache directory by an earlier run
+// Must be called with the lock of the cache held
+func (cache *fileCache) load(dir string) {
+	cache.loaded = true
+	cache.entries = map[string]*cacheEntry{}
+	infos, _ := ioutil.ReadDir(dir)
+	for _, info := range infos {
+		if info.IsDir() || filepath.Ext(info.Name()) == ".tmp" {
+			continue
+		}
+		cache.entries[info.Name()] = &cacheEntry{size: info.Size(), used: info.ModTime()}
+		cache.size += info.Size()
+	}
+}
+
+// Remove least recently used files not in use until the cache fits the limit
+// Must be called with the lock of the cache held
+func (cache *fileCache) evict(dir string, limit int64) {
+	if cache.size <= limit {
+		return
+	}
+	var names []string
+	for name, entry := range cache.entries {
+		if entry.pins == 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return cache.entries[names[i]].used.Before(cache.entries[names[j]].used)
+	})
+	for _, name := range names {
+		if cache.size <= limit {
+			return
+		}
+		os.Remove(filepath.Join(dir, name))
+		cache.size -= cache.entries[name].size
+		delete(cache.entries, name)
+	}
+}
+
+// Make sure the worker has a verified local copy of every side file of an attempt
+// Return the local path of each file by its path on master
+// And the function unpinning them once the attempt is done
+func (worker *Worker) fetchCacheFiles(jobId JobId, files []CacheFile) (map[string]string,
+	func(), error) {
+	dir, limit := worker.cacheLimits()
+	cache := &worker.cache
+	var pinned []string
+	release := func() {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		for _, name := range pinned {
+			if entry, ok := cache.entries[name]; ok {
+				entry.pins--
+			}
+		}
+		cache.evict(dir, limit)
+	}
+	if len(files) == 0 {
+		return nil, release, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, release, fmt.Errorf("cannot create cache: %v", err)
+	}
+
+	paths := map[string]string{}
+	for _, file := range files {
+		name := cacheName(file)
+		local := filepath.Join(dir, name)
+
+		// Pin a cached copy so it is not removed while it is checked and used
+		cache.mu.Lock()
+		if !cache.loaded {
+			cache.load(dir)
+		}
+		entry, hit := cache.entries[name]
+		if hit {
+			entry.pins++
+		}
+		cache.mu.Unlock()
+
+		// A hit is trusted only if its content still matches
+		if hit {
+			if sum, err := hashFile(local); err == nil && sum == file.Sha256 {
+				cache.mu.Lock()
+				entry.used = time.Now()
+				cache.stats.Hits++
+				cache.stats.BytesSaved += file.Size
+				cache.mu.Unlock()
+				pinned = append(pinned, name)
+				paths[file.Path] = local
+				continue
+			}
+			cache.mu.Lock()
+			entry.pins--
+			if entry.pins == 0 {
+				os.Remove(local)
+				cache.size -= entry.size
+				delete(cache.entries, name)
+			}
+			cache.mu.Unlock()
+		}
+
+		if err := worker.downloadCacheFile(jobId, file, local); err != nil {
+			release()
+			return nil, func() {}, err
+		}
+		cache.mu.Lock()
+		cache.stats.Misses++
+		if entry, ok := cache.entries[name]; ok {
+			entry.pins++
+			entry.used = time.Now()
+		} else {
+			cache.entries[name] = &cacheEntry{size: file.Size, used: time.Now(), pins: 1}
+			cache.size += file.Size
+		}
+		cache.evict(dir, limit)
+		cache.mu.Unlock()
+		pinned = append(pinned, name)
+		paths[file.Path] = local
+	}
+	return paths, release, nil
+}
+
+// Download a side file from master into a temp file next to local
+// Renamed to local only if its size and SHA-256 match
+func (worker *Worker) downloadCacheFile(jobId JobId, file CacheFile, local string) error {
+	temp, err := ioutil.TempFile(filepath.Dir(local), "distributor-*.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot cache %v: %v", file.Path, err)
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	hash := sha256.New()
+	writer := io.MultiWriter(temp, hash)
+	var offset int64
+	for offset < file.Size {
+		addr, _ := worker.master()
+		reply := FetchCacheFileReply{}
+		send := FetchCacheFileSend{JobId: jobId, Path: file.Path, Sha256: file.Sha256, Offset: offset,
+			WorkerId: worker.id, Token: worker.sessionToken()}
+		if err := worker.call(worker.CallTimeout, addr, "Master.FetchCacheFile", &send, &reply); err != nil {
+			return fmt.Errorf("cannot fetch %v: %w", file.Path, err)
+		}
+		if reply.Err != OK {
+			return fmt.Errorf("cannot fetch %v: %v", file.Path, reply.Err)
+		}
+		data, err := decodePayload(reply.Data, reply.Encoding)
+		if err != nil {
+			return fmt.Errorf("cannot fetch %v: %v", file.Path, err)
+		}
+		if len(data) == 0 {
+			break
+		}
+		if _, err := writer.Write(data); err != nil {
+			return fmt.Errorf("cannot cache %v: %v", file.Path, err)
+		}
+		offset += int64(len(data))
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if offset != file.Size || sum != file.Sha256 {
+		return fmt.Errorf("%v: downloaded %v bytes with sha256 %v, want %v bytes with sha256 %v",
+			file.Path, offset, sum, file.Size, file.Sha256)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("cannot cache %v: %v", file.Path, err)
+	}
+	return os.Rename(temp.Name(), local)
+}
+
+// Return the counters of the cache
+func (worker *Worker) cacheStats() CacheStats {
+	worker.cache.mu.Lock()
+	defer worker.cache.mu.Unlock()
+	return worker.cache.stats
+}
@@ -0,0 +1,294 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of the errors Call returns
+
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The service of the fake peer, exported so net/rpc registers it
+type CallService struct{}
+
+type CallArgs struct{ Fail bool }
+
+func (CallService) Run(args *CallArgs, reply *GeneralReply) error {
+	if args.Fail {
+		return errors.New("method failed")
+	}
+	reply.Err = OK
+	return nil
+}
+
+// Serve CallService on a free port as the workers do, until the test ends
+// Return its address
+func servePeer(t *testing.T) string {
+	t.Helper()
+	server, listener, err := CreateServerAddr(CallService{}, "127.0.0.1:0", "peer", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeCodec(GobCodec().NewServerCodec(conn, nil))
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// Accept connections on a free port and never reply, return its address
+func hangingPeer(t *testing.T) string {
+	addr, _ := stallingPeer(t)
+	return addr
+}
+
+// Accept connections on a free port, read the requests and never reply
+// Return its address, and the bytes read so far
+func stallingPeer(t *testing.T) (string, func() int64) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	var read int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go func() {
+				buf := make([]byte, 4096)
+				for {
+					n, err := conn.Read(buf)
+					mu.Lock()
+					read += int64(n)
+					mu.Unlock()
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		<-done
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return listener.Addr().String(), func() int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return read
+	}
+}
+
+// Return an address nothing listens on
+func refusingPeer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+// Call Run on the peer at addr within timeout
+func callPeer(addr string, fail bool, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return Call(ctx, addr, "CallService.Run", &CallArgs{Fail: fail}, &GeneralReply{})
+}
+
+func TestCallErrorKinds(t *testing.T) {
+	tests := []struct {
+		name      string
+		addr      func(t *testing.T) string
+		fail      bool
+		kind      error
+		reachable bool
+	}{
+		{"refused", refusingPeer, false, ErrUnreachable, false},
+		{"hanging", hangingPeer, false, ErrTimeout, false},
+		{"method error", servePeer, true, ErrRemote, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := test.addr(t)
+			err := callPeer(addr, test.fail, 200*time.Millisecond)
+			if !errors.Is(err, test.kind) {
+				t.Fatalf("got %v, want %v", err, test.kind)
+			}
+			for _, other := range []error{ErrUnreachable, ErrRemote, ErrTimeout} {
+				if other != test.kind && errors.Is(err, other) {
+					t.Errorf("%v is also %v", err, other)
+				}
+			}
+			var callErr *CallError
+			if !errors.As(err, &callErr) || callErr.RpcName != "CallService.Run" || callErr.Addr != addr {
+				t.Errorf("%v does not name the rpc and the peer", err)
+			}
+			if reachable(err) != test.reachable {
+				t.Errorf("reachable(%v) is %v", err, !test.reachable)
+			}
+		})
+	}
+}
+
+func TestCallRemoteErrorKeepsServerError(t *testing.T) {
+	err := callPeer(servePeer(t), true, time.Second)
+	var serverErr rpc.ServerError
+	if !errors.As(err, &serverErr) || string(serverErr) != "method failed" {
+		t.Fatalf("got %v, want the error of the method", err)
+	}
+}
+
+func TestCallSucceeds(t *testing.T) {
+	reply := GeneralReply{}
+	err := Call(context.Background(), servePeer(t), "CallService.Run", &CallArgs{}, &reply)
+	if err != nil || reply.Err != OK {
+		t.Fatalf("got %v, %v", reply.Err, err)
+	}
+	if !reachable(err) {
+		t.Fatal("peer that replied is unreachable")
+	}
+}
+
+func TestCallCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err := Call(ctx, hangingPeer(t), "CallService.Run", &CallArgs{}, &GeneralReply{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	for _, kind := range []error{ErrUnreachable, ErrRemote, ErrTimeout} {
+		if errors.Is(err, kind) {
+			t.Errorf("cancelled call is %v", kind)
+		}
+	}
+}
+
+func TestOnlyTransportFailuresAreRetried(t *testing.T) {
+	policy := RetryPolicy{Tries: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	for _, kind := range []error{ErrUnreachable, ErrTimeout, ErrRemote} {
+		tries := 0
+		err := retryCall(context.Background(), IDEMPOTENT, policy, func() error {
+			tries++
+			return &CallError{kind, "Worker.IsOnline", "localhost:1", errors.New("failed")}
+		})
+		want := 3
+		if kind == ErrRemote {
+			want = 1
+		}
+		if !errors.Is(err, kind) || tries != want {
+			t.Errorf("%v tried %v times and returned %v, want %v tries", kind, tries, err, want)
+		}
+	}
+}
+
+func TestRemoteErrorsKeepTheCircuitClosed(t *testing.T) {
+	breaker := newCircuitBreaker(CircuitPolicy{Failures: 2, Cooldown: time.Minute})
+	addr, now := "localhost:1", time.Now()
+	remote := &CallError{ErrRemote, "Worker.StartMap", addr, errors.New("failed")}
+	for i := 0; i < 5; i++ {
+		breaker.record(addr, remote, now)
+	}
+	if state := breaker.state(addr); state != CIRCUIT_CLOSED {
+		t.Fatalf("circuit %v after remote errors", state)
+	}
+	unreachable := &CallError{ErrUnreachable, "Worker.StartMap", addr, errors.New("refused")}
+	breaker.record(addr, unreachable, now)
+	if state := breaker.record(addr, unreachable, now); state != CIRCUIT_OPEN {
+		t.Fatalf("circuit %v after 2 unreachable calls, want open", state)
+	}
+}
+
+func TestCallToStalledPeerTimesOut(t *testing.T) {
+	addr, read := stallingPeer(t)
+	start := time.Now()
+	err := callPeer(addr, false, 200*time.Millisecond)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("call returned after %v, timeout was 200ms", elapsed)
+	}
+	if read() == 0 {
+		t.Fatal("peer never got the request")
+	}
+}
+
+func TestStalledWorkerDoesNotBlockScheduler(t *testing.T) {
+	contents := []string{"a b", "b c", "c d"}
+	addr, read := stallingPeer(t)
+	master := startMaster(t, writeInputs(t, contents...), 1,
+		WithCallTimeouts(200*time.Millisecond, 100*time.Millisecond))
+	// Registered first, so it is dispatched tasks before the real worker joins
+	registerAt(t, master, 0, addr, 2)
+	waitFor(t, 5*time.Second, "a dispatch to the stalled worker", func() bool { return read() > 0 })
+
+	startWorker(t, master, nil)
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+}
+
+// A service whose reply gob cannot encode, for it has no exported field
+type UnencodableService struct{}
+
+type UnencodableReply struct{ err Err }
+
+func (UnencodableService) Run(args *CallArgs, reply *UnencodableReply) error {
+	reply.err = OK
+	return nil
+}
+
+func TestUnencodableReplyLoggedAndConnectionClosed(t *testing.T) {
+	logger := &recordLogger{}
+	server := newRPCTransport(nil, GobCodec(), DefaultKeepalivePolicy())
+	server.logger = logger
+	listener, err := server.Listen("UnencodableService", UnencodableService{}, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client := NewRPCTransport(nil)
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// The peer sees the connection close rather than waiting on the reply
+	err = client.Call(ctx, listener.Addr().String(), "UnencodableService.Run", &CallArgs{},
+		&UnencodableReply{})
+	if err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("call of an unencodable reply: %v, want the connection closed", err)
+	}
+	waitFor(t, 5*time.Second, "the encode error logged", func() bool {
+		return logger.contains("ERROR Rpc UnencodableService.Run: cannot encode the body")
+	})
+}
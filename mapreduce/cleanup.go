@@ -0,0 +1,107 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Removal of the intermediate files of a job once it is done
+
+package mapreduce
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+type CleanupJobSend struct {
+	Term  int64
+	Token string
+	JobId JobId
+	// The output directory of the job, where reduce attempts keep temp dirs
+	OutputDir string
+	// Where workers write intermediate files, see WorkerConfig.MapDir
+	MapDir string
+}
+
+// Wait until the job is done, and tell every worker to delete its intermediate files
+// Only a job that finished or failed, or every job once master is aborted
+// A job stopped by Shutdown keeps its files, so it can resume
+// Shutdown waits for the cleanup of a job that is done
+func (master *Master) cleanupWhenDone(job *jobState) {
+	master.mu.Lock()
+	for !job.done() {
+		changed := master.changed
+		master.mu.Unlock()
+		<-changed
+		master.mu.Lock()
+	}
+	ended := job.failure != nil || (job.phaseFinished(MAP) && job.phaseFinished(REDUCE))
+	if !ended && !job.aborted && !master.aborted {
+		master.mu.Unlock()
+		return
+	}
+
+	send := CleanupJobSend{Term: master.term, JobId: job.id, OutputDir: job.outputDir,
+		MapDir: master.config.MapDir}
+	master.mu.Unlock()
+
+	// A worker that cannot be reached keeps its files
+	results := master.broadcast("Worker.CleanupJob", func(_ int64, token string) interface{} {
+		args := send
+		args.Token = token
+		return &args
+	}, broadcastOptions{})
+	for _, result := range results {
+		if result.err != nil {
+			master.config.Logger.Warnf("Job %v: %v", job.id, result.err)
+		}
+	}
+	counts := countOutcomes(results)
+	master.config.Logger.Infof("Job %v: done, cleaned up intermediate files on %v of %v workers, %v unreachable",
+		job.id, counts[BROADCAST_OK], len(results), counts[BROADCAST_UNREACHABLE])
+}
+
+// rpc used by master to delete the intermediate files of a job that is done
+// Running attempts of the job are killed first, so they commit nothing more
+// Final output is kept, and cleaning up a job twice is harmless
+// Reply STALE_TERM if a newer master has dispatched tasks to the worker
+func (worker *Worker) CleanupJob(args *CleanupJobSend, reply *GeneralReply) error {
+	if err := worker.checkToken(args.Token); err != nil {
+		return err
+	}
+	if !worker.acceptTerm(args.Term) {
+		reply.Err = STALE_TERM
+		return nil
+	}
+
+	worker.mu.Lock()
+	for attempt := range worker.tasks {
+		if attempt.JobId == args.JobId {
+			worker.kill(attempt)
+		}
+	}
+	worker.mu.Unlock()
+
+	// Intermediate files, manifests and attempt dirs of map tasks
+	// And attempt dirs of reduce tasks left in the output directory
+	id := strconv.Itoa(int(args.JobId))
+	mapDir := worker.taskMapDir(args.MapDir)
+	patterns := []string{
+		filepath.Join(mapDir, IRP+"-"+id+"-*"),
+		filepath.Join(mapDir, IRP+"-tmp-"+id+"-*"),
+	}
+	if args.OutputDir != "" {
+		patterns = append(patterns, filepath.Join(args.OutputDir, IRP+"-tmp-"+id+"-*"))
+	}
+	removed := 0
+	for _, pattern := range patterns {
+		names, _ := filepath.Glob(pattern)
+		for _, name := range names {
+			if err := os.RemoveAll(name); err != nil {
+				worker.Logger.Warnf("Job %v: cannot clean up %v: %v", args.JobId, name, err)
+				continue
+			}
+			removed++
+		}
+	}
+	worker.Logger.Infof("Job %v: removed %v intermediate files", args.JobId, removed)
+
+	reply.Err = OK
+	return nil
+}
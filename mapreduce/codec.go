@@ -0,0 +1,186 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// The codecs rpc messages are encoded with on the wire
+
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+)
+
+// The names of the wire codecs, stated by workers on registration
+const WIRE_GOB = "gob"
+const WIRE_JSON = "jsonrpc"
+
+// Encodes the rpcs of a connection
+// Both ends of a connection must use the same one, see WithCodec
+type WireCodec interface {
+	// The name workers state in Capabilities, e.g. WIRE_GOB
+	Name() string
+	// Return the client codec of a dialed connection
+	NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec
+	// Return the server codec of an accepted connection
+	// Running the Receive and Reply hooks of interceptors around each method
+	NewServerCodec(conn io.ReadWriteCloser, interceptors []Interceptor) rpc.ServerCodec
+}
+
+type gobCodec struct{}
+
+// Return the default codec, gob with the request id ahead of the arguments
+// Only Go peers read it
+func GobCodec() WireCodec {
+	return gobCodec{}
+}
+
+func (gobCodec) Name() string {
+	return WIRE_GOB
+}
+
+func (gobCodec) NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return newMetaClientCodec(conn)
+}
+
+func (gobCodec) NewServerCodec(conn io.ReadWriteCloser, interceptors []Interceptor) rpc.ServerCodec {
+	return newMetaServerCodec(conn, interceptors)
+}
+
+type jsonCodec struct{}
+
+// Return the JSON-RPC 1.0 codec of net/rpc/jsonrpc
+// So tools in other languages can submit jobs and poll their status
+// E.g. {"method": "Master.GetJobStatus", "params": [{"JobId": 0}], "id": 1}
+// Request ids are not sent, each request served gets a new one
+func JSONCodec() WireCodec {
+	return jsonCodec{}
+}
+
+func (jsonCodec) Name() string {
+	return WIRE_JSON
+}
+
+func (jsonCodec) NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return &jsonClientCodec{jsonrpc.NewClientCodec(conn)}
+}
+
+func (jsonCodec) NewServerCodec(conn io.ReadWriteCloser, interceptors []Interceptor) rpc.ServerCodec {
+	return &jsonServerCodec{ServerCodec: jsonrpc.NewServerCodec(conn),
+		hooks: newServerHooks(conn, interceptors)}
+}
+
+// The client codec of net/rpc/jsonrpc, dropping rpcMeta it cannot send
+type jsonClientCodec struct {
+	rpc.ClientCodec
+}
+
+func (c *jsonClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	if envelope, ok := body.(*rpcEnvelope); ok {
+		body = envelope.args
+	}
+	return c.ClientCodec.WriteRequest(r, body)
+}
+
+// The server codec of net/rpc/jsonrpc, running the hooks of interceptors
+type jsonServerCodec struct {
+	rpc.ServerCodec
+	hooks *serverHooks
+	// The header just read, requests are read one at a time
+	request rpc.Request
+}
+
+func (c *jsonServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.ServerCodec.ReadRequestHeader(r); err != nil {
+		return err
+	}
+	c.request = *r
+	return nil
+}
+
+// Like metaServerCodec, the interceptors of discarded requests and pings are not run
+func (c *jsonServerCodec) ReadRequestBody(body interface{}) error {
+	if err := c.ServerCodec.ReadRequestBody(body); err != nil || body == nil ||
+		c.request.ServiceMethod == KEEPALIVE_METHOD {
+		return err
+	}
+	return c.hooks.received(c.request.Seq, c.request.ServiceMethod, newRequestId(), body)
+}
+
+func (c *jsonServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.hooks.replied(r, body)
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+// Return the name of the codec of the default transport, see WireCodec
+// Empty for other transports, whose peers agree on the encoding by themselves
+func transportWire(transport Transport) string {
+	if rpcTransport, ok := transport.(*rpcTransport); ok {
+		return rpcTransport.codec.Name()
+	}
+	return ""
+}
+
+// A listener master serves next to its own, see WithCodecListener
+type CodecListener struct {
+	// A host:port, where port 0 picks a free port
+	Addr  string
+	Codec WireCodec
+}
+
+// Serve master on every listener of WithCodecListener
+// With the TLS config and interceptors of the default transport
+// Return the listeners, or error once one cannot be listened on
+func (master *Master) listenCodecs() ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, extra := range master.config.CodecListeners {
+		server, listener, err := CreateServerAddr(master, extra.Addr, "Master", master.config.TLS)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, goServe("Master", server, listener, extra.Codec,
+			master.interceptors(), master.config.Logger, master.serveFailed))
+	}
+	return listeners, nil
+}
+
+// Return the codec of the default transport
+func (config *MasterConfig) wireCodec() WireCodec {
+	if config.Codec == nil {
+		return GobCodec()
+	}
+	return config.Codec
+}
+
+// Encode the rpcs of master and its workers with codec instead of GobCodec
+// Workers must set the same codec, see Worker.Codec
+// Ignored if WithTransport is set
+func WithCodec(codec WireCodec) Option {
+	return func(config *MasterConfig) error {
+		if codec == nil {
+			return errors.New("WithCodec: nil codec")
+		}
+		config.Codec = codec
+		return nil
+	}
+}
+
+// Serve master on addr with codec as well, e.g. JSONCodec for tools in other languages
+// Next to the listener workers use, which keeps its own codec
+// May be passed more than once
+func WithCodecListener(addr string, codec WireCodec) Option {
+	return func(config *MasterConfig) error {
+		if codec == nil {
+			return errors.New("WithCodecListener: nil codec")
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("WithCodecListener: %v", err)
+		}
+		config.CodecListeners = append(config.CodecListeners, CodecListener{addr, codec})
+		return nil
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of serving master rpcs over each wire codec
+
+package mapreduce
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Call rpcName on addr over transport, failing the test if it cannot be sent
+func callOver(t *testing.T, transport Transport, addr, rpcName string, args, reply interface{}) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := transport.Call(ctx, addr, rpcName, args, reply); err != nil {
+		t.Fatalf("%v to %v: %v", rpcName, addr, err)
+	}
+}
+
+func TestStatusAndRegistrationOverEveryCodec(t *testing.T) {
+	master := startMaster(t, writeInputs(t, "a b", "b c"), 1,
+		WithCodecListener("127.0.0.1:0", JSONCodec()))
+	// The workers registered have no server, so nothing is dispatched to them
+	master.PauseScheduling()
+	if len(master.CodecAddrs()) != 1 {
+		t.Fatalf("master listens with codecs on %v, want one address", master.CodecAddrs())
+	}
+
+	codecs := []struct {
+		name      string
+		transport Transport
+		addr      string
+	}{
+		{WIRE_GOB, NewRPCTransport(nil), master.Addr().String()},
+		{WIRE_JSON, NewRPCTransportCodec(nil, JSONCodec()), master.CodecAddrs()[0].String()},
+	}
+	var statuses []JobStatus
+	for idx, codec := range codecs {
+		defer codec.transport.Close()
+
+		// Registered as a worker master calls back with gob, whichever codec it sent with
+		registered := RegisterReply{}
+		callOver(t, codec.transport, codec.addr, "Master.RegisterWorker", &RegisterSend{
+			Version: PROTOCOL_VERSION,
+			Addr:    joinAddr("localhost", int64(31000+idx)),
+			Slots:   2,
+			Capabilities: Capabilities{Codecs: []string{CODEC_JSON}, Shuffle: true,
+				Wire: WIRE_GOB},
+		}, &registered)
+		if registered.Err != OK || registered.WorkerId == 0 {
+			t.Fatalf("%v: register replied %v with id %v", codec.name, registered.Err,
+				registered.WorkerId)
+		}
+
+		status := JobStatus{}
+		callOver(t, codec.transport, codec.addr, "Master.GetJobStatus",
+			&JobStatusSend{JobId: DEFAULT_JOB}, &status)
+		if status.Err != OK || status.JobId != DEFAULT_JOB || status.Phase != PHASE_MAP ||
+			status.Version != JOB_STATUS_VERSION || status.Progress.MapPending != 2 ||
+			!status.Progress.Paused {
+			t.Fatalf("%v: status %+v", codec.name, status)
+		}
+		statuses = append(statuses, status)
+
+		unknown := JobStatus{}
+		callOver(t, codec.transport, codec.addr, "Master.GetJobStatus",
+			&JobStatusSend{JobId: 42}, &unknown)
+		if unknown.Err != BAD_JOB_ID || unknown.JobId != 42 {
+			t.Fatalf("%v: status of an unknown job %v of job %v", codec.name, unknown.Err,
+				unknown.JobId)
+		}
+	}
+
+	// Both codecs told the same, but for the worker registered in between
+	gob, json := statuses[0], statuses[1]
+	if gob.Progress.Workers != 1 || json.Progress.Workers != 2 {
+		t.Fatalf("status over gob has %v workers, over json %v, want 1 and 2",
+			gob.Progress.Workers, json.Progress.Workers)
+	}
+	gob.Progress, json.Progress = Progress{}, Progress{}
+	if !reflect.DeepEqual(gob, json) {
+		t.Fatalf("status over gob %+v, over json %+v", gob, json)
+	}
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	if len(master.workers) != 2 {
+		t.Fatalf("%v workers registered, want one over each codec", len(master.workers))
+	}
+}
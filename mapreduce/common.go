@@ -4,9 +4,13 @@
 package mapreduce
 
 import (
+    "context"
+    "crypto/rand"
+    "crypto/tls"
+    "encoding/binary"
+    "errors"
     "fmt"
     "hash/fnv"
-    "log"
     "net"
     "net/rpc"
     "strconv"
@@ -18,9 +22,25 @@ type Err string
 const DURATION = time.Millisecond * 50
 const OFFLINE = time.Millisecond * 500
 
+// The wait of an accept loop after a temporary error, doubled up to ACCEPT_MAX_BACKOFF
+const ACCEPT_BACKOFF = 5 * time.Millisecond
+const ACCEPT_MAX_BACKOFF = time.Second
+
+// The interval a worker sends heartbeats to master
+const HEARTBEAT_INTERVAL = time.Second * 2
+
+// A running attempt records its progress every PROGRESS_RECORDS records
+const PROGRESS_RECORDS = 1000
+
 const IRP = "mr"
 const ROP = "wc"
 
+// The directory of intermediate files produced by map
+const MAP_DIR = "mapresult"
+
+// The default directory of reduce output
+const REDUCE_DIR = "reduceresult"
+
 const (
     OK   = "OK"
     FAIL = "FAIL"
@@ -33,6 +53,8 @@ type ArgEmpty *struct{}
 // Carries a single Error object (aka string)
 type GeneralReply struct {
     Err Err
+    // The backoff master suggests with RETRY_LATER
+    RetryAfter time.Duration
 }
 
 // Key Value pair
@@ -42,52 +64,231 @@ type KeyValue struct {
     Value string
 }
 
-// The function used to call rpc
-func Call(port int64, rpcName string,
-    args interface{}, reply interface{}) bool {
+// Return a random positive id for a worker
+// Unique with overwhelming odds, so workers pick their own
+func newWorkerId() int64 {
+    var buf [8]byte
+    for {
+        if _, err := rand.Read(buf[:]); err != nil {
+            panic(fmt.Sprintf("newWorkerId: %v", err))
+        }
+        if id := int64(binary.BigEndian.Uint64(buf[:]) >> 1); id > 0 {
+            return id
+        }
+    }
+}
+
+// The max duration Call waits for a connection to the peer
+const DIAL_TIMEOUT = 5 * time.Second
+
+// The default max duration of an rpc by what it is for
+// Dispatching tasks, reporting attempts and notifying workers in CALL_TIMEOUT
+// Probing whether a peer is alive in PROBE_TIMEOUT
+const CALL_TIMEOUT = 10 * time.Second
+const PROBE_TIMEOUT = 2 * time.Second
+
+// The kinds of errors Call returns, matched with errors.Is
+var (
+    // The peer cannot be dialed, or the connection broke before a reply
+    ErrUnreachable = errors.New("peer unreachable")
+    // The peer ran the method and it returned an error
+    ErrRemote = errors.New("remote error")
+    // Dialing or the call took too long
+    ErrTimeout = errors.New("rpc timeout")
+)
+
+// The error of a Call, of kind ErrUnreachable, ErrRemote or ErrTimeout
+// Or context.Canceled if the context of the call is cancelled
+type CallError struct {
+    Kind    error
+    RpcName string
+    Addr    string
+    // The error of the dial, of net/rpc or of the context
+    Err error
+}
+
+func (e *CallError) Error() string {
+    return fmt.Sprintf("%v to %v: %v: %v", e.RpcName, e.Addr, e.Kind, e.Err)
+}
+
+// So errors.Is matches the kind as well as the error of net/rpc
+func (e *CallError) Is(target error) bool {
+    return target == e.Kind
+}
+
+func (e *CallError) Unwrap() error {
+    return e.Err
+}
+
+// Return the kind of an error of net/rpc or of the connection
+func callErrorKind(err error) error {
+    if _, ok := err.(rpc.ServerError); ok {
+        return ErrRemote
+    }
+    if err == context.Canceled {
+        return context.Canceled
+    }
+    var netErr net.Error
+    if err == context.DeadlineExceeded || (errors.As(err, &netErr) && netErr.Timeout()) {
+        return ErrTimeout
+    }
+    return ErrUnreachable
+}
+
+// Return true unless err shows the peer cannot be reached
+// A peer that runs the method and returns an error is alive
+func reachable(err error) bool {
+    return err == nil || errors.Is(err, ErrRemote)
+}
+
+// Dial the rpc server at addr, giving up after DIAL_TIMEOUT or once ctx is done
+// Over TLS with tlsConfig unless it is nil, see clientTLS
+// Encoding rpcs with codec
+func dial(ctx context.Context, addr string, tlsConfig *tls.Config, codec WireCodec) (*rpc.Client, error) {
+    ctx, cancel := context.WithTimeout(ctx, DIAL_TIMEOUT)
+    defer cancel()
+
+    dialer := net.Dialer{}
+    conn, err := dialer.DialContext(ctx, "tcp", addr)
+    if err == nil && tlsConfig != nil {
+        tlsConn := tls.Client(conn, clientTLS(tlsConfig))
+        if err = tlsConn.HandshakeContext(ctx); err != nil {
+            conn.Close()
+        }
+        conn = tlsConn
+    }
+    if err != nil {
+        if ctx.Err() != nil {
+            return nil, ctx.Err()
+        }
+        return nil, err
+    }
+    return rpc.NewClientWithCodec(codec.NewClientCodec(conn)), nil
+}
+
+// Call rpcName over client until it replies or ctx is done
+// Once ctx is done, abandon is called to tear the connection down
+// And the reply is not written to afterwards
+func callClient(ctx context.Context, client *rpc.Client, rpcName string,
+    args interface{}, reply interface{}, abandon func()) error {
+    call := client.Go(rpcName, args, reply, make(chan *rpc.Call, 1))
+    select {
+    case <-call.Done:
+        return call.Error
+    case <-ctx.Done():
+        // The call ends once the connection is closed
+        abandon()
+        <-call.Done
+        return ctx.Err()
+    }
+}
+
+// The function used to call rpc on the peer at addr, a host:port
+// Give up once ctx is done, closing the connection
+// Return a *CallError telling a peer that cannot be reached
+// From a method that returns an error, and from a timeout
+func Call(ctx context.Context, addr string, rpcName string,
+    args interface{}, reply interface{}) error {
+    return CallTLS(ctx, nil, addr, rpcName, args, reply)
+}
+
+// Call rpc like Call, over TLS with tlsConfig unless it is nil
+func CallTLS(ctx context.Context, tlsConfig *tls.Config, addr string, rpcName string,
+    args interface{}, reply interface{}) error {
+    return callCodec(ctx, tlsConfig, GobCodec(), addr, rpcName, args, reply)
+}
+
+// Call rpc like CallTLS, encoded with codec
+func callCodec(ctx context.Context, tlsConfig *tls.Config, codec WireCodec, addr string,
+    rpcName string, args interface{}, reply interface{}) error {
     // Get connection object
-    client, err := rpc.Dial("tcp", ":"+strconv.FormatInt(port, 10))
+    client, err := dial(ctx, addr, tlsConfig, codec)
     if err != nil {
-        fmt.Println("Call:", err)
-        return false
+        return &CallError{callErrorKind(err), rpcName, addr, err}
     }
     defer client.Close()
 
     // Connect using connection object
-    e := client.Call(rpcName, args, reply)
-    if e != nil {
-        fmt.Println("Call:", e)
-        return false
+    err = callClient(ctx, client, rpcName, args, reply, func() { client.Close() })
+    if err != nil {
+        return &CallError{callErrorKind(err), rpcName, addr, err}
     }
-
-    return true
+    return nil
 }
 
+// Create the rpc server of remoteObj listening on port
+// Over TLS with tlsConfig unless it is nil, so plain TCP clients are refused
+// Return error if the port cannot be listened on
 func CreateServer(remoteObj interface{}, port int64,
-    serverName string) (*rpc.Server, net.Listener) {
+    serverName string, tlsConfig *tls.Config) (*rpc.Server, net.Listener, error) {
+    return CreateServerAddr(remoteObj, ":"+strconv.FormatInt(port, 10), serverName, tlsConfig)
+}
+
+// Create the rpc server of remoteObj like CreateServer, listening on addr
+// A host:port, where port 0 picks a free port, see listenerPort
+// The address it got is the Addr of the listener
+func CreateServerAddr(remoteObj interface{}, addr string,
+    serverName string, tlsConfig *tls.Config) (*rpc.Server, net.Listener, error) {
     rp := rpc.NewServer()
     rp.Register(remoteObj)
+    // Answer the pings of pooled connections, see KeepalivePolicy
+    rp.RegisterName("Keepalive", keepaliveService{})
 
-    listener, err := net.Listen("tcp", ":"+strconv.FormatInt(port, 10))
+    listener, err := net.Listen("tcp", addr)
     if err != nil {
-        log.Fatal(serverName, "listen error:", err)
+        // Wrapped, so errors.Is tells e.g. syscall.EADDRINUSE and the caller may try again
+        return nil, nil, fmt.Errorf("%v cannot listen on %v: %w", serverName, addr, err)
+    }
+    if tlsConfig != nil {
+        listener = tls.NewListener(listener, tlsConfig)
     }
 
-    return rp, listener
+    return rp, listener, nil
 }
 
-// The event loop that constantly deal with requests
-func RunServer(serviceName string, server *rpc.Server, listener net.Listener) {
-    for {
-        conn, err := listener.Accept()
-        if err == nil {
-            go server.ServeConn(conn)
-        } else {
-            fmt.Println(serviceName, "done")
-            break
-        }
+// Return the port listener got, e.g. the one picked for port 0
+// Or 0 if its address has no port
+func listenerPort(listener net.Listener) int64 {
+    if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+        return int64(addr.Port)
+    }
+    _, port, err := net.SplitHostPort(listener.Addr().String())
+    if err != nil {
+        return 0
     }
-    listener.Close()
+    value, _ := strconv.ParseInt(port, 10, 64)
+    return value
+}
+
+// Return the address a peer listens on, host:port or ":port" for every interface
+func listenAddr(addr string, port int64) string {
+    if addr != "" {
+        return addr
+    }
+    return ":" + strconv.FormatInt(port, 10)
+}
+
+// The event loop that constantly deal with requests
+// Peers keep their connections across calls
+// So the connections are closed as well once the listener is closed
+// Each request runs the Receive and Reply hooks of interceptors, see Interceptor
+// Temporary accept errors, e.g. too many open files, are waited out with backoff
+// Return nil once the listener is closed, or the accept error it stopped on
+func RunServer(serviceName string, server *rpc.Server, listener net.Listener,
+    interceptors ...Interceptor) error {
+    return RunServerCodec(serviceName, server, listener, GobCodec(), interceptors...)
+}
+
+// Serve requests like RunServer, encoded with codec
+func RunServerCodec(serviceName string, server *rpc.Server, listener net.Listener,
+    codec WireCodec, interceptors ...Interceptor) error {
+    return newServeState(nil).serve(serviceName, server, listener, codec, interceptors)
+}
+
+// Return true if err may go away by itself, e.g. a full table of open files
+func temporary(err error) bool {
+    var temp interface{ Temporary() bool }
+    return errors.As(err, &temp) && temp.Temporary()
 }
 
 // A function blocks duration
@@ -109,6 +310,33 @@ func iHash(key string) int {
     return int(h.Sum32() & 0x7fffffff)
 }
 
+// The name of intermediate file in dir produced by map task mapId of job jobId
+// And consumed by reduce task reduceId of the same job
+func intermediateName(dir string, jobId JobId, mapId, reduceId int) string {
+    return dir + "/" + IRP + "-" + int2str(int(jobId)) + "-" +
+        int2str(mapId) + "-" + int2str(reduceId)
+}
+
+// The name of the manifest in dir written once map task mapId of job jobId
+// Has committed all of its intermediate files
+func manifestName(dir string, jobId JobId, mapId int) string {
+    return dir + "/" + IRP + "-" + int2str(int(jobId)) + "-" +
+        int2str(mapId) + ".manifest"
+}
+
+// The private directory in dir where an attempt writes its temp files
+// Each attempt has its own, so a retried attempt never shares files with a zombie
+func attemptDir(dir string, attempt TaskAttempt) string {
+    return dir + "/" + IRP + "-tmp-" + int2str(int(attempt.JobId)) + "-" +
+        taskTypeName(attempt.TaskType) + "-" + int2str(int(attempt.TaskId)) + "-" +
+        int2str(int(attempt.AttemptId))
+}
+
+// The name of output file produced by reduce task reduceId
+func outputName(dir string, reduceId int) string {
+    return dir + "/" + ROP + "-" + int2str(reduceId)
+}
+
 // Convert int64 to string
 func int2str(val int) string {
     return strconv.FormatInt(int64(val), 10)
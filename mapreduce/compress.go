@@ -0,0 +1,143 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Compression of the partitions and side files sent between peers
+
+package mapreduce
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+// The encodings of a payload, identity sends it as it is
+const COMPRESS_IDENTITY = "identity"
+const COMPRESS_GZIP = "gzip"
+
+// The default size below which payloads are sent as they are
+const COMPRESS_THRESHOLD = 4 << 10
+
+// How the partitions reducers fetch from other workers, and the side files
+// Workers fetch from master, are compressed
+// A peer that cannot decode the codec, e.g. one registered without it
+// In Capabilities.Compression, is sent every payload as it is
+type CompressionPolicy struct {
+	// COMPRESS_GZIP, or COMPRESS_IDENTITY to compress nothing
+	Codec string
+	// Payloads smaller than Threshold bytes are sent as they are
+	// 0 means COMPRESS_THRESHOLD
+	Threshold int
+	// The gzip level, 0 means gzip.DefaultCompression
+	Level int
+}
+
+// Return the codecs this build decodes, sent with Capabilities
+func compressionCodecs() []string {
+	return []string{COMPRESS_GZIP}
+}
+
+// Return error if the codec or level of the policy is invalid
+func (policy *CompressionPolicy) validate() error {
+	switch policy.Codec {
+	case COMPRESS_IDENTITY, COMPRESS_GZIP:
+	default:
+		return fmt.Errorf("CompressionPolicy: unknown codec %q", policy.Codec)
+	}
+	if policy.Threshold < 0 {
+		return fmt.Errorf("CompressionPolicy: Threshold must not be negative")
+	}
+	if policy.Level < gzip.HuffmanOnly || policy.Level > gzip.BestCompression {
+		return fmt.Errorf("CompressionPolicy: Level must be within [%v, %v]",
+			gzip.HuffmanOnly, gzip.BestCompression)
+	}
+	return nil
+}
+
+// Return the policy if a peer decoding codecs can be sent payloads by it
+// Nil otherwise, so the peer is sent every payload as it is
+func (policy *CompressionPolicy) acceptedBy(codecs []string) *CompressionPolicy {
+	if policy == nil || policy.Codec == COMPRESS_IDENTITY {
+		return nil
+	}
+	for _, codec := range codecs {
+		if codec == policy.Codec {
+			return policy
+		}
+	}
+	return nil
+}
+
+// Return data encoded by the policy, and its encoding
+// Data below the threshold, or that does not shrink, is returned as it is
+// With COMPRESS_IDENTITY, as is every payload of a nil policy
+func (policy *CompressionPolicy) encode(data []byte) ([]byte, string) {
+	if policy == nil || policy.Codec != COMPRESS_GZIP {
+		return data, COMPRESS_IDENTITY
+	}
+	threshold := policy.Threshold
+	if threshold == 0 {
+		threshold = COMPRESS_THRESHOLD
+	}
+	if len(data) < threshold {
+		return data, COMPRESS_IDENTITY
+	}
+	level := policy.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	var buffer bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buffer, level)
+	if err != nil {
+		return data, COMPRESS_IDENTITY
+	}
+	if _, err := writer.Write(data); err != nil || writer.Close() != nil ||
+		buffer.Len() >= len(data) {
+		return data, COMPRESS_IDENTITY
+	}
+	return buffer.Bytes(), COMPRESS_GZIP
+}
+
+// Return the payload data in encoding decoded
+// An empty encoding is identity, as sent by peers without compression
+func decodePayload(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", COMPRESS_IDENTITY:
+		return data, nil
+	case COMPRESS_GZIP:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode gzip payload: %v", err)
+		}
+		defer reader.Close()
+		decoded, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode gzip payload: %v", err)
+		}
+		return decoded, nil
+	default:
+		return nil, fmt.Errorf("unknown payload encoding %q", encoding)
+	}
+}
+
+// Compress the partitions and side files of every job without its own policy
+// Including the job created by MakeMaster, see CompressionPolicy
+func WithCompression(policy CompressionPolicy) Option {
+	return func(config *MasterConfig) error {
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("WithCompression: %v", err)
+		}
+		config.Compression = &policy
+		return nil
+	}
+}
+
+// Return the policy of the job that the worker can be sent payloads by
+// Must be called with lock held
+func (master *Master) compressionFor(job *jobState, workerId int64) *CompressionPolicy {
+	registry, ok := master.workers[workerId]
+	if !ok {
+		return nil
+	}
+	return job.compression.acceptedBy(registry.compression)
+}
@@ -0,0 +1,535 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Configuration of master, set by options passed to MakeMaster
+
+package mapreduce
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// The timing and sizing knobs of a master
+type MasterConfig struct {
+	// The directory reduce tasks write output to
+	OutputDir string
+	// The directory workers write intermediate files to, see WithMapDir
+	MapDir string
+
+	// The max duration of an rpc to a worker, after which it fails with ErrTimeout
+	// CallTimeout for dispatching tasks and notifying workers
+	// ProbeTimeout for checking whether a worker is alive
+	CallTimeout  time.Duration
+	ProbeTimeout time.Duration
+	// How dispatches and kills are retried while a worker cannot be reached
+	DispatchRetry RetryPolicy
+	// The most dispatches in flight at once, see WithDispatchParallelism
+	DispatchParallelism int
+	// If TLS is set, master serves rpcs and dials workers over TLS with it
+	// Otherwise plain TCP, see WithTLS
+	TLS *tls.Config
+	// If Secret is set, workers must present it to register, see WithSecret
+	Secret string
+	// The transport of rpcs, nil for net/rpc, see WithTransport
+	Transport Transport
+	// The host:port master listens on, empty for the port of MakeMaster
+	// On every interface, see WithListenAddr
+	ListenAddr string
+	// Run around every rpc of the default transport, see WithInterceptors
+	Interceptors []Interceptor
+	// How the default transport pings idle connections, see WithKeepalive
+	Keepalive KeepalivePolicy
+	// The codec of the default transport, nil for GobCodec, see WithCodec
+	Codec WireCodec
+	// The listeners master serves next to its own, see WithCodecListener
+	CodecListeners []CodecListener
+	// The limits of rpc methods, see WithRateLimit
+	// And the most rpcs handled at once, 0 for no cap, see WithMaxInflight
+	RateLimits  map[string]RateLimit
+	MaxInflight int
+	// How far the clocks of master and workers may be apart, see RpcDeadline
+	MaxClockSkew time.Duration
+	// When the circuit to a worker opens, see WithCircuitBreaker
+	Circuit CircuitPolicy
+
+	// If a task stays in PROCESSING longer than TaskTimeout
+	// It is marked as UNPROCESSED and assigned again
+	TaskTimeout time.Duration
+	// If TaskLease is positive, it replaces TaskTimeout
+	// Every attempt holds a lease its worker renews with each heartbeat
+	// A task is only reassigned once the lease of its attempt lapses
+	// So a long task is never preempted while its worker is alive
+	TaskLease time.Duration
+
+	// A backup copy is launched for a task processing longer than
+	// SpeculativeFactor times the median duration of finished tasks
+	SpeculativeFactor float64
+	// The max fraction of tasks in a phase that can be backed up
+	// Set to 0 to disable speculative execution
+	SpeculativeRatio float64
+
+	// If PullMode is true, master does not push tasks to workers
+	// Workers ask for tasks through Master.RequestTask instead
+	PullMode bool
+
+	// Optional hosts (hostname, host:port or port) holding each input file
+	// A map task prefers workers running on one of its hosts
+	InputLocations [][]string
+	// The most bytes of an input file a map task reads, 0 for whole files
+	SplitSize int64
+	// A map task waits LocalityDelay for a worker holding its input
+	// Before it is assigned to any worker
+	LocalityDelay time.Duration
+
+	// The number of attempts a task gets before the whole job fails
+	MaxTaskAttempts int
+	// The max fraction of tasks in a phase that are skipped instead
+	// Once they run out of attempts, 0 fails the job at the first one
+	MaxFailedTaskRatio float64
+
+	// A worker is blacklisted after BlacklistStrikes task failures
+	// Within BlacklistWindow, and readmitted after it keeps passing
+	// Liveness checks for BlacklistCooldown
+	BlacklistStrikes  int
+	BlacklistWindow   time.Duration
+	BlacklistCooldown time.Duration
+
+	// Workers send a heartbeat every HeartbeatInterval
+	// A worker without heartbeat for HeartbeatTTL is considered failed
+	HeartbeatInterval time.Duration
+	HeartbeatTTL      time.Duration
+
+	// A failed worker is forgotten after FailedRetention
+	// So churned workers do not pile up in master
+	FailedRetention time.Duration
+
+	// The max duration the scheduler sleeps without any state change
+	SchedulerTick time.Duration
+
+	// Where master writes its log
+	Logger Logger
+
+	// A running task is reported as a straggler once it takes StragglerFactor
+	// Times the median duration of finished tasks in its phase
+	// To OnStraggler, or to the log if OnStraggler is nil
+	StragglerFactor float64
+	OnStraggler     func(warning StragglerWarning)
+
+	// Callbacks of scheduling events
+	Hooks Hooks
+
+	// The port of the http listener serving diagnostics
+	// /status, /debug/pprof/ and /debug/vars, and /metrics if enabled
+	// 0 disables the listener
+	HTTPPort int64
+
+	// If Metrics is true, master keeps counters and histograms
+	// Served as /metrics on the http listener
+	Metrics bool
+
+	// The write-ahead log of job submissions, task status and registrations
+	// Read by RecoverMaster after a crash, empty disables the log
+	// If WALSync is true, every record is fsynced before master moves on
+	WALPath string
+	WALSync bool
+
+	// The directory holding intermediate files of an earlier run
+	// Map tasks whose manifest and files are complete there are not run again
+	// Empty disables resuming
+	ResumeDir string
+
+	// The file master appends a json line to for every scheduling decision
+	// Read back by ReadEvents, empty disables the event log
+	EventLogPath string
+
+	// The deadline of jobs that do not set their own, see JobSpec.Deadline
+	// Zero means no deadline
+	JobDeadline time.Time
+
+	// The weights of idle CPUs, and of GB of available memory and free disk
+	// In the resources workers report, see ResourceSample
+	// Workers with the highest weighted sum are tried first
+	// All 0 by default, which leaves workers in round-robin order
+	CPUWeight    float64
+	MemoryWeight float64
+	DiskWeight   float64
+
+	// If KeepIntermediate is true, intermediate files are left behind
+	// Otherwise every worker deletes those of a job once it is done or aborted
+	KeepIntermediate bool
+
+	// The policy of skipping bad records of jobs that do not set their own
+	// See JobSpec.SkipBadRecords, nil fails a task at its first bad record
+	SkipBadRecords *SkipPolicy
+	// See JobSpec.Compression, nil compresses nothing
+	Compression *CompressionPolicy
+
+	// The .so holding the Map and Reduce functions, handed to every worker
+	// That registers without it, see RegisterReply
+	// Empty leaves workers with the functions they are made with
+	PluginPath string
+
+	// If Launcher is set, workers are launched and terminated through it
+	// As the tasks waiting to run grow and drain, see AutoscalePolicy
+	Launcher  WorkerLauncher
+	Autoscale AutoscalePolicy
+}
+
+// An option that changes the configuration of a master
+type Option func(config *MasterConfig) error
+
+// Return the configuration master uses without any option
+func defaultConfig() MasterConfig {
+	return MasterConfig{
+		OutputDir:           REDUCE_DIR,
+		MapDir:              MAP_DIR,
+		CallTimeout:         CALL_TIMEOUT,
+		ProbeTimeout:        PROBE_TIMEOUT,
+		DispatchRetry:       DefaultRetryPolicy(),
+		DispatchParallelism: DISPATCH_PARALLELISM,
+		Keepalive:           DefaultKeepalivePolicy(),
+		RateLimits:          DefaultRateLimits(),
+		MaxInflight:         MAX_INFLIGHT_RPCS,
+		MaxClockSkew:        MAX_CLOCK_SKEW,
+		SplitSize:           SPLIT_SIZE,
+		Circuit:             DefaultCircuitPolicy(),
+		TaskTimeout:         TASK_TIMEOUT,
+		SpeculativeFactor:   SPECULATIVE_FACTOR,
+		SpeculativeRatio:    SPECULATIVE_RATIO,
+		LocalityDelay:       LOCALITY_DELAY,
+		MaxTaskAttempts:     MAX_TASK_ATTEMPTS,
+		BlacklistStrikes:    BLACKLIST_STRIKES,
+		BlacklistWindow:     BLACKLIST_WINDOW,
+		BlacklistCooldown:   BLACKLIST_COOLDOWN,
+		HeartbeatInterval:   HEARTBEAT_INTERVAL,
+		HeartbeatTTL:        HEARTBEAT_TTL,
+		FailedRetention:     FAILED_RETENTION,
+		SchedulerTick:       SCHEDULE_TICK,
+		StragglerFactor:     STRAGGLER_FACTOR,
+		Logger:              NewStdLogger(),
+	}
+}
+
+// Set the directory reduce tasks write output to
+func WithOutputDir(dir string) Option {
+	return func(config *MasterConfig) error {
+		if dir == "" {
+			return errors.New("WithOutputDir: empty directory")
+		}
+		config.OutputDir = dir
+		return nil
+	}
+}
+
+// Set the duration a task may stay in PROCESSING before it is reassigned
+func WithTaskTimeout(timeout time.Duration) Option {
+	return func(config *MasterConfig) error {
+		if timeout <= 0 {
+			return errors.New("WithTaskTimeout: timeout must be positive")
+		}
+		config.TaskTimeout = timeout
+		return nil
+	}
+}
+
+// Set the max duration of rpcs to workers, see MasterConfig.CallTimeout
+func WithCallTimeouts(call, probe time.Duration) Option {
+	return func(config *MasterConfig) error {
+		if call <= 0 || probe <= 0 {
+			return errors.New("WithCallTimeouts: timeouts must be positive")
+		}
+		config.CallTimeout = call
+		config.ProbeTimeout = probe
+		return nil
+	}
+}
+
+// Give attempts leases renewed by heartbeats, see MasterConfig.TaskLease
+// The lease must last at least two heartbeat intervals
+func WithTaskLease(lease time.Duration) Option {
+	return func(config *MasterConfig) error {
+		if lease <= 0 {
+			return fmt.Errorf("WithTaskLease: %v is not positive", lease)
+		}
+		config.TaskLease = lease
+		return nil
+	}
+}
+
+// Set when backup copies of stragglers are launched
+// Pass ratio 0 to disable speculative execution
+func WithSpeculation(factor, ratio float64) Option {
+	return func(config *MasterConfig) error {
+		if factor < 1 {
+			return errors.New("WithSpeculation: factor must be at least 1")
+		}
+		if ratio < 0 || ratio > 1 {
+			return errors.New("WithSpeculation: ratio must be within [0, 1]")
+		}
+		config.SpeculativeFactor = factor
+		config.SpeculativeRatio = ratio
+		return nil
+	}
+}
+
+// Let workers ask for tasks through Master.RequestTask
+// Instead of master pushing tasks to them
+func WithPullMode() Option {
+	return func(config *MasterConfig) error {
+		config.PullMode = true
+		return nil
+	}
+}
+
+// Set the hosts holding each input file
+// The files a directory or pattern expands to are held by its hosts
+func WithInputLocations(locations [][]string) Option {
+	return func(config *MasterConfig) error {
+		config.InputLocations = locations
+		return nil
+	}
+}
+
+// Set the duration a map task waits for a worker holding its input
+func WithLocalityDelay(delay time.Duration) Option {
+	return func(config *MasterConfig) error {
+		if delay < 0 {
+			return errors.New("WithLocalityDelay: delay must not be negative")
+		}
+		config.LocalityDelay = delay
+		return nil
+	}
+}
+
+// Set the number of attempts a task gets before the whole job fails
+func WithMaxTaskAttempts(attempts int) Option {
+	return func(config *MasterConfig) error {
+		if attempts < 1 {
+			return errors.New("WithMaxTaskAttempts: attempts must be at least 1")
+		}
+		config.MaxTaskAttempts = attempts
+		return nil
+	}
+}
+
+// Skip tasks that run out of attempts instead of failing the job
+// As long as at most ratio of the tasks in their phase are skipped
+func WithMaxFailedTaskRatio(ratio float64) Option {
+	return func(config *MasterConfig) error {
+		if ratio < 0 || ratio >= 1 {
+			return errors.New("WithMaxFailedTaskRatio: ratio must be within [0, 1)")
+		}
+		config.MaxFailedTaskRatio = ratio
+		return nil
+	}
+}
+
+// Set when workers are blacklisted and readmitted
+func WithBlacklist(strikes int, window, cooldown time.Duration) Option {
+	return func(config *MasterConfig) error {
+		if strikes < 1 {
+			return errors.New("WithBlacklist: strikes must be at least 1")
+		}
+		if window <= 0 || cooldown <= 0 {
+			return errors.New("WithBlacklist: window and cooldown must be positive")
+		}
+		config.BlacklistStrikes = strikes
+		config.BlacklistWindow = window
+		config.BlacklistCooldown = cooldown
+		return nil
+	}
+}
+
+// Set the duration without heartbeat after which a worker is failed
+func WithHeartbeatTTL(ttl time.Duration) Option {
+	return func(config *MasterConfig) error {
+		if ttl <= 0 {
+			return fmt.Errorf("WithHeartbeatTTL: %v is not positive", ttl)
+		}
+		config.HeartbeatTTL = ttl
+		return nil
+	}
+}
+
+// Set the duration a failed worker is kept before it is forgotten
+func WithFailedRetention(retention time.Duration) Option {
+	return func(config *MasterConfig) error {
+		if retention <= 0 {
+			return errors.New("WithFailedRetention: retention must be positive")
+		}
+		config.FailedRetention = retention
+		return nil
+	}
+}
+
+// Set the max duration the scheduler sleeps without any state change
+func WithSchedulerTick(tick time.Duration) Option {
+	return func(config *MasterConfig) error {
+		if tick <= 0 {
+			return errors.New("WithSchedulerTick: tick must be positive")
+		}
+		config.SchedulerTick = tick
+		return nil
+	}
+}
+
+// Serve diagnostics over http on port, see MasterConfig.HTTPPort
+func WithHTTPPort(port int64) Option {
+	return func(config *MasterConfig) error {
+		if port <= 0 || port > 65535 {
+			return errors.New("WithHTTPPort: invalid port")
+		}
+		config.HTTPPort = port
+		return nil
+	}
+}
+
+// Listen on addr, a host:port, instead of every interface and the port of MakeMaster
+// Port 0 picks a free port, see Master.Port
+func WithListenAddr(addr string) Option {
+	return func(config *MasterConfig) error {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("WithListenAddr: %v", err)
+		}
+		config.ListenAddr = addr
+		return nil
+	}
+}
+
+// Keep metrics of tasks and workers, see MasterConfig.Metrics
+func WithMetrics() Option {
+	return func(config *MasterConfig) error {
+		config.Metrics = true
+		return nil
+	}
+}
+
+// Set when running tasks are reported as stragglers, and the callback
+// A nil callback writes the warning to the log
+// The callback is called from a scheduler goroutine outside the lock
+func WithStragglerWarning(factor float64,
+	callback func(warning StragglerWarning)) Option {
+	return func(config *MasterConfig) error {
+		if factor < 1 {
+			return errors.New("WithStragglerWarning: factor must be at least 1")
+		}
+		config.StragglerFactor = factor
+		config.OnStraggler = callback
+		return nil
+	}
+}
+
+// Set the callbacks of scheduling events, see Hooks
+func WithHooks(hooks Hooks) Option {
+	return func(config *MasterConfig) error {
+		config.Hooks = hooks
+		return nil
+	}
+}
+
+// Set where master writes its log
+func WithLogger(logger Logger) Option {
+	return func(config *MasterConfig) error {
+		if logger == nil {
+			return errors.New("WithLogger: nil logger")
+		}
+		config.Logger = logger
+		return nil
+	}
+}
+
+// Append master state to the write-ahead log at path, see RecoverMaster
+// If sync is true, every record is fsynced, which survives a machine crash
+// Instead of only a process crash, at the cost of a disk flush per change
+func WithWAL(path string, sync bool) Option {
+	return func(config *MasterConfig) error {
+		if path == "" {
+			return errors.New("WithWAL: empty path")
+		}
+		config.WALPath = path
+		config.WALSync = sync
+		return nil
+	}
+}
+
+// Resume submitted jobs from the intermediate files of an earlier run in dir
+// Usually MAP_DIR of the workers, see MasterConfig.ResumeDir
+func WithResume(dir string) Option {
+	return func(config *MasterConfig) error {
+		if dir == "" {
+			return errors.New("WithResume: empty directory")
+		}
+		config.ResumeDir = dir
+		return nil
+	}
+}
+
+// Append every scheduling decision to the event log at path, see ReadEvents
+func WithEventLog(path string) Option {
+	return func(config *MasterConfig) error {
+		if path == "" {
+			return errors.New("WithEventLog: empty path")
+		}
+		config.EventLogPath = path
+		return nil
+	}
+}
+
+// Try workers with more idle CPUs, available memory and free disk first
+// Each weighted as given, see MasterConfig.CPUWeight
+func WithResourceWeights(cpu, memory, disk float64) Option {
+	return func(config *MasterConfig) error {
+		if cpu < 0 || memory < 0 || disk < 0 {
+			return errors.New("WithResourceWeights: weights must not be negative")
+		}
+		config.CPUWeight = cpu
+		config.MemoryWeight = memory
+		config.DiskWeight = disk
+		return nil
+	}
+}
+
+// Keep the intermediate files of jobs that are done, for debugging
+func WithKeepIntermediate() Option {
+	return func(config *MasterConfig) error {
+		config.KeepIntermediate = true
+		return nil
+	}
+}
+
+// Skip the records map panics on in every job without its own policy
+// Including the job created by MakeMaster, see SkipPolicy
+func WithSkipBadRecords(policy SkipPolicy) Option {
+	return func(config *MasterConfig) error {
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("WithSkipBadRecords: %v", err)
+		}
+		config.SkipBadRecords = &policy
+		return nil
+	}
+}
+
+// Hand the plugin at path to workers, see MasterConfig.PluginPath
+func WithPlugin(path string) Option {
+	return func(config *MasterConfig) error {
+		if path == "" {
+			return errors.New("WithPlugin: empty path")
+		}
+		config.PluginPath = path
+		return nil
+	}
+}
+
+// Fail every job that has not finished by deadline, see JobSpec.Deadline
+// Including the job created by MakeMaster
+func WithJobDeadline(deadline time.Time) Option {
+	return func(config *MasterConfig) error {
+		if deadline.IsZero() {
+			return errors.New("WithJobDeadline: zero deadline")
+		}
+		config.JobDeadline = deadline
+		return nil
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Records and bytes read and written by tasks, summed per job
+
+package mapreduce
+
+import (
+	"strings"
+)
+
+// The data a task attempt read and wrote
+// A map task reads the lines of its input file, and writes the pairs of its
+// Partitions (after the combiner), or the lines of its output if map-only
+// A reduce task reads the pairs of its partitions, and writes a line per key
+// So the input records of reduce add up to the output records of map
+type TaskCounters struct {
+	InputRecords  int64
+	InputBytes    int64
+	OutputRecords int64
+	OutputBytes   int64
+	// The bytes of the partitions a reduce task fetched from other workers
+	// Before and after compression, the same if none is used
+	UncompressedBytes int64
+	CompressedBytes   int64
+}
+
+// The counters of a job, summed over the tasks finished in each phase
+type JobCounters struct {
+	JobId  JobId
+	Map    TaskCounters
+	Reduce TaskCounters
+}
+
+// Add the counters of another task
+func (counters *TaskCounters) add(other TaskCounters) {
+	counters.InputRecords += other.InputRecords
+	counters.InputBytes += other.InputBytes
+	counters.OutputRecords += other.OutputRecords
+	counters.OutputBytes += other.OutputBytes
+	counters.UncompressedBytes += other.UncompressedBytes
+	counters.CompressedBytes += other.CompressedBytes
+}
+
+// Return the number of lines of content, a last line without newline included
+func countRecords(content []byte) int64 {
+	records := int64(strings.Count(string(content), "\n"))
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		records++
+	}
+	return records
+}
+
+// Return the counters of a phase, summed over its finished tasks
+// Only the attempt accepted as the result of a task counts
+// Must be called with lock held
+func (job *jobState) phaseCounters(taskType TaskType) TaskCounters {
+	var total TaskCounters
+	statusRef, err := job.getStatusRef(taskType)
+	if err != nil {
+		return total
+	}
+	metaRef, _ := job.getMetaRef(taskType)
+	for idx, status := range *statusRef {
+		if status == FINISHED {
+			total.add((*metaRef)[idx].counters)
+		}
+	}
+	return total
+}
+
+// Return the counters of the job
+// Must be called with lock held
+func (job *jobState) counters() JobCounters {
+	return JobCounters{
+		JobId:  job.id,
+		Map:    job.phaseCounters(MAP),
+		Reduce: job.phaseCounters(REDUCE),
+	}
+}
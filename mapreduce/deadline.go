@@ -0,0 +1,113 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Deadlines carried in rpc arguments, so the receiver gives up with the sender
+
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The return type of an rpc that arrived after its sender gave up on it
+// Nothing was done, the sender has moved on already
+const DEADLINE_EXCEEDED = "DEADLINE_EXCEEDED"
+
+// The default bound on how far the clocks of master and workers are apart
+const MAX_CLOCK_SKEW = 5 * time.Second
+
+// Returned by startTask for a start that arrived after its deadline
+var errDeadlinePassed = errors.New("start arrived after its deadline")
+
+// The time the sender of an rpc gives up on it, and the time it was sent
+// Both by the clock of the sender, which may be off from that of the receiver
+// The receiver gives up at At plus MaxClockSkew, as its clock may be behind
+// But never later than the budget At minus Sent after the rpc arrived
+// So a delivery delayed past its deadline is declined, and one from a sender
+// Whose clock is ahead keeps no more than its budget
+// A receiver whose clock is ahead by more than MaxClockSkew declines in error
+type RpcDeadline struct {
+	// Zero if the sender never gives up
+	At   time.Time
+	Sent time.Time
+}
+
+// Return the deadline of an rpc sent now, given up after timeout
+func newRpcDeadline(timeout time.Duration) RpcDeadline {
+	now := time.Now()
+	return RpcDeadline{At: now.Add(timeout), Sent: now}
+}
+
+// Return the deadline by the clock of the receiver at now
+// Return false if the sender never gives up
+func (deadline RpcDeadline) local(now time.Time, maxSkew time.Duration) (time.Time, bool) {
+	if deadline.At.IsZero() {
+		return time.Time{}, false
+	}
+	at := deadline.At.Add(maxSkew)
+	if latest := now.Add(deadline.At.Sub(deadline.Sent)); latest.Before(at) {
+		at = latest
+	}
+	return at, true
+}
+
+// Return the time by the clock of the receiver after which the rpc is declined
+// However late it arrives, as its deadline has then passed by either clock
+// Zero if the sender never gives up
+func (deadline RpcDeadline) expiry(maxSkew time.Duration) time.Time {
+	if deadline.At.IsZero() {
+		return time.Time{}
+	}
+	return deadline.At.Add(maxSkew)
+}
+
+// Return a copy of ctx done once the deadline passes by the clock of the receiver
+// Already done if it passed before the rpc arrived
+func (deadline RpcDeadline) context(ctx context.Context,
+	maxSkew time.Duration) (context.Context, context.CancelFunc) {
+	at, ok := deadline.local(time.Now(), maxSkew)
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, at)
+}
+
+// Log a start declined because it arrived after its deadline
+func (worker *Worker) declineStale(attempt TaskAttempt, deadline RpcDeadline) {
+	worker.Logger.Warnf("Job %v: %v task %v attempt %v sent at %v arrived after master gave it up, decline it",
+		attempt.JobId, taskTypeName(attempt.TaskType), attempt.TaskId, attempt.AttemptId,
+		deadline.Sent.Format(time.RFC3339Nano))
+}
+
+// Return the longest a call retried by policy takes, each try giving up after timeout
+func (policy RetryPolicy) budget(timeout time.Duration) time.Duration {
+	total := time.Duration(policy.Tries) * timeout
+	wait := policy.Backoff
+	for try := 1; try < policy.Tries; try++ {
+		if wait > policy.MaxBackoff {
+			wait = policy.MaxBackoff
+		}
+		total += wait + wait/2
+		wait *= 2
+	}
+	return total
+}
+
+// Return the deadline of a dispatch sent now, once every try of DispatchRetry gave up
+func (master *Master) dispatchDeadline() RpcDeadline {
+	return newRpcDeadline(master.config.DispatchRetry.budget(master.config.CallTimeout))
+}
+
+// Bound how far the clocks of master and workers are taken to be apart
+// When master declines a heartbeat that arrived after its deadline
+// Workers set Worker.MaxClockSkew for dispatches, see RpcDeadline
+func WithMaxClockSkew(skew time.Duration) Option {
+	return func(config *MasterConfig) error {
+		if skew < 0 {
+			return fmt.Errorf("WithMaxClockSkew: %v is negative", skew)
+		}
+		config.MaxClockSkew = skew
+		return nil
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of deadlines carried in rpc arguments
+
+package mapreduce
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRpcDeadlineLocal(t *testing.T) {
+	now := time.Now()
+	skew := 5 * time.Second
+	for _, test := range []struct {
+		name string
+		// The clock of the sender minus that of the receiver
+		ahead time.Duration
+		// How long ago by the clock of the receiver the rpc was sent
+		delay   time.Duration
+		timeout time.Duration
+		want    time.Time
+	}{
+		{"in sync", 0, 0, 10 * time.Second, now.Add(10 * time.Second)},
+		{"sender behind", -3 * time.Second, 0, 10 * time.Second, now.Add(10 * time.Second)},
+		// Taken at its deadline by the clock of the sender, plus the max skew
+		{"sender behind and late", -3 * time.Second, 8 * time.Second, 10 * time.Second,
+			now.Add(4 * time.Second)},
+		{"sender ahead", 3 * time.Second, 0, 10 * time.Second, now.Add(10 * time.Second)},
+		// The budget caps a deadline that is far off by the clock of the receiver
+		{"sender far ahead", time.Hour, 0, 10 * time.Second, now.Add(10 * time.Second)},
+		{"sender far ahead and late", time.Hour, 30 * time.Second, 10 * time.Second,
+			now.Add(10 * time.Second)},
+		// Passed before it arrived by either clock
+		{"delayed past its deadline", 0, 20 * time.Second, 10 * time.Second,
+			now.Add(-5 * time.Second)},
+		{"delayed past its deadline, sender ahead", 3 * time.Second, 20 * time.Second,
+			10 * time.Second, now.Add(-2 * time.Second)},
+	} {
+		sent := now.Add(-test.delay).Add(test.ahead)
+		deadline := RpcDeadline{At: sent.Add(test.timeout), Sent: sent}
+		at, ok := deadline.local(now, skew)
+		if !ok || !at.Equal(test.want) {
+			t.Errorf("%v: local deadline %v, %v, want %v", test.name, at.Sub(now), ok,
+				test.want.Sub(now))
+		}
+	}
+
+	if _, ok := (RpcDeadline{}).local(now, skew); ok {
+		t.Error("a sender that never gives up has a deadline")
+	}
+}
+
+func TestRpcDeadlineExpiry(t *testing.T) {
+	now := time.Now()
+	deadline := RpcDeadline{At: now, Sent: now.Add(-time.Second)}
+	if got := deadline.expiry(5 * time.Second); !got.Equal(now.Add(5 * time.Second)) {
+		t.Fatalf("expiry %v, want 5s past the deadline", got.Sub(now))
+	}
+	if got := (RpcDeadline{}).expiry(5 * time.Second); !got.IsZero() {
+		t.Fatalf("a sender that never gives up expires at %v", got)
+	}
+}
+
+func TestDelayedStartDeclined(t *testing.T) {
+	// The first StartMap arrives as if it was held in flight past its deadline
+	var mu sync.Mutex
+	var replies []Err
+	delayed := false
+	master := startMaster(t, writeInputs(t, "a b", "b c"), 1, WithInterceptors(Interceptor{
+		Call: func(ctx context.Context, info *RPCInfo, next func(ctx context.Context) error) error {
+			args, ok := info.Args.(*MapStartSend)
+			if !ok {
+				return next(ctx)
+			}
+			mu.Lock()
+			if !delayed {
+				delayed = true
+				budget := args.Deadline.At.Sub(args.Deadline.Sent)
+				args.Deadline.Sent = args.Deadline.Sent.Add(-budget - time.Minute)
+				args.Deadline.At = args.Deadline.Sent.Add(budget)
+			}
+			mu.Unlock()
+			err := next(ctx)
+			if reply, ok := info.Reply.(*StartReply); ok && err == nil {
+				mu.Lock()
+				replies = append(replies, reply.Err)
+				mu.Unlock()
+			}
+			return err
+		},
+	}))
+	var runs int32
+	startWorker(t, master, func(worker *Worker) {
+		worker.MapContext = func(ctx context.Context, file, content string) []KeyValue {
+			atomic.AddInt32(&runs, 1)
+			return wcMap(file, content)
+		}
+	})
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts("a b", "b c"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(replies) == 0 || replies[0] != DEADLINE_EXCEEDED {
+		t.Fatalf("starts replied %v, want the first declined with %v", replies, DEADLINE_EXCEEDED)
+	}
+	// The declined start never ran, each map task ran once
+	if runs := atomic.LoadInt32(&runs); runs != 2 {
+		t.Fatalf("map function ran %v times, want 2", runs)
+	}
+}
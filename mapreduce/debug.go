@@ -0,0 +1,94 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Profiling and internal counters served on the diagnostics listener
+
+package mapreduce
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"sync"
+)
+
+// The masters serving diagnostics, published together as expvar "mapreduce"
+// Since an expvar name can only be published once per process
+var (
+	expvarOnce    sync.Once
+	expvarMu      sync.Mutex
+	expvarMasters = map[int64]*Master{}
+)
+
+// The internal counters of a master published by expvar
+type debugVars struct {
+	Workers     int
+	MapQueue    int
+	ReduceQueue int
+	// The number of rounds the dispatch loops have made
+	SchedulerIterations int64
+}
+
+// Return the internal counters of master
+func (master *Master) debugVars() debugVars {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	vars := debugVars{
+		Workers:             len(master.workers),
+		SchedulerIterations: master.schedulerIterations,
+	}
+	for _, job := range master.jobs {
+		vars.MapQueue += len(job.mapQueue)
+		vars.ReduceQueue += len(job.reduceQueue)
+	}
+	return vars
+}
+
+// Publish the counters of master, keyed by its port
+func publishExpvar(master *Master) {
+	expvarOnce.Do(func() {
+		expvar.Publish("mapreduce", expvar.Func(func() interface{} {
+			// Copy the masters first, so the lock of a master
+			// Is never taken while holding expvarMu
+			expvarMu.Lock()
+			masters := map[int64]*Master{}
+			for port, m := range expvarMasters {
+				masters[port] = m
+			}
+			expvarMu.Unlock()
+
+			result := map[string]debugVars{}
+			for port, m := range masters {
+				result[strconv.FormatInt(port, 10)] = m.debugVars()
+			}
+			return result
+		}))
+	})
+
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	expvarMasters[master.port] = master
+}
+
+// Stop publishing the counters of master
+func unpublishExpvar(master *Master) {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	if expvarMasters[master.port] == master {
+		delete(expvarMasters, master.port)
+	}
+}
+
+// Mount pprof under /debug/pprof/ and expvar under /debug/vars
+// Pprof requires the secret if one is set, it exposes the memory and command line
+func (master *Master) handleDebug(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", master.requireSecret(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", master.requireSecret(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", master.requireSecret(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", master.requireSecret(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", master.requireSecret(pprof.Trace))
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	publishExpvar(master)
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Remembering the attempts a worker ran, so a start delivered twice runs once
+
+package mapreduce
+
+import "time"
+
+// The max number of ended attempts a worker remembers
+// Older ones are forgotten first, even if a start of them may still arrive
+const ENDED_ATTEMPTS_KEPT = 1024
+
+// What StartMap and StartReduce reply of an attempt delivered before
+// FINISHED once it has ended, whether it succeeded or failed
+const (
+	ATTEMPT_RUNNING  = "RUNNING"
+	ATTEMPT_FINISHED = "FINISHED"
+	ATTEMPT_KILLED   = "KILLED"
+)
+
+// The return type of StartMap and StartReduce
+type StartReply struct {
+	Err Err
+	// Empty if the attempt is started, otherwise what became of it
+	// Since it was first delivered, e.g. by a dispatch whose reply was lost
+	Outcome string
+}
+
+// Return the idempotency key of the start, the attempt it starts
+func (args *MapStartSend) attempt() TaskAttempt {
+	return TaskAttempt{args.JobId, args.TaskId, MAP, args.AttemptId}
+}
+
+// Return the idempotency key of the start, the attempt it starts
+func (args *ReduceStartSend) attempt() TaskAttempt {
+	return TaskAttempt{args.JobId, args.TaskId, REDUCE, args.AttemptId}
+}
+
+// An attempt that has ended, remembered until no start of it can arrive
+type endedAttempt struct {
+	outcome string
+	// Once passed, a start of the attempt is declined as stale anyway
+	// Zero if master never gives up its dispatch, see RpcDeadline.expiry
+	until time.Time
+}
+
+// Return true if a start of the attempt may still be accepted at now
+func (ended endedAttempt) kept(now time.Time) bool {
+	return ended.until.IsZero() || now.Before(ended.until)
+}
+
+// Return what became of an attempt delivered before, empty if it is new
+// Must be called with lock held
+func (worker *Worker) attemptOutcome(attempt TaskAttempt) string {
+	if killed, ok := worker.tasks[attempt]; ok {
+		if killed {
+			return ATTEMPT_KILLED
+		}
+		return ATTEMPT_RUNNING
+	}
+	if ended, ok := worker.ended[attempt]; ok && ended.kept(time.Now()) {
+		return ended.outcome
+	}
+	return ""
+}
+
+// Return what became of an attempt delivered before, see attemptOutcome
+func (worker *Worker) outcome(attempt TaskAttempt) string {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	return worker.attemptOutcome(attempt)
+}
+
+// Remember an attempt has ended until its dispatch expires
+// Even once master has heard of it, as a start retried before its reply was lost
+// May still arrive after the report
+// Forget those expired, and the oldest once ENDED_ATTEMPTS_KEPT are kept
+// Must be called with lock held
+func (worker *Worker) rememberEnded(attempt TaskAttempt, outcome string) {
+	worker.ended[attempt] = endedAttempt{outcome, worker.expiries[attempt]}
+	worker.endedOrder = append(worker.endedOrder, attempt)
+
+	now := time.Now()
+	kept := worker.endedOrder[:0]
+	for _, attempt := range worker.endedOrder {
+		if ended, ok := worker.ended[attempt]; ok && ended.kept(now) {
+			kept = append(kept, attempt)
+		} else {
+			delete(worker.ended, attempt)
+		}
+	}
+	for len(kept) > ENDED_ATTEMPTS_KEPT {
+		delete(worker.ended, kept[0])
+		kept = kept[1:]
+	}
+	worker.endedOrder = kept
+}
+
+// Forget an ended attempt if master replied its report with UNKNOWN_WORKER
+// As when it ended while the worker switched to a master it is not registered with yet
+// That master never dispatched the attempt, so a start of it from there is a new one
+func (worker *Worker) reportRefused(attempt TaskAttempt, replied Err) {
+	if replied != UNKNOWN_WORKER {
+		return
+	}
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	delete(worker.ended, attempt)
+}
+
+// Forget every ended attempt, once the worker follows a master that numbers attempts anew
+// So a start of that master is never taken for one delivered before
+func (worker *Worker) forgetEnded() {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	worker.ended = map[TaskAttempt]endedAttempt{}
+	worker.endedOrder = nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Starting assigned attempts on their workers off the scheduler loops
+
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The default number of dispatches in flight at once
+const DISPATCH_PARALLELISM = 8
+
+// An attempt assigned to a worker, to be started by Worker.StartMap or StartReduce
+type dispatch struct {
+	job       *jobState
+	workerId  int64
+	addr      string
+	taskId    TaskId
+	taskType  TaskType
+	attemptId AttemptId
+	rpcName   string
+	args      interface{}
+}
+
+// What a dispatch came to, sent to finishDispatches
+type dispatchResult struct {
+	dispatch *dispatch
+	reply    StartReply
+	// Nil if the worker started the attempt
+	err error
+	// If err is set, whether the worker still responds
+	online bool
+}
+
+// Return the running task the dispatch starts
+func (d *dispatch) task() runningTask {
+	return runningTask{
+		jobId:     d.job.id,
+		taskId:    d.taskId,
+		taskType:  d.taskType,
+		attemptId: d.attemptId,
+	}
+}
+
+// Take a dispatch slot, so at most DispatchParallelism dispatches are in flight
+// The lock is released while every slot is taken
+// Return false if master state changes meanwhile, so the caller checks it again
+// Must be called with lock held
+func (master *Master) acquireDispatch() bool {
+	select {
+	case master.dispatchSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	changed := master.changed
+	master.mu.Unlock()
+	defer master.mu.Lock()
+	select {
+	case master.dispatchSlots <- struct{}{}:
+		return true
+	case <-changed:
+		return false
+	}
+}
+
+// Give back a slot taken by acquireDispatch that no dispatch used
+func (master *Master) releaseDispatch() {
+	<-master.dispatchSlots
+}
+
+// Start the attempt in its own goroutine, holding the slot taken for it
+// Shutdown waits for the call to return
+// Must be called with lock held
+func (master *Master) startDispatch(d *dispatch) {
+	master.goLoop(func() { master.runDispatch(d) })
+}
+
+// Call the worker, and probe it if the call fails
+// A worker whose method returned an error is up, so it is not probed
+// Nor is one whose circuit opened, it is taken to be up until its probe fails
+// The result never blocks, as there is room for a result per slot
+func (master *Master) runDispatch(d *dispatch) {
+	result := &dispatchResult{dispatch: d}
+	result.err = master.callRetry(master.config.CallTimeout, d.addr, d.rpcName, d.args, &result.reply)
+	if result.err != nil {
+		result.online = errors.Is(result.err, ErrRemote) || errors.Is(result.err, ErrCircuitOpen) ||
+			reachable(master.call(master.config.ProbeTimeout, d.addr, "Worker.IsOnline", &struct{}{}, &struct{}{}))
+	}
+	master.dispatchResults <- result
+}
+
+// Finish dispatches in the order they return, until master is shut down
+// A failed dispatch is rolled back, see dispatchFailed
+// An attempt started once it no longer runs on master
+// E.g. killed by Abort while its dispatch was in flight, is killed on the worker
+func (master *Master) finishDispatches() {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	for !master.closed {
+		changed := master.changed
+		master.mu.Unlock()
+		select {
+		case result := <-master.dispatchResults:
+			master.mu.Lock()
+			kill := master.finishDispatch(result)
+			master.mu.Unlock()
+			master.releaseDispatch()
+			if kill != nil {
+				master.killTasks([]taskKill{*kill})
+			}
+		case <-changed:
+		}
+		master.mu.Lock()
+	}
+}
+
+// Finish a dispatch
+// Return the attempt to kill if the worker runs an attempt master gave up
+// Must be called with lock held
+func (master *Master) finishDispatch(result *dispatchResult) *taskKill {
+	d := result.dispatch
+	if result.err != nil {
+		master.dispatchFailed(d, result.err, result.online)
+		return nil
+	}
+	// The worker has seen a newer master
+	if result.reply.Err == STALE_TERM {
+		master.fence()
+		return nil
+	}
+	// The start took longer than the deadline by the clock of the worker
+	if result.reply.Err == DEADLINE_EXCEEDED {
+		master.dispatchFailed(d, errors.New("worker declined the start after its deadline"), true)
+		return nil
+	}
+	if result.reply.Outcome != "" {
+		master.config.Logger.Debugf("Job %v: %v task %v attempt %v delivered again, worker has it %v",
+			d.job.id, taskTypeName(d.taskType), d.taskId, d.attemptId, result.reply.Outcome)
+	}
+	if status, _ := d.job.getTaskStatus(d.taskId, d.taskType); status != FINISHED &&
+		!master.holdsTask(d.workerId, d.task()) {
+		master.config.Logger.Infof("Job %v: %v task %v attempt %v started after it was given up, kill it",
+			d.job.id, taskTypeName(d.taskType), d.taskId, d.attemptId)
+		return &taskKill{d.workerId, d.task()}
+	}
+	return nil
+}
+
+// Return true if master has the worker running the task
+// Must be called with lock held
+func (master *Master) holdsTask(workerId int64, task runningTask) bool {
+	registry, ok := master.workers[workerId]
+	if !ok {
+		return false
+	}
+	for _, t := range registry.tasks {
+		if t == task {
+			return true
+		}
+	}
+	return false
+}
+
+// Roll back the assignment of a task that cannot be dispatched
+// The task goes back to unprocessed unless another attempt is running
+// The worker keeps its other tasks if it still responds, otherwise marked failed
+// A dispatch its circuit never sent is not held against the worker
+// An attempt given up while the dispatch was in flight is left as it is
+// Must be called with lock held
+func (master *Master) dispatchFailed(d *dispatch, err error, online bool) {
+	master.config.Logger.Warnf("Job %v: dispatch %v task %v to worker %v failed, worker online: %v: %v",
+		d.job.id, taskTypeName(d.taskType), d.taskId, d.workerId, online, err)
+	master.metrics.dispatchFailed()
+
+	if !master.removeWorkerTask(d.workerId, d.task()) {
+		// The worker has been failed or re-registered, or the attempt timed out
+		return
+	}
+	d.job.dropAttempt(d.taskId, d.taskType, d.attemptId, "dispatch failed")
+	if !errors.Is(err, ErrCircuitOpen) {
+		master.strikeWorker(d.workerId, "dispatch failed")
+	}
+
+	if online {
+		master.updateWorkerStatus(d.workerId)
+	} else {
+		master.failWorker(d.workerId)
+	}
+}
+
+// Start at most n dispatches at once, see MasterConfig.DispatchParallelism
+func WithDispatchParallelism(n int) Option {
+	return func(config *MasterConfig) error {
+		if n < 1 {
+			return fmt.Errorf("WithDispatchParallelism: %v is not positive", n)
+		}
+		config.DispatchParallelism = n
+		return nil
+	}
+}
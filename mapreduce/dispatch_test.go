@@ -0,0 +1,84 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of starting attempts on their workers off the scheduler loops
+
+package mapreduce
+
+import (
+	"testing"
+	"time"
+)
+
+// Return the number of map tasks of the job finished
+func finishedMaps(master *Master) int {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	finished := 0
+	for _, status := range master.jobs[DEFAULT_JOB].mapStatus {
+		if status == FINISHED {
+			finished++
+		}
+	}
+	return finished
+}
+
+func TestSlowDispatchDoesNotSerializeOthers(t *testing.T) {
+	master, cluster := startFakeCluster(t, writeInputs(t, "a", "b", "c", "d"), 0)
+	master.PauseScheduling()
+	slow := cluster.addWorker(t, 1)
+	cluster.setSlow(slow, 2*time.Second)
+	cluster.addWorker(t, 1)
+	master.ResumeScheduling()
+
+	// The fast worker runs the other tasks one by one while the slow start is in flight
+	// And maybe a backup of the task on the slow worker
+	waitFor(t, time.Second, "the fast worker to finish 3 tasks", func() bool {
+		return finishedMaps(master) >= 3
+	})
+}
+
+func TestDispatchesBoundedByParallelism(t *testing.T) {
+	master, cluster := startFakeCluster(t, writeInputs(t, "a", "b", "c", "d"), 0,
+		WithDispatchParallelism(2))
+	cluster.setHold(true)
+	master.PauseScheduling()
+	for i := 0; i < 4; i++ {
+		cluster.setSlow(cluster.addWorker(t, 1), 300*time.Millisecond)
+	}
+	master.ResumeScheduling()
+
+	waitFor(t, time.Second, "the first 2 dispatches", func() bool {
+		return len(cluster.startedAttempts()) == 2
+	})
+	time.Sleep(100 * time.Millisecond)
+	if started := len(cluster.startedAttempts()); started != 2 {
+		t.Fatalf("%v dispatches in flight, want at most 2", started)
+	}
+	waitFor(t, 2*time.Second, "the other 2 dispatches", func() bool {
+		return len(cluster.startedAttempts()) == 4
+	})
+}
+
+func TestDispatchFinishingAfterTimeoutIsKilled(t *testing.T) {
+	logger := &recordLogger{}
+	master, cluster := startFakeCluster(t, writeInputs(t, "a"), 0,
+		WithTaskTimeout(100*time.Millisecond), WithLogger(logger))
+	cluster.setHold(true)
+	master.PauseScheduling()
+	slow := cluster.addWorker(t, 1)
+	cluster.setSlow(slow, 400*time.Millisecond)
+	master.ResumeScheduling()
+
+	// The attempt times out and is given up while its start is in flight
+	// So once the worker starts it after all, master kills it there
+	waitFor(t, 5*time.Second, "the late start to be killed", func() bool {
+		return logger.contains("MAP task 0 attempt 0 started after it was given up, kill it")
+	})
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	if master.holdsTask(slow, runningTask{jobId: DEFAULT_JOB, taskId: 0, taskType: MAP}) {
+		t.Fatal("master holds the attempt given up")
+	}
+	if _, live := master.jobs[DEFAULT_JOB].mapMeta[0].live[0]; live {
+		t.Fatal("attempt given up is live again")
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Winding master down before maintenance, leaving unprocessed tasks to resume
+
+package mapreduce
+
+import (
+	"context"
+)
+
+// The tasks of a job left unprocessed by Drain
+type DrainedJob struct {
+	JobId JobId
+	// PHASE_MAP or PHASE_REDUCE
+	Phase string
+	// The unprocessed tasks of each type, in id order
+	MapTasks    []TaskId
+	ReduceTasks []TaskId
+}
+
+// What Drain leaves behind, every job that has neither finished nor failed
+type DrainSummary struct {
+	Jobs []DrainedJob
+}
+
+type DrainSend struct {
+	Term  int64
+	Token string
+}
+
+// Stop assigning tasks and block until no task is processing
+// Running tasks either finish or time out back to unprocessed
+// Scheduling stays paused afterwards, ResumeScheduling undoes the drain
+// If notifyWorkers is true, every worker is told through Worker.Drain
+// That master is going away, so it does not fail over once master is gone
+// Return the summary to resume from later, see WithResume
+// Return the error of ctx if it is done first, and resume scheduling
+// Unless it was paused before Drain
+func (master *Master) Drain(ctx context.Context,
+	notifyWorkers bool) (DrainSummary, error) {
+	master.mu.Lock()
+	if master.closed {
+		master.mu.Unlock()
+		return DrainSummary{}, ErrMasterClosed
+	}
+
+	wasPaused := master.paused
+	master.paused = true
+	master.config.Logger.Infof("Draining, wait for %v processing tasks",
+		master.processingCount())
+
+	err := master.waitResult(ctx, func() error {
+		switch {
+		case master.aborted:
+			return ErrJobAborted
+		case master.fenced:
+			return ErrMasterFenced
+		case master.closed:
+			return ErrMasterClosed
+		case master.processingCount() > 0:
+			return errJobRunning
+		}
+		return nil
+	})
+	if err != nil {
+		if !wasPaused && !master.halted() {
+			master.config.Logger.Infof("Drain cancelled, scheduling resumed")
+			master.paused = false
+			master.signalChange()
+		}
+		master.mu.Unlock()
+		return DrainSummary{}, err
+	}
+
+	summary := master.drainSummary()
+	master.config.Logger.Infof("Drained, %v jobs left unfinished", len(summary.Jobs))
+
+	send := DrainSend{Term: master.term}
+	master.mu.Unlock()
+
+	// Notify outside the lock, a worker that cannot be reached is skipped
+	if notifyWorkers {
+		results := master.broadcast("Worker.Drain", func(_ int64, token string) interface{} {
+			args := send
+			args.Token = token
+			return &args
+		}, broadcastOptions{})
+		for _, result := range results {
+			if result.err != nil {
+				master.config.Logger.Warnf("Drain: %v", result.err)
+			}
+		}
+	}
+	return summary, nil
+}
+
+// Return the number of processing tasks of jobs that have not halted
+// Must be called with lock held
+func (master *Master) processingCount() int {
+	count := 0
+	for id := JobId(0); id < master.nextJobId; id++ {
+		job := master.jobs[id]
+		if job.halted() {
+			continue
+		}
+		for _, taskType := range []TaskType{MAP, REDUCE} {
+			statusRef, _ := job.getStatusRef(taskType)
+			for _, status := range *statusRef {
+				if status == PROCESSING {
+					count++
+				}
+			}
+		}
+	}
+	return count
+}
+
+// Collect the unprocessed tasks of every job that is not done
+// Must be called with lock held
+func (master *Master) drainSummary() DrainSummary {
+	var summary DrainSummary
+	for id := JobId(0); id < master.nextJobId; id++ {
+		job := master.jobs[id]
+		if job.done() {
+			continue
+		}
+
+		drained := DrainedJob{JobId: job.id, Phase: PHASE_MAP}
+		if job.phaseFinished(MAP) {
+			drained.Phase = PHASE_REDUCE
+		}
+		for idx, status := range job.mapStatus {
+			if status == UNPROCESSED {
+				drained.MapTasks = append(drained.MapTasks, TaskId(idx))
+			}
+		}
+		for idx, status := range job.reduceStatus {
+			if status == UNPROCESSED {
+				drained.ReduceTasks = append(drained.ReduceTasks, TaskId(idx))
+			}
+		}
+		summary.Jobs = append(summary.Jobs, drained)
+	}
+	return summary
+}
@@ -0,0 +1,247 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Human-readable dump of master state for debugging a hung job
+
+package mapreduce
+
+import (
+	"bytes"
+	"fmt"
+	"text/tabwriter"
+	"time"
+)
+
+// The max number of unfinished tasks listed per job in a dump
+// The others are only counted
+const DUMP_MAX_TASKS = 200
+
+type StateDumpSend struct {
+	// The secret of master, see WithSecret
+	Secret string
+}
+
+type StateDumpReply struct {
+	Dump string
+	Err  Err
+}
+
+// A task in the snapshot of a dump
+type dumpTask struct {
+	taskType TaskType
+	id       TaskId
+	status   int
+	attempts int
+	worker   int64
+	// The time since the task started processing or was requeued
+	age time.Duration
+}
+
+// A job in the snapshot of a dump
+type dumpJob struct {
+	id          JobId
+	phase       string
+	nMap        int
+	nReduce     int
+	mapDone     int
+	reduceDone  int
+	mapQueue    int
+	reduceQueue int
+	// The unfinished tasks, at most DUMP_MAX_TASKS
+	tasks []dumpTask
+	// The unfinished tasks left out of tasks
+	omitted int
+}
+
+// A worker in the snapshot of a dump
+type dumpWorker struct {
+	id            int64
+	status        WorkerStatus
+	host          string
+	slots         int
+	tasks         []runningTask
+	lastHeartbeat time.Time
+}
+
+// Everything a dump shows, copied out of master
+type stateSnapshot struct {
+	time    time.Time
+	port    int64
+	term    int64
+	state   string
+	jobs    []dumpJob
+	workers []dumpWorker
+}
+
+// Copy the state shown by a dump
+// Must be called with lock held
+func (master *Master) snapshot() stateSnapshot {
+	now := time.Now()
+	snapshot := stateSnapshot{
+		time:  now,
+		port:  master.port,
+		term:  master.term,
+		state: "RUNNING",
+	}
+	switch {
+	case master.fenced:
+		snapshot.state = "FENCED"
+	case master.closed:
+		snapshot.state = "CLOSED"
+	case master.aborted:
+		snapshot.state = "ABORTED"
+	case master.paused:
+		snapshot.state = "PAUSED"
+	case !master.running:
+		snapshot.state = "NOT STARTED"
+	}
+
+	for id := JobId(0); id < master.nextJobId; id++ {
+		job := master.jobs[id]
+		dump := dumpJob{
+			id:          job.id,
+			phase:       job.status().Phase,
+			nMap:        job.nMap,
+			nReduce:     job.nReduce,
+			mapDone:     job.mapFinishedCount + job.mapSkippedCount,
+			reduceDone:  job.reduceFinishedCount + job.reduceSkippedCount,
+			mapQueue:    len(job.mapQueue),
+			reduceQueue: len(job.reduceQueue),
+		}
+		for _, taskType := range []TaskType{MAP, REDUCE} {
+			statusRef, _ := job.getStatusRef(taskType)
+			metaRef, _ := job.getMetaRef(taskType)
+			for idx, status := range *statusRef {
+				if status == FINISHED || status == SKIPPED {
+					continue
+				}
+				if len(dump.tasks) == DUMP_MAX_TASKS {
+					dump.omitted++
+					continue
+				}
+				meta := (*metaRef)[idx]
+				task := dumpTask{
+					taskType: taskType,
+					id:       TaskId(idx),
+					status:   status,
+					attempts: meta.attempts,
+					worker:   -1,
+				}
+				if meta.attempts > 0 {
+					task.worker = meta.worker
+				}
+				switch {
+				case status == PROCESSING:
+					task.age = now.Sub(meta.startTime)
+				case !meta.pendingSince.IsZero():
+					task.age = now.Sub(meta.pendingSince)
+				case !job.startTime.IsZero():
+					task.age = now.Sub(job.startTime)
+				}
+				dump.tasks = append(dump.tasks, task)
+			}
+		}
+		snapshot.jobs = append(snapshot.jobs, dump)
+	}
+
+	for _, port := range master.workerOrder {
+		registry := master.workers[port]
+		snapshot.workers = append(snapshot.workers, dumpWorker{
+			id:            port,
+			status:        registry.status,
+			host:          registry.host,
+			slots:         registry.slots,
+			tasks:         append([]runningTask(nil), registry.tasks...),
+			lastHeartbeat: registry.lastHeartbeat,
+		})
+	}
+	return snapshot
+}
+
+// Format the snapshot, one section per job and one for the workers
+func (snapshot stateSnapshot) format() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "master %v term %v %v at %v\n", snapshot.port, snapshot.term,
+		snapshot.state, snapshot.time.Format(time.RFC3339))
+
+	for _, job := range snapshot.jobs {
+		fmt.Fprintf(&buf, "\njob %v %v: map %v/%v done, %v queued; reduce %v/%v done, %v queued\n",
+			job.id, job.phase, job.mapDone, job.nMap, job.mapQueue,
+			job.reduceDone, job.nReduce, job.reduceQueue)
+		if len(job.tasks) == 0 {
+			continue
+		}
+		table := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "  TYPE\tTASK\tSTATUS\tATTEMPTS\tWORKER\tAGE")
+		for _, task := range job.tasks {
+			worker := "-"
+			if task.worker != -1 {
+				worker = fmt.Sprint(task.worker)
+			}
+			fmt.Fprintf(table, "  %v\t%v\t%v\t%v\t%v\t%v\n", taskTypeName(task.taskType),
+				task.id, taskStatusName(task.status), task.attempts, worker,
+				task.age.Round(time.Millisecond))
+		}
+		table.Flush()
+		if job.omitted > 0 {
+			fmt.Fprintf(&buf, "  ... %v more unfinished tasks\n", job.omitted)
+		}
+	}
+
+	fmt.Fprintf(&buf, "\n%v workers\n", len(snapshot.workers))
+	if len(snapshot.workers) == 0 {
+		return buf.String()
+	}
+	table := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "  WORKER\tSTATUS\tHOST\tSLOTS\tHEARTBEAT\tTASKS")
+	for _, worker := range snapshot.workers {
+		tasks := "-"
+		if len(worker.tasks) > 0 {
+			var b bytes.Buffer
+			for idx, task := range worker.tasks {
+				if idx > 0 {
+					b.WriteString(" ")
+				}
+				fmt.Fprintf(&b, "%v/%v/%v#%v", task.jobId, taskTypeName(task.taskType),
+					task.taskId, task.attemptId)
+			}
+			tasks = b.String()
+		}
+		host := worker.host
+		if host == "" {
+			host = "-"
+		}
+		fmt.Fprintf(table, "  %v\t%v\t%v\t%v\t%v ago\t%v\n", worker.id,
+			workerStatusName(worker.status), host, worker.slots,
+			snapshot.time.Sub(worker.lastHeartbeat).Round(time.Millisecond), tasks)
+	}
+	table.Flush()
+	return buf.String()
+}
+
+// Return a dump of every job, task and worker of master
+// Unfinished tasks are listed, at most DUMP_MAX_TASKS per job
+// The snapshot is taken under the lock, and formatted outside it
+func (master *Master) DumpState() string {
+	master.mu.Lock()
+	snapshot := master.snapshot()
+	master.mu.Unlock()
+
+	return snapshot.format()
+}
+
+// rpc that lets a remote client dump the state of master, see DumpState
+// Reply AUTH to a wrong secret
+func (master *Master) StateDump(args *StateDumpSend, reply *StateDumpReply) error {
+	if err := master.enter(); err != nil {
+		return err
+	}
+	defer master.inflight.Done()
+
+	if !master.checkSecret(args.Secret) {
+		reply.Err = AUTH
+		return nil
+	}
+
+	reply.Dump = master.DumpState()
+	reply.Err = OK
+	return nil
+}
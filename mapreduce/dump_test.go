@@ -0,0 +1,129 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of dumping the state of master
+
+package mapreduce
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// A dump split into its lines, and the rows of its tables keyed by their first columns
+type parsedDump struct {
+	lines []string
+	// The fields of each task row, keyed by type and task, e.g. "MAP 0"
+	tasks map[string][]string
+	// The fields of each worker row, keyed by worker id
+	workers map[string][]string
+}
+
+func parseDump(dump string) parsedDump {
+	parsed := parsedDump{
+		lines:   strings.Split(dump, "\n"),
+		tasks:   map[string][]string{},
+		workers: map[string][]string{},
+	}
+	// The header of the table the line is in, empty if none
+	var table string
+	for _, line := range parsed.lines {
+		fields := strings.Fields(line)
+		switch {
+		case !strings.HasPrefix(line, "  ") || len(fields) < 2 || fields[0] == "...":
+			table = ""
+		case fields[0] == "TYPE" || fields[0] == "WORKER":
+			table = fields[0]
+		case table == "TYPE":
+			parsed.tasks[fields[0]+" "+fields[1]] = fields
+		case table == "WORKER":
+			parsed.workers[fields[0]] = fields
+		}
+	}
+	return parsed
+}
+
+func TestDumpShowsTasksAndWorkers(t *testing.T) {
+	master := makeMaster(t, writeInputs(t, "a", "b", "c"), 2)
+	workerId := registerWorker(t, master, 2)
+	if taskId, _ := assignMap(master, workerId); taskId != 0 {
+		t.Fatalf("assigned task %v, want task 0", taskId)
+	}
+	dump := parseDump(master.DumpState())
+
+	if !strings.Contains(dump.lines[0], "NOT STARTED") {
+		t.Errorf("header %q, want the master not started", dump.lines[0])
+	}
+	if !containsLine(dump.lines, "job 0 MAP: map 0/3 done, 2 queued; reduce 0/2 done, 2 queued") {
+		t.Errorf("no line with the counts of job 0 in\n%v", strings.Join(dump.lines, "\n"))
+	}
+	worker := fmt.Sprint(workerId)
+	tests := []struct {
+		task                       string
+		status, attempts, assigned string
+	}{
+		{"MAP 0", "PROCESSING", "1", worker},
+		{"MAP 1", "UNPROCESSED", "0", "-"},
+		{"MAP 2", "UNPROCESSED", "0", "-"},
+		{"REDUCE 0", "UNPROCESSED", "0", "-"},
+		{"REDUCE 1", "UNPROCESSED", "0", "-"},
+	}
+	for _, test := range tests {
+		fields := dump.tasks[test.task]
+		if len(fields) != 6 || fields[2] != test.status || fields[3] != test.attempts ||
+			fields[4] != test.assigned {
+			t.Errorf("task %v row %v, want it %v after %v attempts on %v", test.task, fields,
+				test.status, test.attempts, test.assigned)
+		}
+	}
+	if len(dump.tasks) != len(tests) {
+		t.Errorf("dump lists %v tasks, want %v", len(dump.tasks), len(tests))
+	}
+	fields := dump.workers[worker]
+	if len(fields) != 7 || fields[1] != "AVAILABLE" || fields[3] != "2" || fields[6] != "0/MAP/0#0" {
+		t.Errorf("worker row %v, want it available with 2 slots running 0/MAP/0#0", fields)
+	}
+}
+
+func TestDumpTruncatesTasks(t *testing.T) {
+	contents := make([]string, DUMP_MAX_TASKS+5)
+	for idx := range contents {
+		contents[idx] = "a"
+	}
+	master := makeMaster(t, writeInputs(t, contents...), 3)
+	dump := parseDump(master.DumpState())
+
+	if len(dump.tasks) != DUMP_MAX_TASKS {
+		t.Errorf("dump lists %v tasks, want %v", len(dump.tasks), DUMP_MAX_TASKS)
+	}
+	if _, ok := dump.tasks["REDUCE 0"]; ok {
+		t.Error("dump lists a reduce task past the limit")
+	}
+	if !containsLine(dump.lines, "... 8 more unfinished tasks") {
+		t.Errorf("no count of the 8 tasks left out in\n%v", strings.Join(dump.lines[len(dump.lines)-5:], "\n"))
+	}
+}
+
+func TestStateDumpOverRpc(t *testing.T) {
+	master := startMaster(t, writeInputs(t, "a"), 1)
+	reply := StateDumpReply{}
+	if err := callMaster(t, master, "Master.StateDump", &StateDumpSend{}, &reply); err != nil || reply.Err != OK {
+		t.Fatalf("StateDump replied %v, %v", reply.Err, err)
+	}
+	dump := parseDump(reply.Dump)
+	if !strings.Contains(dump.lines[0], "RUNNING") {
+		t.Errorf("header %q, want the master running", dump.lines[0])
+	}
+	if _, ok := dump.tasks["MAP 0"]; !ok {
+		t.Errorf("dump lists no map task 0 in\n%v", reply.Dump)
+	}
+}
+
+// Return true if one of lines is line once trimmed
+func containsLine(lines []string, line string) bool {
+	for _, got := range lines {
+		if strings.TrimSpace(got) == line {
+			return true
+		}
+	}
+	return false
+}
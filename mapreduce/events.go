@@ -0,0 +1,120 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Append-only log of scheduling decisions, one json record per line
+
+package mapreduce
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The kinds of events in the event log
+const (
+	// A task attempt is assigned to a worker
+	EVENT_ASSIGNED = "ASSIGNED"
+	// A worker reports an attempt and the result is accepted
+	EVENT_FINISHED = "FINISHED"
+	// A worker reports an attempt and the result is not accepted
+	EVENT_WASTE = "WASTE"
+	// A worker reports an attempt that failed, e.g. its user function panicked
+	EVENT_FAILED = "FAILED"
+	// A task is handed back to the scheduler to be retried
+	EVENT_REQUEUED = "REQUEUED"
+	// A worker registers, is declared failed, or deregisters when shut down
+	EVENT_WORKER_REGISTERED   = "WORKER_REGISTERED"
+	EVENT_WORKER_FAILED       = "WORKER_FAILED"
+	EVENT_WORKER_DEREGISTERED = "WORKER_DEREGISTERED"
+)
+
+// A single scheduling decision of master
+// Task fields are zero for worker events
+type Event struct {
+	Time      time.Time
+	Kind      string
+	JobId     JobId
+	TaskId    TaskId
+	TaskType  TaskType
+	AttemptId AttemptId
+	WorkerId  int64
+	// The reply to the report for FINISHED and WASTE (OK, WASTE, MISMATCH or ABORTED)
+	Result Err `json:",omitempty"`
+	// The reason the task is requeued for REQUEUED, or the attempt failed for FAILED
+	Reason string `json:",omitempty"`
+}
+
+// The event log master appends to
+type eventLog struct {
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// Open the event log at path for appending
+// Events of earlier runs are kept, so a recovered master adds to them
+func openEventLog(path string) (*eventLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open event log: %v", err)
+	}
+	return &eventLog{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// Close the event log
+func (writer *eventLog) close() error {
+	return writer.file.Close()
+}
+
+// Append an event to the event log of master if enabled
+// A failed append is logged, master keeps running without it
+// Must be called with lock held
+func (master *Master) logEvent(event Event) {
+	if master.events == nil {
+		return
+	}
+	event.Time = time.Now()
+	if err := master.events.encoder.Encode(&event); err != nil {
+		master.config.Logger.Errorf("Cannot append to event log: %v", err)
+	}
+}
+
+// Append an event of a task attempt
+// Must be called with lock held
+func (master *Master) logTaskEvent(kind string, task runningTask,
+	workerId int64, result Err, reason string) {
+	master.logEvent(Event{
+		Kind:      kind,
+		JobId:     task.jobId,
+		TaskId:    task.taskId,
+		TaskType:  task.taskType,
+		AttemptId: task.attemptId,
+		WorkerId:  workerId,
+		Result:    result,
+		Reason:    reason,
+	})
+}
+
+// Read every event of the event log at path, in the order they were written
+func ReadEvents(path string) ([]Event, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadEvents: %v", err)
+	}
+	defer file.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("ReadEvents: line %v: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ReadEvents: %v", err)
+	}
+	return events, nil
+}
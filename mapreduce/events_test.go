@@ -0,0 +1,88 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of the event log of scheduling decisions
+
+package mapreduce
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEventLogRecordsDecisions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	master := makeMaster(t, writeInputs(t, "a"), 1, WithEventLog(path))
+	workerId := registerWorker(t, master, 2)
+	assignMap(master, workerId)
+	master.mu.Lock()
+	master.jobs[DEFAULT_JOB].dropAttempt(0, MAP, 0, "task timeout")
+	master.mu.Unlock()
+	assignMap(master, workerId)
+	finishAttempt(master, workerId, MAP, 0, 1)
+	finishAttempt(master, workerId, MAP, 0, 0)
+	shutdownMaster(master)
+
+	events, err := ReadEvents(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type decision struct {
+		Kind      string
+		AttemptId AttemptId
+		Result    Err
+	}
+	var got []decision
+	for _, event := range events {
+		if event.Time.IsZero() || event.WorkerId != workerId {
+			t.Errorf("event %+v, want a time and worker %v", event, workerId)
+		}
+		got = append(got, decision{event.Kind, event.AttemptId, event.Result})
+	}
+	want := []decision{
+		{EVENT_WORKER_REGISTERED, 0, ""},
+		{EVENT_ASSIGNED, 0, ""},
+		{EVENT_REQUEUED, 0, ""},
+		{EVENT_ASSIGNED, 1, ""},
+		{EVENT_FINISHED, 1, OK},
+		{EVENT_WASTE, 0, WASTE},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("events %+v, want %+v", got, want)
+	}
+}
+
+func TestEventLogFinishesEveryTaskOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	master := startMaster(t, writeInputs(t, "a b", "b c", "c d"), 2, WithEventLog(path))
+	for i := 0; i < 2; i++ {
+		startWorker(t, master, nil)
+	}
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	shutdownMaster(master)
+
+	events, err := ReadEvents(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type task struct {
+		TaskType TaskType
+		TaskId   TaskId
+	}
+	finished := map[task]int{}
+	for _, event := range events {
+		if event.Kind == EVENT_FINISHED {
+			finished[task{event.TaskType, event.TaskId}]++
+		}
+	}
+	if len(finished) != 5 {
+		t.Errorf("tasks %v finished, want 3 maps and 2 reduces", finished)
+	}
+	for task, count := range finished {
+		if count != 1 {
+			t.Errorf("%v task %v finished %v times", taskTypeName(task.TaskType), task.TaskId, count)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// External merge sort of reduce input that does not fit in memory
+
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// The default bytes of input a reduce attempt holds in memory
+// Before it writes a sorted run to disk
+const REDUCE_MEMORY = 256 << 20
+
+// Returned to stop a reduce attempt that is killed between keys
+var errKilled = errors.New("attempt killed")
+
+// The input of a reduce attempt, sorted by key
+// Held in memory until the keys and values reach the budget
+// Then sorted and written to a numbered run file in the attempt dir
+type runBuffer struct {
+	dir    string
+	budget int
+	// The pairs not written to a run yet, and their bytes in total
+	kvs  []KeyValue
+	size int
+	// The run files, in the order they are written
+	runs []string
+	// The number of pairs added
+	total int
+}
+
+// Create the input buffer of a reduce attempt writing runs to dir
+func (worker *Worker) newRunBuffer(dir string) *runBuffer {
+	budget := worker.ReduceMemory
+	if budget <= 0 {
+		budget = REDUCE_MEMORY
+	}
+	return &runBuffer{dir: dir, budget: budget}
+}
+
+// Add a pair, writing a run once the budget is hit
+func (buffer *runBuffer) add(kv KeyValue) error {
+	buffer.kvs = append(buffer.kvs, kv)
+	buffer.size += len(kv.Key) + len(kv.Value)
+	buffer.total++
+	if buffer.size >= buffer.budget {
+		return buffer.spill()
+	}
+	return nil
+}
+
+// Sort the pairs in memory by key, keeping the order of values of a key
+func (buffer *runBuffer) sort() {
+	sort.SliceStable(buffer.kvs, func(i, j int) bool {
+		return buffer.kvs[i].Key < buffer.kvs[j].Key
+	})
+}
+
+// Write the pairs in memory to a new sorted run and empty the buffer
+func (buffer *runBuffer) spill() error {
+	buffer.sort()
+	name := filepath.Join(buffer.dir, fmt.Sprintf("run-%v", len(buffer.runs)))
+	if err := writeSpill(name, buffer.kvs); err != nil {
+		return err
+	}
+	buffer.runs = append(buffer.runs, name)
+	buffer.kvs = nil
+	buffer.size = 0
+	return nil
+}
+
+// Call fn for every key in order, with its values in the order they were added
+// Only the values of one key are held at a time once runs are written
+// Stop at the first error of fn and return it
+func (buffer *runBuffer) each(fn func(key string, values []string) error) error {
+	// Everything fits in memory
+	if len(buffer.runs) == 0 {
+		buffer.sort()
+		for start := 0; start < len(buffer.kvs); {
+			key := buffer.kvs[start].Key
+			var values []string
+			end := start
+			for ; end < len(buffer.kvs) && buffer.kvs[end].Key == key; end++ {
+				values = append(values, buffer.kvs[end].Value)
+			}
+			if err := fn(key, values); err != nil {
+				return err
+			}
+			start = end
+		}
+		return nil
+	}
+
+	if len(buffer.kvs) > 0 {
+		if err := buffer.spill(); err != nil {
+			return err
+		}
+	}
+	var key string
+	var values []string
+	err := mergeRuns(buffer.runs, func(kv *KeyValue) error {
+		if values != nil && kv.Key != key {
+			if err := fn(key, values); err != nil {
+				return err
+			}
+			values = nil
+		}
+		key = kv.Key
+		values = append(values, kv.Value)
+		return nil
+	})
+	if err != nil || values == nil {
+		return err
+	}
+	return fn(key, values)
+}
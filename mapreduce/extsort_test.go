@@ -0,0 +1,127 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of sorting reduce input on disk
+
+package mapreduce
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeRunsInPasses(t *testing.T) {
+	// Two passes, the second merging the two runs left by the first
+	dir := t.TempDir()
+	nRuns := MERGE_FAN_IN*MERGE_FAN_IN + 1
+	var names []string
+	for run := 0; run < nRuns; run++ {
+		name := filepath.Join(dir, fmt.Sprintf("run-%05d", run))
+		kvs := []KeyValue{
+			{Key: fmt.Sprintf("k%03d", run%17), Value: strconv.Itoa(run)},
+			{Key: fmt.Sprintf("k%03d", run%17+20), Value: strconv.Itoa(run)},
+		}
+		if err := writeSpill(name, kvs); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	var merged []KeyValue
+	err := mergeRuns(names, func(kv *KeyValue) error {
+		merged = append(merged, *kv)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged) != 2*nRuns {
+		t.Fatalf("merged %v pairs, want %v", len(merged), 2*nRuns)
+	}
+	for idx := 1; idx < len(merged); idx++ {
+		prev, kv := merged[idx-1], merged[idx]
+		if kv.Key < prev.Key {
+			t.Fatalf("pair %v has key %v after %v", idx, kv.Key, prev.Key)
+		}
+		prevRun, _ := strconv.Atoi(prev.Value)
+		run, _ := strconv.Atoi(kv.Value)
+		if kv.Key == prev.Key && run < prevRun {
+			t.Fatalf("values of key %v out of the order of the runs: %v after %v", kv.Key, run, prevRun)
+		}
+	}
+	// The runs of the first pass are removed once merged, those of the last are what is left
+	if runs, _ := filepath.Glob(filepath.Join(dir, "run-?????.merged")); len(runs) != 0 {
+		t.Errorf("runs %v of the first pass left", runs)
+	}
+	if runs, _ := filepath.Glob(filepath.Join(dir, "run-?????.merged.merged")); len(runs) != 2 {
+		t.Errorf("runs %v of the second pass, want 2", runs)
+	}
+}
+
+func TestMergeRunsReturnsDecodeError(t *testing.T) {
+	dir := t.TempDir()
+	good := writeFile(t, dir, "run-0", "{\"Key\":\"a\",\"Value\":\"1\"}\n{\"Key\":\"c\",\"Value\":\"1\"}\n")
+	bad := writeFile(t, dir, "run-1", "{\"Key\":\"b\",\"Value\":\"1\"}\n{\"Key\":\"d\",\"Va")
+
+	var keys []string
+	err := mergeRuns([]string{good, bad}, func(kv *KeyValue) error {
+		keys = append(keys, kv.Key)
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "cannot read run run-1") {
+		t.Fatalf("merge of a run cut short returned %v, want its read error", err)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("merged keys %v before the error, want %v", keys, want)
+	}
+}
+
+func TestReduceInputLargerThanMemory(t *testing.T) {
+	worker := &Worker{ReduceMemory: 32}
+	buffer := worker.newRunBuffer(t.TempDir())
+	want := map[string][]string{}
+	for i := 0; i < 2000; i++ {
+		key := "k" + strconv.Itoa(i*31%97)
+		value := strconv.Itoa(i)
+		want[key] = append(want[key], value)
+		if err := buffer.add(KeyValue{Key: key, Value: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(buffer.runs) <= MERGE_FAN_IN {
+		t.Fatalf("%v runs written, want more than one merge can open", len(buffer.runs))
+	}
+
+	got := map[string][]string{}
+	var keys []string
+	err := buffer.each(func(key string, values []string) error {
+		keys = append(keys, key)
+		got[key] = values
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sort.StringsAreSorted(keys) {
+		t.Errorf("keys %v not in order", keys)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("values of a key not those added in order")
+	}
+}
+
+func TestReduceMemoryJob(t *testing.T) {
+	contents := []string{"a b a c d e f g", "b b c a h i", "d a a j k l"}
+	master := startMaster(t, writeInputs(t, contents...), 2)
+	startWorker(t, master, func(worker *Worker) {
+		worker.ReduceMemory = 4
+	})
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+}
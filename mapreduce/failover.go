@@ -0,0 +1,133 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Terms of master, fencing of a replaced master and standby failover
+
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The return type of rpc to a worker that has seen a newer term of master
+const STALE_TERM = "STALE_TERM"
+
+// Returned by every rpc of master and by Wait once a newer term has taken over
+var ErrMasterFenced = errors.New("mapreduce: master replaced by a newer term")
+
+// The number of probes of the primary failing in a row before a standby
+// Takes over, also the number of heartbeats failing in a row
+// Before a worker switches to its standby master
+const FAILOVER_PROBES = 3
+
+// Stop scheduling for good, a master of a newer term has taken over
+// Running tasks are left alone, their results go to the new master
+// Nothing more is appended to the write-ahead log
+// Must be called with lock held
+func (master *Master) fence() {
+	if master.fenced {
+		return
+	}
+	master.config.Logger.Warnf("Master of term %v replaced by a newer term, stop scheduling",
+		master.term)
+	master.fenced = true
+	if master.wal != nil {
+		master.wal.close()
+		master.wal = nil
+	}
+	master.signalChange()
+}
+
+// Fence master if term, the newest term a worker has seen, is newer than its own
+// Return ErrMasterFenced if master has been fenced
+// Must be called with lock held
+func (master *Master) checkTerm(term int64) error {
+	if term > master.term {
+		master.fence()
+	}
+	if master.fenced {
+		return ErrMasterFenced
+	}
+	return nil
+}
+
+// Return the term of master
+// It starts at 0 and every RecoverMaster (including a standby taking over)
+// Bumps it past the terms in the log
+func (master *Master) Term() int64 {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	return master.term
+}
+
+// Return true if master has been fenced by a newer term
+func (master *Master) Fenced() bool {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	return master.fenced
+}
+
+// A function used by a standby to check if the primary is still online
+func (master *Master) IsOnline(_, _ *struct{}) error {
+	if err := master.enter(); err != nil {
+		return err
+	}
+	defer master.inflight.Done()
+	return nil
+}
+
+// Run a standby of the primary master at primaryAddr, a host:port
+// The primary must write a write-ahead log to walPath, see WithWAL
+// Probe the primary every HeartbeatInterval and block until FAILOVER_PROBES
+// Probes in a row fail, then recover from the log and run on port
+// With a newer term, so the primary is fenced if it comes back
+// Workers started with StandbyAddr switch to it once the primary is gone
+// Return the error of ctx if it is done before the primary fails
+func RunStandby(ctx context.Context, walPath string, port int64, primaryAddr string,
+	options ...Option) (*Master, error) {
+	primaryAddr, err := parseAddr(primaryAddr)
+	if err != nil {
+		return nil, fmt.Errorf("RunStandby: primary: %v", err)
+	}
+	config := defaultConfig()
+	for _, option := range options {
+		if err := option(&config); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.checkHeartbeat(); err != nil {
+		return nil, err
+	}
+	failures := 0
+	for failures < FAILOVER_PROBES {
+		timer := time.NewTimer(config.HeartbeatInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		probe, cancel := context.WithTimeout(ctx, PROBE_TIMEOUT)
+		online := reachable(callCodec(probe, config.TLS, config.wireCodec(), primaryAddr,
+			"Master.IsOnline", &struct{}{}, &struct{}{}))
+		cancel()
+		if online {
+			failures = 0
+		} else {
+			failures++
+		}
+	}
+
+	master, err := RecoverMaster(walPath, port, options...)
+	if err != nil {
+		return nil, err
+	}
+	master.config.Logger.Warnf("Primary %v failed, take over with term %v",
+		primaryAddr, master.Term())
+	if err := master.RunMaster(); err != nil {
+		return nil, err
+	}
+	return master, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of a standby master taking over from a failed primary
+
+package mapreduce
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStandbyFinishesJobOfFailedPrimary(t *testing.T) {
+	contents := []string{"a b a", "c b", "a c d"}
+	files := writeInputs(t, contents...)
+	// Both masters write the output of the job to the same place
+	outputDir, mapDir := t.TempDir(), t.TempDir()
+	path := filepath.Join(t.TempDir(), "master.wal")
+	options := func(options ...Option) []Option {
+		return testOptions(t, append([]Option{WithOutputDir(outputDir), WithMapDir(mapDir)}, options...)...)
+	}
+	primary, err := MakeMaster(files, 1, 0, options(WithWAL(path, true))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.RunMaster(); err != nil {
+		t.Fatal(err)
+	}
+	standbyPort := freePort(t)
+
+	type result struct {
+		master *Master
+		err    error
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	standbyDone := make(chan result, 1)
+	go func() {
+		master, err := RunStandby(ctx, path, standbyPort, "localhost:"+strconv.FormatInt(primary.Port(), 10), options()...)
+		standbyDone <- result{master, err}
+	}()
+
+	// The primary dies in the middle of the map phase, with the first map stalled
+	stall := newStallingMap(1)
+	startWorker(t, primary, func(worker *Worker) {
+		worker.Slots = 2
+		worker.StandbyAddr = "localhost:" + strconv.FormatInt(standbyPort, 10)
+		worker.MapContext = stall.mapContext
+	})
+	waitFor(t, 5*time.Second, "two map tasks finished on the primary", func() bool {
+		finished := 0
+		for _, record := range primary.Report().Attempts {
+			if record.TaskType == MAP && record.Result == ATTEMPT_OK {
+				finished++
+			}
+		}
+		return finished == 2
+	})
+	shutdownMaster(primary)
+	stall.release(0)
+
+	var standby result
+	select {
+	case standby = <-standbyDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("standby never took over")
+	}
+	if standby.err != nil {
+		t.Fatal(standby.err)
+	}
+	t.Cleanup(func() { shutdownMaster(standby.master) })
+	if standby.master.Term() <= primary.Term() {
+		t.Errorf("standby runs term %v, want it past term %v of the primary",
+			standby.master.Term(), primary.Term())
+	}
+	if err := waitJob(t, standby.master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, outputDir), wordCounts(contents...))
+}
+
+func TestOldPrimaryIsFencedByNewerTerm(t *testing.T) {
+	master, cluster := startFakeCluster(t, writeInputs(t, "a"), 1)
+	master.PauseScheduling()
+	workerId := cluster.addWorker(t, 1)
+
+	// A worker that has registered with the standby carries its newer term
+	reply := HeartbeatReply{}
+	if err := master.Heartbeat(&HeartbeatSend{Term: master.Term() + 1, WorkerId: workerId}, &reply); err != ErrMasterFenced {
+		t.Fatalf("heartbeat of a newer term returned %v, want ErrMasterFenced", err)
+	}
+	if !master.Fenced() {
+		t.Fatal("master not fenced")
+	}
+	if err := waitJob(t, master, time.Second); err != ErrMasterFenced {
+		t.Fatalf("Wait returned %v, want ErrMasterFenced", err)
+	}
+
+	// The fenced master dispatches nothing, even with a free worker
+	master.ResumeScheduling()
+	time.Sleep(200 * time.Millisecond)
+	if started := cluster.startedAttempts(); len(started) != 0 {
+		t.Fatalf("fenced master started %v", started)
+	}
+}
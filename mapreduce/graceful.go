@@ -0,0 +1,215 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Stopping rpc servers gracefully, letting the rpcs they run return first
+
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// Returned by the codec of a server that stops, for a request read afterwards
+// Its connection is closed, so the caller dials again and is refused
+var errServerStopping = errors.New("server stopping")
+
+// A listener whose server can stop gracefully
+// Stop stops accepting, waits for the rpcs running to return until ctx is done
+// Then closes the connections, and returns ctx.Err() if rpcs were still running
+// The listeners of the default transport are ones, see Transport.Listen
+type StoppableListener interface {
+	net.Listener
+	Stop(ctx context.Context) error
+}
+
+// The connections and running rpcs of a server, see RunServerCodec
+type serveState struct {
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	// Set once Stop starts, no rpc is started afterwards
+	stopping bool
+	// The rpcs read and not replied yet
+	active sync.WaitGroup
+	// Told of what the codecs of connections cannot tell their peers
+	logger Logger
+}
+
+// Logger is told of what the codecs of connections cannot tell their peers
+// Stderr if nil, see loggedCodec
+func newServeState(logger Logger) *serveState {
+	if logger == nil {
+		logger = NewStdLogger()
+	}
+	return &serveState{conns: make(map[net.Conn]bool), logger: logger}
+}
+
+// A server codec that logs what it cannot tell the peer, e.g. a response it cannot encode
+type loggedCodec interface {
+	setLogger(logger Logger)
+}
+
+// Accept connections on listener until it is closed, see RunServer
+// The connections are closed once the loop ends, unless Stop closes them
+func (state *serveState) serve(serviceName string, server *rpc.Server, listener net.Listener,
+	codec WireCodec, interceptors []Interceptor) error {
+	var result error
+	var wait time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err == nil {
+			wait = 0
+			state.mu.Lock()
+			state.conns[conn] = true
+			state.mu.Unlock()
+			go func() {
+				serverCodec := codec.NewServerCodec(conn, interceptors)
+				if logged, ok := serverCodec.(loggedCodec); ok {
+					logged.setLogger(state.logger)
+				}
+				server.ServeCodec(&drainCodec{serverCodec, state})
+				state.mu.Lock()
+				delete(state.conns, conn)
+				state.mu.Unlock()
+			}()
+			continue
+		}
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
+		if temporary(err) {
+			if wait *= 2; wait == 0 {
+				wait = ACCEPT_BACKOFF
+			} else if wait > ACCEPT_MAX_BACKOFF {
+				wait = ACCEPT_MAX_BACKOFF
+			}
+			time.Sleep(wait)
+			continue
+		}
+		result = fmt.Errorf("%v accept error: %w", serviceName, err)
+		break
+	}
+	listener.Close()
+
+	state.mu.Lock()
+	stopping := state.stopping
+	state.mu.Unlock()
+	if !stopping {
+		state.closeConns()
+	}
+	return result
+}
+
+// Count an rpc read, return false once the server stops
+func (state *serveState) begin() bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.stopping {
+		return false
+	}
+	state.active.Add(1)
+	return true
+}
+
+// Start no rpc from now on
+func (state *serveState) stop() {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.stopping = true
+}
+
+func (state *serveState) closeConns() {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for conn := range state.conns {
+		conn.Close()
+	}
+}
+
+// The server codec of a connection, counting the rpcs it runs
+// net/rpc writes a response for every request whose header it read
+type drainCodec struct {
+	rpc.ServerCodec
+	state *serveState
+}
+
+func (c *drainCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.ServerCodec.ReadRequestHeader(r); err != nil {
+		return err
+	}
+	if !c.state.begin() {
+		return errServerStopping
+	}
+	return nil
+}
+
+func (c *drainCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	defer c.state.active.Done()
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+// A listener served by RunServerCodec in its own goroutine
+// Close returns once the accept loop did and the connections are closed
+// So the address can be listened on again at once, e.g. by a new master
+// Rpcs running on the connections may still return after, unless Stop is used
+type servedListener struct {
+	net.Listener
+	state *serveState
+	done  chan struct{}
+}
+
+func (listener *servedListener) Close() error {
+	err := listener.Listener.Close()
+	<-listener.done
+	return err
+}
+
+func (listener *servedListener) Stop(ctx context.Context) error {
+	listener.state.stop()
+	listener.Listener.Close()
+	<-listener.done
+
+	drained := make(chan struct{})
+	go func() {
+		listener.state.active.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	listener.state.closeConns()
+	return err
+}
+
+// Serve listener like RunServerCodec in its own goroutine
+// Logging to logger what connections cannot tell their peers, see newServeState
+// Pass the error the accept loop stopped on to failed, unless it is nil
+// Return the listener to close or stop to stop serving, see servedListener
+func goServe(serviceName string, server *rpc.Server, listener net.Listener,
+	codec WireCodec, interceptors []Interceptor, logger Logger, failed func(error)) net.Listener {
+	served := &servedListener{Listener: listener, state: newServeState(logger),
+		done: make(chan struct{})}
+	go func() {
+		err := served.state.serve(serviceName, server, listener, codec, interceptors)
+		close(served.done)
+		if err != nil && failed != nil {
+			failed(err)
+		}
+	}()
+	return served
+}
+
+// Stop serving on listener, gracefully if it is a StoppableListener
+// Otherwise close it at once
+func stopListener(ctx context.Context, listener net.Listener) error {
+	if stoppable, ok := listener.(StoppableListener); ok {
+		return stoppable.Stop(ctx)
+	}
+	return listener.Close()
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of stopping rpc servers gracefully
+
+package mapreduce
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A service whose rpc blocks until released, so a test can stop its server mid-rpc
+type SlowService struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newSlowService() *SlowService {
+	return &SlowService{started: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (service *SlowService) Wait(_ *struct{}, reply *GeneralReply) error {
+	service.started <- struct{}{}
+	<-service.release
+	reply.Err = OK
+	return nil
+}
+
+// Serve service on a free port of localhost with the default transport
+func listenSlow(t *testing.T, service *SlowService) StoppableListener {
+	t.Helper()
+	listener, err := NewRPCTransport(nil).Listen("SlowService", service, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return listener.(StoppableListener)
+}
+
+// Call SlowService.Wait at addr in the background, the error comes on the channel
+func callSlow(addr string) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		transport := NewRPCTransport(nil)
+		defer transport.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		reply := GeneralReply{}
+		err := transport.Call(ctx, addr, "SlowService.Wait", &struct{}{}, &reply)
+		if err == nil && reply.Err != OK {
+			err = &CallError{Kind: ErrRemote, RpcName: "SlowService.Wait", Addr: addr}
+		}
+		result <- err
+	}()
+	return result
+}
+
+// Wait until connections to addr are refused
+func waitRefused(t *testing.T, addr string) {
+	t.Helper()
+	waitFor(t, 5*time.Second, "connections refused", func() bool {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			return true
+		}
+		conn.Close()
+		return false
+	})
+}
+
+func TestStopLetsRunningRpcReply(t *testing.T) {
+	service := newSlowService()
+	listener := listenSlow(t, service)
+	addr := listener.Addr().String()
+	called := callSlow(addr)
+	<-service.started
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- listener.Stop(ctx)
+	}()
+	waitRefused(t, addr)
+	select {
+	case err := <-stopped:
+		t.Fatalf("Stop returned %v while an rpc was running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(service.release)
+	if err := <-called; err != nil {
+		t.Fatalf("rpc running during Stop: %v, want its reply", err)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+}
+
+func TestStopGivesUpOnceCtxIsDone(t *testing.T) {
+	service := newSlowService()
+	defer close(service.release)
+	listener := listenSlow(t, service)
+	called := callSlow(listener.Addr().String())
+	<-service.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := listener.Stop(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Stop: %v, want %v", err, context.DeadlineExceeded)
+	}
+	// The connection is closed under the rpc
+	if err := <-called; err == nil {
+		t.Fatal("rpc got a reply after Stop gave up")
+	}
+}
+
+func TestShutdownDrainsTaskFinished(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.wal")
+	// The reply to the report stalls after TaskFinished has returned
+	replying := make(chan struct{})
+	release := make(chan struct{})
+	cluster := newFakeCluster(1)
+	cluster.Transport = NewRPCTransport(nil, Interceptor{
+		Reply: func(info *RPCInfo, err string, elapsed time.Duration) {
+			if info.Method == "Master.TaskFinished" {
+				close(replying)
+				<-release
+			}
+		},
+	})
+	cluster.setHold(true)
+	master := startMaster(t, writeInputs(t, "a"), 1, cluster.options(WithWAL(path, true))...)
+	cluster.master = master
+	workerId := cluster.addWorker(t, 1)
+	waitFor(t, 5*time.Second, "the map started", func() bool {
+		return len(cluster.startedAttempts()) == 1
+	})
+	attempt := cluster.startedAttempts()[0]
+
+	reported := make(chan Err, 1)
+	go func() {
+		reply := GeneralReply{}
+		err := callMaster(t, master, "Master.TaskFinished", &TaskFinishedSend{
+			JobId:          attempt.JobId,
+			TaskId:         attempt.TaskId,
+			TaskType:       attempt.TaskType,
+			AttemptId:      attempt.AttemptId,
+			WorkerId:       workerId,
+			PartitionBytes: make([]int64, 1),
+		}, &reply)
+		if err != nil {
+			reply.Err = Err(err.Error())
+		}
+		reported <- reply.Err
+	}()
+	<-replying
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- master.Shutdown(ctx)
+	}()
+	waitRefused(t, master.Addr().String())
+	close(release)
+	if reply := <-reported; reply != OK {
+		t.Fatalf("report in flight during Shutdown: %v, want %v", reply, OK)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	recovered, err := RecoverMaster(path, 0, testOptions(t)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdownMaster(recovered)
+	if finished, err := recovered.PhaseFinished(DEFAULT_JOB, MAP); err != nil || !finished {
+		t.Fatalf("recovered job: map finished %v, %v, want it finished", finished, err)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Protocol version and capabilities a worker registers with
+
+package mapreduce
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The version of the rpc protocol between master and workers
+// Bumped whenever an rpc changes in a way an older peer cannot follow
+// Workers from before the handshake send 0
+// Version 2 sends a request id ahead of the arguments of every rpc
+// Version 3 states the wire codec in Capabilities
+const PROTOCOL_VERSION = 3
+
+// The oldest protocol version of a worker master accepts
+const MIN_PROTOCOL_VERSION = 2
+
+// The return type of RegisterWorker for a worker master cannot use
+// The reply carries a Rejection saying why
+const INCOMPATIBLE = "INCOMPATIBLE"
+
+// The encoding of intermediate files, one json object per line
+const CODEC_JSON = "json"
+
+// What a worker can do besides running map and reduce functions
+// Sent with RegisterSend next to its Slots and Plugin
+type Capabilities struct {
+	// The codecs the worker reads and writes intermediate files in
+	Codecs []string
+	// If Shuffle is true, the worker serves Worker.FetchPartition
+	// Otherwise reducers read its map output from a shared MAP_DIR
+	Shuffle bool
+	// The codecs of CompressionPolicy the worker decodes
+	// Empty for workers that compress nothing, which are sent payloads as they are
+	Compression []string
+	// The codec the worker encodes rpcs with, see WireCodec
+	// Empty for a worker on another transport, or from before version 3, which speaks gob
+	Wire string
+}
+
+// The reason master refuses to register a worker
+type Rejection struct {
+	// The capability that does not match, e.g. "version" or "codec"
+	Field string
+	// What master accepts, and what the worker has
+	Want string
+	Got  string
+}
+
+func (rejection *Rejection) Error() string {
+	return fmt.Sprintf("incompatible %v: master wants %v, worker has %v",
+		rejection.Field, rejection.Want, rejection.Got)
+}
+
+// Return why a registering worker cannot be used, nil if it can
+// Wire is the codec of master, empty if its transport has none, see transportWire
+func checkCompatible(args *RegisterSend, wire string) *Rejection {
+	if args.Version < MIN_PROTOCOL_VERSION || args.Version > PROTOCOL_VERSION {
+		return &Rejection{
+			Field: "version",
+			Want:  fmt.Sprintf("%v to %v", MIN_PROTOCOL_VERSION, PROTOCOL_VERSION),
+			Got:   fmt.Sprint(args.Version),
+		}
+	}
+	if got := args.Capabilities.Wire; wire != "" && got != wire && (got != "" || wire != WIRE_GOB) {
+		// Master could not call the worker back
+		return &Rejection{Field: "wire codec", Want: wire, Got: got}
+	}
+	for _, codec := range args.Capabilities.Codecs {
+		if codec == CODEC_JSON {
+			return nil
+		}
+	}
+	return &Rejection{
+		Field: "codec",
+		Want:  CODEC_JSON,
+		Got:   "[" + strings.Join(args.Capabilities.Codecs, " ") + "]",
+	}
+}
+
+// Return the capabilities the worker registers with
+func (worker *Worker) capabilities() Capabilities {
+	return Capabilities{
+		Codecs:  []string{CODEC_JSON},
+		Shuffle: !worker.DisableShuffle,
+		// Producers of partitions encode by the policy reducers send
+		Compression: compressionCodecs(),
+		Wire:        transportWire(worker.transport),
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of the version and capability handshake of registering workers
+
+package mapreduce
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIncompatibleWorkerIsRefused(t *testing.T) {
+	master, cluster := startFakeCluster(t, writeInputs(t, "a b", "b c"), 1)
+	master.PauseScheduling()
+	tests := []struct {
+		name  string
+		args  RegisterSend
+		field string
+	}{
+		{"before the handshake", RegisterSend{Slots: 1}, "version"},
+		{"old protocol", RegisterSend{Version: MIN_PROTOCOL_VERSION - 1, Slots: 1,
+			Capabilities: Capabilities{Codecs: []string{CODEC_JSON}}}, "version"},
+		{"newer protocol", RegisterSend{Version: PROTOCOL_VERSION + 1, Slots: 1,
+			Capabilities: Capabilities{Codecs: []string{CODEC_JSON}}}, "version"},
+		{"no common codec", RegisterSend{Version: PROTOCOL_VERSION, Slots: 1,
+			Capabilities: Capabilities{Codecs: []string{"avro"}}}, "codec"},
+	}
+	for idx, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := test.args
+			args.Addr = joinAddr("localhost", int64(30000+idx))
+			reply := RegisterReply{}
+			if err := callMaster(t, master, "Master.RegisterWorker", &args, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply.Err != INCOMPATIBLE || reply.Rejection == nil || reply.Rejection.Field != test.field {
+				t.Fatalf("replied %v with rejection %+v, want INCOMPATIBLE on %v",
+					reply.Err, reply.Rejection, test.field)
+			}
+		})
+	}
+	master.mu.Lock()
+	registered := len(master.workers)
+	master.mu.Unlock()
+	if registered != 0 {
+		t.Fatalf("%v refused workers registered", registered)
+	}
+
+	// The compatible workers still run the job
+	cluster.addWorker(t, 1)
+	master.ResumeScheduling()
+	if err := waitJob(t, master, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWireCodecMismatchRefused(t *testing.T) {
+	tests := []struct {
+		name string
+		// The codec of master and the one the worker states
+		wire, got string
+		refused   bool
+	}{
+		{"same codec", WIRE_JSON, WIRE_JSON, false},
+		{"gob worker of a json master", WIRE_JSON, WIRE_GOB, true},
+		{"json worker of a gob master", WIRE_GOB, WIRE_JSON, true},
+		// A worker from before version 3 speaks gob
+		{"old worker of a gob master", WIRE_GOB, "", false},
+		{"old worker of a json master", WIRE_JSON, "", true},
+		// Peers on other transports agree on the encoding by themselves
+		{"master on another transport", "", WIRE_JSON, false},
+	}
+	for _, test := range tests {
+		args := &RegisterSend{Version: PROTOCOL_VERSION, Slots: 1,
+			Capabilities: Capabilities{Codecs: []string{CODEC_JSON}, Wire: test.got}}
+		rejection := checkCompatible(args, test.wire)
+		if !test.refused {
+			if rejection != nil {
+				t.Errorf("%v: refused: %v", test.name, rejection)
+			}
+			continue
+		}
+		if rejection == nil || rejection.Field != "wire codec" || rejection.Want != test.wire ||
+			rejection.Got != test.got {
+			t.Errorf("%v: rejection %+v, want one on the wire codec", test.name, rejection)
+		}
+	}
+
+	// Over the wire, a json master refuses a worker stating gob
+	transport := NewRPCTransportCodec(nil, JSONCodec())
+	defer transport.Close()
+	master := startMaster(t, writeInputs(t, "a"), 1, WithCodec(JSONCodec()))
+	reply := RegisterReply{}
+	callOver(t, transport, master.Addr().String(), "Master.RegisterWorker", &RegisterSend{
+		Version:      PROTOCOL_VERSION,
+		Addr:         joinAddr("localhost", 32000),
+		Slots:        1,
+		Capabilities: Capabilities{Codecs: []string{CODEC_JSON}, Wire: WIRE_GOB},
+	}, &reply)
+	if reply.Err != INCOMPATIBLE || reply.Rejection == nil || reply.Rejection.Field != "wire codec" {
+		t.Fatalf("replied %v with rejection %+v, want INCOMPATIBLE on the wire codec",
+			reply.Err, reply.Rejection)
+	}
+}
@@ -0,0 +1,497 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Helpers shared by the tests of master and worker
+
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A logger dropping everything, so test output only shows failures
+type quietLogger struct{}
+
+func (quietLogger) Debugf(format string, args ...interface{}) {}
+func (quietLogger) Infof(format string, args ...interface{})  {}
+func (quietLogger) Warnf(format string, args ...interface{})  {}
+func (quietLogger) Errorf(format string, args ...interface{}) {}
+
+// A logger keeping every line, so tests can look for what was logged
+type recordLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (logger *recordLogger) record(level, format string, args []interface{}) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logger.lines = append(logger.lines, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (logger *recordLogger) Debugf(format string, args ...interface{}) {
+	logger.record("DEBUG", format, args)
+}
+func (logger *recordLogger) Infof(format string, args ...interface{}) {
+	logger.record("INFO", format, args)
+}
+func (logger *recordLogger) Warnf(format string, args ...interface{}) {
+	logger.record("WARN", format, args)
+}
+func (logger *recordLogger) Errorf(format string, args ...interface{}) {
+	logger.record("ERROR", format, args)
+}
+
+// Return true if a line logged so far contains text
+func (logger *recordLogger) contains(text string) bool {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	for _, line := range logger.lines {
+		if strings.Contains(line, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// Word count, the job every end to end test runs
+func wcMap(file, content string) []KeyValue {
+	var kvs []KeyValue
+	for _, word := range strings.Fields(content) {
+		kvs = append(kvs, KeyValue{Key: word, Value: "1"})
+	}
+	return kvs
+}
+
+func wcReduce(key string, values []string) string {
+	return strconv.Itoa(len(values))
+}
+
+// Return the word counts of contents, what wcMap and wcReduce output
+func wordCounts(contents ...string) map[string]string {
+	counts := map[string]int{}
+	for _, content := range contents {
+		for _, word := range strings.Fields(content) {
+			counts[word]++
+		}
+	}
+	result := map[string]string{}
+	for word, count := range counts {
+		result[word] = strconv.Itoa(count)
+	}
+	return result
+}
+
+// Write each of contents to its own file in a temp directory
+// Return the paths of the files
+func writeInputs(t testing.TB, contents ...string) []string {
+	t.Helper()
+	dir := t.TempDir()
+	var files []string
+	for idx, content := range contents {
+		file := filepath.Join(dir, "input-"+strconv.Itoa(idx)+".txt")
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// Write content to name under dir, creating the directories on the way
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	file := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// Return the options every test master starts with
+// Output and intermediate files go to temp directories, and the log is dropped
+// Options of the test come after, so they win
+func testOptions(t testing.TB, options ...Option) []Option {
+	return append([]Option{
+		WithOutputDir(t.TempDir()),
+		WithMapDir(t.TempDir()),
+		WithLogger(quietLogger{}),
+		WithHeartbeatInterval(50 * time.Millisecond),
+		WithSchedulerTick(10 * time.Millisecond),
+	}, options...)
+}
+
+// Make and run a master on a free port of localhost
+// It is shut down once the test ends
+func startMaster(t testing.TB, files []string, nReduce int, options ...Option) *Master {
+	t.Helper()
+	master, err := MakeMaster(files, nReduce, 0, testOptions(t, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := master.RunMaster(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shutdownMaster(master) })
+	return master
+}
+
+// Make a master that is not run, so tests drive its scheduling by hand
+func makeMaster(t *testing.T, files []string, nReduce int, options ...Option) *Master {
+	t.Helper()
+	master, err := MakeMaster(files, nReduce, 0, testOptions(t, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return master
+}
+
+// The port of the next worker registered by registerWorker
+var fakePort = 20000
+
+// Register a worker with slots that is never called, master being not run
+// Return its id
+func registerWorker(t testing.TB, master *Master, slots int) int64 {
+	t.Helper()
+	fakePort++
+	return registerAt(t, master, 0, joinAddr("localhost", int64(fakePort)), slots)
+}
+
+// Register the worker with id at addr, master picks the id if it is 0
+// Return its id
+func registerAt(t testing.TB, master *Master, workerId int64, addr string, slots int) int64 {
+	t.Helper()
+	reply := RegisterReply{}
+	err := master.RegisterWorker(&RegisterSend{
+		WorkerId:     workerId,
+		Version:      PROTOCOL_VERSION,
+		Addr:         addr,
+		Slots:        slots,
+		Capabilities: Capabilities{Codecs: []string{CODEC_JSON}, Shuffle: true},
+	}, &reply)
+	if err != nil || reply.Err != OK {
+		t.Fatalf("register worker: %v, %v", reply.Err, err)
+	}
+	return reply.WorkerId
+}
+
+// Report the attempt finished on the worker, return the reply
+func finishAttempt(master *Master, workerId int64, taskType TaskType, taskId TaskId,
+	attemptId AttemptId) Err {
+	reply := GeneralReply{}
+	master.TaskFinished(&TaskFinishedSend{
+		JobId:          DEFAULT_JOB,
+		TaskId:         taskId,
+		TaskType:       taskType,
+		AttemptId:      attemptId,
+		WorkerId:       workerId,
+		PartitionBytes: make([]int64, master.jobs[DEFAULT_JOB].nReduce),
+	}, &reply)
+	return reply.Err
+}
+
+// Workers faked by the transport of master, so tests see every dispatch
+// An attempt started on them finishes at once unless held
+// Rpcs to master still go over the rpc transport it embeds
+type fakeCluster struct {
+	Transport
+	master  *Master
+	nReduce int
+	mu      sync.Mutex
+	// The id of the worker at each address
+	workers map[string]int64
+	// The attempts started, in dispatch order
+	started []TaskAttempt
+	// Calls to a worker down fail as if it were unreachable
+	down map[int64]bool
+	// So do the next calls to a flaky worker, as many as it has left
+	flaky map[int64]int
+	// Starts on a slow worker take their delay, or until they time out
+	slow map[int64]time.Duration
+	// Attempts started while hold is true never finish
+	hold bool
+	// The bytes map task id writes to each partition, zeros if nil
+	partitionBytes func(taskId TaskId) []int64
+}
+
+// Make a cluster of fake workers for a master of jobs with nReduce partitions
+// Its master is set once made with the options of the cluster
+func newFakeCluster(nReduce int) *fakeCluster {
+	return &fakeCluster{
+		Transport: NewRPCTransport(nil),
+		nReduce:   nReduce,
+		workers:   map[string]int64{},
+		down:      map[int64]bool{},
+		flaky:     map[int64]int{},
+		slow:      map[int64]time.Duration{},
+	}
+}
+
+// Return the options of a master of the cluster, followed by options
+// Fake workers send no heartbeat, so they only expire if options say so
+func (cluster *fakeCluster) options(options ...Option) []Option {
+	return append([]Option{WithTransport(cluster), WithHeartbeatTTL(time.Minute)}, options...)
+}
+
+// Make and run a master whose workers are faked by the returned cluster
+func startFakeCluster(t testing.TB, files []string, nReduce int,
+	options ...Option) (*Master, *fakeCluster) {
+	t.Helper()
+	cluster := newFakeCluster(nReduce)
+	cluster.master = startMaster(t, files, nReduce, cluster.options(options...)...)
+	return cluster.master, cluster
+}
+
+// Register a fake worker with slots, return its id
+func (cluster *fakeCluster) addWorker(t testing.TB, slots int) int64 {
+	t.Helper()
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	workerId := registerWorker(t, cluster.master, slots)
+	cluster.master.mu.Lock()
+	cluster.workers[cluster.master.workers[workerId].addr] = workerId
+	cluster.master.mu.Unlock()
+	return workerId
+}
+
+// Register the worker again at its address, as its process does once restarted
+// It keeps its id if keepId, otherwise master picks a new one
+// Return the id it has now
+func (cluster *fakeCluster) restartWorker(t *testing.T, workerId int64, keepId bool) int64 {
+	t.Helper()
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	cluster.master.mu.Lock()
+	registry := cluster.master.workers[workerId]
+	addr, slots := registry.addr, registry.slots
+	cluster.master.mu.Unlock()
+	id := int64(0)
+	if keepId {
+		id = workerId
+	}
+	id = registerAt(t, cluster.master, id, addr, slots)
+	cluster.workers[addr] = id
+	return id
+}
+
+// Fail every call to the worker from now on, or stop failing them
+func (cluster *fakeCluster) setDown(workerId int64, down bool) {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	cluster.down[workerId] = down
+}
+
+// Fail the next calls to the worker, then let the others go through
+func (cluster *fakeCluster) setFlaky(workerId int64, calls int) {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	cluster.flaky[workerId] = calls
+}
+
+// Make every start on the worker take delay from now on
+func (cluster *fakeCluster) setSlow(workerId int64, delay time.Duration) {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	cluster.slow[workerId] = delay
+}
+
+// Hold the attempts started from now on, or finish those started later
+func (cluster *fakeCluster) setHold(hold bool) {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	cluster.hold = hold
+}
+
+// Return the attempts started so far, in dispatch order
+func (cluster *fakeCluster) startedAttempts() []TaskAttempt {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	return append([]TaskAttempt(nil), cluster.started...)
+}
+
+func (cluster *fakeCluster) Call(ctx context.Context, addr string, rpcName string,
+	args interface{}, reply interface{}) error {
+	cluster.mu.Lock()
+	workerId, ok := cluster.workers[addr]
+	if !ok {
+		cluster.mu.Unlock()
+		return cluster.Transport.Call(ctx, addr, rpcName, args, reply)
+	}
+	flaky := cluster.flaky[workerId] > 0
+	if flaky {
+		cluster.flaky[workerId]--
+	}
+	if cluster.down[workerId] || flaky {
+		cluster.mu.Unlock()
+		return &CallError{Kind: ErrUnreachable, RpcName: rpcName, Addr: addr, Err: errors.New("worker down")}
+	}
+	var attempt TaskAttempt
+	switch args := args.(type) {
+	case *MapStartSend:
+		attempt = TaskAttempt{args.JobId, args.TaskId, MAP, args.AttemptId}
+	case *ReduceStartSend:
+		attempt = TaskAttempt{args.JobId, args.TaskId, REDUCE, args.AttemptId}
+	default:
+		cluster.mu.Unlock()
+		return nil
+	}
+	cluster.started = append(cluster.started, attempt)
+	hold, delay := cluster.hold, cluster.slow[workerId]
+	cluster.mu.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return &CallError{Kind: ErrTimeout, RpcName: rpcName, Addr: addr, Err: ctx.Err()}
+		}
+	}
+	if !hold {
+		go cluster.finish(workerId, attempt)
+	}
+	return nil
+}
+
+// Report the attempt finished on the worker, as a worker would once it is done
+func (cluster *fakeCluster) finish(workerId int64, attempt TaskAttempt) {
+	bytes := make([]int64, cluster.nReduce)
+	if attempt.TaskType == MAP && cluster.partitionBytes != nil {
+		bytes = cluster.partitionBytes(attempt.TaskId)
+	}
+	cluster.master.TaskFinished(&TaskFinishedSend{
+		JobId:          attempt.JobId,
+		TaskId:         attempt.TaskId,
+		TaskType:       attempt.TaskType,
+		AttemptId:      attempt.AttemptId,
+		WorkerId:       workerId,
+		PartitionBytes: bytes,
+	}, &GeneralReply{})
+}
+
+// Call the rpc of master over the network, as a remote worker or client would
+func callMaster(t *testing.T, master *Master, rpcName string, args, reply interface{}) error {
+	t.Helper()
+	transport := NewRPCTransport(nil)
+	defer transport.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return transport.Call(ctx, master.Addr().String(), rpcName, args, reply)
+}
+
+// Shut master down, giving rpcs running a second to finish
+func shutdownMaster(master *Master) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	master.Shutdown(ctx)
+}
+
+// Make a word count worker of master, setup changes it before it starts
+// It is shut down once the test ends
+func startWorker(t *testing.T, master *Master, setup func(worker *Worker)) *Worker {
+	t.Helper()
+	worker := MakeWorker(0, master.Addr().String(), wcMap, wcReduce)
+	worker.Logger = quietLogger{}
+	if setup != nil {
+		setup(worker)
+	}
+	if err := worker.StartWorker(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shutdownWorker(worker) })
+	return worker
+}
+
+// Shut worker down, giving attempts running a second to finish
+func shutdownWorker(worker *Worker) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	worker.Shutdown(ctx)
+}
+
+// Wait for the job of master to end, failing the test after timeout
+// Return the error of the job
+func waitJob(t *testing.T, master *Master, timeout time.Duration) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := master.Wait(ctx)
+	if err == context.DeadlineExceeded {
+		t.Fatalf("job still running after %v", timeout)
+	}
+	return err
+}
+
+// Poll cond until it is true, failing the test with what after timeout
+func waitFor(t testing.TB, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %v waiting for %v", timeout, what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Return the pairs written to the reduce output files in dir
+func readOutput(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, ROP+"-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := map[string]string{}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if line == "" {
+				continue
+			}
+			fields := strings.SplitN(line, " ", 2)
+			if len(fields) != 2 {
+				t.Fatalf("bad output line %q in %v", line, file)
+			}
+			if _, ok := result[fields[0]]; ok {
+				t.Fatalf("key %q written twice", fields[0])
+			}
+			result[fields[0]] = fields[1]
+		}
+	}
+	return result
+}
+
+// Fail the test unless got and want hold the same pairs
+func checkCounts(t *testing.T, got, want map[string]string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v keys %v, want %v keys %v", len(got), sortedKeys(got), len(want), sortedKeys(want))
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Fatalf("count of %q is %q, want %q", key, got[key], value)
+		}
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Callbacks invoked on scheduling events
+
+package mapreduce
+
+import (
+	"runtime/debug"
+	"time"
+)
+
+// The max number of events waiting for their callbacks
+// Events beyond it are dropped so the scheduler never blocks
+const HOOK_QUEUE = 1024
+
+// An event of a task attempt
+type TaskEvent struct {
+	JobId     JobId
+	TaskId    TaskId
+	TaskType  TaskType
+	AttemptId AttemptId
+	WorkerId  int64
+	// The reply to the report (OK, WASTE or ABORTED) for OnTaskFinished
+	Result Err
+	// The reason the task is handed back for OnTaskRequeued
+	Reason string
+	Time   time.Time
+}
+
+// An event of a worker
+type WorkerEvent struct {
+	WorkerId int64
+	Host     string
+	Slots    int
+	Time     time.Time
+}
+
+// Optional callbacks of scheduling events, nil fields are skipped
+// Callbacks run one at a time on a dedicated goroutine outside the lock
+// They must not call back into Master synchronously
+// Because events queue up behind a callback that blocks
+type Hooks struct {
+	// A task attempt is assigned to a worker
+	OnTaskScheduled func(event TaskEvent)
+	// A worker reports a task attempt, accepted or not
+	OnTaskFinished func(event TaskEvent)
+	// A task is handed back to the scheduler to be retried
+	OnTaskRequeued func(event TaskEvent)
+	// A worker registers
+	OnWorkerRegistered func(event WorkerEvent)
+	// A worker is declared failed
+	OnWorkerFailed func(event WorkerEvent)
+}
+
+// Return true if any callback is set
+func (hooks *Hooks) any() bool {
+	return hooks.OnTaskScheduled != nil || hooks.OnTaskFinished != nil ||
+		hooks.OnTaskRequeued != nil || hooks.OnWorkerRegistered != nil ||
+		hooks.OnWorkerFailed != nil
+}
+
+// A queued callback and the name of its hook, e.g. "OnTaskFinished"
+type hookCall struct {
+	name     string
+	callback func()
+}
+
+// Start the goroutine running callbacks until Shutdown
+func (master *Master) startHooks() {
+	master.hookQueue = make(chan hookCall, HOOK_QUEUE)
+	master.hookStop = make(chan struct{})
+	go func() {
+		for {
+			select {
+			case call := <-master.hookQueue:
+				master.runHook(call)
+			case <-master.hookStop:
+				return
+			}
+		}
+	}()
+}
+
+// Run a callback, recovering from a panic in it
+// So a faulty hook loses its event rather than the callbacks after it
+func (master *Master) runHook(call hookCall) {
+	defer func() {
+		if r := recover(); r != nil {
+			master.config.Logger.Errorf("Hook %v panic: %v\n%s", call.name, r, debug.Stack())
+		}
+	}()
+	call.callback()
+}
+
+// Queue a callback of the named hook without blocking
+// Must be called with lock held
+func (master *Master) queueHook(name string, callback func()) {
+	if master.hookQueue == nil || master.closed {
+		return
+	}
+	select {
+	case master.hookQueue <- hookCall{name, callback}:
+	default:
+		master.config.Logger.Warnf("Hook queue full, %v event dropped", name)
+	}
+}
+
+// Queue a task event for the named callback if it is set
+// Must be called with lock held
+func (master *Master) taskHook(name string, callback func(event TaskEvent), event TaskEvent) {
+	if callback == nil {
+		return
+	}
+	event.Time = time.Now()
+	master.queueHook(name, func() { callback(event) })
+}
+
+// Queue a worker event for the named callback if it is set
+// Must be called with lock held
+func (master *Master) workerHook(name string, callback func(event WorkerEvent),
+	workerId int64) {
+	if callback == nil {
+		return
+	}
+	registry := master.workers[workerId]
+	event := WorkerEvent{
+		WorkerId: workerId,
+		Host:     registry.host,
+		Slots:    registry.slots,
+		Time:     time.Now(),
+	}
+	master.queueHook(name, func() { callback(event) })
+}
+
+// Return the event of a task attempt
+func (task runningTask) event(workerId int64) TaskEvent {
+	return TaskEvent{
+		JobId:     task.jobId,
+		TaskId:    task.taskId,
+		TaskType:  task.taskType,
+		AttemptId: task.attemptId,
+		WorkerId:  workerId,
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of the callbacks of scheduling events
+
+package mapreduce
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBlockedHookDoesNotStallDispatch(t *testing.T) {
+	blocked := make(chan struct{})
+	defer close(blocked)
+	hooks := Hooks{
+		OnTaskScheduled: func(event TaskEvent) { <-blocked },
+	}
+	master, cluster := startFakeCluster(t, writeInputs(t, "a", "b", "c", "d"), 2, WithHooks(hooks))
+	cluster.addWorker(t, 2)
+
+	if err := waitJob(t, master, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPanickingHookIsRecovered(t *testing.T) {
+	var mu sync.Mutex
+	finished := 0
+	hooks := Hooks{
+		OnTaskScheduled: func(event TaskEvent) { panic("bad hook") },
+		OnTaskFinished: func(event TaskEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			finished++
+		},
+	}
+	logger := &recordLogger{}
+	master, cluster := startFakeCluster(t, writeInputs(t, "a", "b"), 1,
+		WithHooks(hooks), WithLogger(logger))
+	cluster.addWorker(t, 1)
+
+	if err := waitJob(t, master, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// Two map tasks and a reduce task finish, after every scheduled hook panicked
+	waitFor(t, 5*time.Second, "the finished hooks", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return finished == 3
+	})
+	if !logger.contains("Hook OnTaskScheduled panic: bad hook") {
+		t.Fatal("panic of the hook not logged with its name")
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Planning the input files of a job from paths, glob patterns and directory walks
+
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A directory tree to take input files from, see JobSpec.Inputs
+// Patterns are those of path.Match, see matchInput
+// Hidden files and markers are left out unless IncludeHidden, see hiddenInput
+type InputSpec struct {
+	Root string
+	// Walk the directories under Root as well, otherwise only its own files
+	Recursive bool
+	// Take only the files matching one of them, every file if empty
+	Include []string
+	// Leave out the files and directories matching one of them, e.g. "tmp/" and "_*"
+	Exclude []string
+	// Leave out files smaller than MinSize or larger than MaxSize, 0 is no max
+	MinSize       int64
+	MaxSize       int64
+	IncludeHidden bool
+	// Optional hosts holding the files, see WithInputLocations
+	Locations []string `json:",omitempty"`
+}
+
+// The files found and left out walking the Inputs of a job
+// Files under a directory left out are never walked, so not counted
+type InputCounts struct {
+	Discovered int
+	Skipped    int
+}
+
+// The input files of a job in order, with the hosts holding each
+type inputList struct {
+	files     []string
+	locations [][]string
+	seen      map[string]bool
+	// True once a file has hosts
+	located bool
+}
+
+func newInputList() *inputList {
+	return &inputList{seen: make(map[string]bool)}
+}
+
+// Add file held by hosts, unless it is in the list already
+func (list *inputList) add(file string, hosts []string) {
+	if list.seen[file] {
+		return
+	}
+	list.seen[file] = true
+	list.files = append(list.files, file)
+	list.locations = append(list.locations, hosts)
+	list.located = list.located || len(hosts) > 0
+}
+
+// Return the hosts holding each file, nil if no file has any
+func (list *inputList) hosts() [][]string {
+	if !list.located {
+		return nil
+	}
+	return list.locations
+}
+
+// Return the input files of spec, those of InputFiles then those each of Inputs takes
+// A file named twice is kept where it first appears
+// With the hosts holding each, and the counts of walking Inputs
+func planInputs(spec JobSpec) ([]string, [][]string, InputCounts, error) {
+	list := newInputList()
+	if err := list.expand(spec.InputFiles, spec.InputLocations); err != nil {
+		return nil, nil, InputCounts{}, err
+	}
+	var counts InputCounts
+	if spec.InputCounts != nil {
+		counts = *spec.InputCounts
+	}
+	for _, input := range spec.Inputs {
+		files, walked, err := input.walk()
+		if err != nil {
+			return nil, nil, InputCounts{}, err
+		}
+		counts.Discovered += walked.Discovered
+		counts.Skipped += walked.Skipped
+		for _, file := range files {
+			list.add(file, input.Locations)
+		}
+	}
+	return list.files, list.hosts(), counts, nil
+}
+
+// Return true if path has the meta characters of filepath.Match
+func hasGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// Add the input files named by paths, in order
+// A directory is every regular file under it, walked with each directory sorted by name
+// Leaving out hidden files and markers, see hiddenInput
+// A glob pattern, e.g. "/data/2024-*/", is what its sorted matches expand to
+// Any other path is kept as is, it may only exist on the workers holding it
+// The locations of each path, if any, are those of the files it expands to
+// Return error if a pattern or directory expands to no file
+func (list *inputList) expand(paths []string, locations [][]string) error {
+	for idx, path := range paths {
+		expanded, err := expandInput(path)
+		if err != nil {
+			return err
+		}
+		var hosts []string
+		if idx < len(locations) {
+			hosts = locations[idx]
+		}
+		for _, file := range expanded {
+			list.add(file, hosts)
+		}
+	}
+	return nil
+}
+
+// Return the input files named by path, see expand
+func expandInput(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err == nil && info.IsDir() {
+		files, err := listFiles(path)
+		if err == nil && len(files) == 0 {
+			err = fmt.Errorf("directory %q holds no files", path)
+		}
+		return files, err
+	}
+	// A file found as named is never taken as a pattern, e.g. "data[1].txt"
+	if err == nil || !hasGlob(path) {
+		return []string{path}, nil
+	}
+
+	// Cleaned, since a trailing slash matches nothing, e.g. in "/data/2024-*/"
+	matches, err := filepath.Glob(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("bad pattern %q: %v", path, err)
+	}
+	var files []string
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			// E.g. a dangling symlink
+			continue
+		}
+		if !info.IsDir() {
+			if info.Mode().IsRegular() {
+				files = append(files, match)
+			}
+			continue
+		}
+		under, err := listFiles(match)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, under...)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("pattern %q matches no files", path)
+	}
+	return files, nil
+}
+
+// Return the regular files under dir but hidden ones, recursively, see walkFiles
+func listFiles(dir string) ([]string, error) {
+	files, _, err := InputSpec{Root: dir, Recursive: true}.walkFiles()
+	return files, err
+}
+
+// Return error if the input cannot be walked
+func (input InputSpec) validate() error {
+	if input.Root == "" {
+		return errors.New("input without root")
+	}
+	if input.MinSize < 0 || input.MaxSize < 0 {
+		return fmt.Errorf("input %v has a negative size limit", input.Root)
+	}
+	if input.MaxSize > 0 && input.MaxSize < input.MinSize {
+		return fmt.Errorf("input %v has max size %v below min size %v", input.Root,
+			input.MaxSize, input.MinSize)
+	}
+	for _, pattern := range input.Include {
+		if strings.HasSuffix(pattern, "/") {
+			return fmt.Errorf("input %v includes %q, which only matches directories",
+				input.Root, pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("input %v has bad pattern %q: %v", input.Root, pattern, err)
+		}
+	}
+	for _, pattern := range input.Exclude {
+		if _, err := path.Match(strings.TrimSuffix(pattern, "/"), ""); err != nil {
+			return fmt.Errorf("input %v has bad pattern %q: %v", input.Root, pattern, err)
+		}
+	}
+	return nil
+}
+
+// Return the files the input takes, see walkFiles, and the counts of the walk
+// Return error if the input is invalid, cannot be walked or takes no file
+func (input InputSpec) walk() ([]string, InputCounts, error) {
+	if err := input.validate(); err != nil {
+		return nil, InputCounts{}, err
+	}
+	files, counts, err := input.walkFiles()
+	if err == nil && len(files) == 0 {
+		err = fmt.Errorf("input %v takes none of %v files", input.Root, counts.Discovered)
+	}
+	return files, counts, err
+}
+
+// Return the files the input takes and the counts of the walk
+// Each directory is walked sorted by name, so the order never changes with the same tree
+// Symlinks to files are followed, symlinks to directories are not, so a cycle ends
+func (input InputSpec) walkFiles() ([]string, InputCounts, error) {
+	var files []string
+	var counts InputCounts
+	err := input.walkDir(input.Root, "", &files, &counts)
+	return files, counts, err
+}
+
+// Walk dir at rel, its slash path relative to Root
+func (input InputSpec) walkDir(dir, rel string, files *[]string, counts *InputCounts) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("cannot list %q: %v", dir, err)
+	}
+	for _, info := range infos {
+		full := filepath.Join(dir, info.Name())
+		entry := path.Join(rel, info.Name())
+		if info.Mode()&os.ModeSymlink != 0 {
+			// A dangling symlink is no file
+			if info, err = os.Stat(full); err != nil || info.IsDir() {
+				continue
+			}
+		}
+		if info.IsDir() {
+			if input.Recursive && !input.excluded(entry, true) {
+				if err := input.walkDir(full, entry, files, counts); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		counts.Discovered++
+		if input.excluded(entry, false) || !input.included(entry) || !input.sized(info.Size()) {
+			counts.Skipped++
+			continue
+		}
+		*files = append(*files, full)
+	}
+	return nil
+}
+
+// Return true if the name is of a hidden file or a marker, e.g. ".git", "_SUCCESS" or "part-0.crc"
+func hiddenInput(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") ||
+		strings.HasSuffix(name, ".crc")
+}
+
+// Return true if pattern matches the entry at rel, a slash path relative to Root
+// A pattern ending with a slash only matches directories
+// One with another slash matches rel, one without matches the name at any depth
+func matchInput(pattern, rel string, dir bool) bool {
+	if strings.HasSuffix(pattern, "/") {
+		if !dir {
+			return false
+		}
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	target := rel
+	if !strings.Contains(pattern, "/") {
+		target = path.Base(rel)
+	}
+	ok, _ := path.Match(pattern, target)
+	return ok
+}
+
+// Return true if the entry at rel is left out, hidden or matching one of Exclude
+func (input InputSpec) excluded(rel string, dir bool) bool {
+	if !input.IncludeHidden && hiddenInput(path.Base(rel)) {
+		return true
+	}
+	for _, pattern := range input.Exclude {
+		if matchInput(pattern, rel, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if the file at rel matches one of Include, or Include is empty
+func (input InputSpec) included(rel string) bool {
+	for _, pattern := range input.Include {
+		if matchInput(pattern, rel, false) {
+			return true
+		}
+	}
+	return len(input.Include) == 0
+}
+
+// Return true if a file of size is within MinSize and MaxSize
+func (input InputSpec) sized(size int64) bool {
+	return size >= input.MinSize && (input.MaxSize == 0 || size <= input.MaxSize)
+}
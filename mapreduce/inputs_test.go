@@ -0,0 +1,384 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of planning input files from paths, patterns and directory walks
+
+package mapreduce
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Return the paths of files relative to dir, with slashes
+func relPaths(t *testing.T, dir string, files []string) []string {
+	t.Helper()
+	var result []string
+	for _, file := range files {
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, filepath.ToSlash(rel))
+	}
+	return result
+}
+
+// Plan the inputs of a job of paths, failing the test on error
+func planPaths(t *testing.T, paths ...string) []string {
+	t.Helper()
+	files, _, _, err := planInputs(JobSpec{InputFiles: paths})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestDirectoryExpandsToNestedFilesInOrder(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"z.txt", "sub/deeper/c.txt", "a.txt", "sub/b.txt"} {
+		writeFile(t, dir, name, name)
+	}
+
+	// Twice, so the order is the same with the same tree
+	for i := 0; i < 2; i++ {
+		got := relPaths(t, dir, planPaths(t, dir))
+		want := []string{"a.txt", "sub/b.txt", "sub/deeper/c.txt", "z.txt"}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expanded %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPatternExpandsMatchedDirectories(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"2024-02/b.log", "2023-12/old.log", "2024-01/a.log",
+		"2024-01/nested/c.log", "2024-notes.txt"} {
+		writeFile(t, dir, name, name)
+	}
+
+	got := relPaths(t, dir, planPaths(t, filepath.Join(dir, "2024-*")+"/"))
+	want := []string{"2024-01/a.log", "2024-01/nested/c.log", "2024-02/b.log", "2024-notes.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expanded %v, want %v", got, want)
+	}
+}
+
+func TestSymlinkedFilesFollowedAndDirectoriesNot(t *testing.T) {
+	outside := t.TempDir()
+	real := writeFile(t, outside, "real.txt", "real")
+	writeFile(t, outside, "tree/hidden-by-link.txt", "not walked")
+	dir := t.TempDir()
+	writeFile(t, dir, "a.txt", "a")
+	if err := os.Symlink(real, filepath.Join(dir, "b-link.txt")); err != nil {
+		t.Skipf("cannot symlink: %v", err)
+	}
+	os.Symlink(filepath.Join(outside, "tree"), filepath.Join(dir, "c-dir"))
+	// A loop would never end if directory links were followed
+	os.Symlink(dir, filepath.Join(dir, "d-loop"))
+	os.Symlink(filepath.Join(outside, "gone.txt"), filepath.Join(dir, "e-dangling.txt"))
+
+	got := relPaths(t, dir, planPaths(t, dir))
+	want := []string{"a.txt", "b-link.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expanded %v, want %v", got, want)
+	}
+	// The link reads as the file it points to
+	content, err := ioutil.ReadFile(filepath.Join(dir, "b-link.txt"))
+	if err != nil || string(content) != "real" {
+		t.Fatalf("read link: %q, %v", content, err)
+	}
+}
+
+func TestPathsExpandingToNoFileRefused(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty")
+	if err := os.Mkdir(empty, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "data/a.txt", "a")
+
+	for _, path := range []string{
+		filepath.Join(dir, "*.csv"),
+		filepath.Join(dir, "data", "2024-*", "*"),
+		empty,
+		filepath.Join(dir, "[bad"),
+	} {
+		_, _, _, err := planInputs(JobSpec{InputFiles: []string{path}})
+		if err == nil || !strings.Contains(err.Error(), path) {
+			t.Errorf("planning %q: %v, want an error naming it", path, err)
+		}
+	}
+	// MakeMaster fails as well, rather than making a job of no map task
+	if _, err := MakeMaster([]string{filepath.Join(dir, "*.csv")}, 1, 0,
+		testOptions(t)...); err == nil {
+		t.Fatal("MakeMaster accepted a pattern matching no files")
+	}
+}
+
+func TestPlainPathsKeptAndDuplicatesDropped(t *testing.T) {
+	dir := t.TempDir()
+	a := writeFile(t, dir, "a.txt", "a")
+	b := writeFile(t, dir, "b.txt", "b")
+	// Not found on master, it may be found on the workers holding it
+	remote := filepath.Join(dir, "on-workers-only.txt")
+
+	got := planPaths(t, b, remote, dir, a)
+	want := []string{b, remote, a}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expanded %v, want %v", got, want)
+	}
+}
+
+func TestExpandedFilesKeepLocationsOfTheirEntry(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "tree/a.txt", "a")
+	writeFile(t, dir, "tree/b.txt", "b")
+	single := writeFile(t, dir, "single.txt", "c")
+
+	files, locations, _, err := planInputs(JobSpec{
+		InputFiles:     []string{filepath.Join(dir, "tree"), single},
+		InputLocations: [][]string{{"host-1"}, {"host-2"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("expanded %v, want 3 files", files)
+	}
+	want := [][]string{{"host-1"}, {"host-1"}, {"host-2"}}
+	if !reflect.DeepEqual(locations, want) {
+		t.Fatalf("locations %v, want %v", locations, want)
+	}
+}
+
+func TestSubmitPlansInputsWithoutTheLock(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a/x.txt", "x")
+	writeFile(t, dir, "b/y.txt", "y")
+	side := writeFile(t, t.TempDir(), "dict.txt", "side")
+	master := makeMaster(t, writeInputs(t, "a"), 1)
+
+	// Planned and hashed while another rpc holds the lock
+	master.mu.Lock()
+	plan, err := master.planJob(JobSpec{InputFiles: []string{dir}, NReduce: 1,
+		CacheFiles: []string{side}})
+	master.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.splits) != 2 {
+		t.Fatalf("planned %v splits, want 2", len(plan.splits))
+	}
+	if len(plan.cacheFiles) != 1 || plan.cacheFiles[0].Sha256 == "" {
+		t.Fatalf("planned side files %+v, want dict.txt hashed", plan.cacheFiles)
+	}
+
+	id, err := master.Submit(JobSpec{InputFiles: []string{dir}, NReduce: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	if nMap := master.jobs[id].nMap; nMap != 2 {
+		t.Fatalf("job of a directory of 2 files has %v map tasks, want 2", nMap)
+	}
+}
+
+func TestMatchInput(t *testing.T) {
+	for _, test := range []struct {
+		pattern, rel string
+		dir          bool
+		want         bool
+	}{
+		// A pattern without a slash matches the name at any depth
+		{"*.log", "a.log", false, true},
+		{"*.log", "x/y/a.log", false, true},
+		{"*.log", "a.txt", false, false},
+		{"tmp", "x/tmp", true, true},
+		// One with a slash matches the whole relative path
+		{"x/*.log", "x/a.log", false, true},
+		{"x/*.log", "y/x/a.log", false, false},
+		{"*/a.log", "x/y/a.log", false, false},
+		// One ending with a slash only matches directories
+		{"tmp/", "tmp", true, true},
+		{"tmp/", "x/tmp", true, true},
+		{"tmp/", "tmp", false, false},
+		{"x/tmp/", "x/tmp", true, true},
+		{"x/tmp/", "y/tmp", true, false},
+		// A bad pattern matches nothing
+		{"[", "[", false, false},
+	} {
+		if got := matchInput(test.pattern, test.rel, test.dir); got != test.want {
+			t.Errorf("matchInput(%q, %q, %v) = %v, want %v", test.pattern, test.rel,
+				test.dir, got, test.want)
+		}
+	}
+}
+
+func TestInputExcluded(t *testing.T) {
+	for _, test := range []struct {
+		input InputSpec
+		rel   string
+		dir   bool
+		want  bool
+	}{
+		{InputSpec{}, "a.txt", false, false},
+		// Hidden files and markers are left out by default
+		{InputSpec{}, ".git", true, true},
+		{InputSpec{}, "x/.hidden.txt", false, true},
+		{InputSpec{}, "_SUCCESS", false, true},
+		{InputSpec{}, "x/_temporary", true, true},
+		{InputSpec{}, "part-0.crc", false, true},
+		{InputSpec{}, "x.crc/a.txt", false, false},
+		// And taken with IncludeHidden
+		{InputSpec{IncludeHidden: true}, "_SUCCESS", false, false},
+		{InputSpec{IncludeHidden: true}, ".git", true, false},
+		{InputSpec{Exclude: []string{"_*"}, IncludeHidden: true}, "_SUCCESS", false, true},
+		// Exclude patterns
+		{InputSpec{Exclude: []string{"*.tmp"}}, "x/a.tmp", false, true},
+		{InputSpec{Exclude: []string{"*.tmp"}}, "x/a.txt", false, false},
+		{InputSpec{Exclude: []string{"tmp/"}}, "tmp", true, true},
+		{InputSpec{Exclude: []string{"tmp/"}}, "tmp", false, false},
+		{InputSpec{Exclude: []string{"a/b"}}, "a/b", true, true},
+		{InputSpec{Exclude: []string{"a/b"}}, "c/a/b", true, false},
+	} {
+		if got := test.input.excluded(test.rel, test.dir); got != test.want {
+			t.Errorf("%+v excluded(%q, %v) = %v, want %v", test.input, test.rel, test.dir,
+				got, test.want)
+		}
+	}
+}
+
+func TestInputIncludedAndSized(t *testing.T) {
+	input := InputSpec{Include: []string{"*.log", "raw/*"}, MinSize: 2, MaxSize: 4}
+	for rel, want := range map[string]bool{
+		"a.log": true, "x/y/a.log": true, "raw/a.bin": true, "x/raw/a.bin": false, "a.txt": false,
+	} {
+		if got := input.included(rel); got != want {
+			t.Errorf("included(%q) = %v, want %v", rel, got, want)
+		}
+	}
+	if !(InputSpec{}).included("anything") {
+		t.Error("empty Include left out a file")
+	}
+	for size, want := range map[int64]bool{1: false, 2: true, 4: true, 5: false} {
+		if got := input.sized(size); got != want {
+			t.Errorf("sized(%v) = %v, want %v", size, got, want)
+		}
+	}
+	if !(InputSpec{MinSize: 1}).sized(1 << 40) {
+		t.Error("MaxSize 0 left out a large file")
+	}
+}
+
+// Write the tree walked by the input walk tests
+func writeInputTree(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"a.log":             "aaa",
+		"b.txt":             "bbb",
+		"empty.log":         "",
+		"large.log":         "0123456789",
+		".hidden.log":       "hhh",
+		"_SUCCESS":          "",
+		"part-0.crc":        "ccc",
+		"sub/c.log":         "ccc",
+		"sub/tmp/d.log":     "ddd",
+		"sub/deep/e.log":    "eee",
+		"tmp/f.log":         "fff",
+		".git/g.log":        "ggg",
+		"_temporary/h.log":  "hhh",
+		"sub/deep/skip.tmp": "iii",
+	} {
+		writeFile(t, dir, name, content)
+	}
+	return dir
+}
+
+func TestInputWalk(t *testing.T) {
+	dir := writeInputTree(t)
+	for _, test := range []struct {
+		name   string
+		input  InputSpec
+		want   []string
+		counts InputCounts
+	}{
+		{"top level only", InputSpec{},
+			[]string{"a.log", "b.txt", "empty.log", "large.log"}, InputCounts{7, 3}},
+		{"recursive", InputSpec{Recursive: true},
+			[]string{"a.log", "b.txt", "empty.log", "large.log", "sub/c.log",
+				"sub/deep/e.log", "sub/deep/skip.tmp", "sub/tmp/d.log", "tmp/f.log"},
+			InputCounts{12, 3}},
+		{"include and exclude", InputSpec{Recursive: true, Include: []string{"*.log"},
+			Exclude: []string{"sub/deep"}},
+			[]string{"a.log", "empty.log", "large.log", "sub/c.log", "sub/tmp/d.log",
+				"tmp/f.log"},
+			InputCounts{10, 4}},
+		// Directories pruned are never walked, so not counted
+		{"prune", InputSpec{Recursive: true, Exclude: []string{"tmp/", "*.tmp"}},
+			[]string{"a.log", "b.txt", "empty.log", "large.log", "sub/c.log",
+				"sub/deep/e.log"},
+			InputCounts{10, 4}},
+		{"sizes", InputSpec{Recursive: true, Include: []string{"*.log"}, MinSize: 1,
+			MaxSize: 3},
+			[]string{"a.log", "sub/c.log", "sub/deep/e.log", "sub/tmp/d.log", "tmp/f.log"},
+			InputCounts{12, 7}},
+		{"hidden", InputSpec{IncludeHidden: true, Include: []string{"*.log"}},
+			[]string{".hidden.log", "a.log", "empty.log", "large.log"}, InputCounts{7, 3}},
+	} {
+		test.input.Root = dir
+		files, counts, err := test.input.walk()
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if got := relPaths(t, dir, files); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: took %v, want %v", test.name, got, test.want)
+		}
+		if counts != test.counts {
+			t.Errorf("%v: counts %+v, want %+v", test.name, counts, test.counts)
+		}
+	}
+}
+
+func TestInputTakingNoFileRefused(t *testing.T) {
+	dir := writeInputTree(t)
+	for _, input := range []InputSpec{
+		{Root: dir, Include: []string{"*.csv"}},
+		{Root: dir, MinSize: 100},
+		{Root: filepath.Join(dir, "missing")},
+		{Root: dir, Include: []string{"logs/"}},
+		{Root: dir, MinSize: 4, MaxSize: 3},
+		{Root: dir, Exclude: []string{"["}},
+	} {
+		if _, _, err := input.walk(); err == nil {
+			t.Errorf("%+v walked, want an error", input)
+		}
+	}
+}
+
+func TestReportCountsWalkedInputs(t *testing.T) {
+	dir := writeInputTree(t)
+	master := makeMaster(t, writeInputs(t, "a"), 1)
+	id, err := master.Submit(JobSpec{NReduce: 1, Inputs: []InputSpec{
+		{Root: dir, Recursive: true, Include: []string{"*.log"}, Exclude: []string{"tmp/"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, job := range master.Report().Jobs {
+		if job.JobId != id {
+			continue
+		}
+		if want := (InputCounts{Discovered: 10, Skipped: 5}); job.Inputs != want {
+			t.Fatalf("reported inputs %+v, want %+v", job.Inputs, want)
+		}
+		return
+	}
+	t.Fatalf("no report of job %v", id)
+}
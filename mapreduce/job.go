@@ -0,0 +1,469 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Jobs submitted to master and the state kept for each of them
+
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Job id
+type JobId int
+
+// The id of the job created by MakeMaster
+const DEFAULT_JOB JobId = 0
+
+// The return type of rpc for a job never submitted
+const BAD_JOB_ID = "BAD_JOB_ID"
+
+// Returned for a job id that was never submitted
+var ErrUnknownJob = errors.New("mapreduce: unknown job")
+
+// Wrapped by the *JobFailure of a job that ran past its deadline
+var ErrDeadlineExceeded = errors.New("mapreduce: job deadline exceeded")
+
+// The description of a job submitted to master
+type JobSpec struct {
+	// Files, directories or glob patterns, see inputList.expand
+	InputFiles []string
+	// Optional trees to walk for more input files, taken after InputFiles
+	Inputs []InputSpec `json:",omitempty"`
+	// Set once master walks Inputs, so a recovered master reports them without walking again
+	InputCounts *InputCounts `json:",omitempty"`
+	// The number of reduce tasks, 0 for a map-only job
+	NReduce int
+	// The directory reduce tasks write output to
+	// Default to the OutputDir of master
+	// Jobs sharing an output directory overwrite the output of each other
+	OutputDir string
+	// Optional hosts holding each input file, see WithInputLocations
+	InputLocations [][]string
+	// Optional byte ranges of InputFiles, each read by one map task
+	// Default to PlanSplits of InputFiles by the SplitSize of master
+	Splits []InputSplit `json:",omitempty"`
+	// The job fails with ErrDeadlineExceeded if it has not finished by then
+	// Default to the JobDeadline of master, zero means no deadline
+	Deadline time.Time
+	// Optional policy skipping the input records map panics on
+	// Default to the SkipBadRecords of master, nil fails the task at once
+	SkipBadRecords *SkipPolicy `json:",omitempty"`
+	// Optional side files every attempt reads, e.g. a lookup table
+	// Workers fetch each from master once and keep it in their cache
+	// User functions find the local copies in TaskInfo.CacheFiles
+	CacheFiles []string `json:",omitempty"`
+	// Optional compression of the partitions reducers fetch and of side files
+	// Default to the Compression of master, nil compresses nothing
+	Compression *CompressionPolicy `json:",omitempty"`
+	// The secret of master a remote client presents to SubmitJob, see WithSecret
+	// Cleared before the job is planned, so it is never logged
+	Secret string `json:",omitempty"`
+}
+
+type SubmitJobReply struct {
+	JobId JobId
+	Err   Err
+	// The backoff master suggests with RETRY_LATER
+	RetryAfter time.Duration
+}
+
+// The state of a single job
+type jobState struct {
+	// The id of the job, and the master running it
+	id     JobId
+	master *Master
+
+	// The number of map tasks, one per split
+	nMap int
+	// The number of reduce tasks
+	nReduce int
+	// A list of input files
+	inputFiles []string
+	// The files found and left out walking the inputs of the job
+	inputCounts InputCounts
+	// The byte range of input each map task reads
+	splits []InputSplit
+	// The directory reduce tasks write output to
+	outputDir string
+	// The hosts holding the input of each map task
+	inputLocations [][]string
+	// The time the job must finish by, zero if there is none
+	deadline time.Time
+	// The policy of map tasks skipping bad records, nil if there is none
+	skipPolicy *SkipPolicy
+	// The side files of the job, hashed when it is submitted
+	cacheFiles []CacheFile
+	// The compression of payloads sent for the job, nil if there is none
+	compression *CompressionPolicy
+
+	// Mark the map task that is finished
+	mapStatus        []int
+	mapFinishedCount int
+	// Mark the reduce task that is finished
+	reduceStatus        []int
+	reduceFinishedCount int
+	// The number of tasks of each phase skipped after failing
+	mapSkippedCount    int
+	reduceSkippedCount int
+
+	// The bookkeeping data of map and reduce tasks
+	mapMeta    []taskMeta
+	reduceMeta []taskMeta
+
+	// The unprocessed tasks of each phase in dispatch order
+	// Requeued tasks are put to the front so they are assigned next
+	mapQueue    []TaskId
+	reduceQueue []TaskId
+
+	// The intermediate bytes of each reduce partition
+	// Reported by finished map tasks
+	partitionBytes []int64
+
+	// The time the scheduler starts running the job
+	startTime time.Time
+
+	// Set once a task runs out of attempts and the job fails
+	failure *JobFailure
+	// Set once the job alone is aborted, see AbortJob
+	aborted bool
+	// True while assigning tasks of the job is paused, see PauseJob
+	paused bool
+}
+
+// A job spec resolved against the files it names, ready to be added to master
+type jobPlan struct {
+	spec           JobSpec
+	cacheFiles     []CacheFile
+	inputFiles     []string
+	inputLocations [][]string
+	inputCounts    InputCounts
+	splits         []InputSplit
+}
+
+// Check spec, hash its side files, and expand, walk and split its inputs
+// Touches the file system only, so it runs without the lock
+// Which is never held while walking a large tree or hashing a large file
+// Return error if spec is invalid or its files cannot be read
+func (master *Master) planJob(spec JobSpec) (*jobPlan, error) {
+	if spec.NReduce < 0 {
+		return nil, fmt.Errorf("Submit: invalid number of reduce tasks %v", spec.NReduce)
+	}
+	if spec.SkipBadRecords != nil {
+		if err := spec.SkipBadRecords.validate(); err != nil {
+			return nil, fmt.Errorf("Submit: %v", err)
+		}
+	}
+	if spec.Compression != nil {
+		if err := spec.Compression.validate(); err != nil {
+			return nil, fmt.Errorf("Submit: %v", err)
+		}
+	}
+	cacheFiles, err := readCacheFiles(spec.CacheFiles)
+	if err != nil {
+		return nil, fmt.Errorf("Submit: %v", err)
+	}
+	inputFiles, inputLocations, inputCounts, err := planInputs(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Submit: %v", err)
+	}
+	splits := spec.Splits
+	if splits == nil {
+		splits = PlanSplits(inputFiles, master.config.SplitSize)
+	}
+	for _, split := range splits {
+		if err := split.validate(); err != nil {
+			return nil, fmt.Errorf("Submit: %v", err)
+		}
+	}
+	return &jobPlan{
+		spec:           spec,
+		cacheFiles:     cacheFiles,
+		inputFiles:     inputFiles,
+		inputLocations: inputLocations,
+		inputCounts:    inputCounts,
+		splits:         splits,
+	}, nil
+}
+
+// Add the job planned by planJob to master and log it
+// The job is scheduled at once if master is running, otherwise by RunMaster
+// Must be called with lock held
+func (master *Master) submit(plan *jobPlan) JobId {
+	spec := plan.spec
+	job := &jobState{
+		id:             master.nextJobId,
+		master:         master,
+		nMap:           len(plan.splits),
+		nReduce:        spec.NReduce,
+		inputFiles:     plan.inputFiles,
+		inputCounts:    plan.inputCounts,
+		splits:         plan.splits,
+		outputDir:      spec.OutputDir,
+		inputLocations: splitLocations(plan.inputFiles, plan.inputLocations, plan.splits),
+		deadline:       spec.Deadline,
+		skipPolicy:     spec.SkipBadRecords,
+		cacheFiles:     plan.cacheFiles,
+		compression:    spec.Compression,
+	}
+	if job.outputDir == "" {
+		job.outputDir = master.config.OutputDir
+	}
+	if job.deadline.IsZero() {
+		job.deadline = master.config.JobDeadline
+	}
+	if job.skipPolicy == nil {
+		job.skipPolicy = master.config.SkipBadRecords
+	}
+	if job.compression == nil {
+		job.compression = master.config.Compression
+	}
+
+	// Init task status
+	job.mapStatus = make([]int, job.nMap)
+	job.reduceStatus = make([]int, job.nReduce)
+	job.mapMeta = make([]taskMeta, job.nMap)
+	job.reduceMeta = make([]taskMeta, job.nReduce)
+	job.partitionBytes = make([]int64, job.nReduce)
+	for i := 0; i < job.nMap; i++ {
+		job.mapQueue = append(job.mapQueue, TaskId(i))
+	}
+	for i := 0; i < job.nReduce; i++ {
+		job.reduceQueue = append(job.reduceQueue, TaskId(i))
+	}
+
+	master.jobs[job.id] = job
+	master.nextJobId++
+
+	resolved := spec
+	resolved.InputFiles = plan.inputFiles
+	resolved.InputLocations = plan.inputLocations
+	// InputFiles holds what the walk took
+	resolved.Inputs = nil
+	if plan.inputCounts != (InputCounts{}) {
+		resolved.InputCounts = &plan.inputCounts
+	}
+	resolved.OutputDir = job.outputDir
+	resolved.Deadline = job.deadline
+	resolved.SkipBadRecords = job.skipPolicy
+	resolved.Compression = job.compression
+	// Logged as planned, so recovery keeps the tasks if the files change
+	resolved.Splits = job.splits
+	master.logRecord(walRecord{Kind: WAL_SUBMIT, Spec: &resolved})
+
+	if master.config.ResumeDir != "" {
+		job.resume(master.config.ResumeDir)
+	}
+
+	if master.running {
+		master.startJob(job)
+	}
+	return job.id
+}
+
+// Start scheduling the job
+// Must be called with lock held
+func (master *Master) startJob(job *jobState) {
+	job.startTime = time.Now()
+	master.goLoop(func() { schedule(master, job) })
+	if !job.deadline.IsZero() {
+		master.goLoop(func() { master.watchDeadline(job) })
+	}
+	if !master.config.KeepIntermediate {
+		master.goLoop(func() { master.cleanupWhenDone(job) })
+	}
+}
+
+// Fail the job once its deadline passes before it is done
+// The same way as Abort, but only for the tasks of this job
+func (master *Master) watchDeadline(job *jobState) {
+	master.mu.Lock()
+	for !job.done() {
+		remaining := time.Until(job.deadline)
+		if remaining <= 0 {
+			master.expireJob(job)
+			return
+		}
+
+		changed := master.changed
+		master.mu.Unlock()
+		timer := time.NewTimer(remaining)
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+		master.mu.Lock()
+	}
+	master.mu.Unlock()
+}
+
+// Mark the job failed with ErrDeadlineExceeded and kill its running tasks
+// Must be called with lock held, the lock is released before the kills
+func (master *Master) expireJob(job *jobState) {
+	progress := master.progress([]*jobState{job}, job.startTime)
+	master.config.Logger.Errorf("Job %v: deadline exceeded at %.1f%%, stop it",
+		job.id, progress.Percentage)
+	job.failure = &JobFailure{
+		JobId:            job.id,
+		TaskId:           -1,
+		Err:              "deadline exceeded",
+		DeadlineExceeded: true,
+	}
+	master.signalChange()
+
+	kills := master.releaseTasks(func(task runningTask) bool {
+		return task.jobId == job.id
+	})
+	master.mu.Unlock()
+	master.killTasks(kills)
+}
+
+// Submit a job to a running or not yet running master
+// Its inputs are planned before the lock is taken, see planJob
+// Return the id of the job
+func (master *Master) Submit(spec JobSpec) (JobId, error) {
+	plan, err := master.planJob(spec)
+	if err != nil {
+		return -1, err
+	}
+
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	if master.closed {
+		return -1, ErrMasterClosed
+	}
+	return master.submit(plan), nil
+}
+
+// rpc that lets a remote client submit a job, see Submit
+// Reply AUTH to a wrong secret
+func (master *Master) SubmitJob(args *JobSpec, reply *SubmitJobReply) error {
+	if !master.admit("Master.SubmitJob", reply) {
+		return nil
+	}
+	defer master.release()
+	if err := master.enter(); err != nil {
+		return err
+	}
+	defer master.inflight.Done()
+
+	if !master.checkSecret(args.Secret) {
+		reply.Err = AUTH
+		return nil
+	}
+	spec := *args
+	spec.Secret = ""
+	id, err := master.Submit(spec)
+	if err != nil {
+		return err
+	}
+	reply.JobId = id
+	reply.Err = OK
+	return nil
+}
+
+// Return the ids of submitted jobs in submission order
+func (master *Master) Jobs() []JobId {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	var result []JobId
+	for id := JobId(0); id < master.nextJobId; id++ {
+		result = append(result, id)
+	}
+	return result
+}
+
+// Return the job of id, or nil if it was never submitted
+// Must be called with lock held
+func (master *Master) getJob(id JobId) *jobState {
+	return master.jobs[id]
+}
+
+// Return true if the job stops before finishing
+// Because it has failed or been aborted, or master has been shut down, aborted or fenced
+// Must be called with lock held
+func (job *jobState) halted() bool {
+	return job.failure != nil || job.aborted || job.master.halted()
+}
+
+// Return true if the job has finished or halted
+// Must be called with lock held
+func (job *jobState) done() bool {
+	return job.halted() ||
+		(job.phaseFinished(MAP) && job.phaseFinished(REDUCE))
+}
+
+// Return the error Wait reports for a job that has stopped
+// Return nil if the job has finished, or errJobRunning if it is still running
+// Must be called with lock held
+func (job *jobState) result() error {
+	if job.failure != nil {
+		failure := *job.failure
+		return &failure
+	}
+	if job.aborted || job.master.aborted {
+		return ErrJobAborted
+	}
+	if job.master.fenced {
+		return ErrMasterFenced
+	}
+	if job.master.closed {
+		return ErrMasterClosed
+	}
+	if job.phaseFinished(MAP) && job.phaseFinished(REDUCE) {
+		return nil
+	}
+	return errJobRunning
+}
+
+// Internal marker of a job that is neither finished nor halted
+var errJobRunning = errors.New("mapreduce: job running")
+
+// Block until the job has finished and return nil
+// Return the same errors as Wait, or ErrUnknownJob
+func (master *Master) WaitJob(ctx context.Context, id JobId) error {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	job := master.getJob(id)
+	if job == nil {
+		return ErrUnknownJob
+	}
+	return master.waitResult(ctx, job.result)
+}
+
+// Block until result returns anything but errJobRunning
+// Or ctx is done
+// Must be called with lock held, the lock is released while waiting
+func (master *Master) waitResult(ctx context.Context, result func() error) error {
+	for {
+		if err := result(); err != errJobRunning {
+			return err
+		}
+
+		// Woken by the same signal as the scheduler
+		changed := master.changed
+		master.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			master.mu.Lock()
+			return ctx.Err()
+		}
+		master.mu.Lock()
+	}
+}
+
+// Return true if the job has finished, failed or been aborted
+// Return false if the job was never submitted
+func (master *Master) JobDone(id JobId) bool {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	job := master.getJob(id)
+	return job != nil && job.done()
+}
@@ -0,0 +1,313 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// The state of a job served to clients of a remote master
+
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The schema version of JobStatus
+// Fields are only ever added, older clients ignore the ones they do not know
+// The version is bumped if the meaning of a field changes
+const JOB_STATUS_VERSION = 1
+
+// The phases of a job
+const (
+	PHASE_MAP     = "MAP"
+	PHASE_REDUCE  = "REDUCE"
+	PHASE_DONE    = "DONE"
+	PHASE_FAILED  = "FAILED"
+	PHASE_ABORTED = "ABORTED"
+	// Master has been shut down or fenced before the job finished
+	PHASE_STOPPED = "STOPPED"
+)
+
+type JobStatusSend struct {
+	JobId JobId
+	// The secret of master, see WithSecret
+	Secret string
+}
+
+// The state of a job, replied by Master.GetJobStatus
+type JobStatus struct {
+	// JOB_STATUS_VERSION of the master replying
+	Version int
+	JobId   JobId
+	// One of the PHASE constants
+	Phase string
+	// The tasks of the job, with the workers of master
+	Progress Progress
+	// Done is true once the job has finished, failed or been aborted
+	Done    bool
+	Failed  bool
+	Aborted bool
+	// The task that failed the job, nil unless Failed
+	Failure *JobFailure
+	// The input records skipped by finished map tasks, see SkipPolicy
+	SkippedRecords int
+	// The records and bytes of the finished tasks of each phase
+	Counters JobCounters
+	Err      Err
+	// The backoff master suggests with RETRY_LATER
+	RetryAfter time.Duration
+}
+
+// Return the state of the job
+// Must be called with lock held
+func (job *jobState) status() JobStatus {
+	status := JobStatus{
+		Version:        JOB_STATUS_VERSION,
+		JobId:          job.id,
+		Progress:       job.master.progress([]*jobState{job}, job.startTime),
+		Done:           job.done(),
+		Failed:         job.failure != nil,
+		Aborted:        job.aborted || job.master.aborted,
+		SkippedRecords: job.skippedRecords(),
+		Counters:       job.counters(),
+		Err:            OK,
+	}
+
+	switch err := job.result(); {
+	case job.failure != nil:
+		failure := *job.failure
+		status.Failure = &failure
+		status.Phase = PHASE_FAILED
+	case err == ErrJobAborted:
+		status.Phase = PHASE_ABORTED
+	case err == nil:
+		status.Phase = PHASE_DONE
+	case err != errJobRunning:
+		status.Phase = PHASE_STOPPED
+	case job.phaseFinished(MAP):
+		status.Phase = PHASE_REDUCE
+	default:
+		status.Phase = PHASE_MAP
+	}
+	return status
+}
+
+// rpc that lets a remote client query the state of a job
+// Reply BAD_JOB_ID if the job was never submitted, and AUTH to a wrong secret
+func (master *Master) GetJobStatus(args *JobStatusSend, reply *JobStatus) error {
+	if !master.admit("Master.GetJobStatus", reply) {
+		return nil
+	}
+	defer master.release()
+	if err := master.enter(); err != nil {
+		return err
+	}
+	defer master.inflight.Done()
+
+	if !master.checkSecret(args.Secret) {
+		reply.Version = JOB_STATUS_VERSION
+		reply.JobId = args.JobId
+		reply.Err = AUTH
+		return nil
+	}
+
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	job := master.getJob(args.JobId)
+	if job == nil {
+		reply.Version = JOB_STATUS_VERSION
+		reply.JobId = args.JobId
+		reply.Err = BAD_JOB_ID
+		return nil
+	}
+	*reply = job.status()
+	return nil
+}
+
+// Ask the master at masterAddr for the state of a job
+// Asked again after the backoff master suggests while it replies RETRY_LATER
+// Return ErrUnknownJob if the job was never submitted
+// And ErrOverloaded once it was turned away RETRY_LATER_TRIES times
+func GetJobStatus(masterAddr string, id JobId) (JobStatus, error) {
+	return GetJobStatusWithSecret(masterAddr, id, "")
+}
+
+// Ask for the state of a job like GetJobStatus, presenting the secret of master
+// Return an error wrapping ErrAuth if master refuses the secret
+func GetJobStatusWithSecret(masterAddr string, id JobId, secret string) (JobStatus, error) {
+	var reply JobStatus
+	for try := 0; ; try++ {
+		reply = JobStatus{}
+		ctx, cancel := context.WithTimeout(context.Background(), CALL_TIMEOUT)
+		err := Call(ctx, masterAddr, "Master.GetJobStatus",
+			&JobStatusSend{JobId: id, Secret: secret}, &reply)
+		cancel()
+		if err != nil {
+			return JobStatus{}, fmt.Errorf("GetJobStatus: %w", err)
+		}
+		wait, throttled := reply.backoff()
+		if !throttled {
+			break
+		}
+		if try+1 >= RETRY_LATER_TRIES {
+			return reply, fmt.Errorf("GetJobStatus: %w", ErrOverloaded)
+		}
+		time.Sleep(wait)
+	}
+	if reply.Err == BAD_JOB_ID {
+		return reply, ErrUnknownJob
+	}
+	if reply.Err == AUTH {
+		return reply, fmt.Errorf("GetJobStatus: %w", ErrAuth)
+	}
+	if reply.Err != OK {
+		return reply, errors.New("GetJobStatus: " + string(reply.Err))
+	}
+	return reply, nil
+}
+
+// The longest a single WaitDone call blocks on master
+const MAX_WAIT_DONE = time.Minute
+
+// Returned by WaitForJob if the master is replaced by a new process
+// Which may not know the job, so the wait cannot go on
+var ErrMasterRestarted = errors.New("mapreduce: master restarted during wait")
+
+// Returned by WaitForJob if the job is not done before the timeout
+var ErrWaitTimeout = errors.New("mapreduce: wait timed out")
+
+type WaitDoneSend struct {
+	JobId JobId
+	// The longest master blocks before replying, at most MAX_WAIT_DONE
+	// 0 replies at once
+	MaxWait time.Duration
+	// The secret of master, see WithSecret
+	Secret string
+}
+
+type WaitDoneReply struct {
+	// True once the job has finished, failed or been aborted
+	Done bool
+	// The error of a failed or aborted job, empty if it finished
+	Result string
+	// The incarnation of the master replying
+	Incarnation int64
+	Err         Err
+	// The backoff master suggests with RETRY_LATER
+	RetryAfter time.Duration
+}
+
+// rpc that blocks until the job is done or MaxWait passes
+// Reply BAD_JOB_ID if the job was never submitted, and AUTH to a wrong secret
+// Return ErrMasterClosed or ErrMasterFenced if master stops while waiting
+// Rate limited, but holds no slot in flight while it blocks
+func (master *Master) WaitDone(args *WaitDoneSend, reply *WaitDoneReply) error {
+	if !master.admit("Master.WaitDone", reply) {
+		return nil
+	}
+	master.release()
+	if err := master.enter(); err != nil {
+		return err
+	}
+	defer master.inflight.Done()
+
+	// A reply refused carries no incarnation, like one turned away
+	if !master.checkSecret(args.Secret) {
+		reply.Err = AUTH
+		return nil
+	}
+
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	reply.Incarnation = master.incarnation
+	job := master.getJob(args.JobId)
+	if job == nil {
+		reply.Err = BAD_JOB_ID
+		return nil
+	}
+
+	wait := args.MaxWait
+	if wait > MAX_WAIT_DONE {
+		wait = MAX_WAIT_DONE
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+
+	reply.Err = OK
+	switch err := master.waitResult(ctx, job.result); err {
+	case context.DeadlineExceeded, errJobRunning:
+	case ErrMasterClosed, ErrMasterFenced:
+		return err
+	case nil:
+		reply.Done = true
+	default:
+		reply.Done = true
+		reply.Result = err.Error()
+	}
+	return nil
+}
+
+// Block until the job on the master at masterAddr is done, or timeout passes
+// Every call to master blocks up to interval, and an unreachable master
+// Is retried every interval, e.g. while a standby takes over
+// A master replying RETRY_LATER is asked again after the backoff it suggests
+// Return nil if the job finished, an error if it failed or was aborted
+// ErrUnknownJob, ErrMasterRestarted or ErrWaitTimeout
+func WaitForJob(masterAddr string, id JobId, interval, timeout time.Duration) error {
+	return WaitForJobWithSecret(masterAddr, id, "", interval, timeout)
+}
+
+// Block until the job is done like WaitForJob, presenting the secret of master
+// Return an error wrapping ErrAuth if master refuses the secret
+func WaitForJobWithSecret(masterAddr string, id JobId, secret string,
+	interval, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var incarnation int64
+
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return ErrWaitTimeout
+		}
+		wait := interval
+		if wait > remaining {
+			wait = remaining
+		}
+
+		var reply WaitDoneReply
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), wait+CALL_TIMEOUT)
+		err := Call(ctx, masterAddr, "Master.WaitDone",
+			&WaitDoneSend{JobId: id, MaxWait: wait, Secret: secret}, &reply)
+		cancel()
+		if err != nil {
+			time.Sleep(wait - time.Since(start))
+			continue
+		}
+		// A reply turned away carries no incarnation
+		if wait, throttled := reply.backoff(); throttled {
+			if wait > time.Until(deadline) {
+				wait = time.Until(deadline)
+			}
+			time.Sleep(wait)
+			continue
+		}
+		if reply.Err == AUTH {
+			return fmt.Errorf("WaitForJob: %w", ErrAuth)
+		}
+		if incarnation == 0 {
+			incarnation = reply.Incarnation
+		} else if reply.Incarnation != incarnation {
+			return ErrMasterRestarted
+		}
+		if reply.Err == BAD_JOB_ID {
+			return ErrUnknownJob
+		}
+		if reply.Done {
+			if reply.Result != "" {
+				return errors.New(reply.Result)
+			}
+			return nil
+		}
+	}
+}
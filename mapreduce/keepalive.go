@@ -0,0 +1,188 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Pinging idle pooled connections, so broken ones are dropped before calls use them
+
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"time"
+)
+
+// The default idle time before a pooled connection is pinged
+// The wait for the reply of a ping, and the pings in a row it may miss
+const KEEPALIVE_IDLE = 30 * time.Second
+const KEEPALIVE_TIMEOUT = 5 * time.Second
+const KEEPALIVE_MISSES = 2
+
+// The rpc every server answers pings with, see CreateServerAddr
+const KEEPALIVE_METHOD = "Keepalive.Ping"
+
+// How pooled connections are kept alive
+// A connection no call used for Idle is pinged, and dropped once it misses
+// Misses pings in a row, or at once if the ping finds it broken
+// So a session a NAT or firewall dropped in silence is dialed again
+// Instead of hanging the next call until its timeout
+type KeepalivePolicy struct {
+	// 0 never pings
+	Idle    time.Duration
+	Timeout time.Duration
+	Misses  int
+}
+
+// Return the policy of KEEPALIVE_IDLE, KEEPALIVE_TIMEOUT and KEEPALIVE_MISSES
+func DefaultKeepalivePolicy() KeepalivePolicy {
+	return KeepalivePolicy{
+		Idle:    KEEPALIVE_IDLE,
+		Timeout: KEEPALIVE_TIMEOUT,
+		Misses:  KEEPALIVE_MISSES,
+	}
+}
+
+// Return an error if the policy cannot be used
+func (policy KeepalivePolicy) check() error {
+	if policy.Idle < 0 {
+		return errors.New("idle time must not be negative")
+	}
+	if policy.Idle > 0 && (policy.Timeout <= 0 || policy.Misses < 1) {
+		return errors.New("timeout and misses must be positive")
+	}
+	return nil
+}
+
+// Return how often idle connections are looked for
+// So a connection is pinged between Idle and one and a half Idle after its last use
+func (policy KeepalivePolicy) interval() time.Duration {
+	if policy.Idle >= 2 {
+		return policy.Idle / 2
+	}
+	return policy.Idle
+}
+
+// The service answering KEEPALIVE_METHOD next to the rcvr of every server
+type keepaliveService struct{}
+
+// Answer a ping
+func (keepaliveService) Ping(args *struct{}, reply *struct{}) error {
+	return nil
+}
+
+// The counters of the connections of a pool, see PooledTransport
+type PoolStats struct {
+	// The connections cached at the moment
+	Open int
+	// The connections dialed, pings sent
+	// And connections dropped because they missed pings or a ping found them broken
+	Dials     int64
+	Pings     int64
+	Evictions int64
+	// The calls sent again over a new connection after their connection broke
+	Redials int64
+}
+
+// A Transport keeping persistent connections that can count them
+// The transport of NewRPCTransport is one
+type PooledTransport interface {
+	Transport
+	PoolStats() PoolStats
+}
+
+// Return the counters of the pool
+func (pool *clientPool) Stats() PoolStats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	stats := pool.stats
+	stats.Open = len(pool.clients)
+	return stats
+}
+
+// Return the counters of the connections of master to workers
+// Return false if its transport keeps none, see PooledTransport
+func (master *Master) poolStats() (PoolStats, bool) {
+	pooled, ok := master.transport.(PooledTransport)
+	if !ok {
+		return PoolStats{}, false
+	}
+	return pooled.PoolStats(), true
+}
+
+// Start the keepalive loop unless it runs already, or the policy never pings
+// Must be called with lock held
+func (pool *clientPool) startKeepalive() {
+	if pool.pinging || pool.keepalive.Idle <= 0 {
+		return
+	}
+	pool.pinging = true
+	go pool.keepaliveLoop()
+}
+
+// Ping idle connections until the pool is closed or has none left
+// It is started again by the next connection dialed
+func (pool *clientPool) keepaliveLoop() {
+	ticker := time.NewTicker(pool.keepalive.interval())
+	defer ticker.Stop()
+	for range ticker.C {
+		pool.mu.Lock()
+		if pool.closed || len(pool.clients) == 0 {
+			pool.pinging = false
+			pool.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		for addr, entry := range pool.clients {
+			if entry.calls == 0 && !entry.pinging && now.Sub(entry.lastUsed) >= pool.keepalive.Idle {
+				entry.pinging = true
+				go pool.ping(addr, entry)
+			}
+		}
+		pool.mu.Unlock()
+	}
+}
+
+// Ping the peer at addr over entry, and drop entry if it does not answer
+// A peer that does not know KEEPALIVE_METHOD still answers, so it is alive
+func (pool *clientPool) ping(addr string, entry *pooledClient) {
+	call := entry.client.Go(KEEPALIVE_METHOD, &struct{}{}, &struct{}{}, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(pool.keepalive.Timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-timer.C:
+		err = ErrTimeout
+	}
+
+	pool.mu.Lock()
+	entry.pinging = false
+	pool.stats.Pings++
+	if _, ok := err.(rpc.ServerError); err == nil || ok {
+		entry.misses = 0
+		entry.lastUsed = time.Now()
+		pool.mu.Unlock()
+		return
+	}
+	entry.misses++
+	evict := err != ErrTimeout || entry.misses >= pool.keepalive.Misses
+	if evict && pool.clients[addr] == entry {
+		pool.stats.Evictions++
+	}
+	pool.mu.Unlock()
+
+	if evict {
+		pool.drop(addr, entry)
+	}
+}
+
+// Ping pooled connections by policy, see KeepalivePolicy
+// Pass Idle 0 to disable pings
+func WithKeepalive(policy KeepalivePolicy) Option {
+	return func(config *MasterConfig) error {
+		if err := policy.check(); err != nil {
+			return fmt.Errorf("WithKeepalive: %v", err)
+		}
+		config.Keepalive = policy
+		return nil
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Leases of task attempts, renewed by the heartbeats of their workers
+
+package mapreduce
+
+import (
+	"time"
+)
+
+type HeartbeatReply struct {
+	// The attempts whose lease master denies, see MasterConfig.TaskLease
+	// They have been given up, so the worker kills them
+	Revoked []TaskAttempt
+	// The backoff master suggests, set with RETRY_LATER
+	RetryAfter time.Duration
+	Err        Err
+}
+
+// The lease of an attempt on its worker
+type workerLease struct {
+	// The lease master grants, and the time it lapses unless renewed
+	duration time.Duration
+	expires  time.Time
+}
+
+// Grant the lease of an attempt once it starts
+// Must be called with lock held
+func (meta *taskMeta) grantLease(attemptId AttemptId, lease time.Duration) {
+	if lease <= 0 {
+		return
+	}
+	if meta.leases == nil {
+		meta.leases = map[AttemptId]time.Time{}
+	}
+	meta.leases[attemptId] = time.Now().Add(lease)
+}
+
+// Renew the lease of an attempt a worker reports running
+// Denied unless the attempt is still live and held by the worker
+// An attempt whose lease has lapsed but is not given up yet is renewed
+// Must be called with lock held
+func (master *Master) renewLease(workerId int64, attempt TaskAttempt) bool {
+	job := master.getJob(attempt.JobId)
+	if job == nil {
+		return false
+	}
+	metaRef, err := job.getMetaRef(attempt.TaskType)
+	if err != nil || attempt.TaskId < 0 || int(attempt.TaskId) >= len(*metaRef) {
+		return false
+	}
+	meta := &(*metaRef)[attempt.TaskId]
+	if _, ok := meta.live[attempt.AttemptId]; !ok {
+		return false
+	}
+	held := runningTask{
+		jobId:     attempt.JobId,
+		taskId:    attempt.TaskId,
+		taskType:  attempt.TaskType,
+		attemptId: attempt.AttemptId,
+	}
+	for _, task := range master.workers[workerId].tasks {
+		if task == held {
+			meta.grantLease(attempt.AttemptId, master.config.TaskLease)
+			return true
+		}
+	}
+	return false
+}
+
+// Give up the live attempts of a task whose lease has lapsed
+// Their slots are freed and they are killed on their workers
+// The task is retried once no attempt is left
+// Must be called with lock held
+func (job *jobState) expireLeases(taskId TaskId, taskType TaskType) {
+	master := job.master
+	metaRef, _ := job.getMetaRef(taskType)
+	meta := &(*metaRef)[taskId]
+	now := time.Now()
+	for attemptId := range meta.live {
+		if meta.leases[attemptId].After(now) {
+			continue
+		}
+		master.config.Logger.Warnf("Job %v: lease of %v task %v attempt %v lapsed, reassign it",
+			job.id, taskTypeName(taskType), taskId, attemptId)
+		task := runningTask{
+			jobId:     job.id,
+			taskId:    taskId,
+			taskType:  taskType,
+			attemptId: attemptId,
+		}
+		delete(meta.leases, attemptId)
+		for workerId, registry := range master.workers {
+			for _, t := range registry.tasks {
+				if t == task {
+					master.strikeWorker(workerId, "lease lapsed")
+				}
+			}
+		}
+		job.dropAttempt(taskId, taskType, attemptId, "lease lapsed")
+		kills := master.releaseTasks(func(t runningTask) bool { return t == task })
+		go master.killTasks(kills)
+	}
+}
+
+// Record the lease of an attempt the worker starts
+// Must be called with lock held
+func (worker *Worker) grantLease(attempt TaskAttempt, lease time.Duration) {
+	if lease > 0 {
+		worker.leases[attempt] = workerLease{lease, time.Now().Add(lease)}
+	}
+}
+
+// Apply the reply to a heartbeat sent at sent listing attempts
+// Revoked attempts are killed, the leases of the others are renewed
+// Then attempts whose lease lapsed without master renewing it are killed
+// Master has given them up by then, so nothing they write is accepted
+func (worker *Worker) renewLeases(sent time.Time, attempts []TaskAttempt,
+	reply *HeartbeatReply) {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+
+	revoked := map[TaskAttempt]bool{}
+	if reply != nil {
+		for _, attempt := range reply.Revoked {
+			revoked[attempt] = true
+			if worker.kill(attempt) {
+				worker.Logger.Warnf("Job %v: master denies the lease of %v task %v attempt %v, kill it",
+					attempt.JobId, taskTypeName(attempt.TaskType), attempt.TaskId, attempt.AttemptId)
+			}
+		}
+		for _, attempt := range attempts {
+			if lease, ok := worker.leases[attempt]; ok && !revoked[attempt] {
+				lease.expires = sent.Add(lease.duration)
+				worker.leases[attempt] = lease
+			}
+		}
+	}
+
+	now := time.Now()
+	for attempt, lease := range worker.leases {
+		if lease.expires.Before(now) && worker.kill(attempt) {
+			worker.Logger.Warnf("Job %v: lease of %v task %v attempt %v lapsed, kill it",
+				attempt.JobId, taskTypeName(attempt.TaskType), attempt.TaskId, attempt.AttemptId)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of the leases of task attempts
+
+package mapreduce
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Send the heartbeat of a worker running attempts, return the reply
+func heartbeat(t *testing.T, master *Master, workerId int64, attempts ...TaskAttempt) HeartbeatReply {
+	t.Helper()
+	reply := HeartbeatReply{}
+	if err := master.Heartbeat(&HeartbeatSend{WorkerId: workerId, Tasks: attempts}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Err != OK {
+		t.Fatalf("heartbeat: %v", reply.Err)
+	}
+	return reply
+}
+
+// Make the lease of map task 0 attempt 0 lapse, without giving the attempt up
+func lapseLease(master *Master) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	master.jobs[DEFAULT_JOB].mapMeta[0].leases[0] = time.Now().Add(-time.Millisecond)
+}
+
+// Give up the map attempts whose lease lapsed, as the timeout checker does
+func expireMapLeases(master *Master) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	master.jobs[DEFAULT_JOB].expireLeases(0, MAP)
+}
+
+func isRevoked(reply HeartbeatReply, attempt TaskAttempt) bool {
+	for _, revoked := range reply.Revoked {
+		if revoked == attempt {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLongTaskKeepsItsLease(t *testing.T) {
+	var calls int32
+	master := startMaster(t, writeInputs(t, "a b a"), 1, WithTaskLease(200*time.Millisecond))
+	startWorker(t, master, func(worker *Worker) {
+		// Runs for several leases, renewed by the heartbeats meanwhile
+		worker.MapContext = func(ctx context.Context, file, content string) []KeyValue {
+			atomic.AddInt32(&calls, 1)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+			return wcMap(file, content)
+		}
+	})
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts("a b a"))
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Fatalf("map ran %v times, want once", calls)
+	}
+}
+
+func TestLapsedLeaseRenewedBeforeItIsGivenUp(t *testing.T) {
+	master := makeMaster(t, writeInputs(t, "a"), 1, WithTaskLease(time.Minute))
+	workerId := registerWorker(t, master, 1)
+	assignMap(master, workerId)
+	attempt := TaskAttempt{DEFAULT_JOB, 0, MAP, 0}
+
+	// The heartbeat wins the race with the checker, so the attempt goes on
+	lapseLease(master)
+	if reply := heartbeat(t, master, workerId, attempt); isRevoked(reply, attempt) {
+		t.Fatal("lapsed lease not renewed before the attempt was given up")
+	}
+	expireMapLeases(master)
+	if reply := finishAttempt(master, workerId, MAP, 0, 0); reply != OK {
+		t.Fatalf("finish renewed attempt: %v", reply)
+	}
+}
+
+func TestLapsedLeaseDeniedOnceItIsGivenUp(t *testing.T) {
+	master := makeMaster(t, writeInputs(t, "a"), 1, WithTaskLease(time.Minute))
+	workerId := registerWorker(t, master, 1)
+	assignMap(master, workerId)
+	attempt := TaskAttempt{DEFAULT_JOB, 0, MAP, 0}
+
+	// The checker wins the race, so the heartbeat tells the worker to abandon it
+	lapseLease(master)
+	expireMapLeases(master)
+	if reply := heartbeat(t, master, workerId, attempt); !isRevoked(reply, attempt) {
+		t.Fatal("lease of an attempt given up renewed")
+	}
+	if reply := finishAttempt(master, workerId, MAP, 0, 0); reply == OK {
+		t.Fatal("attempt given up finished")
+	}
+
+	// The retry is a new attempt with its own lease, the old one stays denied
+	if taskId, attemptId := assignMap(master, workerId); taskId != 0 || attemptId != 1 {
+		t.Fatalf("assigned task %v attempt %v, want task 0 attempt 1", taskId, attemptId)
+	}
+	reply := heartbeat(t, master, workerId, attempt, TaskAttempt{DEFAULT_JOB, 0, MAP, 1})
+	if len(reply.Revoked) != 1 || !isRevoked(reply, attempt) {
+		t.Fatalf("revoked %v, want only attempt 0", reply.Revoked)
+	}
+}
+
+func TestLeaseOfAnotherWorkerDenied(t *testing.T) {
+	master := makeMaster(t, writeInputs(t, "a"), 1, WithTaskLease(time.Minute))
+	holder := registerWorker(t, master, 1)
+	other := registerWorker(t, master, 1)
+	assignMap(master, holder)
+	attempt := TaskAttempt{DEFAULT_JOB, 0, MAP, 0}
+
+	if reply := heartbeat(t, master, other, attempt); !isRevoked(reply, attempt) {
+		t.Fatal("lease renewed for a worker not holding the attempt")
+	}
+	if reply := heartbeat(t, master, holder, attempt); isRevoked(reply, attempt) {
+		t.Fatal("lease of the holder denied")
+	}
+}
+
+func TestWorkerKillsAttemptWhoseLeaseLapsed(t *testing.T) {
+	started, killed := make(chan struct{}), make(chan struct{})
+	master := startMaster(t, writeInputs(t, "a"), 1, WithTaskLease(time.Minute))
+	worker := startWorker(t, master, func(worker *Worker) {
+		worker.MapContext = func(ctx context.Context, file, content string) []KeyValue {
+			close(started)
+			<-ctx.Done()
+			close(killed)
+			return nil
+		}
+	})
+	attempt := TaskAttempt{DEFAULT_JOB, 0, MAP, 0}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("attempt never started")
+	}
+
+	// No heartbeat renewed it, as if master were unreachable
+	// Lapsed again each time, since a heartbeat on its way may still renew it
+	waitFor(t, 5*time.Second, "the attempt whose lease lapsed to be killed", func() bool {
+		worker.mu.Lock()
+		if lease, ok := worker.leases[attempt]; ok {
+			lease.expires = time.Now().Add(-time.Millisecond)
+			worker.leases[attempt] = lease
+		}
+		worker.mu.Unlock()
+		worker.renewLeases(time.Now(), nil, nil)
+		select {
+		case <-killed:
+			return true
+		default:
+			return false
+		}
+	})
+}
@@ -0,0 +1,48 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// The leveled logger used by master and worker
+
+package mapreduce
+
+import (
+	"log"
+	"os"
+)
+
+// A leveled logger
+// Implementations must be safe for concurrent use
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// A Logger writing to a standard library logger
+// Debug lines are dropped unless Debug is true
+type StdLogger struct {
+	Logger *log.Logger
+	Debug  bool
+}
+
+// Return a Logger writing to stderr, the default of master and worker
+func NewStdLogger() *StdLogger {
+	return &StdLogger{Logger: log.New(os.Stderr, "", log.LstdFlags)}
+}
+
+func (logger *StdLogger) Debugf(format string, args ...interface{}) {
+	if logger.Debug {
+		logger.Logger.Printf("DEBUG "+format, args...)
+	}
+}
+
+func (logger *StdLogger) Infof(format string, args ...interface{}) {
+	logger.Logger.Printf("INFO "+format, args...)
+}
+
+func (logger *StdLogger) Warnf(format string, args ...interface{}) {
+	logger.Logger.Printf("WARN "+format, args...)
+}
+
+func (logger *StdLogger) Errorf(format string, args ...interface{}) {
+	logger.Logger.Printf("ERROR "+format, args...)
+}
@@ -4,7 +4,13 @@
 package mapreduce
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -15,6 +21,9 @@ type TaskId int
 // Task type (MAP, REDUCE)
 type TaskType int
 
+// The id of a single dispatch of a task
+type AttemptId int
+
 // Type to indicate worker status
 type WorkerStatus int
 
@@ -23,6 +32,8 @@ const (
 	AVAILABLE = 0
 	RUNNING   = 1
 	FAILED    = 2
+	// Alive but no longer assigned tasks after repeated task failures
+	BLACKLISTED = 3
 )
 
 // The status of tasks
@@ -30,17 +41,215 @@ const (
 	UNPROCESSED = 0
 	PROCESSING  = 1
 	FINISHED    = 2
+	// Permanently failed after too many attempts
+	TASK_FAILED = 3
+	// Failed like TASK_FAILED, but left out so the job can still finish
+	// See MasterConfig.MaxFailedTaskRatio
+	SKIPPED = 4
 )
 
 // The return type of rpc
 const (
-	WASTE = "WASTE"
+	WASTE          = "WASTE"
+	BAD_TASK_TYPE  = "BAD_TASK_TYPE"
+	BAD_TASK_ID    = "BAD_TASK_ID"
+	UNKNOWN_WORKER = "UNKNOWN_WORKER"
+	ABORTED        = "ABORTED"
+	// The reporting worker does not hold the task attempt it reports
+	MISMATCH = "MISMATCH"
+)
+
+// Returned by every rpc of master after Shutdown
+var ErrMasterClosed = errors.New("mapreduce: master closed")
+
+// Returned by Wait after the job is aborted
+var ErrJobAborted = errors.New("mapreduce: job aborted")
+
+// Wrapped by the errors of helpers given a task type other than MAP and REDUCE
+var ErrBadTaskType = errors.New("mapreduce: unexpected task type")
+
+// Return the error of an unexpected task type
+func badTaskType(taskType TaskType) error {
+	return fmt.Errorf("%w %v", ErrBadTaskType, taskType)
+}
+
+// The default duration a task may stay in PROCESSING
+// Before it is handed back to the scheduler
+const TASK_TIMEOUT = time.Second * 10
+
+// The default duration a map task waits for a worker holding its input
+// Before it is assigned to any worker
+const LOCALITY_DELAY = time.Second * 3
+
+// The default duration after the last heartbeat
+// Before a worker is considered failed
+const HEARTBEAT_TTL = HEARTBEAT_INTERVAL * 3
+
+// The default duration a failed worker is kept before it is forgotten
+const FAILED_RETENTION = time.Minute * 10
+
+// The default number of attempts a task gets before the job fails
+const MAX_TASK_ATTEMPTS = 4
+
+// The default blacklist settings
+// A worker is blacklisted after BLACKLIST_STRIKES task failures
+// Within BLACKLIST_WINDOW, and readmitted after it keeps passing
+// Liveness checks for BLACKLIST_COOLDOWN
+const (
+	BLACKLIST_STRIKES  = 3
+	BLACKLIST_WINDOW   = time.Minute
+	BLACKLIST_COOLDOWN = time.Second * 30
+)
+
+// The max duration the scheduler sleeps without any state change
+// Time based decisions (e.g. backing up stragglers) are made at least this often
+const SCHEDULE_TICK = time.Second
+
+// The default speculative execution settings
+// A backup copy is launched for a task processing longer than
+// SPECULATIVE_FACTOR times the median duration of finished tasks
+// At most SPECULATIVE_RATIO of the tasks in a phase are backed up
+const (
+	SPECULATIVE_FACTOR = 2.0
+	SPECULATIVE_RATIO  = 0.1
 )
 
+// A task attempt running on a worker
+type runningTask struct {
+	jobId     JobId
+	taskId    TaskId
+	taskType  TaskType
+	attemptId AttemptId
+}
+
 // The data structure that stores worker status
+// A worker is AVAILABLE while it has a free slot
+// And RUNNING once all of its slots are taken
 type WorkerRegistry struct {
 	status WorkerStatus
-	taskId TaskId
+	// The host the worker runs on, and the host:port master reaches it at
+	host string
+	addr string
+	// The number of tasks the worker can run at the same time
+	slots int
+	// The task attempts the worker is running
+	tasks []runningTask
+	// The number of attempts the worker has reported
+	// And the total time they took
+	reported int
+	busyTime time.Duration
+	// The number of attempts accepted as the result of their task
+	// And of task failures attributed to the worker
+	completed int
+	failures  int
+	// The time a task is last assigned to the worker
+	lastAssigned time.Time
+	// The time of recent task failures attributed to the worker
+	strikes []time.Time
+	// The time the worker is blacklisted or last fails a liveness check
+	blacklistedAt time.Time
+	// The time the worker is declared failed
+	failedAt time.Time
+	// The time of the last heartbeat (or registration) of the worker
+	// And the task attempts it reported running
+	lastHeartbeat  time.Time
+	heartbeatTasks []TaskAttempt
+	// The resources of its host in the last heartbeat
+	resources ResourceSample
+	// The counters of its cache in the last heartbeat
+	cache CacheStats
+	// The time the worker last has no task running
+	// Zero while it runs some
+	idleSince time.Time
+	// Set once the autoscaler terminates the worker, which is assigned no task
+	retiring bool
+	// If sharedOutput is true, the worker serves no Worker.FetchPartition
+	// And reducers read its map output from a shared MAP_DIR
+	sharedOutput bool
+	// The session token issued on registration, empty without a secret
+	token string
+	// The codecs of CompressionPolicy the worker decodes
+	compression []string
+}
+
+// The reason a job fails
+type JobFailure struct {
+	JobId     JobId
+	TaskId    TaskId
+	TaskType  TaskType
+	InputFile string
+	// The error of the last attempt of the task
+	Err string
+	// True if the job ran past its deadline, no task is named then
+	DeadlineExceeded bool
+}
+
+// Return ErrDeadlineExceeded for a job that ran past its deadline
+// So errors.Is tells it apart from a failed task
+func (failure *JobFailure) Unwrap() error {
+	if failure.DeadlineExceeded {
+		return ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// Describe the failure
+func (failure *JobFailure) Error() string {
+	if failure.DeadlineExceeded {
+		return fmt.Sprintf("mapreduce: job %v failed: %v",
+			failure.JobId, failure.Err)
+	}
+	return fmt.Sprintf("mapreduce: job %v failed at task %v (%v): %v",
+		failure.JobId, failure.TaskId, failure.InputFile, failure.Err)
+}
+
+// The bookkeeping data of a single task
+type taskMeta struct {
+	// The time the task is moved to PROCESSING
+	startTime time.Time
+	// The highest fraction done reported by a running attempt
+	// And the time it last grew, zero if nothing is reported since startTime
+	progress     float64
+	progressTime time.Time
+	// The time it takes to finish the task
+	duration time.Duration
+	// The number of times the task is dispatched to a worker
+	// Also the id of the next attempt
+	attempts int
+	// The attempts given up, counted against MaxTaskAttempts
+	// So a backup copy only counts if it fails
+	failures int
+	// The attempts that may still report TaskFinished
+	// And the time each of them is dispatched
+	live map[AttemptId]time.Time
+	// The time the lease of each attempt lapses, see MasterConfig.TaskLease
+	leases map[AttemptId]time.Time
+	// True if a backup copy of the task has been launched
+	// And the worker of each backup attempt
+	speculated bool
+	backups    map[AttemptId]int64
+	// The time the task is moved back to UNPROCESSED
+	// Zero if it has never been assigned
+	pendingSince time.Time
+	// The worker of the latest attempt that is not a backup, and whether it holds the input
+	worker int64
+	local  bool
+	// The worker whose attempt finished the task, which holds its output
+	// 0 if unknown, e.g. resumed from an earlier run
+	outputWorker int64
+	// The bytes written to each reduce partition by a finished map task
+	partitionBytes []int64
+	// The input records a finished map task skipped, see SkipPolicy
+	skippedRecords int
+	// The records and bytes of the attempt that finished the task
+	counters TaskCounters
+	// The reason the latest attempt is given up
+	lastError string
+	// True once an attempt fails in a way running it again cannot fix
+	// So the task is not retried, see TaskFailedSend.Permanent
+	permanent bool
+	// True once the task has been reported as a straggler
+	stragglerWarned bool
 }
 
 // The master data structure
@@ -49,14 +258,17 @@ type Master struct {
 	mu sync.Mutex
 
 	// The mapping that stores the status of registered workers
-	workers map[int64]WorkerRegistry
+	workers map[int64]*WorkerRegistry
+	// Registered workers in registration order
+	// Searched round-robin starting from nextWorker
+	workerOrder []int64
+	nextWorker  int
+	// The number of tasks assigned to each worker
+	assignCount map[int64]int
 
-	// The number of map tasks
-	nMap int
-	// The number of reduce tasks
-	nReduce int
-	// A list of input files
-	inputFiles []string
+	// The submitted jobs, with ids from 0 to nextJobId - 1
+	jobs      map[JobId]*jobState
+	nextJobId JobId
 
 	// Deprecated
 	// User-defined map function
@@ -70,272 +282,2405 @@ type Master struct {
 	// And return the merged data of string type
 	//fReduce func(string, []string) string
 
-	// Mark the map task that is finished
-	mapStatus        []int
-	mapFinishedCount int
-	// Mark the reduce task that is finished
-	reduceStatus        []int
-	reduceFinishedCount int
-
 	// The port of master node
 	port int64
+
+	// The plugin handed to workers, nil if there is none
+	plugin *pluginFile
+
+	// The time master starts running
+	startTime time.Time
+	// Set by RunMaster, jobs submitted afterwards are scheduled at once
+	running bool
+
+	// The listener of the rpc server, closed by Shutdown
+	listener net.Listener
+	// The listeners of WithCodecListener, closed by Shutdown as well
+	codecListeners []net.Listener
+	// The transport of rpcs, its connections to workers closed by Shutdown
+	transport Transport
+	// The rate limits and in-flight cap of rpc handlers, see admit
+	limiter *rateLimiter
+	// The circuits of the workers master calls, see breakerCall
+	breaker *circuitBreaker
+	// A slot taken by each dispatch in flight, and room for the result of each
+	dispatchSlots   chan struct{}
+	dispatchResults chan *dispatchResult
+	// The http server of diagnostics, nil if disabled
+	httpServer *http.Server
+	// Set by Shutdown
+	closed bool
+	// Set by Abort
+	aborted bool
+	// Set by PauseScheduling, no new task is assigned while paused
+	paused bool
+	// The term of master, and whether a newer term has taken over
+	term   int64
+	fenced bool
+	// Unique to each master process, so remote clients notice a restart
+	incarnation int64
+	// The rpc handlers in flight, and the scheduler loops running
+	inflight sync.WaitGroup
+	loops    sync.WaitGroup
+
+	// The number of map attempts whose input has location hints
+	// And the number of those assigned to a worker holding the input
+	hintedAssigned int
+	localAssigned  int
+
+	// Closed and replaced whenever a worker becomes available
+	// Or a task changes to unprocessed or finished
+	changed chan struct{}
+
+	// The configuration set by options
+	config MasterConfig
+
+	// The metrics registry, nil unless enabled by WithMetrics
+	metrics *metrics
+
+	// The timing records of every task attempt
+	timeline taskTimeline
+
+	// The state of the scaling loop, used if config has a Launcher
+	scaler autoscaler
+
+	// The number of rounds the dispatch loops have made
+	schedulerIterations int64
+
+	// The callbacks waiting to run, nil if no hook is set
+	// And closed by Shutdown to stop running them
+	hookQueue chan hookCall
+	hookStop  chan struct{}
+
+	// The write-ahead log, nil unless enabled by WithWAL
+	wal *wal
+
+	// The event log, nil unless enabled by WithEventLog
+	events *eventLog
 }
 
 // Create a new master node
-// Init values
-func MakeMaster(inputFiles []string, nReduce int, port int64) *Master {
-	// Create and init master
+// Init values, then apply options on top of the default configuration
+// The input files and nReduce make up job DEFAULT_JOB, see Submit
+// Input files may be directories or glob patterns, see JobSpec.InputFiles
+// If nReduce is 0, the job is map-only and map tasks write the final output
+// Return error if any argument or option is invalid
+func MakeMaster(inputFiles []string, nReduce int, port int64,
+	options ...Option) (*Master, error) {
+	master, err := newMaster(port, options)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start a new log, the records of an earlier run are dropped
+	if master.config.WALPath != "" {
+		master.wal, err = openWAL(master.config.WALPath, master.config.WALSync, true)
+		if err != nil {
+			return nil, fmt.Errorf("MakeMaster: %v", err)
+		}
+		master.logRecord(walRecord{Kind: WAL_TERM, Term: master.term})
+	}
+
+	plan, err := master.planJob(JobSpec{
+		InputFiles:     inputFiles,
+		NReduce:        nReduce,
+		InputLocations: master.config.InputLocations,
+	})
+	if err != nil {
+		return nil, err
+	}
+	master.submit(plan)
+
+	return master, nil
+}
+
+// Create a master without any job
+// Init values, then apply options on top of the default configuration
+func newMaster(port int64, options []Option) (*Master, error) {
 	master := Master{}
-	master.workers = map[int64]WorkerRegistry{}
-	master.nMap = len(inputFiles)
-	master.nReduce = nReduce
-	master.inputFiles = inputFiles
+	master.config = defaultConfig()
+	for _, option := range options {
+		if err := option(&master.config); err != nil {
+			return nil, err
+		}
+	}
+	if err := master.config.checkHeartbeat(); err != nil {
+		return nil, err
+	}
 
-	// Init task status
-	master.mapStatus = make([]int, master.nMap)
-	master.reduceStatus = make([]int, master.nReduce)
+	master.workers = map[int64]*WorkerRegistry{}
+	master.assignCount = map[int64]int{}
+	master.jobs = map[JobId]*jobState{}
+	if master.config.Metrics {
+		master.metrics = &metrics{}
+	}
+	if master.config.EventLogPath != "" {
+		events, err := openEventLog(master.config.EventLogPath)
+		if err != nil {
+			return nil, err
+		}
+		master.events = events
+	}
+	if master.config.PluginPath != "" {
+		plugin, err := readPlugin(master.config.PluginPath)
+		if err != nil {
+			return nil, fmt.Errorf("WithPlugin: %v", err)
+		}
+		master.plugin = plugin
+	}
+	if master.config.Hooks.any() {
+		master.startHooks()
+	}
 
 	master.port = port
+	master.changed = make(chan struct{})
+	master.dispatchSlots = make(chan struct{}, master.config.DispatchParallelism)
+	master.dispatchResults = make(chan *dispatchResult, master.config.DispatchParallelism)
+	master.limiter = newRateLimiter(master.config.RateLimits, master.config.MaxInflight)
+	master.breaker = newCircuitBreaker(master.config.Circuit)
+	master.transport = master.config.Transport
+	if master.transport == nil {
+		transport := newRPCTransport(master.config.TLS, master.config.Codec,
+			master.config.Keepalive, master.interceptors()...)
+		transport.serveFailed = master.serveFailed
+		transport.logger = master.config.Logger
+		master.transport = transport
+	}
+	master.incarnation = time.Now().UnixNano()
 
-	return &master
+	return &master, nil
 }
 
 // Register workers to master
+// Workers are keyed by the id they send, master picks one if it is 0
+// A worker registering again is reset to AVAILABLE
+// The attempts it was running died with the old process, so they are requeued
+// A new id on the address of a registered worker means the process restarted
+// So the old worker is removed and its attempts requeued the same way
+// Workers on different hosts are only told apart by Host, so it must be set
+// A worker master cannot use is refused with INCOMPATIBLE and the reason
+// A worker without the plugin of master is not registered
+// Reply PLUGIN_REQUIRED with the plugin instead, see Master.FetchPlugin
 func (master *Master) RegisterWorker(args *RegisterSend,
-	reply *GeneralReply) error {
+	reply *RegisterReply) error {
+	if !master.admit("Master.RegisterWorker", reply) {
+		return nil
+	}
+	defer master.release()
+	if err := master.enter(); err != nil {
+		return err
+	}
+	defer master.inflight.Done()
+
 	// Lock the register operation
 	master.mu.Lock()
 	defer master.mu.Unlock()
 
+	if err := master.checkTerm(args.Term); err != nil {
+		return err
+	}
+
+	if !master.checkSecret(args.Secret) {
+		master.config.Logger.Warnf("Refuse worker %v at %v: wrong secret", args.WorkerId,
+			args.reachableAddr())
+		reply.Err = AUTH
+		return nil
+	}
+	if rejection := checkCompatible(args, transportWire(master.transport)); rejection != nil {
+		master.config.Logger.Warnf("Refuse worker %v at %v: %v", args.WorkerId,
+			args.reachableAddr(), rejection)
+		reply.Rejection = rejection
+		reply.Err = INCOMPATIBLE
+		return nil
+	}
+	if master.plugin != nil && args.Plugin != master.plugin.info.Sha256 {
+		reply.Plugin = master.plugin.info
+		reply.Err = PLUGIN_REQUIRED
+		return nil
+	}
+
 	// Register the worker with id
-	// Initially available
-	master.workers[args.Port] = WorkerRegistry{
-		status: AVAILABLE,
-		taskId: -1,
+	// Initially available with all slots free
+	slots := args.Slots
+	if slots < 1 {
+		slots = 1
+	}
+	workerId := args.WorkerId
+	for workerId == 0 || (args.WorkerId == 0 && master.workers[workerId] != nil) {
+		workerId = newWorkerId()
+	}
+	addr := args.reachableAddr()
+	for id, old := range master.workers {
+		if id != workerId && old.addr == addr {
+			master.config.Logger.Warnf("Worker %v at %v restarted as worker %v",
+				id, addr, workerId)
+			master.requeueWorker(id, old)
+			master.deleteWorker(id)
+		}
+	}
+	var token string
+	if master.config.Secret != "" {
+		token = newToken()
+	}
+	if old, ok := master.workers[workerId]; !ok {
+		master.workerOrder = append(master.workerOrder, workerId)
+		master.noteRegistered()
+	} else {
+		master.requeueWorker(workerId, old)
+	}
+	master.workers[workerId] = &WorkerRegistry{
+		slots:         slots,
+		host:          args.Host,
+		addr:          addr,
+		sharedOutput:  !args.Capabilities.Shuffle,
+		compression:   args.Capabilities.Compression,
+		lastHeartbeat: time.Now(),
+		token:         token,
 	}
+	master.updateWorkerStatus(workerId)
+	master.workerHook("OnWorkerRegistered", master.config.Hooks.OnWorkerRegistered, workerId)
+	master.logEvent(Event{Kind: EVENT_WORKER_REGISTERED, WorkerId: workerId})
+	master.logRecord(walRecord{
+		Kind:     WAL_WORKER,
+		WorkerId: workerId,
+		Host:     args.Host,
+		Addr:     addr,
+		Slots:    slots,
+		Token:    token,
+	})
+	reply.WorkerId = workerId
+	reply.Token = token
+	reply.Config = master.workerConfig(args.Capabilities)
 	reply.Err = OK
 
 	return nil
 }
 
-// rpc that indicates the task is finished (map or reduce)
-func (master *Master) TaskFinished(args *TaskFinishedSend,
+// rpc used by a worker shutting down, see Worker.Shutdown
+// Forget the worker at once and requeue the attempts it was running
+func (master *Master) DeregisterWorker(args *DeregisterSend,
 	reply *GeneralReply) error {
+	if !master.admit("Master.DeregisterWorker", reply) {
+		return nil
+	}
+	defer master.release()
+	if err := master.enter(); err != nil {
+		return err
+	}
+	defer master.inflight.Done()
 
 	master.mu.Lock()
 	defer master.mu.Unlock()
 
-	// Reference (or pointer) to store actual status array
-	// And counter integer
-	var statusRef *[]int
-	var counter *int
+	if err := master.checkTerm(args.Term); err != nil {
+		return err
+	}
 
-	// Assign actual value to statusRef and counter
-	switch args.TaskType {
-	case MAP:
-		// If the finished task type is map
-		statusRef = &master.mapStatus
-		counter = &master.mapFinishedCount
-	case REDUCE:
-		// If the finished task type is reduce
-		statusRef = &master.reduceStatus
-		counter = &master.reduceFinishedCount
-	default:
-		// If not match any task type, throw error
-		log.Fatal("Unexpected Task Type")
+	registry, ok := master.workers[args.WorkerId]
+	if !ok {
+		reply.Err = UNKNOWN_WORKER
+		return nil
+	}
+	if !master.checkToken(args.WorkerId, args.Token) {
+		reply.Err = AUTH
+		return nil
 	}
+	master.config.Logger.Infof("Worker %v deregistered, requeue %v tasks",
+		args.WorkerId, len(registry.tasks))
+	for _, t := range registry.tasks {
+		master.jobs[t.jobId].dropAttempt(t.taskId, t.taskType, t.attemptId,
+			"worker shut down")
+	}
+	registry.tasks = nil
+	master.deleteWorker(args.WorkerId)
+	master.logEvent(Event{Kind: EVENT_WORKER_DEREGISTERED, WorkerId: args.WorkerId})
+
+	reply.Err = OK
+	return nil
+}
 
-	// Mark worker as available
-	master.workers[args.WorkerId] = WorkerRegistry{
-		status: AVAILABLE,
-		taskId: -1,
+// rpc that workers call periodically to show they are alive
+// A worker that has expired (declared failed) comes back with no task
+// The attempts it was running have been given up and are wasted
+// With leases, the attempts it runs are renewed, and those given up revoked
+// Reply DEADLINE_EXCEEDED without renewing anything if the worker gave up on it
+func (master *Master) Heartbeat(args *HeartbeatSend,
+	reply *HeartbeatReply) error {
+	if !master.admit("Master.Heartbeat", reply) {
+		return nil
 	}
+	defer master.release()
+	if err := master.enter(); err != nil {
+		return err
+	}
+	defer master.inflight.Done()
+	ctx, cancel := args.Deadline.context(context.Background(), master.config.MaxClockSkew)
+	defer cancel()
 
-	// If task already finished, reply WASTE
-	if (*statusRef)[args.TaskId] == FINISHED {
-		reply.Err = WASTE
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	if err := master.checkTerm(args.Term); err != nil {
+		return err
+	}
+	// The worker gave up on it, renewing leases now would outlast those of the worker
+	if ctx.Err() != nil {
+		reply.Err = DEADLINE_EXCEEDED
 		return nil
 	}
 
-	// Mark task as finished, and inc counter
-	(*statusRef)[args.TaskId] = FINISHED
-	*counter++
+	registry, ok := master.workers[args.WorkerId]
+	if !ok {
+		reply.Err = UNKNOWN_WORKER
+		return nil
+	}
+	if !master.checkToken(args.WorkerId, args.Token) {
+		reply.Err = AUTH
+		return nil
+	}
+
+	registry.lastHeartbeat = time.Now()
+	registry.heartbeatTasks = args.Tasks
+	registry.resources = args.Resources
+	registry.cache = args.Cache
+	for _, progress := range args.Progress {
+		master.recordProgress(progress)
+	}
+	if master.config.TaskLease > 0 {
+		for _, attempt := range args.Tasks {
+			if !master.renewLease(args.WorkerId, attempt) {
+				reply.Revoked = append(reply.Revoked, attempt)
+			}
+		}
+	}
+	if registry.status == FAILED {
+		master.config.Logger.Infof("Worker %v is back", args.WorkerId)
+		master.updateWorkerStatus(args.WorkerId)
+	}
 
 	reply.Err = OK
 	return nil
 }
 
-// Execute the master
-func (master *Master) RunMaster() {
-	// Create the corresponding server
-	rp, listener := CreateServer(master, master.port, "Master")
-
-	// Run server concurrently
-	go RunServer("Master", rp, listener)
+// Record the progress of a live attempt reported by heartbeat
+// Only progress beyond what the task has reported before counts
+// Must be called with lock held
+func (master *Master) recordProgress(progress TaskProgress) {
+	attempt := progress.Attempt
+	job := master.getJob(attempt.JobId)
+	if job == nil {
+		return
+	}
+	metaRef, err := job.getMetaRef(attempt.TaskType)
+	if err != nil || attempt.TaskId < 0 || int(attempt.TaskId) >= len(*metaRef) {
+		return
+	}
+	meta := &(*metaRef)[attempt.TaskId]
+	if _, ok := meta.live[attempt.AttemptId]; !ok || progress.Fraction <= meta.progress {
+		return
+	}
+	meta.progress = progress.Fraction
+	meta.progressTime = time.Now()
+}
 
-	// Schedule tasks
-	// Run map tasks
-	// Then run reduce tasks
-	go schedule(master)
+// Return the time the task last showed a sign of life
+// The time it last made progress, or started processing if it has made none
+func (meta *taskMeta) lastActive() time.Time {
+	if meta.progressTime.After(meta.startTime) {
+		return meta.progressTime
+	}
+	return meta.startTime
 }
 
-// Return the port of available worker
-// Return -1 if no worker is available
-func (master *Master) getAvailableWorker() int64 {
-	for port, v := range master.workers {
-		if v.status == AVAILABLE {
-			return port
+// Periodically fail workers whose last heartbeat is older than HeartbeatTTL
+// Their in-flight tasks are requeued exactly once, by failWorker
+// And forget workers that have been failed for FailedRetention
+func (master *Master) checkExpiredWorker() {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	for master.active() {
+		for port, registry := range master.workers {
+			if registry.status != FAILED &&
+				time.Since(registry.lastHeartbeat) > master.config.HeartbeatTTL {
+				master.config.Logger.Warnf("Worker %v heartbeat expired", port)
+				master.failWorker(port)
+			}
+			if registry.status == FAILED &&
+				time.Since(registry.failedAt) > master.config.FailedRetention {
+				master.config.Logger.Infof("Worker %v forgotten after failing", port)
+				master.deleteWorker(port)
+			}
 		}
+
+		master.mu.Unlock()
+		time.Sleep(master.config.SchedulerTick)
+		master.mu.Lock()
 	}
-	return -1
 }
 
-// Get the reference of status array given task type
-func (master *Master) getStatusRef(taskType TaskType) *[]int {
-	// The reference to actual status array
-	var statusRef *[]int
-
-	switch taskType {
-	case MAP:
-		statusRef = &master.mapStatus
-	case REDUCE:
-		statusRef = &master.reduceStatus
-	default:
-		log.Fatal("Unexpected Task Type")
+// rpc that indicates the task is finished (map or reduce)
+func (master *Master) TaskFinished(args *TaskFinishedSend,
+	reply *GeneralReply) error {
+	if !master.admit("Master.TaskFinished", reply) {
+		return nil
+	}
+	defer master.release()
+	if err := master.enter(); err != nil {
+		return err
 	}
+	defer master.inflight.Done()
 
-	return statusRef
-}
+	master.mu.Lock()
+	defer master.mu.Unlock()
 
-// Return the unprocessed task id of task type
-// Return -1 if no unprocessed task is found
-func (master *Master) getUnprocessedTaskId(taskType TaskType) TaskId {
-	// The reference to actual task status array
-	statusRef := master.getStatusRef(taskType)
+	if err := master.checkTerm(args.Term); err != nil {
+		return err
+	}
 
-	for idx, status := range *statusRef {
-		if status == UNPROCESSED {
-			return TaskId(idx)
-		}
+	job := master.getJob(args.JobId)
+	if job == nil {
+		reply.Err = BAD_JOB_ID
+		return nil
 	}
 
-	return -1
-}
+	// Reference (or pointer) to store actual status array
+	// And counter integer
+	var statusRef *[]int
+	var counter *int
 
-// Set the status indicated by taskId and taskType
-func (master *Master) setTaskStatus(id TaskId, taskType TaskType, status int) {
-	statusRef := master.getStatusRef(taskType)
-	(*statusRef)[id] = status
-}
+	// Assign actual value to statusRef and counter
+	switch args.TaskType {
+	case MAP:
+		// If the finished task type is map
+		statusRef = &job.mapStatus
+		counter = &job.mapFinishedCount
+	case REDUCE:
+		// If the finished task type is reduce
+		statusRef = &job.reduceStatus
+		counter = &job.reduceFinishedCount
+	default:
+		// If not match any task type, reject the rpc
+		reply.Err = BAD_TASK_TYPE
+		return nil
+	}
 
-// Get the status indicated by taskId and taskType
-func (master *Master) getTaskStatus(id TaskId, taskType TaskType) int {
-	statusRef := master.getStatusRef(taskType)
-	return (*statusRef)[id]
-}
+	// Reject task id out of range and worker never registered
+	// Before any state is touched
+	if args.TaskId < 0 || int(args.TaskId) >= len(*statusRef) {
+		reply.Err = BAD_TASK_ID
+		return nil
+	}
+	// Replied without an rpc error, so a worker forgotten after failing
+	// Receives the reply and can tell it apart from a lost connection
+	if _, ok := master.workers[args.WorkerId]; !ok {
+		reply.Err = UNKNOWN_WORKER
+		return nil
+	}
+	if !master.checkToken(args.WorkerId, args.Token) {
+		reply.Err = AUTH
+		return nil
+	}
 
-// Set the status of worker to status
-func (master *Master) setWorkerStatus(workerId int64, status WorkerRegistry) {
-	master.workers[workerId] = status
-}
+	// Count every report that is not accepted
+	reported := runningTask{
+		jobId:     args.JobId,
+		taskId:    args.TaskId,
+		taskType:  args.TaskType,
+		attemptId: args.AttemptId,
+	}
+	defer func() {
+		event := reported.event(args.WorkerId)
+		event.Result = reply.Err
+		master.taskHook("OnTaskFinished", master.config.Hooks.OnTaskFinished, event)
 
-// Periodically assign unprocessed task to available workers
-func (master *Master) checkAvailableWorkerForTask(taskType TaskType) {
-	for {
-		// If task has already finished, then just quit
-		// Because it is no longer necessary
-		if master.PhaseFinished(taskType) {
-			break
+		master.timeline.readRetried(reported, args.ReadRetries)
+		if reply.Err == OK {
+			master.timeline.ended(reported, ATTEMPT_OK)
+			master.logTaskEvent(EVENT_FINISHED, reported, args.WorkerId, reply.Err, "")
+		} else {
+			master.timeline.ended(reported, ATTEMPT_WASTE)
+			master.metrics.taskWasted(args.TaskType)
+			master.logTaskEvent(EVENT_WASTE, reported, args.WorkerId, reply.Err, "")
 		}
+	}()
 
-		master.mu.Lock()
+	// An aborted or failed job accepts no more results
+	// Abort frees every slot, so it is checked before the slot
+	if job.aborted || master.aborted {
+		reply.Err = ABORTED
+		return nil
+	}
 
-		// Get unprocessed task id
-		taskId := master.getUnprocessedTaskId(taskType)
-		if taskId == -1 {
-			Pause()
-			master.mu.Unlock()
-			continue
+	// Free the slot of the reported task only
+	// Reject the report if the worker does not hold the attempt
+	// Wasted if master gave it up, e.g. it timed out or the worker failed or registered again
+	// A mismatch if it was never assigned
+	// The slots of a job that expired are already freed
+	if !master.removeWorkerTask(args.WorkerId, reported) {
+		if job.halted() || job.givenUp(args.TaskId, args.TaskType, args.AttemptId) {
+			reply.Err = WASTE
+			return nil
 		}
+		master.config.Logger.Warnf("Job %v: worker %v reports %v task %v attempt %v it does not hold",
+			job.id, args.WorkerId, taskTypeName(args.TaskType), args.TaskId, args.AttemptId)
+		reply.Err = MISMATCH
+		return nil
+	}
+	master.updateWorkerStatus(args.WorkerId)
 
-		// Get available worker
-		workerId := master.getAvailableWorker()
-		if workerId == -1 {
-			Pause()
-			master.mu.Unlock()
-			continue
-		}
+	if job.halted() {
+		reply.Err = WASTE
+		return nil
+	}
 
-		// Set task status and worker status
-		master.setTaskStatus(taskId, taskType, PROCESSING)
-		master.setWorkerStatus(workerId, WorkerRegistry{
-			status: RUNNING,
-			taskId: taskId,
-		})
+	// If the attempt has been given up (e.g. it timed out)
+	// Or task already finished, reply WASTE
+	metaRef, err := job.getMetaRef(args.TaskType)
+	if err != nil {
+		reply.Err = BAD_TASK_TYPE
+		return fmt.Errorf("TaskFinished: %v", err)
+	}
+	live := (*metaRef)[args.TaskId].live
+	start, ok := live[args.AttemptId]
+	if !ok {
+		reply.Err = WASTE
+		return nil
+	}
+	delete(live, args.AttemptId)
 
-		args := MapStartSend{
-			InputFile: master.inputFiles[taskId],
-			TaskId:    taskId,
-			ReduceNum: master.nReduce,
-		}
-		reply := GeneralReply{}
+	// Record how fast the worker runs tasks
+	registry := master.workers[args.WorkerId]
+	registry.reported++
+	registry.busyTime += time.Since(start)
 
-		master.mu.Unlock()
+	if status := (*statusRef)[args.TaskId]; status == FINISHED || status == SKIPPED {
+		reply.Err = WASTE
+		return nil
+	}
 
-		// Start map function
-		Call(workerId, "Worker.StartMap", &args, &reply)
+	// Mark task as finished, and inc counter
+	(*metaRef)[args.TaskId].outputWorker = args.WorkerId
+	(*metaRef)[args.TaskId].skippedRecords = args.SkippedRecords
+	(*metaRef)[args.TaskId].counters = args.Counters
+	if err := job.setTaskStatus(args.TaskId, args.TaskType, FINISHED); err != nil {
+		reply.Err = BAD_TASK_TYPE
+		return fmt.Errorf("TaskFinished: %v", err)
+	}
+	*counter++
+	registry.completed++
 
-		Pause()
+	// Backup copies still running can only be wasted, free their slots and kill them
+	if len(live) > 0 {
+		(*metaRef)[args.TaskId].live = map[AttemptId]time.Time{}
+		kills := master.releaseTasks(func(task runningTask) bool {
+			return task.jobId == reported.jobId && task.taskId == reported.taskId &&
+				task.taskType == reported.taskType
+		})
+		go master.killTasks(kills)
 	}
-}
 
-// Remove Unavailable worker in a loop
-func (master *Master) removeUnavailableWorker(taskType TaskType) {
-	master.mu.Lock()
-	defer master.mu.Unlock()
+	// Record the duration of the winning attempt
+	(*metaRef)[args.TaskId].duration = time.Since((*metaRef)[args.TaskId].startTime)
+	master.metrics.taskFinished(args.TaskType, (*metaRef)[args.TaskId].duration)
 
-	for workId, _ := range master.workers {
-		if !Call(workId, "Worker.IsOnline", &struct{}{}, &struct{}{}) {
-			master.workers[workId] = WorkerRegistry{taskId: 0, status: FAILED}
-			// If this worker is running a task
-			// Mark task as unprocessed (meaning have to be redo)
-			if id := master.workers[workId].taskId; id != -1 {
-				master.setTaskStatus(id, taskType, UNPROCESSED)
+	// Aggregate the size of each reduce partition produced by map
+	// Once all partitions are known, dispatch the largest ones first
+	if args.TaskType == MAP {
+		for idx, size := range args.PartitionBytes {
+			if idx < job.nReduce {
+				job.partitionBytes[idx] += size
+				(*metaRef)[args.TaskId].partitionBytes =
+					append((*metaRef)[args.TaskId].partitionBytes, size)
 			}
 		}
-
-		time.Sleep(time.Second)
+		if job.phaseFinished(MAP) {
+			job.orderReduceQueue()
+		}
 	}
-}
 
-// Return true if map has finished
-func (master *Master) MapFinished() bool {
-	master.mu.Lock()
-	defer master.mu.Unlock()
-	return master.mapFinishedCount == master.nMap
+	reply.Err = OK
+	return nil
 }
 
-// Return true if reduce has finished
-func (master *Master) ReduceFinished() bool {
+// rpc that reports an attempt that failed on the worker, e.g. its user function panicked
+// The task is requeued at once and the attempt counts against MaxTaskAttempts
+// Unknown or stale attempts are rejected the same as by TaskFinished
+func (master *Master) TaskFailed(args *TaskFailedSend,
+	reply *GeneralReply) error {
+	if !master.admit("Master.TaskFailed", reply) {
+		return nil
+	}
+	defer master.release()
+	if err := master.enter(); err != nil {
+		return err
+	}
+	defer master.inflight.Done()
+
 	master.mu.Lock()
 	defer master.mu.Unlock()
-	return master.reduceFinishedCount == master.nReduce
-}
 
-// Return true if the phase indicated by taskType has finished
-func (master *Master) PhaseFinished(taskType TaskType) bool {
-	switch taskType {
-	case MAP:
-		return master.MapFinished()
-	case REDUCE:
-		return master.ReduceFinished()
-	default:
-		log.Fatal("Unexpected Task Type")
+	if err := master.checkTerm(args.Term); err != nil {
+		return err
 	}
-	return false
-}
 
-// Check if the whole task has finished
-func (master *Master) Done() bool {
-	return master.MapFinished() && master.ReduceFinished()
+	job := master.getJob(args.JobId)
+	if job == nil {
+		reply.Err = BAD_JOB_ID
+		return nil
+	}
+	metaRef, err := job.getMetaRef(args.TaskType)
+	if err != nil {
+		reply.Err = BAD_TASK_TYPE
+		return nil
+	}
+	if args.TaskId < 0 || int(args.TaskId) >= len(*metaRef) {
+		reply.Err = BAD_TASK_ID
+		return nil
+	}
+	if _, ok := master.workers[args.WorkerId]; !ok {
+		reply.Err = UNKNOWN_WORKER
+		return nil
+	}
+	if !master.checkToken(args.WorkerId, args.Token) {
+		reply.Err = AUTH
+		return nil
+	}
+	if job.aborted || master.aborted {
+		reply.Err = ABORTED
+		return nil
+	}
+
+	failed := runningTask{
+		jobId:     args.JobId,
+		taskId:    args.TaskId,
+		taskType:  args.TaskType,
+		attemptId: args.AttemptId,
+	}
+	if !master.removeWorkerTask(args.WorkerId, failed) {
+		if job.halted() {
+			reply.Err = WASTE
+		} else {
+			reply.Err = MISMATCH
+		}
+		return nil
+	}
+	master.updateWorkerStatus(args.WorkerId)
+
+	if job.halted() {
+		reply.Err = WASTE
+		return nil
+	}
+	// Already given up, e.g. it timed out
+	if _, ok := (*metaRef)[args.TaskId].live[args.AttemptId]; !ok {
+		reply.Err = WASTE
+		return nil
+	}
+
+	master.config.Logger.Errorf("Job %v: %v task %v attempt %v failed on worker %v: %v\n%v",
+		job.id, taskTypeName(args.TaskType), args.TaskId, args.AttemptId,
+		args.WorkerId, args.Err, args.Stack)
+	if args.Log != "" {
+		master.timeline.captured(failed, args.Log)
+	}
+	master.timeline.readRetried(failed, args.ReadRetries)
+	if args.Permanent {
+		(*metaRef)[args.TaskId].permanent = true
+	}
+	master.logTaskEvent(EVENT_FAILED, failed, args.WorkerId, "", args.Err)
+	job.dropAttempt(args.TaskId, args.TaskType, args.AttemptId, args.Err)
+
+	reply.Err = OK
+	return nil
+}
+
+// rpc that hands out a task to an idle worker in pull mode
+// Reply RUN with a map or reduce task, WAIT if no task can be assigned now
+// Or DONE once master has been aborted
+// Jobs are served in submission order
+// A worker keeps waiting after every job finishes, as more may be submitted
+func (master *Master) RequestTask(args *RequestTaskSend,
+	reply *RequestTaskReply) error {
+	if !master.admit("Master.RequestTask", reply) {
+		return nil
+	}
+	defer master.release()
+	if err := master.enter(); err != nil {
+		return err
+	}
+	defer master.inflight.Done()
+
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	if err := master.checkTerm(args.Term); err != nil {
+		return err
+	}
+
+	registry, ok := master.workers[args.WorkerId]
+	if !ok {
+		return fmt.Errorf("RequestTask: unknown worker %v", args.WorkerId)
+	}
+	if !master.checkToken(args.WorkerId, args.Token) {
+		return fmt.Errorf("RequestTask: %v: worker %v", AUTH, args.WorkerId)
+	}
+	if len(registry.tasks) >= registry.slots || registry.retiring {
+		reply.Instruction = WAIT
+		return nil
+	}
+
+	if master.halted() {
+		reply.Instruction = DONE
+		return nil
+	}
+	if master.paused {
+		reply.Instruction = WAIT
+		return nil
+	}
+
+	for id := JobId(0); id < master.nextJobId; id++ {
+		job := master.jobs[id]
+		if job.done() || job.paused {
+			continue
+		}
+
+		// Reduce tasks are handed out only after all map tasks finish
+		var taskType TaskType = MAP
+		if job.phaseFinished(MAP) {
+			taskType = REDUCE
+		}
+
+		taskId, attemptId := master.assignTask(job, args.WorkerId, taskType)
+		if taskId == -1 {
+			continue
+		}
+
+		reply.Instruction = RUN
+		reply.TaskType = taskType
+		switch taskType {
+		case MAP:
+			reply.MapArgs = job.makeMapStartSend(taskId, attemptId)
+		case REDUCE:
+			reply.ReduceArgs = job.makeReduceStartSend(taskId, attemptId)
+			reply.ReduceArgs.Compression = master.compressionFor(job, args.WorkerId)
+		}
+		return nil
+	}
+
+	reply.Instruction = WAIT
+	return nil
+}
+
+// Log the error a listener of master stopped serving on
+// Workers can no longer reach master there, the listener is not opened again
+func (master *Master) serveFailed(err error) {
+	master.config.Logger.Errorf("Stopped serving: %v", err)
+}
+
+// Execute the master
+// Return error if the port of master, or HTTPPort, cannot be listened on
+// Wrapping the error of the listen, so RunMaster may be called again, e.g. once
+// A port in use is freed
+// With port 0, master runs on the port it got, see Port
+func (master *Master) RunMaster() error {
+	// Create the corresponding server, run concurrently
+	addr := listenAddr(master.config.ListenAddr, master.port)
+	listener, err := master.transport.Listen("Master", master, addr)
+	if err != nil {
+		return fmt.Errorf("RunMaster: %w", err)
+	}
+	codecListeners, err := master.listenCodecs()
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("RunMaster: %w", err)
+	}
+	httpListener, err := master.listenHTTP()
+	if err != nil {
+		listener.Close()
+		for _, codecListener := range codecListeners {
+			codecListener.Close()
+		}
+		return fmt.Errorf("RunMaster: %w", err)
+	}
+
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	if port := listenerPort(listener); port != 0 {
+		master.port = port
+	}
+
+	master.startTime = time.Now()
+	master.listener = listener
+	master.codecListeners = codecListeners
+	master.running = true
+
+	// Serve diagnostics if enabled
+	if httpListener != nil {
+		master.startHTTP(httpListener)
+	}
+
+	// Run thread to periodically fail workers that stop sending heartbeats
+	// The failed task is requeued into its own phase
+	master.goLoop(master.checkExpiredWorker)
+
+	// Run thread to periodically readmit blacklisted workers
+	master.goLoop(master.checkBlacklistedWorker)
+
+	// Run thread to periodically probe workers whose circuit is open
+	master.goLoop(master.checkCircuits)
+
+	// Run thread to periodically report stragglers
+	master.goLoop(master.checkStragglers)
+
+	// Run thread to finish the dispatches of the schedulers
+	master.goLoop(master.finishDispatches)
+
+	// Run thread to periodically launch or terminate workers if enabled
+	if master.config.Launcher != nil {
+		master.goLoop(master.checkAutoscale)
+	}
+
+	// Schedule every job submitted so far
+	// Run map tasks
+	// Then run reduce tasks
+	for id := JobId(0); id < master.nextJobId; id++ {
+		master.startJob(master.jobs[id])
+	}
+	return nil
+}
+
+// Run a scheduler loop in its own goroutine
+// Shutdown waits for it to return
+func (master *Master) goLoop(loop func()) {
+	master.loops.Add(1)
+	go func() {
+		defer master.loops.Done()
+		loop()
+	}()
+}
+
+// Mark the start of an rpc handler
+// Return ErrMasterClosed if master has been shut down
+// Or ErrMasterFenced if a newer term has taken over
+func (master *Master) enter() error {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	if master.closed {
+		return ErrMasterClosed
+	}
+	if master.fenced {
+		return ErrMasterFenced
+	}
+	master.inflight.Add(1)
+	return nil
+}
+
+// The args of the rpcs that let a remote client control a job
+type JobControlSend struct {
+	JobId JobId
+	// The secret of master, see WithSecret
+	Secret string
+}
+
+// rpc that lets a remote client abort a job, see abortJob
+// Other jobs keep running
+// Reply BAD_JOB_ID if the job was never submitted, and AUTH to a wrong secret
+func (master *Master) AbortJob(args *JobControlSend, reply *GeneralReply) error {
+	if err := master.enter(); err != nil {
+		return err
+	}
+	defer master.inflight.Done()
+
+	if !master.checkSecret(args.Secret) {
+		reply.Err = AUTH
+		return nil
+	}
+
+	master.mu.Lock()
+	if master.closed {
+		master.mu.Unlock()
+		return ErrMasterClosed
+	}
+	job := master.getJob(args.JobId)
+	if job == nil {
+		master.mu.Unlock()
+		reply.Err = BAD_JOB_ID
+		return nil
+	}
+	reply.Err = OK
+	master.abortJob(job)
+	return nil
+}
+
+// Abort the job, the same way as Abort but only for the tasks of this job
+// A job that is done already is left as it is
+// Must be called with lock held, the lock is released before the kills
+func (master *Master) abortJob(job *jobState) {
+	if job.done() {
+		master.mu.Unlock()
+		return
+	}
+	master.config.Logger.Warnf("Job %v: aborted", job.id)
+	job.aborted = true
+	master.signalChange()
+
+	kills := master.releaseTasks(func(task runningTask) bool {
+		return task.jobId == job.id
+	})
+	master.mu.Unlock()
+	master.killTasks(kills)
+}
+
+// Abort every job
+// Stop the scheduler and kill every running task on workers
+// So they discard partial output and become idle
+// Later results are rejected with ABORTED
+func (master *Master) Abort() error {
+	master.mu.Lock()
+	if master.closed {
+		master.mu.Unlock()
+		return ErrMasterClosed
+	}
+	if master.aborted {
+		master.mu.Unlock()
+		return nil
+	}
+	master.config.Logger.Warnf("Every job aborted")
+	master.aborted = true
+	master.signalChange()
+
+	// Free every slot of every job
+	kills := master.releaseTasks(func(task runningTask) bool { return true })
+	master.mu.Unlock()
+
+	master.killTasks(kills)
+	return nil
+}
+
+// A running attempt to be killed on its worker
+type taskKill struct {
+	workerId int64
+	task     runningTask
+}
+
+// Return the running attempts that match, so they can be killed outside the lock
+// Their slots are freed by killTasks once their workers were told
+// As a worker only frees the slot of an attempt once it is killed
+// So a task retried on the same worker never finds its slot still taken there
+// Must be called with lock held
+func (master *Master) releaseTasks(match func(task runningTask) bool) []taskKill {
+	var kills []taskKill
+	for port, registry := range master.workers {
+		for _, task := range registry.tasks {
+			if match(task) {
+				kills = append(kills, taskKill{port, task})
+				master.timeline.ended(task, ATTEMPT_ABORTED)
+			}
+		}
+	}
+	return kills
+}
+
+// Tell workers to kill the attempts, so they discard partial output
+// Then free the slots the attempts still take on master, see releaseTasks
+// Each broadcast kills an attempt on every worker that has one left
+// So workers are told at the same time, and a worker forgotten meanwhile is skipped
+// Must be called without lock held
+func (master *Master) killTasks(kills []taskKill) {
+	defer master.freeKilled(kills)
+	pending := make(map[int64][]runningTask)
+	for _, k := range kills {
+		pending[k.workerId] = append(pending[k.workerId], k.task)
+	}
+	for len(pending) > 0 {
+		sent := false
+		results := master.broadcast("Worker.KillTask", func(workerId int64, token string) interface{} {
+			tasks := pending[workerId]
+			if len(tasks) == 0 {
+				return nil
+			}
+			pending[workerId] = tasks[1:]
+			sent = true
+			return &KillTaskSend{Attempt: TaskAttempt{
+				JobId:     tasks[0].jobId,
+				TaskId:    tasks[0].taskId,
+				TaskType:  tasks[0].taskType,
+				AttemptId: tasks[0].attemptId,
+			}, Token: token}
+		}, broadcastOptions{idempotency: IDEMPOTENT, all: true})
+		for workerId, result := range results {
+			if result.err != nil {
+				master.config.Logger.Debugf("Kill on worker %v: %v", workerId, result.err)
+			}
+		}
+		if !sent {
+			return
+		}
+	}
+}
+
+// Free the slots of killed attempts their workers still hold on master
+// Unless a late report has freed them already
+func (master *Master) freeKilled(kills []taskKill) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	for _, k := range kills {
+		registry, ok := master.workers[k.workerId]
+		if !ok || !master.removeWorkerTask(k.workerId, k.task) {
+			continue
+		}
+		// A failed worker is not made available by a kill
+		if registry.status == FAILED {
+			registry.trackIdle()
+			continue
+		}
+		master.updateWorkerStatus(k.workerId)
+	}
+}
+
+// rpc that lets a remote client pause assigning tasks of a job
+// Like PauseScheduling, but other jobs keep being scheduled
+// Reply BAD_JOB_ID if the job was never submitted, and AUTH to a wrong secret
+func (master *Master) PauseJob(args *JobControlSend, reply *GeneralReply) error {
+	return master.pauseJob(args, reply, true)
+}
+
+// rpc that lets a remote client resume assigning tasks of a job after PauseJob
+// Reply BAD_JOB_ID if the job was never submitted, and AUTH to a wrong secret
+func (master *Master) ResumeJob(args *JobControlSend, reply *GeneralReply) error {
+	return master.pauseJob(args, reply, false)
+}
+
+// Pause or resume assigning tasks of the job in args
+// The scheduler of the job is woken up at once once it is resumed
+func (master *Master) pauseJob(args *JobControlSend, reply *GeneralReply, paused bool) error {
+	if err := master.enter(); err != nil {
+		return err
+	}
+	defer master.inflight.Done()
+
+	if !master.checkSecret(args.Secret) {
+		reply.Err = AUTH
+		return nil
+	}
+
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	if master.closed {
+		return ErrMasterClosed
+	}
+	job := master.getJob(args.JobId)
+	if job == nil {
+		reply.Err = BAD_JOB_ID
+		return nil
+	}
+	if job.paused != paused {
+		if paused {
+			master.config.Logger.Infof("Job %v: scheduling paused", job.id)
+		} else {
+			master.config.Logger.Infof("Job %v: scheduling resumed", job.id)
+			master.signalChange()
+		}
+		job.paused = paused
+	}
+	reply.Err = OK
+	return nil
+}
+
+// Stop assigning new tasks, including backup copies of stragglers
+// Running tasks keep going and their results are still recorded
+func (master *Master) PauseScheduling() error {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	if master.closed {
+		return ErrMasterClosed
+	}
+	if !master.paused {
+		master.config.Logger.Infof("Scheduling paused")
+		master.paused = true
+	}
+	return nil
+}
+
+// Assign tasks again after PauseScheduling
+// The scheduler is woken up at once instead of at the next tick
+func (master *Master) ResumeScheduling() error {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	if master.closed {
+		return ErrMasterClosed
+	}
+	if master.paused {
+		master.config.Logger.Infof("Scheduling resumed")
+		master.paused = false
+		master.signalChange()
+	}
+	return nil
+}
+
+// Return true if scheduling is paused
+func (master *Master) Paused() bool {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	return master.paused
+}
+
+// Stop the master
+// Stop the listener so no new rpc (including registration) is accepted
+// Rpcs running are answered until ctx is done before connections are closed
+// And close the http server of diagnostics
+// Stop the scheduler loops, and wait for them and in-flight rpc handlers
+// Return the error of ctx if they do not finish before ctx is done
+// Every rpc of master returns ErrMasterClosed afterwards
+func (master *Master) Shutdown(ctx context.Context) error {
+	master.mu.Lock()
+	if master.closed {
+		master.mu.Unlock()
+		return ErrMasterClosed
+	}
+	master.closed = true
+	if master.hookStop != nil {
+		close(master.hookStop)
+	}
+	master.signalChange()
+	listener := master.listener
+	codecListeners := master.codecListeners
+	httpServer := master.httpServer
+	master.mu.Unlock()
+
+	// Rpcs running finish before their connections are closed
+	if listener != nil {
+		stopListener(ctx, listener)
+	}
+	for _, listener := range codecListeners {
+		stopListener(ctx, listener)
+	}
+	if httpServer != nil {
+		httpServer.Close()
+		unpublishExpvar(master)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		master.inflight.Wait()
+		master.loops.Wait()
+		close(done)
+	}()
+
+	// The logs are closed only once the rpcs that got in have returned
+	// So a transition that was replied to is never missing from the log
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	master.transport.Close()
+	master.closeLogs()
+	return err
+}
+
+// Close the write-ahead log and the event log of master
+// Records appended afterwards are dropped
+func (master *Master) closeLogs() {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	if master.wal != nil {
+		master.wal.close()
+		master.wal = nil
+	}
+	if master.events != nil {
+		master.events.close()
+		master.events = nil
+	}
+}
+
+// Return the ids of available workers
+// In round-robin order starting from nextWorker so tasks spread evenly
+// Workers whose circuit is not closed are skipped until it closes
+func (master *Master) getAvailableWorkers() []int64 {
+	var result []int64
+	n := len(master.workerOrder)
+	for i := 0; i < n; i++ {
+		port := master.workerOrder[(master.nextWorker+i)%n]
+		if registry := master.workers[port]; registry.status == AVAILABLE && !registry.retiring &&
+			master.breaker.state(registry.addr) == CIRCUIT_CLOSED {
+			result = append(result, port)
+		}
+	}
+	return result
+}
+
+// Return true if worker a is expected to run a task faster than worker b
+// By the average duration of the attempts they reported
+// A worker without history is considered the fastest
+func (master *Master) fasterWorker(a, b int64) bool {
+	return master.workerStats(a).AverageDuration <
+		master.workerStats(b).AverageDuration
+}
+
+// Return true if worker a has more resources to spare than worker b
+// By the resource weights of config
+func (master *Master) richerWorker(a, b int64) bool {
+	return master.config.resourceScore(master.workers[a].resources) >
+		master.config.resourceScore(master.workers[b].resources)
+}
+
+// Return the percentage of map attempts with location hints
+// That are assigned to a worker holding the input
+// Return 0 if no such attempt has been made
+func (master *Master) LocalTaskPercentage() float64 {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	if master.hintedAssigned == 0 {
+		return 0
+	}
+	return float64(master.localAssigned) * 100 / float64(master.hintedAssigned)
+}
+
+// Move the round-robin cursor past the worker
+func (master *Master) advanceWorkerCursor(workerId int64) {
+	for idx, port := range master.workerOrder {
+		if port == workerId {
+			master.nextWorker = idx + 1
+			return
+		}
+	}
+}
+
+// Return the number of tasks assigned to each worker
+func (master *Master) AssignmentCounts() map[int64]int {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	result := map[int64]int{}
+	for port, count := range master.assignCount {
+		result[port] = count
+	}
+	return result
+}
+
+// Get the reference of status array given task type
+// Return error if task type is unexpected
+func (job *jobState) getStatusRef(taskType TaskType) (*[]int, error) {
+	switch taskType {
+	case MAP:
+		return &job.mapStatus, nil
+	case REDUCE:
+		return &job.reduceStatus, nil
+	}
+	return nil, badTaskType(taskType)
+}
+
+// Get the reference of meta array given task type
+// Return error if task type is unexpected
+func (job *jobState) getMetaRef(taskType TaskType) (*[]taskMeta, error) {
+	switch taskType {
+	case MAP:
+		return &job.mapMeta, nil
+	case REDUCE:
+		return &job.reduceMeta, nil
+	}
+	return nil, badTaskType(taskType)
+}
+
+// Get the reference of dispatch queue given task type
+// Return error if task type is unexpected
+func (job *jobState) getQueueRef(taskType TaskType) (*[]TaskId, error) {
+	switch taskType {
+	case MAP:
+		return &job.mapQueue, nil
+	case REDUCE:
+		return &job.reduceQueue, nil
+	}
+	return nil, badTaskType(taskType)
+}
+
+// Put the task to the front of its dispatch queue
+func (job *jobState) requeueTask(id TaskId, taskType TaskType) error {
+	if err := job.dequeueTask(id, taskType); err != nil {
+		return err
+	}
+	queueRef, _ := job.getQueueRef(taskType)
+	*queueRef = append([]TaskId{id}, *queueRef...)
+	return nil
+}
+
+// Remove the task from its dispatch queue
+func (job *jobState) dequeueTask(id TaskId, taskType TaskType) error {
+	queueRef, err := job.getQueueRef(taskType)
+	if err != nil {
+		return err
+	}
+	for idx, queued := range *queueRef {
+		if queued == id {
+			*queueRef = append((*queueRef)[:idx], (*queueRef)[idx+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Return the unprocessed task id of task type at the front of the queue
+// Return -1 if no unprocessed task is found or task type is unexpected
+func (job *jobState) getUnprocessedTaskId(taskType TaskType) TaskId {
+	queueRef, err := job.getQueueRef(taskType)
+	if err != nil || len(*queueRef) == 0 {
+		return -1
+	}
+	return (*queueRef)[0]
+}
+
+// Return true if the worker runs on a host holding the input of map task id
+func (job *jobState) isLocal(id TaskId, workerId int64) bool {
+	if int(id) >= len(job.inputLocations) {
+		return false
+	}
+
+	registry := job.master.workers[workerId]
+	port := strconv.FormatInt(addrPort(registry.addr), 10)
+	for _, location := range job.inputLocations[id] {
+		if location == registry.host || location == port || location == registry.addr ||
+			location == joinAddr(registry.host, addrPort(registry.addr)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the unprocessed task id of task type to assign to the worker
+// A map task with location hints goes to a worker holding its input
+// Unless it has waited LocalityDelay for such worker
+// The returned flag tells if the worker holds the input
+// Return -1 if no task should be assigned to the worker
+func (job *jobState) getTaskForWorker(workerId int64,
+	taskType TaskType) (TaskId, bool) {
+	if taskType != MAP || len(job.inputLocations) == 0 {
+		return job.getUnprocessedTaskId(taskType), false
+	}
+
+	// Search the queue in order for a local task
+	var fallback TaskId = -1
+	for _, id := range job.mapQueue {
+		idx := int(id)
+		if idx >= len(job.inputLocations) ||
+			len(job.inputLocations[idx]) == 0 {
+			// No hints, any worker is fine
+			if fallback == -1 {
+				fallback = id
+			}
+			continue
+		}
+		if job.isLocal(id, workerId) {
+			return id, true
+		}
+
+		since := job.mapMeta[idx].pendingSince
+		if since.IsZero() {
+			since = job.startTime
+		}
+		if fallback == -1 && time.Since(since) > job.master.config.LocalityDelay {
+			fallback = id
+		}
+	}
+
+	return fallback, false
+}
+
+// Put the largest reduce partitions first in the dispatch queue
+// Called once the size of every partition is known
+func (job *jobState) orderReduceQueue() {
+	sort.SliceStable(job.reduceQueue, func(i, j int) bool {
+		return job.partitionBytes[job.reduceQueue[i]] >
+			job.partitionBytes[job.reduceQueue[j]]
+	})
+}
+
+// Return the id of a processing task that is worth a backup copy on the worker
+// A worker running an attempt of the task is no use for its backup
+// Return -1 if no such task is found or task type is unexpected
+func (job *jobState) getStragglerTaskId(taskType TaskType, workerId int64) TaskId {
+	statusRef, err := job.getStatusRef(taskType)
+	if err != nil {
+		return -1
+	}
+	metaRef, _ := job.getMetaRef(taskType)
+	config := &job.master.config
+
+	if config.SpeculativeRatio <= 0 {
+		return -1
+	}
+
+	// Collect durations of finished tasks and count backed up tasks
+	// Tasks finished by an earlier run (resumed or recovered) took no time here
+	var durations []time.Duration
+	speculated := 0
+	for idx, status := range *statusRef {
+		if status == FINISHED && (*metaRef)[idx].attempts > 0 {
+			durations = append(durations, (*metaRef)[idx].duration)
+		}
+		if (*metaRef)[idx].speculated {
+			speculated++
+		}
+	}
+
+	// No median to compare to yet
+	if len(durations) == 0 {
+		return -1
+	}
+
+	// Keep the number of backup copies under the cap
+	limit := int(config.SpeculativeRatio * float64(len(*statusRef)))
+	if limit < 1 {
+		limit = 1
+	}
+	if speculated >= limit {
+		return -1
+	}
+
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+	threshold := time.Duration(
+		float64(durations[len(durations)/2]) * config.SpeculativeFactor,
+	)
+
+	// A task still making progress is slow rather than stuck
+	for idx, status := range *statusRef {
+		meta := (*metaRef)[idx]
+		if status == PROCESSING && !meta.speculated &&
+			time.Since(meta.lastActive()) > threshold &&
+			!job.master.runsTask(workerId, job.id, TaskId(idx), taskType) {
+			return TaskId(idx)
+		}
+	}
+
+	return -1
+}
+
+// Set the status indicated by taskId and taskType
+// Record the start time if the task goes to PROCESSING
+// A task going back to UNPROCESSED is put to the front of the queue
+// Return error if task type is unexpected
+func (job *jobState) setTaskStatus(id TaskId, taskType TaskType, status int) error {
+	statusRef, err := job.getStatusRef(taskType)
+	if err != nil {
+		return err
+	}
+	(*statusRef)[id] = status
+
+	metaRef, _ := job.getMetaRef(taskType)
+	record := walRecord{
+		Kind:     WAL_TASK,
+		JobId:    job.id,
+		TaskId:   id,
+		TaskType: taskType,
+		Status:   status,
+		Attempts: (*metaRef)[id].attempts,
+		Failures: (*metaRef)[id].failures,
+		Err:      (*metaRef)[id].lastError,
+	}
+	if status == FINISHED {
+		record.WorkerId = (*metaRef)[id].outputWorker
+	}
+	job.master.logRecord(record)
+
+	// Only unprocessed tasks stay in the dispatch queue
+	switch status {
+	case PROCESSING:
+		(*metaRef)[id].startTime = time.Now()
+		(*metaRef)[id].progress = 0
+		(*metaRef)[id].progressTime = time.Time{}
+		(*metaRef)[id].stragglerWarned = false
+		job.dequeueTask(id, taskType)
+	case UNPROCESSED:
+		(*metaRef)[id].pendingSince = time.Now()
+		job.requeueTask(id, taskType)
+		job.master.signalChange()
+	default:
+		job.dequeueTask(id, taskType)
+		job.master.signalChange()
+	}
+	return nil
+}
+
+// Get the status indicated by taskId and taskType
+// Return error if task type is unexpected
+func (job *jobState) getTaskStatus(id TaskId, taskType TaskType) (int, error) {
+	statusRef, err := job.getStatusRef(taskType)
+	if err != nil {
+		return 0, err
+	}
+	return (*statusRef)[id], nil
+}
+
+// Requeue the attempts of a worker that registers again
+// They died with its old process
+// Must be called with lock held
+func (master *Master) requeueWorker(workerId int64, registry *WorkerRegistry) {
+	if len(registry.tasks) == 0 {
+		return
+	}
+	master.config.Logger.Warnf("Worker %v registered again while running %v tasks, requeue them",
+		workerId, len(registry.tasks))
+	for _, t := range registry.tasks {
+		master.jobs[t.jobId].dropAttempt(t.taskId, t.taskType, t.attemptId,
+			"worker restarted")
+	}
+	registry.tasks = nil
+}
+
+// Return true if the worker holds a slot of an attempt of the task
+// Must be called with lock held
+func (master *Master) runsTask(workerId int64, jobId JobId, taskId TaskId,
+	taskType TaskType) bool {
+	registry, ok := master.workers[workerId]
+	if !ok {
+		return false
+	}
+	for _, task := range registry.tasks {
+		if task.jobId == jobId && task.taskId == taskId && task.taskType == taskType {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove a failed worker from master
+// Its late rpcs get UNKNOWN_WORKER, and it is brand new if it registers again
+func (master *Master) deleteWorker(workerId int64) {
+	if registry, ok := master.workers[workerId]; ok {
+		master.transport.Forget(registry.addr)
+		master.breaker.forget(registry.addr)
+	}
+	delete(master.workers, workerId)
+	delete(master.assignCount, workerId)
+	for idx, port := range master.workerOrder {
+		if port == workerId {
+			master.workerOrder = append(master.workerOrder[:idx],
+				master.workerOrder[idx+1:]...)
+			if idx < master.nextWorker {
+				master.nextWorker--
+			}
+			break
+		}
+	}
+}
+
+// Set the status of worker by its free slots
+// Wake the scheduler if the worker becomes available
+// A blacklisted worker stays blacklisted
+func (master *Master) updateWorkerStatus(workerId int64) {
+	registry, ok := master.workers[workerId]
+	if !ok {
+		return
+	}
+	registry.trackIdle()
+	if registry.status == BLACKLISTED {
+		return
+	}
+	if len(registry.tasks) < registry.slots {
+		registry.status = AVAILABLE
+		master.signalChange()
+	} else {
+		registry.status = RUNNING
+	}
+}
+
+// Set idleSince once the worker runs no task, and clear it while it runs some
+func (registry *WorkerRegistry) trackIdle() {
+	if len(registry.tasks) > 0 {
+		registry.idleSince = time.Time{}
+	} else if registry.idleSince.IsZero() {
+		registry.idleSince = time.Now()
+	}
+}
+
+// Take a slot of the worker for task
+func (master *Master) addWorkerTask(workerId int64, task runningTask) {
+	registry := master.workers[workerId]
+	registry.tasks = append(registry.tasks, task)
+	master.updateWorkerStatus(workerId)
+}
+
+// Free the slot of the worker taken by task
+// Return false if the worker is not running task or has been deleted
+func (master *Master) removeWorkerTask(workerId int64, task runningTask) bool {
+	registry, ok := master.workers[workerId]
+	if !ok {
+		return false
+	}
+	for idx, t := range registry.tasks {
+		if t == task {
+			registry.tasks = append(registry.tasks[:idx], registry.tasks[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Mark the worker as failed
+// Give up every attempt it is running, so a late report from it is wasted
+// And mark the tasks as unprocessed (meaning have to be redo)
+func (master *Master) failWorker(workerId int64) {
+	registry := master.workers[workerId]
+	registry.failures += len(registry.tasks)
+	for _, t := range registry.tasks {
+		master.jobs[t.jobId].dropAttempt(t.taskId, t.taskType, t.attemptId,
+			"worker failed")
+	}
+	registry.tasks = nil
+	registry.status = FAILED
+	registry.failedAt = time.Now()
+	master.workerHook("OnWorkerFailed", master.config.Hooks.OnWorkerFailed, workerId)
+	master.logEvent(Event{Kind: EVENT_WORKER_FAILED, WorkerId: workerId})
+}
+
+// Attribute a task failure to the worker
+// Blacklist it once it has BlacklistStrikes failures within BlacklistWindow
+func (master *Master) strikeWorker(workerId int64, reason string) {
+	registry, ok := master.workers[workerId]
+	if !ok {
+		return
+	}
+	registry.failures++
+	if registry.status == FAILED || registry.status == BLACKLISTED {
+		return
+	}
+
+	// Only keep the strikes within the window
+	now := time.Now()
+	var strikes []time.Time
+	for _, t := range registry.strikes {
+		if now.Sub(t) < master.config.BlacklistWindow {
+			strikes = append(strikes, t)
+		}
+	}
+	registry.strikes = append(strikes, now)
+
+	if len(registry.strikes) >= master.config.BlacklistStrikes {
+		master.config.Logger.Warnf("Worker %v blacklisted after %v failures, last: %v",
+			workerId, len(registry.strikes), reason)
+		registry.status = BLACKLISTED
+		registry.blacklistedAt = now
+	}
+}
+
+// Periodically probe blacklisted workers
+// A worker that keeps responding for BlacklistCooldown is readmitted
+func (master *Master) checkBlacklistedWorker() {
+	for master.isActive() {
+		// Snapshot blacklisted workers and probe them outside the lock
+		master.mu.Lock()
+		var ids []int64
+		var addrs []string
+		for id, registry := range master.workers {
+			if registry.status == BLACKLISTED {
+				ids = append(ids, id)
+				addrs = append(addrs, registry.addr)
+			}
+		}
+		master.mu.Unlock()
+
+		for idx, port := range ids {
+			online := reachable(master.call(master.config.ProbeTimeout, addrs[idx], "Worker.IsOnline", &struct{}{}, &struct{}{}))
+
+			master.mu.Lock()
+			registry, ok := master.workers[port]
+			if ok && registry.status == BLACKLISTED {
+				if !online {
+					// Start the cooldown over
+					registry.blacklistedAt = time.Now()
+				} else if time.Since(registry.blacklistedAt) > master.config.BlacklistCooldown {
+					master.config.Logger.Infof("Worker %v readmitted", port)
+					registry.strikes = nil
+					registry.status = AVAILABLE
+					master.updateWorkerStatus(port)
+				}
+			}
+			master.mu.Unlock()
+		}
+
+		time.Sleep(master.config.SchedulerTick)
+	}
+}
+
+// Return the ids of blacklisted workers
+func (master *Master) Blacklist() []int64 {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	var result []int64
+	for _, port := range master.workerOrder {
+		if master.workers[port].status == BLACKLISTED {
+			result = append(result, port)
+		}
+	}
+	return result
+}
+
+// Wake up every goroutine waiting for master state to change
+// Must be called with lock held
+func (master *Master) signalChange() {
+	close(master.changed)
+	master.changed = make(chan struct{})
+}
+
+// Block until master state changes or a scheduler tick passes
+// Must be called with lock held, the lock is released while waiting
+func (master *Master) waitChange() {
+	master.waitChangeUntil(time.Now().Add(master.config.SchedulerTick))
+}
+
+// Block until master state changes or deadline passes
+// Must be called with lock held, the lock is released while waiting
+func (master *Master) waitChangeUntil(deadline time.Time) {
+	changed := master.changed
+	master.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(deadline))
+	select {
+	case <-changed:
+	case <-timer.C:
+	}
+	timer.Stop()
+
+	master.mu.Lock()
+}
+
+// Block until the phase of the job indicated by taskType has finished
+// Or the job stops
+func (master *Master) waitPhase(job *jobState, taskType TaskType) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	if _, err := job.getStatusRef(taskType); err != nil {
+		master.config.Logger.Errorf("Job %v: waitPhase: %v", job.id, err)
+		return
+	}
+	for !job.phaseFinished(taskType) && !job.halted() {
+		master.waitChange()
+	}
+}
+
+// Pick a task of taskType in the job for the worker and mark both as busy
+// A straggler is backed up if there is no unprocessed task
+// Return the task id and the id of this attempt
+// Return -1 if no task needs a worker now
+// Must be called with lock held
+func (master *Master) assignTask(job *jobState, workerId int64,
+	taskType TaskType) (TaskId, AttemptId) {
+	// A map task may run again after its output is lost
+	// Reduce tasks wait until the map phase has finished again
+	if taskType == REDUCE && !job.phaseFinished(MAP) {
+		return -1, -1
+	}
+
+	// Get unprocessed task id
+	// If there is none, try to back up a straggler
+	taskId, local := job.getTaskForWorker(workerId, taskType)
+	backup := false
+	if taskId == -1 {
+		taskId = job.getStragglerTaskId(taskType, workerId)
+		backup = true
+	}
+	if taskId == -1 {
+		return -1, -1
+	}
+
+	// Set task status and worker status
+	// A backup copy keeps the start time of the original attempt
+	metaRef, err := job.getMetaRef(taskType)
+	if err != nil {
+		master.config.Logger.Errorf("Job %v: assignTask: %v", job.id, err)
+		return -1, -1
+	}
+	if backup {
+		master.config.Logger.Infof("Job %v: %v task %v is a straggler, launch backup",
+			job.id, taskTypeName(taskType), taskId)
+		(*metaRef)[taskId].speculated = true
+	} else if err := job.setTaskStatus(taskId, taskType, PROCESSING); err != nil {
+		master.config.Logger.Errorf("Job %v: assignTask: %v", job.id, err)
+		return -1, -1
+	}
+
+	// Start a new attempt
+	meta := &(*metaRef)[taskId]
+	attemptId := AttemptId(meta.attempts)
+	meta.attempts++
+	if meta.live == nil {
+		meta.live = map[AttemptId]time.Time{}
+	}
+	meta.live[attemptId] = time.Now()
+	meta.grantLease(attemptId, master.config.TaskLease)
+	// The task keeps the worker of its primary attempt
+	if backup {
+		if meta.backups == nil {
+			meta.backups = map[AttemptId]int64{}
+		}
+		meta.backups[attemptId] = workerId
+	} else {
+		meta.worker = workerId
+		meta.local = local
+	}
+
+	// Record the locality decision of hinted map tasks
+	if taskType == MAP && int(taskId) < len(job.inputLocations) &&
+		len(job.inputLocations[taskId]) > 0 {
+		master.hintedAssigned++
+		if local {
+			master.localAssigned++
+		}
+	}
+
+	task := runningTask{
+		jobId:     job.id,
+		taskId:    taskId,
+		taskType:  taskType,
+		attemptId: attemptId,
+	}
+	master.addWorkerTask(workerId, task)
+	master.workers[workerId].lastAssigned = time.Now()
+	master.timeline.assigned(task, workerId)
+	master.taskHook("OnTaskScheduled", master.config.Hooks.OnTaskScheduled, task.event(workerId))
+	master.logTaskEvent(EVENT_ASSIGNED, task, workerId, "", "")
+	master.assignCount[workerId]++
+	master.metrics.taskDispatched(taskType)
+
+	return taskId, attemptId
+}
+
+// Give up an attempt that will never report its result
+// The task is retried if no other attempt is running
+// Must be called with lock held
+func (job *jobState) dropAttempt(taskId TaskId, taskType TaskType,
+	attemptId AttemptId, reason string) {
+	metaRef, err := job.getMetaRef(taskType)
+	if err != nil {
+		job.master.config.Logger.Errorf("Job %v: dropAttempt: %v", job.id, err)
+		return
+	}
+	live := (*metaRef)[taskId].live
+	if _, ok := live[attemptId]; ok {
+		(*metaRef)[taskId].failures++
+	}
+	delete(live, attemptId)
+	job.master.timeline.ended(runningTask{
+		jobId:     job.id,
+		taskId:    taskId,
+		taskType:  taskType,
+		attemptId: attemptId,
+	}, ATTEMPT_FAILED)
+
+	if status, _ := job.getTaskStatus(taskId, taskType); len(live) == 0 &&
+		status == PROCESSING {
+		job.retryTask(taskId, taskType, reason)
+	}
+}
+
+// Return true if the attempt was started and master has given it up since
+// Must be called with lock held
+func (job *jobState) givenUp(taskId TaskId, taskType TaskType, attemptId AttemptId) bool {
+	metaRef, err := job.getMetaRef(taskType)
+	if err != nil {
+		return false
+	}
+	meta := &(*metaRef)[taskId]
+	_, live := meta.live[attemptId]
+	return attemptId >= 0 && int(attemptId) < meta.attempts && !live
+}
+
+// Hand a processing task back to the scheduler
+// If it has run out of attempts, mark it failed and fail the whole job
+// Must be called with lock held
+func (job *jobState) retryTask(taskId TaskId, taskType TaskType,
+	reason string) {
+	metaRef, err := job.getMetaRef(taskType)
+	if err != nil {
+		job.master.config.Logger.Errorf("Job %v: retryTask: %v", job.id, err)
+		return
+	}
+	meta := &(*metaRef)[taskId]
+	meta.lastError = reason
+
+	if meta.failures < job.master.config.MaxTaskAttempts && !meta.permanent {
+		job.setTaskStatus(taskId, taskType, UNPROCESSED)
+		job.master.metrics.taskRequeued(taskType)
+
+		task := runningTask{
+			jobId:     job.id,
+			taskId:    taskId,
+			taskType:  taskType,
+			attemptId: AttemptId(meta.attempts - 1),
+		}
+		event := task.event(meta.worker)
+		event.Reason = reason
+		job.master.taskHook("OnTaskRequeued", job.master.config.Hooks.OnTaskRequeued, event)
+		job.master.logTaskEvent(EVENT_REQUEUED, task, meta.worker, "", reason)
+		return
+	}
+
+	if job.canSkip(taskType) {
+		job.master.config.Logger.Errorf("Job %v: %v task %v failed after %v attempts, skip it: %v",
+			job.id, taskTypeName(taskType), taskId, meta.failures, reason)
+		job.setTaskStatus(taskId, taskType, SKIPPED)
+
+		// Attempts still running can only be wasted, free their slots
+		meta.live = map[AttemptId]time.Time{}
+		kills := job.master.releaseTasks(func(task runningTask) bool {
+			return task.jobId == job.id && task.taskId == taskId &&
+				task.taskType == taskType
+		})
+		go job.master.killTasks(kills)
+
+		if taskType == MAP {
+			job.mapSkippedCount++
+			if job.phaseFinished(MAP) {
+				job.orderReduceQueue()
+			}
+		} else {
+			job.reduceSkippedCount++
+		}
+		return
+	}
+
+	job.master.config.Logger.Errorf("Job %v: %v task %v failed after %v attempts: %v",
+		job.id, taskTypeName(taskType), taskId, meta.failures, reason)
+	job.setTaskStatus(taskId, taskType, TASK_FAILED)
+	if job.failure == nil {
+		job.failure = &JobFailure{
+			JobId:    job.id,
+			TaskId:   taskId,
+			TaskType: taskType,
+			Err:      reason,
+		}
+		if taskType == MAP {
+			job.failure.InputFile = job.splits[taskId].File
+		}
+	}
+}
+
+// Return true if one more task of taskType can be skipped
+// Without the skipped tasks of the phase exceeding MaxFailedTaskRatio
+// Must be called with lock held
+func (job *jobState) canSkip(taskType TaskType) bool {
+	total, skipped := job.nMap, job.mapSkippedCount
+	if taskType == REDUCE {
+		total, skipped = job.nReduce, job.reduceSkippedCount
+	}
+	return float64(skipped+1) <= job.master.config.MaxFailedTaskRatio*float64(total)
+}
+
+// Return true if master stops scheduling every job
+// Because it has been shut down, aborted or fenced
+// Must be called with lock held
+func (master *Master) halted() bool {
+	return master.closed || master.aborted || master.fenced
+}
+
+// Return true if master has not halted
+// Must be called with lock held
+func (master *Master) active() bool {
+	return !master.halted()
+}
+
+// Return true if master has not halted
+func (master *Master) isActive() bool {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	return master.active()
+}
+
+// Build the arguments to start map task taskId
+func (job *jobState) makeMapStartSend(taskId TaskId,
+	attemptId AttemptId) MapStartSend {
+	return MapStartSend{
+		Term:           job.master.term,
+		JobId:          job.id,
+		InputFile:      job.splits[taskId].File,
+		Offset:         job.splits[taskId].Offset,
+		Length:         job.splits[taskId].Length,
+		TaskId:         taskId,
+		AttemptId:      attemptId,
+		ReduceNum:      job.nReduce,
+		MapOnly:        job.nReduce == 0,
+		OutputDir:      job.outputDir,
+		MapDir:         job.master.config.MapDir,
+		SkipBadRecords: job.skipPolicy,
+		CacheFiles:     job.cacheFiles,
+		Lease:          job.master.config.TaskLease,
+	}
+}
+
+// Build the arguments to start reduce task taskId
+func (job *jobState) makeReduceStartSend(taskId TaskId,
+	attemptId AttemptId) ReduceStartSend {
+	send := ReduceStartSend{
+		Term:       job.master.term,
+		JobId:      job.id,
+		TaskId:     taskId,
+		AttemptId:  attemptId,
+		MapNum:     job.nMap,
+		OutputDir:  job.outputDir,
+		MapDir:     job.master.config.MapDir,
+		MapWorkers: make([]int64, job.nMap),
+		MapAddrs:   make([]string, job.nMap),
+		CacheFiles: job.cacheFiles,
+		Lease:      job.master.config.TaskLease,
+	}
+	for idx, meta := range job.mapMeta {
+		// Left 0 for output in a shared MAP_DIR, so reducers read it there
+		registry, ok := job.master.workers[meta.outputWorker]
+		if ok && registry.sharedOutput {
+			continue
+		}
+		send.MapWorkers[idx] = meta.outputWorker
+		if ok {
+			send.MapAddrs[idx] = registry.addr
+		}
+	}
+	for idx, status := range job.mapStatus {
+		if status == SKIPPED {
+			send.SkippedMaps = append(send.SkippedMaps, TaskId(idx))
+		}
+	}
+	return send
+}
+
+// Assign unprocessed task of the job to available workers
+// Sleep until a worker is freed or a task is requeued if nothing can be done
+func (master *Master) checkAvailableWorkerForTask(job *jobState,
+	taskType TaskType) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	if _, err := job.getStatusRef(taskType); err != nil {
+		master.config.Logger.Errorf("Job %v: checkAvailableWorkerForTask: %v", job.id, err)
+		return
+	}
+
+	// If task has already finished, then just quit
+	// Because it is no longer necessary
+	for !job.phaseFinished(taskType) && !job.halted() {
+		master.schedulerIterations++
+
+		// Nothing is assigned until scheduling is resumed
+		if master.paused || job.paused {
+			master.waitChange()
+			continue
+		}
+		// Nor while DispatchParallelism dispatches are in flight
+		if !master.acquireDispatch() {
+			continue
+		}
+
+		// Find an available worker and a task for it
+		// Workers with the most resources first if resources are weighted
+		// The largest reduce partitions go to the fastest workers
+		workers := master.getAvailableWorkers()
+		if master.config.resourceWeighted() {
+			sort.SliceStable(workers, func(i, j int) bool {
+				return master.richerWorker(workers[i], workers[j])
+			})
+		}
+		if taskType == REDUCE {
+			sort.SliceStable(workers, func(i, j int) bool {
+				return master.fasterWorker(workers[i], workers[j])
+			})
+		}
+
+		var workerId int64 = -1
+		var taskId TaskId = -1
+		var attemptId AttemptId
+		for _, port := range workers {
+			taskId, attemptId = master.assignTask(job, port, taskType)
+			if taskId != -1 {
+				workerId = port
+				break
+			}
+		}
+		if taskId == -1 {
+			master.releaseDispatch()
+			master.waitChange()
+			continue
+		}
+		master.advanceWorkerCursor(workerId)
+
+		// Build the rpc that starts the task
+		var rpcName string
+		var args interface{}
+		switch taskType {
+		case MAP:
+			mapArgs := job.makeMapStartSend(taskId, attemptId)
+			mapArgs.Token = master.workerToken(workerId)
+			mapArgs.Deadline = master.dispatchDeadline()
+			rpcName, args = "Worker.StartMap", &mapArgs
+		case REDUCE:
+			reduceArgs := job.makeReduceStartSend(taskId, attemptId)
+			reduceArgs.Token = master.workerToken(workerId)
+			reduceArgs.Compression = master.compressionFor(job, workerId)
+			reduceArgs.Deadline = master.dispatchDeadline()
+			rpcName, args = "Worker.StartReduce", &reduceArgs
+		}
+
+		// Start map or reduce function without waiting for the worker
+		// So a slow worker holds up no other assignment, see finishDispatches
+		master.startDispatch(&dispatch{
+			job:       job,
+			workerId:  workerId,
+			addr:      master.workers[workerId].addr,
+			taskId:    taskId,
+			taskType:  taskType,
+			attemptId: attemptId,
+			rpcName:   rpcName,
+			args:      args,
+		})
+	}
+}
+
+// Mark tasks of the job that exceed TaskTimeout as unprocessed
+// Wake up at the next deadline of a running task, or once master state changes
+// A late TaskFinished of such task is still accepted or wasted by TaskFinished
+func (master *Master) checkTimeoutTask(job *jobState, taskType TaskType) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	statusRef, err := job.getStatusRef(taskType)
+	if err != nil {
+		master.config.Logger.Errorf("Job %v: checkTimeoutTask: %v", job.id, err)
+		return
+	}
+	metaRef, _ := job.getMetaRef(taskType)
+
+	for !job.phaseFinished(taskType) && !job.halted() {
+		// A task assigned after this pass times out a full timeout from now at the earliest
+		now := time.Now()
+		next := now.Add(master.config.TaskTimeout)
+		if master.config.TaskLease > 0 {
+			next = now.Add(master.config.TaskLease)
+		}
+		for idx, status := range *statusRef {
+			if status != PROCESSING {
+				continue
+			}
+			meta := &(*metaRef)[idx]
+			// With leases, a task keeps running as long as its worker renews them
+			if master.config.TaskLease > 0 {
+				job.expireLeases(TaskId(idx), taskType)
+				for attemptId := range meta.live {
+					if lapse := meta.leases[attemptId]; lapse.Before(next) {
+						next = lapse
+					}
+				}
+				continue
+			}
+			// A task keeps running as long as it makes progress
+			deadline := meta.lastActive().Add(master.config.TaskTimeout)
+			if now.After(deadline) {
+				master.config.Logger.Warnf("Job %v: %v task %v timeout at %.0f%%, reassign it",
+					job.id, taskTypeName(taskType), idx, 100*meta.progress)
+				job.timeoutTask(TaskId(idx), taskType)
+			} else if deadline.Before(next) {
+				next = deadline
+			}
+		}
+
+		master.waitChangeUntil(next)
+	}
+}
+
+// Give up every live attempt of a task that timed out
+// Their workers are struck, their slots freed and they are killed on their workers
+// So a late report is wasted, and the task can go back to the same worker
+// The task is retried once no attempt is left
+// Must be called with lock held
+func (job *jobState) timeoutTask(taskId TaskId, taskType TaskType) {
+	master := job.master
+	metaRef, _ := job.getMetaRef(taskType)
+	meta := &(*metaRef)[taskId]
+	for attemptId := range meta.live {
+		task := runningTask{
+			jobId:     job.id,
+			taskId:    taskId,
+			taskType:  taskType,
+			attemptId: attemptId,
+		}
+		for workerId, registry := range master.workers {
+			for _, t := range registry.tasks {
+				if t == task {
+					master.strikeWorker(workerId, "task timeout")
+				}
+			}
+		}
+		job.dropAttempt(taskId, taskType, attemptId, "task timeout")
+		kills := master.releaseTasks(func(t runningTask) bool { return t == task })
+		go master.killTasks(kills)
+	}
+	// No attempt was live, e.g. its dispatch is still in flight
+	if status, _ := job.getTaskStatus(taskId, taskType); status == PROCESSING &&
+		len(meta.live) == 0 {
+		meta.failures++
+		job.retryTask(taskId, taskType, "task timeout")
+	}
+}
+
+// Return true if map of the job has finished
+// Return false if the job was never submitted
+func (master *Master) MapFinished(id JobId) bool {
+	finished, _ := master.PhaseFinished(id, MAP)
+	return finished
+}
+
+// Return true if reduce of the job has finished
+// Return false if the job was never submitted
+func (master *Master) ReduceFinished(id JobId) bool {
+	finished, _ := master.PhaseFinished(id, REDUCE)
+	return finished
+}
+
+// Return true if the phase indicated by taskType has finished
+// Skipped tasks count as finished
+// Return false if task type is unexpected
+// Must be called with lock held
+func (job *jobState) phaseFinished(taskType TaskType) bool {
+	switch taskType {
+	case MAP:
+		return job.mapFinishedCount+job.mapSkippedCount == job.nMap
+	case REDUCE:
+		return job.reduceFinishedCount+job.reduceSkippedCount == job.nReduce
+	}
+	return false
+}
+
+// Return true if the phase of the job indicated by taskType has finished
+// Return ErrUnknownJob if the job was never submitted
+// And ErrBadTaskType if task type is unexpected
+func (master *Master) PhaseFinished(id JobId, taskType TaskType) (bool, error) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	job := master.getJob(id)
+	if job == nil {
+		return false, ErrUnknownJob
+	}
+	if taskType != MAP && taskType != REDUCE {
+		return false, badTaskType(taskType)
+	}
+	return job.phaseFinished(taskType), nil
+}
+
+// Return true if the job has no reduce phase
+func (master *Master) MapOnly(id JobId) bool {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	job := master.getJob(id)
+	return job != nil && job.nReduce == 0
+}
+
+// Check if every submitted job has finished
+// A job also counts once it has failed or been aborted, see JobDone
+func (master *Master) Done() bool {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	for _, job := range master.jobs {
+		if !job.done() {
+			return false
+		}
+	}
+	return true
+}
+
+// Block until every submitted job has finished and return nil
+// Return the *JobFailure of the first failed job, ErrJobAborted after Abort
+// ErrMasterClosed after Shutdown
+// Or the error of ctx if it is done first, the jobs keep running then
+func (master *Master) Wait(ctx context.Context) error {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	return master.waitResult(ctx, func() error {
+		running := false
+		for id := JobId(0); id < master.nextJobId; id++ {
+			switch err := master.jobs[id].result(); err {
+			case nil:
+			case errJobRunning:
+				running = true
+			default:
+				return err
+			}
+		}
+		if running {
+			return errJobRunning
+		}
+		return nil
+	})
+}
+
+// Return true if the job has failed because a task ran out of attempts
+func (master *Master) Failed(id JobId) bool {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	job := master.getJob(id)
+	return job != nil && job.failure != nil
+}
+
+// Return the port master listens on
+// The one it got once RunMaster has returned, if given port 0
+func (master *Master) Port() int64 {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	return master.port
+}
+
+// Return the address master listens on, nil until RunMaster
+func (master *Master) Addr() net.Addr {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	if master.listener == nil {
+		return nil
+	}
+	return master.listener.Addr()
+}
+
+// Return the addresses of the listeners of WithCodecListener, in the order passed
+// Nil until RunMaster
+func (master *Master) CodecAddrs() []net.Addr {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	var addrs []net.Addr
+	for _, listener := range master.codecListeners {
+		addrs = append(addrs, listener.Addr())
+	}
+	return addrs
+}
+
+// Return true if the job has been aborted
+func (master *Master) Aborted() bool {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	return master.aborted
+}
+
+// Return the task that failed the job
+// Return nil if the job has not failed
+func (master *Master) FailureReason(id JobId) *JobFailure {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	job := master.getJob(id)
+	if job == nil || job.failure == nil {
+		return nil
+	}
+	failure := *job.failure
+	return &failure
 }
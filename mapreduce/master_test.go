@@ -0,0 +1,1051 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of scheduling tasks on master
+
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Return the record of an attempt, false if master has none
+func attemptRecord(master *Master, taskType TaskType, taskId TaskId,
+	attemptId AttemptId) (AttemptRecord, bool) {
+	for _, record := range master.Report().Attempts {
+		if record.TaskType == taskType && record.TaskId == taskId && record.AttemptId == attemptId {
+			return record, true
+		}
+	}
+	return AttemptRecord{}, false
+}
+
+// A map whose first calls block until they are let go, like a stalled worker
+// Later calls count words right away
+type stallingMap struct {
+	mu    sync.Mutex
+	calls int
+	// The channel the n-th call blocks on
+	gates []chan struct{}
+	// If killable, a call also returns once its attempt is killed
+	killable bool
+}
+
+func newStallingMap(stalls int) *stallingMap {
+	m := &stallingMap{}
+	for i := 0; i < stalls; i++ {
+		m.gates = append(m.gates, make(chan struct{}))
+	}
+	return m
+}
+
+func (m *stallingMap) mapContext(ctx context.Context, file, content string) []KeyValue {
+	m.mu.Lock()
+	call := m.calls
+	m.calls++
+	m.mu.Unlock()
+	if call >= len(m.gates) {
+		return wcMap(file, content)
+	}
+	if m.killable {
+		select {
+		case <-m.gates[call]:
+		case <-ctx.Done():
+			return nil
+		}
+	} else {
+		<-m.gates[call]
+	}
+	return wcMap(file, content)
+}
+
+// Let the n-th call go
+func (m *stallingMap) release(n int) {
+	close(m.gates[n])
+}
+
+func TestTimedOutTaskIsReassigned(t *testing.T) {
+	contents := []string{"a b a"}
+	// The stalled attempt returns once it is killed
+	stall := newStallingMap(1)
+	stall.killable = true
+	defer stall.release(0)
+	master := startMaster(t, writeInputs(t, contents...), 1, WithTaskTimeout(300*time.Millisecond))
+	startWorker(t, master, func(worker *Worker) {
+		worker.MapContext = stall.mapContext
+	})
+
+	// With a single slot, the retry only runs if the timed out attempt freed it
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+	record, ok := attemptRecord(master, MAP, 0, 0)
+	if !ok || record.Result != ATTEMPT_FAILED {
+		t.Fatalf("first attempt %+v, want it failed by the timeout", record)
+	}
+}
+
+func TestKilledAttemptKeepsSlotUntilWorkerTold(t *testing.T) {
+	master, cluster := startFakeCluster(t, writeInputs(t, "a"), 0)
+	cluster.setHold(true)
+	workerId := cluster.addWorker(t, 1)
+	waitFor(t, time.Second, "the map started", func() bool {
+		return len(cluster.startedAttempts()) == 1
+	})
+
+	// The worker frees the slot once told, so master may not hand it out before
+	master.mu.Lock()
+	kills := master.releaseTasks(func(task runningTask) bool { return true })
+	held := len(master.workers[workerId].tasks)
+	master.mu.Unlock()
+	if len(kills) != 1 || held != 1 {
+		t.Fatalf("%v attempts to kill, %v slots taken, want the running one still taking its slot",
+			len(kills), held)
+	}
+
+	master.killTasks(kills)
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	if registry := master.workers[workerId]; len(registry.tasks) != 0 || registry.status != AVAILABLE {
+		t.Fatalf("worker %v with tasks %v once the kill was sent, want it free", registry.status,
+			registry.tasks)
+	}
+}
+
+func TestWorkerIdleOnceItsLastAttemptIsKilled(t *testing.T) {
+	for _, status := range []WorkerStatus{AVAILABLE, FAILED} {
+		t.Run(workerStatusName(status), func(t *testing.T) {
+			master, cluster := startFakeCluster(t, writeInputs(t, "a"), 0)
+			cluster.setHold(true)
+			// A free slot is left, so the worker stays AVAILABLE while it runs the map
+			workerId := cluster.addWorker(t, 2)
+			waitFor(t, time.Second, "the map started", func() bool {
+				return len(cluster.startedAttempts()) == 1
+			})
+
+			master.mu.Lock()
+			registry := master.workers[workerId]
+			if registry.status != AVAILABLE || !registry.idleSince.IsZero() {
+				master.mu.Unlock()
+				t.Fatalf("worker %v idle since %v while running the map",
+					workerStatusName(registry.status), registry.idleSince)
+			}
+			registry.status = status
+			kills := master.releaseTasks(func(task runningTask) bool { return true })
+			master.mu.Unlock()
+			master.killTasks(kills)
+
+			master.mu.Lock()
+			defer master.mu.Unlock()
+			if registry.status != status || registry.idleSince.IsZero() {
+				t.Fatalf("worker %v idle since %v once its map was killed, want it %v and idle",
+					workerStatusName(registry.status), registry.idleSince, workerStatusName(status))
+			}
+		})
+	}
+}
+
+func TestLateReportOfTimedOutAttemptIsWasted(t *testing.T) {
+	contents := []string{"a b a"}
+	stall := newStallingMap(2)
+	master := startMaster(t, writeInputs(t, contents...), 1, WithTaskTimeout(300*time.Millisecond))
+	worker := startWorker(t, master, func(worker *Worker) {
+		worker.Slots = 2
+		worker.MapContext = stall.mapContext
+	})
+	defer stall.release(0)
+
+	waitFor(t, 5*time.Second, "the retry of the timed out attempt", func() bool {
+		_, ok := attemptRecord(master, MAP, 0, 1)
+		return ok
+	})
+	if record, _ := attemptRecord(master, MAP, 0, 0); record.Result != ATTEMPT_FAILED {
+		t.Fatalf("first attempt %+v, want it failed by the timeout", record)
+	}
+	master.mu.Lock()
+	for _, task := range master.workers[worker.Id()].tasks {
+		if task.attemptId == 0 {
+			t.Errorf("worker still holds the slot of the timed out attempt")
+		}
+	}
+	master.mu.Unlock()
+
+	// The stalled worker reports after all
+	reply := GeneralReply{}
+	err := master.TaskFinished(&TaskFinishedSend{
+		JobId:          DEFAULT_JOB,
+		TaskId:         0,
+		TaskType:       MAP,
+		AttemptId:      0,
+		WorkerId:       worker.Id(),
+		PartitionBytes: []int64{0},
+	}, &reply)
+	if err != nil || reply.Err != WASTE {
+		t.Fatalf("late report replied %v, %v, want WASTE", reply.Err, err)
+	}
+
+	stall.release(1)
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+}
+
+// Assign a map task of the default job to the worker like the scheduler
+func assignMap(master *Master, workerId int64) (TaskId, AttemptId) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	return master.assignTask(master.jobs[DEFAULT_JOB], workerId, MAP)
+}
+
+// Return a master whose map task 1 is a straggler
+// Running as attempt 0 on the returned worker, after map task 0 finished there
+func stragglerMaster(t *testing.T, options ...Option) (*Master, int64) {
+	options = append([]Option{WithSpeculation(1, 1)}, options...)
+	master := makeMaster(t, writeInputs(t, "a", "b"), 1, options...)
+	primary := registerWorker(t, master, 2)
+	if taskId, attemptId := assignMap(master, primary); taskId != 0 || attemptId != 0 {
+		t.Fatalf("assigned task %v attempt %v, want task 0 attempt 0", taskId, attemptId)
+	}
+	if reply := finishAttempt(master, primary, MAP, 0, 0); reply != OK {
+		t.Fatalf("finish task 0: %v", reply)
+	}
+	if taskId, _ := assignMap(master, primary); taskId != 1 {
+		t.Fatalf("assigned task %v, want task 1", taskId)
+	}
+	master.mu.Lock()
+	master.jobs[DEFAULT_JOB].mapMeta[1].startTime = time.Now().Add(-time.Second)
+	master.mu.Unlock()
+	return master, primary
+}
+
+// Measure how soon a freed slot is handed out again
+// And how long past its deadline a timed out task is dispatched again
+func BenchmarkSchedulingLatency(b *testing.B) {
+	b.Run("slot freed", func(b *testing.B) {
+		// Reports come faster than workers would send them
+		master, cluster := startFakeCluster(b, writeInputs(b, make([]string, b.N)...), 0,
+			WithRateLimit("Master.TaskFinished", RateLimit{}))
+		b.ResetTimer()
+		// Each finished map frees the only slot for the next one
+		cluster.addWorker(b, 1)
+		if err := master.Wait(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	})
+
+	b.Run("timed out", func(b *testing.B) {
+		const timeout = 5 * time.Millisecond
+		_, cluster := startFakeCluster(b, writeInputs(b, "a"), 0, WithTaskTimeout(timeout),
+			WithMaxTaskAttempts(b.N+1), WithBlacklist(b.N+1, time.Minute, time.Minute))
+		cluster.setHold(true)
+		b.ResetTimer()
+		start := time.Now()
+		// Every attempt times out and is dispatched again to the same worker
+		cluster.addWorker(b, 1)
+		waitFor(b, time.Minute, "every attempt to time out", func() bool {
+			return len(cluster.startedAttempts()) > b.N
+		})
+		late := time.Since(start)/time.Duration(b.N) - timeout
+		b.ReportMetric(float64(late.Microseconds()), "µs-late/op")
+	})
+}
+
+func TestBackupSkipsWorkerRunningTask(t *testing.T) {
+	master, primary := stragglerMaster(t)
+
+	// The primary worker has a free slot, but a backup there is no use
+	if taskId, _ := assignMap(master, primary); taskId != -1 {
+		t.Fatalf("backed up task %v on the worker running it", taskId)
+	}
+	other := registerWorker(t, master, 1)
+	taskId, attemptId := assignMap(master, other)
+	if taskId != 1 || attemptId != 1 {
+		t.Fatalf("backup is task %v attempt %v, want task 1 attempt 1", taskId, attemptId)
+	}
+
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	meta := master.jobs[DEFAULT_JOB].mapMeta[1]
+	if meta.worker != primary {
+		t.Errorf("task has worker %v, want the worker of its primary attempt %v", meta.worker, primary)
+	}
+	if meta.backups[1] != other || len(meta.backups) != 1 {
+		t.Errorf("backups %v, want attempt 1 on worker %v", meta.backups, other)
+	}
+}
+
+func TestBackupDoesNotUseUpAttempts(t *testing.T) {
+	master, primary := stragglerMaster(t, WithMaxTaskAttempts(2))
+	other := registerWorker(t, master, 1)
+	if taskId, attemptId := assignMap(master, other); taskId != 1 || attemptId != 1 {
+		t.Fatalf("backup is task %v attempt %v, want task 1 attempt 1", taskId, attemptId)
+	}
+	if reply := finishAttempt(master, other, MAP, 1, 1); reply != OK {
+		t.Fatalf("finish backup: %v", reply)
+	}
+
+	// Two attempts were made and none failed
+	// So the task may fail once after its output is lost, and still run again
+	master.mu.Lock()
+	job := master.jobs[DEFAULT_JOB]
+	job.reopenMap(1)
+	master.mu.Unlock()
+	taskId, attemptId := assignMap(master, primary)
+	if taskId != 1 || attemptId != 2 {
+		t.Fatalf("assigned task %v attempt %v, want task 1 attempt 2", taskId, attemptId)
+	}
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	job.dropAttempt(1, MAP, 2, "worker failed")
+	if status := job.mapStatus[1]; status != UNPROCESSED {
+		t.Fatalf("task status %v after its first failure, want it requeued", status)
+	}
+	if job.failure != nil {
+		t.Fatalf("job failed: %v", job.failure)
+	}
+}
+
+func TestReduceStartsAfterEveryMap(t *testing.T) {
+	contents := []string{"a b a", "c b", "a c d", "e"}
+	master := startMaster(t, writeInputs(t, contents...), 3)
+	for i := 0; i < 2; i++ {
+		startWorker(t, master, nil)
+	}
+
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+	var mapsDone time.Time
+	reduces := map[TaskId]bool{}
+	for _, record := range master.Report().Attempts {
+		if record.TaskType == MAP && record.Finished.After(mapsDone) {
+			mapsDone = record.Finished
+		}
+	}
+	for _, record := range master.Report().Attempts {
+		if record.TaskType != REDUCE {
+			continue
+		}
+		reduces[record.TaskId] = true
+		if record.Assigned.Before(mapsDone) {
+			t.Errorf("reduce task %v assigned at %v, before the last map finished at %v",
+				record.TaskId, record.Assigned, mapsDone)
+		}
+	}
+	if len(reduces) != 3 {
+		t.Errorf("reduce tasks %v ran, want all 3", reduces)
+	}
+}
+
+func TestFailedDispatchIsRequeued(t *testing.T) {
+	master, cluster := startFakeCluster(t, writeInputs(t, "a"), 0)
+	down := cluster.addWorker(t, 1)
+	cluster.setDown(down, true)
+	waitFor(t, 5*time.Second, "the worker failed by its dispatch", func() bool {
+		master.mu.Lock()
+		defer master.mu.Unlock()
+		return master.workers[down].status == FAILED
+	})
+	up := cluster.addWorker(t, 1)
+
+	if err := waitJob(t, master, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if record, _ := attemptRecord(master, MAP, 0, 0); record.WorkerId != down || record.Result != ATTEMPT_FAILED {
+		t.Errorf("first attempt %+v, want it failed on worker %v", record, down)
+	}
+	if record, _ := attemptRecord(master, MAP, 0, 1); record.WorkerId != up || record.Result != ATTEMPT_OK {
+		t.Errorf("second attempt %+v, want it finished on worker %v", record, up)
+	}
+}
+
+func TestZombieCompletionIsWasted(t *testing.T) {
+	master := makeMaster(t, writeInputs(t, "a"), 1)
+	zombie := registerWorker(t, master, 1)
+	if taskId, attemptId := assignMap(master, zombie); taskId != 0 || attemptId != 0 {
+		t.Fatalf("assigned task %v attempt %v, want task 0 attempt 0", taskId, attemptId)
+	}
+	master.mu.Lock()
+	master.failWorker(zombie)
+	master.mu.Unlock()
+	other := registerWorker(t, master, 1)
+	if taskId, attemptId := assignMap(master, other); taskId != 0 || attemptId != 1 {
+		t.Fatalf("reassigned task %v attempt %v, want task 0 attempt 1", taskId, attemptId)
+	}
+
+	// The failed worker comes back and reports the attempt it was running
+	reply := HeartbeatReply{}
+	master.Heartbeat(&HeartbeatSend{WorkerId: zombie}, &reply)
+	if reply.Err != OK {
+		t.Fatalf("heartbeat replied %v", reply.Err)
+	}
+	if reply := finishAttempt(master, zombie, MAP, 0, 0); reply != WASTE {
+		t.Fatalf("zombie completion replied %v, want WASTE", reply)
+	}
+	master.mu.Lock()
+	status := master.jobs[DEFAULT_JOB].mapStatus[0]
+	master.mu.Unlock()
+	if status != PROCESSING {
+		t.Fatalf("task status %v after the zombie completion, want it still processing", status)
+	}
+	if reply := finishAttempt(master, other, MAP, 0, 1); reply != OK {
+		t.Fatalf("completion of the current attempt replied %v", reply)
+	}
+	if !master.MapFinished(DEFAULT_JOB) {
+		t.Fatal("map not finished by the current attempt")
+	}
+}
+
+func TestMalformedTaskFinishedLeavesStateAlone(t *testing.T) {
+	master := makeMaster(t, writeInputs(t, "a", "b"), 1)
+	workerId := registerWorker(t, master, 1)
+	if taskId, _ := assignMap(master, workerId); taskId != 0 {
+		t.Fatalf("assigned task %v, want task 0", taskId)
+	}
+	valid := TaskFinishedSend{
+		JobId:          DEFAULT_JOB,
+		TaskId:         0,
+		TaskType:       MAP,
+		AttemptId:      0,
+		WorkerId:       workerId,
+		PartitionBytes: []int64{1},
+	}
+	tests := []struct {
+		name    string
+		corrupt func(args *TaskFinishedSend)
+		want    Err
+	}{
+		{"unknown job", func(args *TaskFinishedSend) { args.JobId = 7 }, BAD_JOB_ID},
+		{"negative task id", func(args *TaskFinishedSend) { args.TaskId = -1 }, BAD_TASK_ID},
+		{"task id out of range", func(args *TaskFinishedSend) { args.TaskId = 2 }, BAD_TASK_ID},
+		{"unknown task type", func(args *TaskFinishedSend) { args.TaskType = 7 }, BAD_TASK_TYPE},
+		{"unknown worker", func(args *TaskFinishedSend) { args.WorkerId = workerId + 1 }, UNKNOWN_WORKER},
+	}
+
+	snapshot := func() []int {
+		master.mu.Lock()
+		defer master.mu.Unlock()
+		return append([]int(nil), master.jobs[DEFAULT_JOB].mapStatus...)
+	}
+	before := snapshot()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := valid
+			test.corrupt(&args)
+			reply := GeneralReply{}
+			master.TaskFinished(&args, &reply)
+			if reply.Err != test.want {
+				t.Errorf("replied %v, want %v", reply.Err, test.want)
+			}
+			if after := snapshot(); !reflect.DeepEqual(after, before) {
+				t.Errorf("task status changed from %v to %v", before, after)
+			}
+		})
+	}
+
+	// The master still takes the valid report
+	if reply := finishAttempt(master, workerId, MAP, 0, 0); reply != OK {
+		t.Fatalf("valid report replied %v", reply)
+	}
+	if _, err := master.PhaseFinished(DEFAULT_JOB, 7); !errors.Is(err, ErrBadTaskType) {
+		t.Errorf("PhaseFinished of an unknown task type returned %v, want ErrBadTaskType", err)
+	}
+	if _, err := master.PhaseFinished(7, MAP); err != ErrUnknownJob {
+		t.Errorf("PhaseFinished of an unknown job returned %v, want ErrUnknownJob", err)
+	}
+	if _, err := master.jobs[DEFAULT_JOB].getStatusRef(7); !errors.Is(err, ErrBadTaskType) {
+		t.Errorf("getStatusRef of an unknown task type returned %v, want ErrBadTaskType", err)
+	}
+}
+
+func TestAssignmentsSpreadEvenly(t *testing.T) {
+	var contents []string
+	for i := 0; i < 40; i++ {
+		contents = append(contents, "a")
+	}
+	master, cluster := startFakeCluster(t, writeInputs(t, contents...), 0)
+	// Every worker is registered before a task is dispatched
+	// And has a slot for each task, so none is ever skipped for being busy
+	master.PauseScheduling()
+	cluster.setHold(true)
+	var workers []int64
+	for i := 0; i < 4; i++ {
+		workers = append(workers, cluster.addWorker(t, len(contents)))
+	}
+	master.ResumeScheduling()
+
+	waitFor(t, 5*time.Second, "every map started", func() bool {
+		return len(cluster.startedAttempts()) == len(contents)
+	})
+	counts := master.AssignmentCounts()
+	for _, workerId := range workers {
+		if counts[workerId] != 10 {
+			t.Fatalf("assignment counts %v, want 10 on each worker", counts)
+		}
+	}
+}
+
+func TestLargestPartitionReducedFirst(t *testing.T) {
+	master, cluster := startFakeCluster(t, writeInputs(t, "a", "b"), 3)
+	cluster.partitionBytes = func(taskId TaskId) []int64 {
+		return []int64{1, 100, 10}
+	}
+	// A single slot starts the reduce tasks one by one
+	cluster.addWorker(t, 1)
+
+	if err := waitJob(t, master, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	var order []TaskId
+	for _, attempt := range cluster.startedAttempts() {
+		if attempt.TaskType == REDUCE {
+			order = append(order, attempt.TaskId)
+		}
+	}
+	if want := []TaskId{1, 2, 0}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("reduce tasks started in order %v, want %v by partition size", order, want)
+	}
+}
+
+func TestOrphanedTaskIsAssignedNext(t *testing.T) {
+	master := makeMaster(t, writeInputs(t, "a", "b", "c", "d"), 1)
+	killed := registerWorker(t, master, 1)
+	other := registerWorker(t, master, 1)
+	if taskId, _ := assignMap(master, killed); taskId != 0 {
+		t.Fatalf("assigned task %v, want task 0", taskId)
+	}
+	if taskId, _ := assignMap(master, other); taskId != 1 {
+		t.Fatalf("assigned task %v, want task 1", taskId)
+	}
+
+	// Tasks 2 and 3 have waited longer, but the orphaned task goes first
+	master.mu.Lock()
+	master.failWorker(killed)
+	master.mu.Unlock()
+	next := registerWorker(t, master, 2)
+	if taskId, attemptId := assignMap(master, next); taskId != 0 || attemptId != 1 {
+		t.Fatalf("assigned task %v attempt %v, want the orphaned task 0 attempt 1", taskId, attemptId)
+	}
+	if taskId, _ := assignMap(master, next); taskId != 2 {
+		t.Fatalf("assigned task %v after the orphan, want task 2", taskId)
+	}
+}
+
+func TestExpiredWorkerRequeuesTaskOnce(t *testing.T) {
+	master, cluster := startFakeCluster(t, writeInputs(t, "a"), 0,
+		WithHeartbeatTTL(200*time.Millisecond))
+	cluster.setHold(true)
+	workerId := cluster.addWorker(t, 1)
+	waitFor(t, 5*time.Second, "the silent worker to expire", func() bool {
+		master.mu.Lock()
+		defer master.mu.Unlock()
+		return master.workers[workerId].status == FAILED
+	})
+
+	failures := func() int {
+		master.mu.Lock()
+		defer master.mu.Unlock()
+		return master.jobs[DEFAULT_JOB].mapMeta[0].failures
+	}
+	if n := failures(); n != 1 {
+		t.Fatalf("task failed %v times once its worker expired, want 1", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := failures(); n != 1 {
+		t.Fatalf("task failed %v times while its worker stayed expired, want 1", n)
+	}
+
+	// The heartbeat arrives late, the attempt it carries was given up
+	cluster.setHold(false)
+	reply := HeartbeatReply{}
+	master.Heartbeat(&HeartbeatSend{
+		WorkerId: workerId,
+		Tasks:    []TaskAttempt{{DEFAULT_JOB, 0, MAP, 0}},
+	}, &reply)
+	if reply.Err != OK {
+		t.Fatalf("late heartbeat replied %v", reply.Err)
+	}
+	if reply := finishAttempt(master, workerId, MAP, 0, 0); reply != WASTE {
+		t.Fatalf("report of the given up attempt replied %v, want WASTE", reply)
+	}
+	if err := waitJob(t, master, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if record, _ := attemptRecord(master, MAP, 0, 1); record.Result != ATTEMPT_OK {
+		t.Fatalf("second attempt %+v, want it finished", record)
+	}
+}
+
+func TestSlowWorkerBlocksNoRpc(t *testing.T) {
+	master, cluster := startFakeCluster(t, writeInputs(t, "a", "b"), 0)
+	cluster.setHold(true)
+	master.PauseScheduling()
+	fast := cluster.addWorker(t, 1)
+	slow := cluster.addWorker(t, 1)
+	cluster.setSlow(slow, time.Second)
+	master.ResumeScheduling()
+	// Both tasks are started, the start on the slow worker takes a second
+	waitFor(t, 5*time.Second, "a task started on each worker", func() bool {
+		return len(cluster.startedAttempts()) == 2
+	})
+
+	start := time.Now()
+	registerWorker(t, master, 1)
+	if reply := finishAttempt(master, fast, MAP, startedOn(master, fast), 0); reply != OK {
+		t.Fatalf("finish on the fast worker replied %v", reply)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("RegisterWorker and TaskFinished took %v while the slow worker was called", elapsed)
+	}
+}
+
+// Return the id of the task master has the worker running
+func startedOn(master *Master, workerId int64) TaskId {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	return master.workers[workerId].tasks[0].taskId
+}
+
+func TestShutdownLeaksNoGoroutine(t *testing.T) {
+	files := writeInputs(t, "a b a")
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		master, err := MakeMaster(files, 1, 0, testOptions(t)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := master.RunMaster(); err != nil {
+			t.Fatal(err)
+		}
+		if err := master.Shutdown(context.Background()); err != nil {
+			t.Fatalf("shutdown %v: %v", i, err)
+		}
+	}
+	// Goroutines of closed connections may take a moment to return
+	waitFor(t, 5*time.Second, "the goroutines of shut down masters to return", func() bool {
+		return runtime.NumGoroutine() <= before
+	})
+}
+
+func TestRpcsAfterShutdownReturnErrMasterClosed(t *testing.T) {
+	master := startMaster(t, writeInputs(t, "a"), 1)
+	if err := master.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := master.Shutdown(context.Background()); err != ErrMasterClosed {
+		t.Errorf("second Shutdown returned %v, want ErrMasterClosed", err)
+	}
+	register := RegisterReply{}
+	if err := master.RegisterWorker(&RegisterSend{Version: PROTOCOL_VERSION}, &register); err != ErrMasterClosed {
+		t.Errorf("RegisterWorker returned %v, want ErrMasterClosed", err)
+	}
+	if err := master.TaskFinished(&TaskFinishedSend{}, &GeneralReply{}); err != ErrMasterClosed {
+		t.Errorf("TaskFinished returned %v, want ErrMasterClosed", err)
+	}
+	if err := master.Heartbeat(&HeartbeatSend{}, &HeartbeatReply{}); err != ErrMasterClosed {
+		t.Errorf("Heartbeat returned %v, want ErrMasterClosed", err)
+	}
+}
+
+func TestJobControlsActOnOneJob(t *testing.T) {
+	master, cluster := startFakeCluster(t, writeInputs(t, "a", "b"), 1)
+	cluster.setHold(true)
+	other, err := master.Submit(JobSpec{InputFiles: writeInputs(t, "c", "d"), NReduce: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	workerId := cluster.addWorker(t, 4)
+	waitFor(t, time.Second, "the maps of both jobs to start", func() bool {
+		return len(cluster.startedAttempts()) == 4
+	})
+
+	control := func(rpc string, id JobId) Err {
+		t.Helper()
+		reply := GeneralReply{}
+		if err := callMaster(t, master, rpc, &JobControlSend{JobId: id}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply.Err
+	}
+	for _, rpc := range []string{"Master.AbortJob", "Master.PauseJob", "Master.ResumeJob"} {
+		if reply := control(rpc, other+1); reply != BAD_JOB_ID {
+			t.Errorf("%v of a job never submitted got %v", rpc, reply)
+		}
+	}
+	if reply := control("Master.PauseJob", other); reply != OK {
+		t.Fatalf("pause got %v", reply)
+	}
+	if reply := control("Master.AbortJob", DEFAULT_JOB); reply != OK {
+		t.Fatalf("abort got %v", reply)
+	}
+	if err := master.WaitJob(context.Background(), DEFAULT_JOB); err != ErrJobAborted {
+		t.Fatalf("aborted job ended with %v", err)
+	}
+	if master.Aborted() || master.Paused() || master.JobDone(other) {
+		t.Fatalf("master aborted %v, paused %v, other job done %v, want only the one job stopped",
+			master.Aborted(), master.Paused(), master.JobDone(other))
+	}
+
+	// The aborted job takes no more results, the paused one does but starts nothing new
+	for _, attempt := range cluster.startedAttempts() {
+		if attempt.JobId == DEFAULT_JOB {
+			if reply := finishAttempt(master, workerId, MAP, attempt.TaskId, attempt.AttemptId); reply != ABORTED {
+				t.Errorf("late report of the aborted job got %v", reply)
+			}
+			continue
+		}
+		cluster.finish(workerId, attempt)
+	}
+	if done, _ := master.PhaseFinished(other, MAP); !done {
+		t.Fatal("maps of the paused job not finished by their reports")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if started := len(cluster.startedAttempts()); started != 4 {
+		t.Fatalf("%v attempts started, want no reduce of the paused job", started)
+	}
+
+	cluster.setHold(false)
+	if reply := control("Master.ResumeJob", other); reply != OK {
+		t.Fatalf("resume got %v", reply)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := master.WaitJob(ctx, other); err != nil {
+		t.Fatalf("resumed job ended with %v", err)
+	}
+}
+
+func TestCancelledWaitLeavesJobRunning(t *testing.T) {
+	contents := []string{"a b a"}
+	master := startMaster(t, writeInputs(t, contents...), 1)
+
+	// No worker has registered, so the job cannot finish yet
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if err := master.Wait(ctx); err != context.Canceled {
+		t.Fatalf("Wait returned %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Wait returned %v after its context was cancelled", elapsed)
+	}
+	if master.Done() {
+		t.Fatal("job done without a worker")
+	}
+
+	startWorker(t, master, nil)
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+}
+
+func TestWaitReturnsJobFailure(t *testing.T) {
+	master := startMaster(t, writeInputs(t, "a"), 1, WithMaxTaskAttempts(1))
+	startWorker(t, master, func(worker *Worker) {
+		worker.MapContext = func(ctx context.Context, file, content string) []KeyValue {
+			panic("bad record")
+		}
+	})
+
+	err := waitJob(t, master, 10*time.Second)
+	var failure *JobFailure
+	if !errors.As(err, &failure) {
+		t.Fatalf("Wait returned %v, want a *JobFailure", err)
+	}
+	if !master.Failed(DEFAULT_JOB) {
+		t.Fatal("job not failed")
+	}
+}
+
+func TestWaitReturnsDeadlineExceeded(t *testing.T) {
+	master := startMaster(t, writeInputs(t, "a"), 1,
+		WithJobDeadline(time.Now().Add(200*time.Millisecond)))
+	// The map runs until its attempt is killed
+	killed := make(chan struct{})
+	var once sync.Once
+	startWorker(t, master, func(worker *Worker) {
+		worker.MapContext = func(ctx context.Context, file, content string) []KeyValue {
+			<-ctx.Done()
+			once.Do(func() { close(killed) })
+			return nil
+		}
+	})
+
+	err := waitJob(t, master, 5*time.Second)
+	var failure *JobFailure
+	if !errors.Is(err, ErrDeadlineExceeded) || !errors.As(err, &failure) || !failure.DeadlineExceeded {
+		t.Fatalf("Wait returned %v, want the deadline exceeded", err)
+	}
+	select {
+	case <-killed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("running map not killed once the deadline passed")
+	}
+
+	// Remote clients see the same reason
+	waited := WaitDoneReply{}
+	if err := callMaster(t, master, "Master.WaitDone",
+		&WaitDoneSend{JobId: DEFAULT_JOB, MaxWait: time.Second}, &waited); err != nil {
+		t.Fatal(err)
+	}
+	if !waited.Done || waited.Result != err.Error() {
+		t.Fatalf("WaitDone replied %+v, want done with %q", waited, err)
+	}
+	status := JobStatus{}
+	if err := callMaster(t, master, "Master.GetJobStatus", &JobStatusSend{JobId: DEFAULT_JOB},
+		&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Phase != PHASE_FAILED || status.Failure == nil || !status.Failure.DeadlineExceeded {
+		t.Fatalf("status %v with failure %+v, want the deadline exceeded", status.Phase, status.Failure)
+	}
+}
+
+func TestFailedTasksSkippedUpToRatio(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		bad  int
+	}{
+		{"below the ratio", 2},
+		{"above the ratio", 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// The first inputs fail every attempt, and a fifth of the 10 maps may be skipped
+			contents := make([]string, 10)
+			for i := range contents {
+				contents[i] = "a b"
+				if i < test.bad {
+					contents[i] = "bad"
+				}
+			}
+			files := writeInputs(t, contents...)
+			master := startMaster(t, files, 1, WithMaxTaskAttempts(2), WithMaxFailedTaskRatio(0.2))
+			startWorker(t, master, func(worker *Worker) {
+				worker.MapContext = func(ctx context.Context, file, content string) []KeyValue {
+					if content == "bad" {
+						panic("bad record")
+					}
+					return wcMap(file, content)
+				}
+			})
+
+			err := waitJob(t, master, 10*time.Second)
+			skipped := master.Report().Jobs[DEFAULT_JOB].Skipped
+			bad := map[string]bool{}
+			for _, task := range skipped {
+				if task.TaskType != MAP || task.InputFile != files[task.TaskId] ||
+					int(task.TaskId) >= test.bad || task.Err == "" {
+					t.Errorf("skipped %+v, want a map of a bad input with its error", task)
+				}
+				bad[task.InputFile] = true
+			}
+			if len(skipped) != 2 || len(bad) != 2 {
+				t.Fatalf("skipped %+v, want 2 of the bad maps", skipped)
+			}
+
+			if test.bad <= 2 {
+				if err != nil {
+					t.Fatalf("job with %v bad inputs failed: %v", test.bad, err)
+				}
+				checkCounts(t, readOutput(t, master.config.OutputDir),
+					wordCounts(contents[test.bad:]...))
+				return
+			}
+			var failure *JobFailure
+			if !errors.As(err, &failure) || failure.TaskType != MAP ||
+				int(failure.TaskId) >= test.bad || bad[failure.InputFile] {
+				t.Fatalf("Wait returned %v, want the bad map that was not skipped", err)
+			}
+		})
+	}
+}
+
+func TestMapOnlyJob(t *testing.T) {
+	contents := []string{"a b", "c d e"}
+	master := startMaster(t, writeInputs(t, contents...), 0)
+	// The first attempt fails, so the job also covers a retry
+	var mu sync.Mutex
+	failed := false
+	startWorker(t, master, func(worker *Worker) {
+		worker.MapContext = func(ctx context.Context, file, content string) []KeyValue {
+			mu.Lock()
+			defer mu.Unlock()
+			if !failed {
+				failed = true
+				panic("first attempt fails")
+			}
+			return wcMap(file, content)
+		}
+	})
+
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !master.MapOnly(DEFAULT_JOB) || !master.Done() {
+		t.Fatalf("map only %v, done %v, want both", master.MapOnly(DEFAULT_JOB), master.Done())
+	}
+	// Each map task wrote its output file
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+	retried := false
+	for _, record := range master.Report().Attempts {
+		if record.TaskType == REDUCE {
+			t.Fatalf("reduce attempt %+v in a map-only job", record)
+		}
+		retried = retried || record.Result == ATTEMPT_FAILED
+	}
+	if !retried {
+		t.Fatal("no attempt failed, want the first one retried")
+	}
+}
+
+func TestInvalidTaskTypeOverRpc(t *testing.T) {
+	contents := []string{"a b a"}
+	master := startMaster(t, writeInputs(t, contents...), 1)
+	workerId := registerWorker(t, master, 1)
+	const bad TaskType = 7
+
+	finished := GeneralReply{}
+	err := callMaster(t, master, "Master.TaskFinished", &TaskFinishedSend{
+		JobId: DEFAULT_JOB, TaskType: bad, WorkerId: workerId,
+	}, &finished)
+	if finished.Err != BAD_TASK_TYPE {
+		t.Errorf("TaskFinished replied %v, %v, want BAD_TASK_TYPE", finished.Err, err)
+	}
+	failed := GeneralReply{}
+	if err := callMaster(t, master, "Master.TaskFailed", &TaskFailedSend{
+		JobId: DEFAULT_JOB, TaskType: bad, WorkerId: workerId,
+	}, &failed); err != nil || failed.Err != BAD_TASK_TYPE {
+		t.Errorf("TaskFailed replied %v, %v, want BAD_TASK_TYPE", failed.Err, err)
+	}
+	// Progress of an unknown task type is dropped with the rest of the heartbeat kept
+	attempt := TaskAttempt{DEFAULT_JOB, 0, bad, 0}
+	heartbeat := HeartbeatReply{}
+	if err := callMaster(t, master, "Master.Heartbeat", &HeartbeatSend{
+		WorkerId: workerId,
+		Tasks:    []TaskAttempt{attempt},
+		Progress: []TaskProgress{{attempt, 0.5}},
+	}, &heartbeat); err != nil || heartbeat.Err != OK {
+		t.Errorf("Heartbeat replied %v, %v, want OK", heartbeat.Err, err)
+	}
+	master.mu.Lock()
+	_, statusErr := master.jobs[DEFAULT_JOB].getTaskStatus(0, bad)
+	setErr := master.jobs[DEFAULT_JOB].setTaskStatus(0, bad, FINISHED)
+	master.mu.Unlock()
+	if !errors.Is(statusErr, ErrBadTaskType) || !errors.Is(setErr, ErrBadTaskType) {
+		t.Errorf("getTaskStatus returned %v and setTaskStatus %v, want ErrBadTaskType", statusErr, setErr)
+	}
+
+	// The master survives and still runs the job
+	startWorker(t, master, nil)
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+}
+
+func TestRestartedWorkerRequeuesItsTask(t *testing.T) {
+	for _, keepId := range []bool{true, false} {
+		name := "new id"
+		if keepId {
+			name = "same id"
+		}
+		t.Run(name, func(t *testing.T) {
+			master, cluster := startFakeCluster(t, writeInputs(t, "a b a"), 1)
+			cluster.setHold(true)
+			old := cluster.addWorker(t, 1)
+			waitFor(t, 5*time.Second, "the map dispatched", func() bool {
+				return len(cluster.startedAttempts()) == 1
+			})
+
+			// The worker crashes before it reports, and comes back at once
+			cluster.setHold(false)
+			restarted := cluster.restartWorker(t, old, keepId)
+			if err := waitJob(t, master, 5*time.Second); err != nil {
+				t.Fatal(err)
+			}
+			if reply := finishAttempt(master, old, MAP, 0, 0); reply == OK {
+				t.Fatal("report of the attempt lost in the crash was accepted")
+			}
+
+			finished := 0
+			for _, record := range master.Report().Attempts {
+				if record.TaskType == MAP && record.Result == ATTEMPT_OK {
+					finished++
+					if record.AttemptId != 1 || record.WorkerId != restarted {
+						t.Errorf("map finished by %+v, want attempt 1 on worker %v", record, restarted)
+					}
+				}
+			}
+			if finished != 1 {
+				t.Fatalf("map finished %v times, want once", finished)
+			}
+			master.mu.Lock()
+			defer master.mu.Unlock()
+			if registry := master.workers[restarted]; len(registry.tasks) != 0 || registry.status != AVAILABLE {
+				t.Errorf("restarted worker %v holds %v, want it available", registry.status, registry.tasks)
+			}
+		})
+	}
+}
+
+func TestTaskFinishedFromWrongWorkerIsMismatch(t *testing.T) {
+	master := makeMaster(t, writeInputs(t, "a", "b"), 1)
+	holder := registerWorker(t, master, 2)
+	other := registerWorker(t, master, 1)
+	if taskId, _ := assignMap(master, holder); taskId != 0 {
+		t.Fatalf("assigned task %v, want task 0", taskId)
+	}
+	snapshot := func() ([]int, int) {
+		master.mu.Lock()
+		defer master.mu.Unlock()
+		job := master.jobs[DEFAULT_JOB]
+		return append([]int(nil), job.mapStatus...), job.mapFinishedCount
+	}
+	before, count := snapshot()
+
+	tests := []struct {
+		name      string
+		workerId  int64
+		taskId    TaskId
+		attemptId AttemptId
+	}{
+		{"wrong worker", other, 0, 0},
+		{"wrong task", holder, 1, 0},
+		{"wrong attempt", holder, 0, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if reply := finishAttempt(master, test.workerId, MAP, test.taskId, test.attemptId); reply != MISMATCH {
+				t.Errorf("replied %v, want MISMATCH", reply)
+			}
+			if after, n := snapshot(); !reflect.DeepEqual(after, before) || n != count {
+				t.Errorf("task status changed from %v to %v", before, after)
+			}
+		})
+	}
+	master.mu.Lock()
+	held := len(master.workers[holder].tasks)
+	master.mu.Unlock()
+	if held != 1 {
+		t.Fatalf("holder has %v tasks after the rejected reports, want 1", held)
+	}
+
+	// A worker that failed reports the attempt master gave up
+	master.mu.Lock()
+	master.failWorker(holder)
+	master.mu.Unlock()
+	if reply := finishAttempt(master, holder, MAP, 0, 0); reply != WASTE {
+		t.Errorf("report of the failed worker replied %v, want WASTE", reply)
+	}
+	if after, n := snapshot(); after[0] != UNPROCESSED || n != 0 {
+		t.Errorf("task status %v after the report of the failed worker, want it requeued", after)
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Counters and histograms of master in the Prometheus text format
+
+package mapreduce
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The upper bounds (in seconds) of the task duration histogram buckets
+var DURATION_BUCKETS = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+// A cumulative histogram of durations
+type histogram struct {
+	// The number of observations not above each bucket bound
+	counts []int64
+	// The total of observed seconds, and the number of observations
+	sum   float64
+	count int64
+}
+
+// Add a duration to the histogram
+func (h *histogram) observe(duration time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(DURATION_BUCKETS))
+	}
+	seconds := duration.Seconds()
+	for idx, bound := range DURATION_BUCKETS {
+		if seconds <= bound {
+			h.counts[idx]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// The metrics registry of master
+// Guarded by the lock of master, a nil registry records nothing
+type metrics struct {
+	// Counters of each phase, indexed by task type
+	dispatched [2]int64
+	finished   [2]int64
+	wasted     [2]int64
+	requeued   [2]int64
+	// The number of start rpcs that fail
+	dispatchFailures int64
+	// The durations of finished tasks of each phase
+	durations [2]histogram
+	// The rpcs master sent and served, see metricsInterceptor
+	rpcs map[rpcKey]rpcStat
+}
+
+// The rpcs counted together, by side (client or server), method and outcome
+type rpcKey struct {
+	side   string
+	method string
+	result string
+}
+
+// The number of rpcs and their total duration
+type rpcStat struct {
+	count   int64
+	seconds float64
+}
+
+// Return true if taskType indexes the counters
+func validPhase(taskType TaskType) bool {
+	return taskType == MAP || taskType == REDUCE
+}
+
+// Count a task attempt started on a worker
+func (m *metrics) taskDispatched(taskType TaskType) {
+	if m != nil && validPhase(taskType) {
+		m.dispatched[taskType]++
+	}
+}
+
+// Count a task finished by the attempt that took duration
+func (m *metrics) taskFinished(taskType TaskType, duration time.Duration) {
+	if m != nil && validPhase(taskType) {
+		m.finished[taskType]++
+		m.durations[taskType].observe(duration)
+	}
+}
+
+// Count a report that is not accepted
+func (m *metrics) taskWasted(taskType TaskType) {
+	if m != nil && validPhase(taskType) {
+		m.wasted[taskType]++
+	}
+}
+
+// Count a task handed back to the scheduler
+func (m *metrics) taskRequeued(taskType TaskType) {
+	if m != nil && validPhase(taskType) {
+		m.requeued[taskType]++
+	}
+}
+
+// Count a start rpc that fails
+func (m *metrics) dispatchFailed() {
+	if m != nil {
+		m.dispatchFailures++
+	}
+}
+
+// Count an rpc that took elapsed
+func (m *metrics) rpcDone(side, method, result string, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	if m.rpcs == nil {
+		m.rpcs = make(map[rpcKey]rpcStat)
+	}
+	key := rpcKey{side, method, result}
+	stat := m.rpcs[key]
+	stat.count++
+	stat.seconds += elapsed.Seconds()
+	m.rpcs[key] = stat
+}
+
+// Return a copy that shares nothing with the registry
+func (m *metrics) snapshot() metrics {
+	result := *m
+	result.rpcs = make(map[rpcKey]rpcStat, len(m.rpcs))
+	for key, stat := range m.rpcs {
+		result.rpcs[key] = stat
+	}
+	for idx := range result.durations {
+		counts := result.durations[idx].counts
+		result.durations[idx].counts = append([]int64(nil), counts...)
+	}
+	return result
+}
+
+// Write a counter or gauge with one sample per phase
+func writePhaseMetric(w io.Writer, name, kind, help string, values [2]int64) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+	fmt.Fprintf(w, "%v{phase=\"map\"} %v\n", name, values[MAP])
+	fmt.Fprintf(w, "%v{phase=\"reduce\"} %v\n", name, values[REDUCE])
+}
+
+// Write a metric with a single sample
+func writeMetric(w io.Writer, name, kind, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n%v %v\n",
+		name, help, name, kind, name, value)
+}
+
+// Write the metrics in the Prometheus text exposition format
+// Worker gauges are counted from the registries at the moment
+func (master *Master) writeMetrics(w io.Writer) {
+	master.mu.Lock()
+	m := master.metrics.snapshot()
+	progress := master.progress(nil, master.startTime)
+	master.mu.Unlock()
+
+	writePhaseMetric(w, "mapreduce_tasks_dispatched_total", "counter",
+		"Task attempts started on workers.", m.dispatched)
+	writePhaseMetric(w, "mapreduce_tasks_finished_total", "counter",
+		"Tasks finished.", m.finished)
+	writePhaseMetric(w, "mapreduce_tasks_wasted_total", "counter",
+		"Task reports not accepted.", m.wasted)
+	writePhaseMetric(w, "mapreduce_tasks_requeued_total", "counter",
+		"Tasks handed back to the scheduler.", m.requeued)
+	writeMetric(w, "mapreduce_dispatch_failures_total", "counter",
+		"Start rpcs that failed.", m.dispatchFailures)
+
+	writeMetric(w, "mapreduce_workers_registered", "gauge",
+		"Registered workers.", int64(progress.Workers))
+	writeMetric(w, "mapreduce_workers_available", "gauge",
+		"Workers with a free slot.", int64(progress.AvailableWorkers))
+	writeMetric(w, "mapreduce_workers_failed", "gauge",
+		"Workers declared failed.", int64(progress.FailedWorkers))
+
+	name := "mapreduce_task_duration_seconds"
+	fmt.Fprintf(w, "# HELP %v Duration of finished tasks.\n# TYPE %v histogram\n",
+		name, name)
+	for _, taskType := range []TaskType{MAP, REDUCE} {
+		phase := strings.ToLower(taskTypeName(taskType))
+		h := m.durations[taskType]
+		for idx, bound := range DURATION_BUCKETS {
+			var count int64
+			if len(h.counts) > 0 {
+				count = h.counts[idx]
+			}
+			fmt.Fprintf(w, "%v_bucket{phase=\"%v\",le=\"%v\"} %v\n",
+				name, phase, bound, count)
+		}
+		fmt.Fprintf(w, "%v_bucket{phase=\"%v\",le=\"+Inf\"} %v\n", name, phase, h.count)
+		fmt.Fprintf(w, "%v_sum{phase=\"%v\"} %v\n", name, phase, h.sum)
+		fmt.Fprintf(w, "%v_count{phase=\"%v\"} %v\n", name, phase, h.count)
+	}
+
+	writeRPCMetrics(w, m.rpcs)
+
+	writeThrottleMetrics(w, master.limiter.snapshot())
+
+	if stats, ok := master.poolStats(); ok {
+		writeMetric(w, "mapreduce_connections_open", "gauge",
+			"Pooled connections to workers.", int64(stats.Open))
+		writeMetric(w, "mapreduce_connection_dials_total", "counter",
+			"Connections dialed to workers.", stats.Dials)
+		writeMetric(w, "mapreduce_keepalive_pings_total", "counter",
+			"Keepalive pings sent over idle connections.", stats.Pings)
+		writeMetric(w, "mapreduce_connection_evictions_total", "counter",
+			"Connections dropped because they missed keepalive pings.", stats.Evictions)
+		writeMetric(w, "mapreduce_connection_redials_total", "counter",
+			"Rpcs sent again over a new connection.", stats.Redials)
+	}
+}
+
+// Write the count and total duration of rpcs by side, method and outcome
+// Sorted, so the output is stable across scrapes
+func writeRPCMetrics(w io.Writer, rpcs map[rpcKey]rpcStat) {
+	keys := make([]rpcKey, 0, len(rpcs))
+	for key := range rpcs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].side != keys[j].side {
+			return keys[i].side < keys[j].side
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].result < keys[j].result
+	})
+
+	name := "mapreduce_rpcs_total"
+	fmt.Fprintf(w, "# HELP %v Rpcs sent and served.\n# TYPE %v counter\n", name, name)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%v{side=\"%v\",method=\"%v\",result=\"%v\"} %v\n",
+			name, key.side, key.method, key.result, rpcs[key].count)
+	}
+	name = "mapreduce_rpc_seconds_total"
+	fmt.Fprintf(w, "# HELP %v Total duration of rpcs sent and served.\n# TYPE %v counter\n",
+		name, name)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%v{side=\"%v\",method=\"%v\",result=\"%v\"} %v\n",
+			name, key.side, key.method, key.result, rpcs[key].seconds)
+	}
+}
+
+// Serve the metrics
+func (master *Master) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	master.writeMetrics(w)
+}
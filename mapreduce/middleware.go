@@ -0,0 +1,463 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Interceptors around the rpcs a transport sends and serves, and request ids
+
+package mapreduce
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// The random bytes of a request id
+const REQUEST_ID_BYTES = 8
+
+// What an interceptor knows of an rpc
+type RPCInfo struct {
+	// The rpc, e.g. "Worker.StartMap"
+	Method string
+	// The host:port of the peer called
+	// On the server the one the request came from, empty if the transport cannot tell
+	Addr string
+	// The id the caller gave the request, sent along with it
+	// Empty on the server if the caller sent none
+	RequestId string
+	// The job and task named by the arguments, -1 if they name none
+	JobId  JobId
+	TaskId TaskId
+	// The arguments, and the reply once the method has returned
+	Args  interface{}
+	Reply interface{}
+}
+
+// The hooks a transport runs around every rpc it sends or serves
+// Any of them may be nil, see NewRPCTransport
+// Interceptors run in the order given, each around the ones after it
+// So one checking credentials or encoding payloads hooks in like logging does
+type Interceptor struct {
+	// Send the rpc by calling next, e.g. to time it or to decorate its arguments
+	// Return the error of next, or its own without calling next to refuse the call
+	Call func(ctx context.Context, info *RPCInfo, next func(ctx context.Context) error) error
+	// Run once a request is read, before its method
+	// An error refuses the request, its method is not run and the caller gets ErrRemote
+	Receive func(info *RPCInfo) error
+	// Run once the method has returned or the request was refused, in reverse order
+	// With its error, empty if none, and the time since the request was read
+	Reply func(info *RPCInfo, err string, elapsed time.Duration)
+}
+
+type requestIdKey struct{}
+
+// Return ctx carrying id, sent as the request id of the rpcs called with it
+// An rpc called without one is given a new id
+func ContextWithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// Return the request id ctx carries, empty if none
+func RequestIdFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// Return a new random request id in hex
+func newRequestId() string {
+	b := make([]byte, REQUEST_ID_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Return the info of an rpc, naming the job and task its arguments name
+func newRPCInfo(method string, addr string, requestId string, args interface{}) *RPCInfo {
+	info := &RPCInfo{Method: method, Addr: addr, RequestId: requestId,
+		JobId: -1, TaskId: -1, Args: args}
+	value := reflect.ValueOf(args)
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return info
+	}
+	if field := value.FieldByName("Attempt"); field.IsValid() {
+		if attempt, ok := field.Interface().(TaskAttempt); ok {
+			info.JobId, info.TaskId = attempt.JobId, attempt.TaskId
+			return info
+		}
+	}
+	if field := value.FieldByName("JobId"); field.IsValid() {
+		if jobId, ok := field.Interface().(JobId); ok {
+			info.JobId = jobId
+		}
+	}
+	if field := value.FieldByName("TaskId"); field.IsValid() {
+		if taskId, ok := field.Interface().(TaskId); ok {
+			info.TaskId = taskId
+		}
+	}
+	return info
+}
+
+// Return the ids of the rpc for log lines, e.g. "request 3f2a job 0 task 4"
+func (info *RPCInfo) String() string {
+	text := "request " + info.RequestId
+	if info.JobId >= 0 {
+		text += fmt.Sprintf(" job %v", info.JobId)
+	}
+	if info.TaskId >= 0 {
+		text += fmt.Sprintf(" task %v", info.TaskId)
+	}
+	return text
+}
+
+// Return the Err field of a reply, e.g. OK or STALE_TERM, empty if it has none
+func replyErr(reply interface{}) string {
+	value := reflect.ValueOf(reply)
+	if value.Kind() == reflect.Ptr && !value.IsNil() {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return ""
+	}
+	if field := value.FieldByName("Err"); field.IsValid() && field.Kind() == reflect.String {
+		return field.String()
+	}
+	return ""
+}
+
+// Run the Call hooks of interceptors around send, in order
+func interceptCall(ctx context.Context, interceptors []Interceptor, info *RPCInfo,
+	send func(ctx context.Context) error) error {
+	next := send
+	for idx := len(interceptors) - 1; idx >= 0; idx-- {
+		if call := interceptors[idx].Call; call != nil {
+			inner := next
+			next = func(ctx context.Context) error { return call(ctx, info, inner) }
+		}
+	}
+	return next(ctx)
+}
+
+// Log every rpc sent and served at debug level
+// With its method, request id, job and task, duration and result
+func LogInterceptor(logger Logger) Interceptor {
+	return Interceptor{
+		Call: func(ctx context.Context, info *RPCInfo, next func(ctx context.Context) error) error {
+			start := time.Now()
+			err := next(ctx)
+			result := replyErr(info.Reply)
+			if err != nil {
+				result = err.Error()
+			}
+			logger.Debugf("Rpc %v to %v, %v: %v in %v",
+				info.Method, info.Addr, info, result, time.Since(start))
+			return err
+		},
+		Reply: func(info *RPCInfo, err string, elapsed time.Duration) {
+			result := replyErr(info.Reply)
+			if err != "" {
+				result = err
+			}
+			logger.Debugf("Rpc %v served, %v: %v in %v", info.Method, info, result, elapsed)
+		},
+	}
+}
+
+// Return " by request id" for log lines, or nothing if id is empty
+func byRequest(id string) string {
+	if id == "" {
+		return ""
+	}
+	return " by request " + id
+}
+
+// The metadata sent ahead of the arguments of every rpc
+type rpcMeta struct {
+	RequestId string
+}
+
+// The arguments of an rpc wrapped with its metadata, unwrapped by the codec
+type rpcEnvelope struct {
+	meta rpcMeta
+	args interface{}
+}
+
+// Arguments that keep the request id of the rpc that carried them
+// Set once they are decoded, so a worker can log it
+type requestTagged interface {
+	setRequestId(id string)
+}
+
+// The gob client codec of net/rpc, sending rpcMeta ahead of the arguments
+type metaClientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func newMetaClientCodec(conn io.ReadWriteCloser) *metaClientCodec {
+	encBuf := bufio.NewWriter(conn)
+	return &metaClientCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(encBuf), encBuf}
+}
+
+func (c *metaClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	meta := rpcMeta{}
+	if envelope, ok := body.(*rpcEnvelope); ok {
+		meta, body = envelope.meta, envelope.args
+	}
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(&meta); err != nil {
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *metaClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *metaClientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *metaClientCodec) Close() error {
+	return c.rwc.Close()
+}
+
+// A request read by a server codec whose response is not written yet
+type pendingRPC struct {
+	info  *RPCInfo
+	start time.Time
+}
+
+// The Receive and Reply hooks of interceptors a server codec runs around each method
+type serverHooks struct {
+	interceptors []Interceptor
+	// The address of the peer of the connection, see remoteAddr
+	peer string
+	// Responses are written by the goroutines running the methods
+	mu      sync.Mutex
+	pending map[uint64]*pendingRPC
+}
+
+func newServerHooks(conn io.ReadWriteCloser, interceptors []Interceptor) *serverHooks {
+	return &serverHooks{interceptors: interceptors, peer: remoteAddr(conn),
+		pending: make(map[uint64]*pendingRPC)}
+}
+
+// Return the address of the peer of conn, empty unless it is a net.Conn
+func remoteAddr(conn io.ReadWriteCloser) string {
+	if netConn, ok := conn.(net.Conn); ok && netConn.RemoteAddr() != nil {
+		return netConn.RemoteAddr().String()
+	}
+	return ""
+}
+
+// Run the Receive hooks of the request seq just decoded into body
+// Arguments that keep their sender learn it first, see peerObserved
+// Return the error of the first hook that refuses it
+func (hooks *serverHooks) received(seq uint64, method, requestId string, body interface{}) error {
+	if observed, ok := body.(peerObserved); ok {
+		observed.setPeerAddr(hooks.peer)
+	}
+	info := newRPCInfo(method, hooks.peer, requestId, body)
+	hooks.mu.Lock()
+	hooks.pending[seq] = &pendingRPC{info, time.Now()}
+	hooks.mu.Unlock()
+	for _, interceptor := range hooks.interceptors {
+		if interceptor.Receive != nil {
+			if err := interceptor.Receive(info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Run the Reply hooks of the request r answers in reverse order, if it was received
+func (hooks *serverHooks) replied(r *rpc.Response, body interface{}) {
+	hooks.mu.Lock()
+	pending, ok := hooks.pending[r.Seq]
+	delete(hooks.pending, r.Seq)
+	hooks.mu.Unlock()
+	if !ok {
+		return
+	}
+	pending.info.Reply = body
+	elapsed := time.Since(pending.start)
+	for idx := len(hooks.interceptors) - 1; idx >= 0; idx-- {
+		if reply := hooks.interceptors[idx].Reply; reply != nil {
+			reply(pending.info, r.Error, elapsed)
+		}
+	}
+}
+
+// The gob server codec of net/rpc, reading rpcMeta ahead of the arguments
+// And running the Receive and Reply hooks of interceptors around each method
+type metaServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	hooks  *serverHooks
+	// Told of responses that cannot be encoded, stderr if nil, see loggedCodec
+	logger Logger
+	// The header just read, requests are read one at a time
+	request rpc.Request
+	mu      sync.Mutex
+	closed  bool
+}
+
+func newMetaServerCodec(conn io.ReadWriteCloser, interceptors []Interceptor) *metaServerCodec {
+	encBuf := bufio.NewWriter(conn)
+	return &metaServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(encBuf),
+		encBuf: encBuf,
+		hooks:  newServerHooks(conn, interceptors),
+	}
+}
+
+func (c *metaServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	c.request = *r
+	return nil
+}
+
+// Body is nil for a request net/rpc discards, e.g. of an unknown method
+// Its interceptors are not run, nor those of keepalive pings
+func (c *metaServerCodec) ReadRequestBody(body interface{}) error {
+	var meta rpcMeta
+	if err := c.dec.Decode(&meta); err != nil {
+		return err
+	}
+	if err := c.dec.Decode(body); err != nil || body == nil ||
+		c.request.ServiceMethod == KEEPALIVE_METHOD {
+		return err
+	}
+	if tagged, ok := body.(requestTagged); ok {
+		tagged.setRequestId(meta.RequestId)
+	}
+	return c.hooks.received(c.request.Seq, c.request.ServiceMethod, meta.RequestId, body)
+}
+
+func (c *metaServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.hooks.replied(r, body)
+	if err := c.enc.Encode(r); err != nil {
+		c.encodeFailed(r, "response", err)
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		c.encodeFailed(r, "body", err)
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+// Close the connection if part of a response could not be encoded
+// So the peer sees it is broken rather than waiting on it, like net/rpc
+func (c *metaServerCodec) encodeFailed(r *rpc.Response, part string, err error) {
+	if c.encBuf.Flush() == nil {
+		logger := c.logger
+		if logger == nil {
+			logger = NewStdLogger()
+		}
+		logger.Errorf("Rpc %v: cannot encode the %v, close the connection: %v",
+			r.ServiceMethod, part, err)
+		c.Close()
+	}
+}
+
+func (c *metaServerCodec) setLogger(logger Logger) {
+	c.logger = logger
+}
+
+func (c *metaServerCodec) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		// Only call c.rwc.Close once, as net/rpc may close the codec twice
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+// Return the interceptors a master runs on its default transport
+// Logging, request counts if metrics are enabled, then those of WithInterceptors
+func (master *Master) interceptors() []Interceptor {
+	interceptors := []Interceptor{LogInterceptor(master.config.Logger)}
+	if master.metrics != nil {
+		interceptors = append(interceptors, master.metricsInterceptor())
+	}
+	return append(interceptors, master.config.Interceptors...)
+}
+
+// Return the outcome of a call for metrics, by the kind of its *CallError
+func callOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrRemote):
+		return "remote"
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "unreachable"
+	}
+}
+
+// Count the rpcs master sends and serves, and their durations, see writeMetrics
+func (master *Master) metricsInterceptor() Interceptor {
+	record := func(side string, info *RPCInfo, result string, elapsed time.Duration) {
+		master.mu.Lock()
+		defer master.mu.Unlock()
+		master.metrics.rpcDone(side, info.Method, result, elapsed)
+	}
+	return Interceptor{
+		Call: func(ctx context.Context, info *RPCInfo, next func(ctx context.Context) error) error {
+			start := time.Now()
+			err := next(ctx)
+			record("client", info, callOutcome(err), time.Since(start))
+			return err
+		},
+		Reply: func(info *RPCInfo, err string, elapsed time.Duration) {
+			result := "ok"
+			if err != "" {
+				result = "error"
+			}
+			record("server", info, result, elapsed)
+		},
+	}
+}
+
+// Run interceptors around the rpcs master sends and serves, after logging and metrics
+// Ignored if WithTransport is set, whose transport runs those it was made with
+func WithInterceptors(interceptors ...Interceptor) Option {
+	return func(config *MasterConfig) error {
+		config.Interceptors = append(config.Interceptors, interceptors...)
+		return nil
+	}
+}
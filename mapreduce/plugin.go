@@ -0,0 +1,284 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Distribution of the plugin holding the map and reduce functions to workers
+
+package mapreduce
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"plugin"
+	"time"
+)
+
+// The return type of RegisterWorker for a worker without the plugin of master
+// The reply names the plugin, so the worker fetches it and registers again
+const PLUGIN_REQUIRED = "PLUGIN_REQUIRED"
+
+// The return type of FetchPlugin for a hash other than the plugin of master
+const BAD_PLUGIN = "BAD_PLUGIN"
+
+// The max bytes of the plugin sent by a single FetchPlugin
+const PLUGIN_CHUNK = 1 << 20
+
+// The directory workers cache plugins in by default
+const PLUGIN_DIR = "plugins"
+
+// The plugin master hands to workers, see WithPlugin
+type PluginInfo struct {
+	// The base name of the .so file, and the hex SHA-256 of its bytes
+	Name   string
+	Sha256 string
+	Size   int64
+}
+
+type RegisterReply struct {
+	// The id master registered the worker with, set with OK
+	WorkerId int64
+	// Set with PLUGIN_REQUIRED
+	Plugin PluginInfo
+	// Set with INCOMPATIBLE
+	Rejection *Rejection
+	// The session token of the worker if master has a secret, set with OK
+	Token string
+	// The configuration of master the worker follows, set with OK
+	Config WorkerConfig
+	// The backoff master suggests, set with RETRY_LATER
+	RetryAfter time.Duration
+	Err        Err
+}
+
+type FetchPluginSend struct {
+	Sha256 string
+	Offset int64
+	// The secret of the job, as the worker has no session token yet
+	Secret string
+}
+
+type FetchPluginReply struct {
+	// At most PLUGIN_CHUNK bytes from Offset, empty past the end
+	Data []byte
+	Err  Err
+}
+
+// The plugin served by master, read once so every worker gets the same bytes
+type pluginFile struct {
+	info PluginInfo
+	data []byte
+}
+
+// Read the plugin at path and hash it
+func readPlugin(path string) (*pluginFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read plugin: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	return &pluginFile{
+		info: PluginInfo{
+			Name:   filepath.Base(path),
+			Sha256: hex.EncodeToString(sum[:]),
+			Size:   int64(len(data)),
+		},
+		data: data,
+	}, nil
+}
+
+// rpc used by workers to download the plugin of master chunk by chunk
+// Reply BAD_PLUGIN if master has no plugin or another one
+// And AUTH for a wrong secret
+func (master *Master) FetchPlugin(args *FetchPluginSend,
+	reply *FetchPluginReply) error {
+	if err := master.enter(); err != nil {
+		return err
+	}
+	defer master.inflight.Done()
+
+	if !master.checkSecret(args.Secret) {
+		reply.Err = AUTH
+		return nil
+	}
+	// The plugin never changes once master is made, so no lock is needed
+	file := master.plugin
+	if file == nil || args.Sha256 != file.info.Sha256 {
+		reply.Err = BAD_PLUGIN
+		return nil
+	}
+	if args.Offset < 0 {
+		return fmt.Errorf("FetchPlugin: negative offset %v", args.Offset)
+	}
+	if args.Offset < file.info.Size {
+		end := args.Offset + PLUGIN_CHUNK
+		if end > file.info.Size {
+			end = file.info.Size
+		}
+		reply.Data = file.data[args.Offset:end]
+	}
+	reply.Err = OK
+	return nil
+}
+
+// Make sure the worker runs the plugin master names
+// A plugin cached under PluginDir/<sha256>/<name> is used as it is
+// Otherwise it is downloaded from master and verified before it is cached
+// Then the Map and Reduce functions of the plugin replace those of the worker
+// And so do its Setup and Cleanup hooks, if it exports them
+func (worker *Worker) installPlugin(addr string, info PluginInfo) error {
+	dir := worker.PluginDir
+	if dir == "" {
+		dir = PLUGIN_DIR
+	}
+	path := filepath.Join(dir, info.Sha256, filepath.Base(info.Name))
+
+	if sum, err := hashFile(path); err != nil || sum != info.Sha256 {
+		worker.Logger.Infof("Fetch plugin %v (%v bytes) from master", info.Name, info.Size)
+		if err := worker.downloadPlugin(addr, info, path); err != nil {
+			return err
+		}
+	}
+	return worker.loadPlugin(path, info.Sha256)
+}
+
+// Load the plugin at path in place of the functions of the worker
+// Master accepts the worker without handing it a plugin if it has the same one
+// Must be called before StartWorker
+func (worker *Worker) LoadPlugin(path string) error {
+	sum, err := hashFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot open plugin: %v", err)
+	}
+	return worker.loadPlugin(path, sum)
+}
+
+// Open the plugin at path with the hex SHA-256 sum
+// And replace the functions and hooks of the worker with those it exports
+func (worker *Worker) loadPlugin(path, sum string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open plugin: %v", err)
+	}
+	fMap, err := p.Lookup("Map")
+	if err != nil {
+		return fmt.Errorf("cannot open plugin: %v", err)
+	}
+	fReduce, err := p.Lookup("Reduce")
+	if err != nil {
+		return fmt.Errorf("cannot open plugin: %v", err)
+	}
+	mapFunc, ok := fMap.(func(string, string) []KeyValue)
+	if !ok {
+		return errors.New("cannot open plugin: Map has the wrong type")
+	}
+	reduceFunc, ok := fReduce.(func(string, []string) string)
+	if !ok {
+		return errors.New("cannot open plugin: Reduce has the wrong type")
+	}
+
+	setup, cleanup, err := lookupHooks(p)
+	if err != nil {
+		return err
+	}
+
+	worker.mu.Lock()
+	worker.fMap = mapFunc
+	worker.fReduce = reduceFunc
+	if setup != nil {
+		worker.Setup = setup
+	}
+	if cleanup != nil {
+		worker.Cleanup = cleanup
+	}
+	worker.plugin = sum
+	worker.mu.Unlock()
+	worker.Logger.Infof("Loaded plugin %v %v", path, sum)
+	return nil
+}
+
+// Return the Setup and Cleanup hooks a plugin exports, nil for those it does not
+// Return error if a hook has the wrong type
+func lookupHooks(p *plugin.Plugin) (func(context.Context, TaskInfo), func(TaskInfo), error) {
+	var setup func(context.Context, TaskInfo)
+	var cleanup func(TaskInfo)
+	if symbol, err := p.Lookup("Setup"); err == nil {
+		var ok bool
+		if setup, ok = symbol.(func(context.Context, TaskInfo)); !ok {
+			return nil, nil, errors.New("cannot open plugin: Setup has the wrong type")
+		}
+	}
+	if symbol, err := p.Lookup("Cleanup"); err == nil {
+		var ok bool
+		if cleanup, ok = symbol.(func(TaskInfo)); !ok {
+			return nil, nil, errors.New("cannot open plugin: Cleanup has the wrong type")
+		}
+	}
+	return setup, cleanup, nil
+}
+
+// Download the plugin into a temp file next to path
+// Renamed to path only if its size and SHA-256 match info
+func (worker *Worker) downloadPlugin(addr string, info PluginInfo, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("cannot cache plugin: %v", err)
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), "distributor")
+	if err != nil {
+		return fmt.Errorf("cannot cache plugin: %v", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	hash := sha256.New()
+	writer := io.MultiWriter(file, hash)
+	var offset int64
+	for offset < info.Size {
+		reply := FetchPluginReply{}
+		if err := worker.call(worker.CallTimeout, addr, "Master.FetchPlugin",
+			&FetchPluginSend{Sha256: info.Sha256, Offset: offset, Secret: worker.Secret}, &reply); err != nil {
+			return fmt.Errorf("cannot fetch plugin: %w", err)
+		}
+		if reply.Err != OK {
+			return fmt.Errorf("cannot fetch plugin: %v", reply.Err)
+		}
+		if len(reply.Data) == 0 {
+			break
+		}
+		if _, err := writer.Write(reply.Data); err != nil {
+			return fmt.Errorf("cannot cache plugin: %v", err)
+		}
+		offset += int64(len(reply.Data))
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if offset != info.Size || sum != info.Sha256 {
+		return fmt.Errorf("plugin %v: downloaded %v bytes with sha256 %v, want %v bytes with sha256 %v",
+			info.Name, offset, sum, info.Size, info.Sha256)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("cannot cache plugin: %v", err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("cannot cache plugin: %v", err)
+	}
+	return nil
+}
+
+// Return the hex SHA-256 of the file at path
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,226 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Persistent rpc connections to peers, reused across calls
+
+package mapreduce
+
+import (
+	"context"
+	"crypto/tls"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// The rpc clients of the peers master or a worker calls, keyed by address
+// net/rpc multiplexes concurrent calls over a single connection
+// A nil pool dials for every call, like Call
+type clientPool struct {
+	mu      sync.Mutex
+	clients map[string]*pooledClient
+	// Set by close, calls afterwards dial for every call
+	closed bool
+	// The TLS config peers are dialed with, nil for plain TCP
+	tls *tls.Config
+	// The codec of the connections
+	codec WireCodec
+	// How idle connections are pinged, and whether the keepalive loop runs
+	keepalive KeepalivePolicy
+	pinging   bool
+	stats     PoolStats
+}
+
+// A cached client, and whether the pool has closed it
+// A client closed by the pool fails the calls it is running with
+// rpc.ErrShutdown, which are not sent again as they may have run
+type pooledClient struct {
+	client  *rpc.Client
+	dropped bool
+	// The calls in flight, and the time the last one returned
+	calls    int
+	lastUsed time.Time
+	// The pings in a row that timed out, and whether one is in flight
+	misses  int
+	pinging bool
+}
+
+func newClientPool(tlsConfig *tls.Config, codec WireCodec, keepalive KeepalivePolicy) *clientPool {
+	return &clientPool{clients: make(map[string]*pooledClient), tls: tlsConfig,
+		codec: codec, keepalive: keepalive}
+}
+
+// Call rpcName on the peer at addr over its cached connection
+// A connection the peer broke before the call is sent is dialed again once
+// A connection that breaks during the call, or whose call outlives ctx
+// Is dropped, and the call is not sent again
+// Unless ctx marks it IDEMPOTENT, then it is sent once more over a new connection
+// Return a *CallError like Call
+func (pool *clientPool) Call(ctx context.Context, addr string, rpcName string,
+	args interface{}, reply interface{}) error {
+	if pool == nil {
+		return Call(ctx, addr, rpcName, args, reply)
+	}
+	idempotent := IdempotencyFrom(ctx) == IDEMPOTENT
+	for try := 0; ; try++ {
+		entry, err := pool.get(ctx, addr)
+		if err != nil {
+			return &CallError{callErrorKind(err), rpcName, addr, err}
+		}
+		if entry == nil {
+			return callCodec(ctx, pool.tlsConfig(), pool.codec, addr, rpcName, args, reply)
+		}
+
+		pool.begin(entry)
+		err = callClient(ctx, entry.client, rpcName, args, reply,
+			func() { pool.drop(addr, entry) })
+		pool.end(entry)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(rpc.ServerError); ok {
+			return &CallError{ErrRemote, rpcName, addr, err}
+		}
+		dropped := pool.drop(addr, entry)
+		unsent := err == rpc.ErrShutdown && !dropped
+		broken := idempotent && ctx.Err() == nil && callErrorKind(err) == ErrUnreachable
+		if try > 0 || !(unsent || broken) {
+			return &CallError{callErrorKind(err), rpcName, addr, err}
+		}
+		pool.mu.Lock()
+		pool.stats.Redials++
+		pool.mu.Unlock()
+	}
+}
+
+// Count a call in flight over entry, so it is not pinged meanwhile
+func (pool *clientPool) begin(entry *pooledClient) {
+	pool.mu.Lock()
+	entry.calls++
+	pool.mu.Unlock()
+}
+
+// Count a call over entry done, it is idle from now on if it was the last
+func (pool *clientPool) end(entry *pooledClient) {
+	pool.mu.Lock()
+	entry.calls--
+	entry.lastUsed = time.Now()
+	pool.mu.Unlock()
+}
+
+// Return the client of the peer at addr, dialing it if there is none
+// Return nil if the pool is closed
+func (pool *clientPool) get(ctx context.Context, addr string) (*pooledClient, error) {
+	pool.mu.Lock()
+	if pool.closed {
+		pool.mu.Unlock()
+		return nil, nil
+	}
+	if entry, ok := pool.clients[addr]; ok {
+		pool.mu.Unlock()
+		return entry, nil
+	}
+	pool.mu.Unlock()
+
+	// Dial outside the lock, so an unreachable peer blocks no other call
+	client, err := dial(ctx, addr, pool.tlsConfig(), pool.codec)
+	if err != nil {
+		return nil, err
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if cached, ok := pool.clients[addr]; ok || pool.closed {
+		// Another call dialed meanwhile, or the pool is closed
+		client.Close()
+		if ok {
+			return cached, nil
+		}
+		return nil, nil
+	}
+	entry := &pooledClient{client: client, lastUsed: time.Now()}
+	pool.clients[addr] = entry
+	pool.stats.Dials++
+	pool.startKeepalive()
+	return entry, nil
+}
+
+// Return the TLS config peers are dialed with
+func (pool *clientPool) tlsConfig() *tls.Config {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pool.tls
+}
+
+// Close and forget entry if it is still the one cached for addr
+// Return true if the pool had already closed it
+func (pool *clientPool) drop(addr string, entry *pooledClient) bool {
+	pool.mu.Lock()
+	dropped := entry.dropped
+	entry.dropped = true
+	if pool.clients[addr] == entry {
+		delete(pool.clients, addr)
+	}
+	pool.mu.Unlock()
+	if !dropped {
+		entry.client.Close()
+	}
+	return dropped
+}
+
+// Close the connection to the peer at addr, e.g. once it is forgotten
+func (pool *clientPool) forget(addr string) {
+	if pool == nil {
+		return
+	}
+	pool.mu.Lock()
+	entry, ok := pool.clients[addr]
+	pool.mu.Unlock()
+	if ok {
+		pool.drop(addr, entry)
+	}
+}
+
+// Close every connection
+func (pool *clientPool) close() {
+	if pool == nil {
+		return
+	}
+	pool.mu.Lock()
+	entries := pool.clients
+	pool.clients = make(map[string]*pooledClient)
+	pool.closed = true
+	pool.mu.Unlock()
+	for addr, entry := range entries {
+		pool.drop(addr, entry)
+	}
+}
+
+// Call rpcName on the worker at addr over its connection, giving up after timeout
+func (master *Master) call(timeout time.Duration, addr string, rpcName string,
+	args interface{}, reply interface{}) error {
+	return master.callContext(context.Background(), timeout, addr, rpcName, args, reply)
+}
+
+// Call rpcName like call, with what ctx carries, e.g. ContextWithIdempotency
+func (master *Master) callContext(ctx context.Context, timeout time.Duration, addr string,
+	rpcName string, args interface{}, reply interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return master.breakerCall(addr, rpcName, func() error {
+		return master.transport.Call(ctx, addr, rpcName, args, reply)
+	})
+}
+
+// Call rpcName on master or the worker at addr over its connection
+// Giving up after timeout
+func (worker *Worker) call(timeout time.Duration, addr string, rpcName string,
+	args interface{}, reply interface{}) error {
+	return worker.callContext(context.Background(), timeout, addr, rpcName, args, reply)
+}
+
+// Call rpcName like call, with what ctx carries, e.g. ContextWithIdempotency
+func (worker *Worker) callContext(ctx context.Context, timeout time.Duration, addr string,
+	rpcName string, args interface{}, reply interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return worker.transport.Call(ctx, addr, rpcName, args, reply)
+}
@@ -0,0 +1,206 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Snapshot of the progress of jobs and workers
+
+package mapreduce
+
+import "time"
+
+// The estimate of a phase that cannot be made yet
+// Because no task of the phase has finished, or no worker is running
+const ETA_UNKNOWN time.Duration = -1
+
+// The number of latest finished attempts of a phase the estimate averages
+const ETA_WINDOW = 20
+
+// The progress of jobs at a moment
+type Progress struct {
+	// The number of map tasks in each state
+	MapFinished   int
+	MapProcessing int
+	MapPending    int
+	MapSkipped    int
+	// The number of reduce tasks in each state
+	ReduceFinished   int
+	ReduceProcessing int
+	ReducePending    int
+	ReduceSkipped    int
+	// The percentage of finished or skipped tasks, 100 if there is no task
+	Percentage float64
+
+	// The number of registered workers and of those in each state
+	Workers            int
+	AvailableWorkers   int
+	FailedWorkers      int
+	BlacklistedWorkers int
+
+	// True if scheduling is paused
+	Paused bool
+	// The time since the scheduler starts running
+	Elapsed time.Duration
+
+	// The estimated time left in each phase and in total
+	// From the mean duration of the latest finished attempts of the phase
+	// And the slots of available and running workers
+	// ETA_UNKNOWN until an estimate can be made
+	MapRemaining       time.Duration
+	ReduceRemaining    time.Duration
+	EstimatedRemaining time.Duration
+}
+
+// Count the tasks of the jobs and the workers of master
+// Must be called with lock held
+func (master *Master) progress(jobs []*jobState, start time.Time) Progress {
+	// Paused if master is, or every one of the jobs is
+	result := Progress{Paused: master.paused || len(jobs) > 0}
+	for _, job := range jobs {
+		result.Paused = result.Paused && (master.paused || job.paused)
+	}
+
+	count := func(statuses []int, finished, processing, pending, skipped *int) {
+		for _, status := range statuses {
+			switch status {
+			case FINISHED:
+				*finished++
+			case PROCESSING:
+				*processing++
+			case UNPROCESSED:
+				*pending++
+			case SKIPPED:
+				*skipped++
+			}
+		}
+	}
+	total := 0
+	for _, job := range jobs {
+		count(job.mapStatus, &result.MapFinished, &result.MapProcessing,
+			&result.MapPending, &result.MapSkipped)
+		count(job.reduceStatus, &result.ReduceFinished, &result.ReduceProcessing,
+			&result.ReducePending, &result.ReduceSkipped)
+		total += job.nMap + job.nReduce
+	}
+	result.Percentage = 100
+	if total > 0 {
+		done := result.MapFinished + result.ReduceFinished +
+			result.MapSkipped + result.ReduceSkipped
+		result.Percentage = float64(done) * 100 / float64(total)
+	}
+
+	for _, registry := range master.workers {
+		result.Workers++
+		switch registry.status {
+		case AVAILABLE:
+			result.AvailableWorkers++
+		case FAILED:
+			result.FailedWorkers++
+		case BLACKLISTED:
+			result.BlacklistedWorkers++
+		}
+	}
+
+	if !start.IsZero() {
+		result.Elapsed = time.Since(start)
+	}
+
+	result.MapRemaining = master.estimate(jobs, MAP)
+	result.ReduceRemaining = master.estimate(jobs, REDUCE)
+	result.EstimatedRemaining = ETA_UNKNOWN
+	if result.MapRemaining != ETA_UNKNOWN && result.ReduceRemaining != ETA_UNKNOWN {
+		result.EstimatedRemaining = result.MapRemaining + result.ReduceRemaining
+	}
+	return result
+}
+
+// Estimate the time left in the phase of the jobs indicated by taskType
+// The work left is the mean duration for each pending task
+// And what is left of the mean for each processing task
+// Spread over every slot of the available and running workers
+// Must be called with lock held
+func (master *Master) estimate(jobs []*jobState, taskType TaskType) time.Duration {
+	var work time.Duration
+	for _, job := range jobs {
+		if job.halted() || job.phaseFinished(taskType) {
+			continue
+		}
+		mean, ok := job.meanDuration(taskType)
+		if !ok {
+			return ETA_UNKNOWN
+		}
+
+		statusRef, _ := job.getStatusRef(taskType)
+		metaRef, _ := job.getMetaRef(taskType)
+		for idx, status := range *statusRef {
+			switch status {
+			case UNPROCESSED:
+				work += mean
+			case PROCESSING:
+				if left := mean - time.Since((*metaRef)[idx].startTime); left > 0 {
+					work += left
+				}
+			}
+		}
+	}
+	if work == 0 {
+		return 0
+	}
+
+	slots := 0
+	for _, registry := range master.workers {
+		if registry.status == AVAILABLE || registry.status == RUNNING {
+			slots += registry.slots
+		}
+	}
+	if slots == 0 {
+		return ETA_UNKNOWN
+	}
+	return work / time.Duration(slots)
+}
+
+// Return the mean duration of the latest ETA_WINDOW attempts
+// That finished tasks of taskType in the job
+// Return false if there is none
+// Must be called with lock held
+func (job *jobState) meanDuration(taskType TaskType) (time.Duration, bool) {
+	records := job.master.timeline.records
+	var total time.Duration
+	count := 0
+	for idx := len(records) - 1; idx >= 0 && count < ETA_WINDOW; idx-- {
+		record := records[idx]
+		if record.JobId != job.id || record.TaskType != taskType ||
+			record.Result != ATTEMPT_OK {
+			continue
+		}
+		total += record.Finished.Sub(record.Assigned)
+		count++
+	}
+	if count == 0 {
+		return 0, false
+	}
+	return total / time.Duration(count), true
+}
+
+// Return the progress of every submitted job together
+// Cheap enough to be polled every second
+func (master *Master) Progress() Progress {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	var jobs []*jobState
+	for id := JobId(0); id < master.nextJobId; id++ {
+		jobs = append(jobs, master.jobs[id])
+	}
+	return master.progress(jobs, master.startTime)
+}
+
+// Return the progress of a single job
+// Elapsed is counted from the time the job starts being scheduled
+// Return ErrUnknownJob if the job was never submitted
+func (master *Master) JobProgress(id JobId) (Progress, error) {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	job := master.getJob(id)
+	if job == nil {
+		return Progress{}, ErrUnknownJob
+	}
+	return master.progress([]*jobState{job}, job.startTime), nil
+}
@@ -0,0 +1,328 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Rate limits and a cap of rpcs in flight, so a flood of rpcs cannot starve master
+
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The return type of an rpc master turns away, see RateLimit and WithMaxInflight
+// Nothing was done, so the caller sends it again after RetryAfter
+const RETRY_LATER = "RETRY_LATER"
+
+// The default rate of a method without its own limit, and its burst
+const RATE_LIMIT = 1000
+const RATE_BURST = 2000
+
+// The default number of rpcs master handles at once
+const MAX_INFLIGHT_RPCS = 512
+
+// The backoff suggested once MaxInflight rpcs are in flight
+// And the least suggested for a rate limit
+const RETRY_LATER_BACKOFF = 100 * time.Millisecond
+const RETRY_LATER_MIN = 10 * time.Millisecond
+
+// The times a worker sends an rpc master keeps turning away before it gives up
+const RETRY_LATER_TRIES = 10
+
+// The reasons an rpc is turned away, counted by metrics
+const (
+	THROTTLE_RATE     = "rate"
+	THROTTLE_INFLIGHT = "inflight"
+)
+
+// Returned once master turns an rpc away RETRY_LATER_TRIES times in a row
+var ErrOverloaded = errors.New("mapreduce: master overloaded")
+
+// A token bucket per method, refilled at Rate per second up to Burst
+type RateLimit struct {
+	// 0 is unlimited
+	Rate  float64
+	Burst int
+}
+
+// Return the limits of each method by default, generous enough to never hit
+// Unless a client sends far more than a worker would
+// Methods not in the map are limited by RATE_LIMIT and RATE_BURST
+func DefaultRateLimits() map[string]RateLimit {
+	return map[string]RateLimit{
+		// A script registering in a loop
+		"Master.RegisterWorker": {Rate: 100, Burst: 200},
+		// Thousands of workers each sending one per HEARTBEAT_INTERVAL
+		"Master.Heartbeat": {Rate: 5000, Burst: 10000},
+	}
+}
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// Take a token at now
+// Return 0 if there was one, otherwise the wait until there is
+func (bucket *tokenBucket) take(now time.Time) time.Duration {
+	if !bucket.last.IsZero() {
+		bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.limit.Rate
+	}
+	if max := float64(bucket.limit.Burst); bucket.tokens > max {
+		bucket.tokens = max
+	}
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / bucket.limit.Rate * float64(time.Second))
+}
+
+// The rate limits and in-flight cap of master, with a lock of its own
+// So rpcs turned away never take the lock of master
+type rateLimiter struct {
+	mu       sync.Mutex
+	limits   map[string]RateLimit
+	buckets  map[string]*tokenBucket
+	inflight int
+	// 0 is unlimited
+	maxInflight int
+	// The rpcs turned away, by method and reason
+	throttled map[throttleKey]int64
+}
+
+type throttleKey struct {
+	method string
+	reason string
+}
+
+func newRateLimiter(limits map[string]RateLimit, maxInflight int) *rateLimiter {
+	return &rateLimiter{
+		limits:      limits,
+		buckets:     make(map[string]*tokenBucket),
+		maxInflight: maxInflight,
+		throttled:   make(map[throttleKey]int64),
+	}
+}
+
+// Take a token of method and a slot in flight
+// Return 0 if the rpc may run, otherwise the backoff to suggest
+func (limiter *rateLimiter) admit(method string) time.Duration {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if limiter.maxInflight > 0 && limiter.inflight >= limiter.maxInflight {
+		limiter.throttled[throttleKey{method, THROTTLE_INFLIGHT}]++
+		return jitter(RETRY_LATER_BACKOFF)
+	}
+	bucket, ok := limiter.buckets[method]
+	if !ok {
+		limit, ok := limiter.limits[method]
+		if !ok {
+			limit = RateLimit{Rate: RATE_LIMIT, Burst: RATE_BURST}
+		}
+		bucket = &tokenBucket{limit: limit, tokens: float64(limit.Burst)}
+		limiter.buckets[method] = bucket
+	}
+	if bucket.limit.Rate > 0 {
+		if wait := bucket.take(time.Now()); wait > 0 {
+			limiter.throttled[throttleKey{method, THROTTLE_RATE}]++
+			if wait < RETRY_LATER_MIN {
+				wait = RETRY_LATER_MIN
+			}
+			return jitter(wait)
+		}
+	}
+	limiter.inflight++
+	return 0
+}
+
+// Give back the slot of an rpc admit let run
+func (limiter *rateLimiter) release() {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.inflight--
+}
+
+// Return the rpcs turned away so far
+func (limiter *rateLimiter) snapshot() map[throttleKey]int64 {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	result := make(map[throttleKey]int64, len(limiter.throttled))
+	for key, count := range limiter.throttled {
+		result[key] = count
+	}
+	return result
+}
+
+// Return wait with up to half of it added at random
+// So callers turned away at the same time do not come back in lockstep
+func jitter(wait time.Duration) time.Duration {
+	return wait + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// A reply master can turn away with RETRY_LATER
+type throttledReply interface {
+	// Mark the reply RETRY_LATER, suggesting the caller waits for after
+	retryLater(after time.Duration)
+}
+
+// A reply whose caller honors RETRY_LATER, see Worker.callMaster
+type retriedReply interface {
+	throttledReply
+	// Return the backoff master suggests, false unless it replied RETRY_LATER
+	backoff() (time.Duration, bool)
+}
+
+func (reply *GeneralReply) retryLater(after time.Duration) {
+	reply.Err, reply.RetryAfter = RETRY_LATER, after
+}
+
+func (reply *GeneralReply) backoff() (time.Duration, bool) {
+	return reply.RetryAfter, reply.Err == RETRY_LATER
+}
+
+func (reply *RegisterReply) retryLater(after time.Duration) {
+	reply.Err, reply.RetryAfter = RETRY_LATER, after
+}
+
+func (reply *RegisterReply) backoff() (time.Duration, bool) {
+	return reply.RetryAfter, reply.Err == RETRY_LATER
+}
+
+func (reply *HeartbeatReply) retryLater(after time.Duration) {
+	reply.Err, reply.RetryAfter = RETRY_LATER, after
+}
+
+func (reply *HeartbeatReply) backoff() (time.Duration, bool) {
+	return reply.RetryAfter, reply.Err == RETRY_LATER
+}
+
+func (reply *RequestTaskReply) retryLater(after time.Duration) {
+	reply.Instruction, reply.RetryAfter = RETRY_LATER, after
+}
+
+func (reply *RequestTaskReply) backoff() (time.Duration, bool) {
+	return reply.RetryAfter, reply.Instruction == RETRY_LATER
+}
+
+func (reply *WaitDoneReply) retryLater(after time.Duration) {
+	reply.Err, reply.RetryAfter = RETRY_LATER, after
+}
+
+func (reply *WaitDoneReply) backoff() (time.Duration, bool) {
+	return reply.RetryAfter, reply.Err == RETRY_LATER
+}
+
+func (reply *SubmitJobReply) retryLater(after time.Duration) {
+	reply.Err, reply.RetryAfter = RETRY_LATER, after
+}
+
+func (reply *SubmitJobReply) backoff() (time.Duration, bool) {
+	return reply.RetryAfter, reply.Err == RETRY_LATER
+}
+
+func (reply *JobStatus) retryLater(after time.Duration) {
+	reply.Err, reply.RetryAfter = RETRY_LATER, after
+}
+
+func (reply *JobStatus) backoff() (time.Duration, bool) {
+	return reply.RetryAfter, reply.Err == RETRY_LATER
+}
+
+// Let the rpc method run unless it is over its rate limit, or MaxInflight run already
+// Otherwise reply RETRY_LATER and return false
+// Release must be called once an admitted rpc returns
+// Called by the rpcs workers and clients send in bulk, not by probes or operator controls
+// Long polls like WaitDone release their slot before they block
+// Must be called without lock held
+func (master *Master) admit(method string, reply throttledReply) bool {
+	wait := master.limiter.admit(method)
+	if wait == 0 {
+		return true
+	}
+	master.config.Logger.Debugf("Throttle %v, retry after %v", method, wait)
+	reply.retryLater(wait)
+	return false
+}
+
+// Give back the slot of an rpc admit let run
+func (master *Master) release() {
+	master.limiter.release()
+}
+
+// Call rpcName on master with args, which replies a GeneralReply
+// Send it again after the backoff master suggests while it replies RETRY_LATER
+// To whichever master the worker follows by then
+// Return the Err master replied
+// Or ErrOverloaded once it was turned away RETRY_LATER_TRIES times
+func (worker *Worker) callMaster(rpcName string, args interface{}) (Err, error) {
+	for try := 0; try < RETRY_LATER_TRIES; try++ {
+		addr, _ := worker.master()
+		reply := GeneralReply{}
+		if err := worker.call(worker.CallTimeout, addr, rpcName, args, &reply); err != nil {
+			return "", err
+		}
+		wait, throttled := reply.backoff()
+		if !throttled {
+			return reply.Err, nil
+		}
+		worker.Logger.Debugf("Master throttles %v, retry after %v", rpcName, wait)
+		time.Sleep(wait)
+	}
+	return "", fmt.Errorf("%v: %w", rpcName, ErrOverloaded)
+}
+
+// Write the rpcs turned away by method and reason
+func writeThrottleMetrics(w io.Writer, throttled map[throttleKey]int64) {
+	keys := make([]throttleKey, 0, len(throttled))
+	for key := range throttled {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].reason < keys[j].reason
+	})
+	name := "mapreduce_rpcs_throttled_total"
+	fmt.Fprintf(w, "# HELP %v Rpcs master turned away with RETRY_LATER.\n# TYPE %v counter\n",
+		name, name)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%v{method=\"%v\",reason=\"%v\"} %v\n", name, key.method, key.reason,
+			throttled[key])
+	}
+}
+
+// Limit the rpc method like RateLimit, e.g. "Master.RegisterWorker"
+// Rate 0 lifts the limit
+func WithRateLimit(method string, limit RateLimit) Option {
+	return func(config *MasterConfig) error {
+		if !strings.HasPrefix(method, "Master.") {
+			return fmt.Errorf("WithRateLimit: %q is not a method of master", method)
+		}
+		if limit.Rate < 0 || (limit.Rate > 0 && limit.Burst < 1) {
+			return errors.New("WithRateLimit: rate must not be negative, and burst positive")
+		}
+		config.RateLimits[method] = limit
+		return nil
+	}
+}
+
+// Handle at most n rpcs at once, turning the rest away with RETRY_LATER
+// 0 lifts the cap
+func WithMaxInflight(n int) Option {
+	return func(config *MasterConfig) error {
+		if n < 0 {
+			return fmt.Errorf("WithMaxInflight: %v is negative", n)
+		}
+		config.MaxInflight = n
+		return nil
+	}
+}
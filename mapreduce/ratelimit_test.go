@@ -0,0 +1,142 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of rate limiting master rpcs
+
+package mapreduce
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Return the rpcs of method master turned away for reason so far
+func throttledCount(master *Master, method, reason string) int64 {
+	return master.limiter.snapshot()[throttleKey{method, reason}]
+}
+
+func TestThrottledRepliesCarryRetryAfter(t *testing.T) {
+	// A token every 1000s, so the second call is always turned away
+	slow := RateLimit{Rate: 0.001, Burst: 1}
+	master := makeMaster(t, writeInputs(t, "a"), 1,
+		WithRateLimit("Master.SubmitJob", slow),
+		WithRateLimit("Master.GetJobStatus", slow),
+		WithRateLimit("Master.WaitDone", slow))
+	files := writeInputs(t, "b")
+
+	var submitted SubmitJobReply
+	for i := 0; i < 2; i++ {
+		submitted = SubmitJobReply{}
+		if err := master.SubmitJob(&JobSpec{InputFiles: files, NReduce: 1}, &submitted); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if submitted.Err != RETRY_LATER || submitted.RetryAfter < RETRY_LATER_MIN {
+		t.Fatalf("throttled SubmitJob replied %v after %v", submitted.Err, submitted.RetryAfter)
+	}
+
+	var status JobStatus
+	for i := 0; i < 2; i++ {
+		status = JobStatus{}
+		master.GetJobStatus(&JobStatusSend{JobId: DEFAULT_JOB}, &status)
+	}
+	if status.Err != RETRY_LATER || status.RetryAfter < RETRY_LATER_MIN {
+		t.Fatalf("throttled GetJobStatus replied %v after %v", status.Err, status.RetryAfter)
+	}
+
+	var done WaitDoneReply
+	for i := 0; i < 2; i++ {
+		done = WaitDoneReply{}
+		master.WaitDone(&WaitDoneSend{JobId: DEFAULT_JOB}, &done)
+	}
+	if done.Err != RETRY_LATER || done.RetryAfter < RETRY_LATER_MIN {
+		t.Fatalf("throttled WaitDone replied %v after %v", done.Err, done.RetryAfter)
+	}
+}
+
+func TestClientsWaitOutRetryLater(t *testing.T) {
+	contents := []string{"a b", "b c"}
+	limit := RateLimit{Rate: 20, Burst: 1}
+	master := startMaster(t, writeInputs(t, contents...), 1,
+		WithRateLimit("Master.GetJobStatus", limit),
+		WithRateLimit("Master.WaitDone", limit))
+	addr := master.Addr().String()
+
+	for i := 0; i < 3; i++ {
+		if _, err := GetJobStatus(addr, DEFAULT_JOB); err != nil {
+			t.Fatalf("GetJobStatus turned away: %v", err)
+		}
+	}
+	if throttledCount(master, "Master.GetJobStatus", THROTTLE_RATE) == 0 {
+		t.Fatal("no GetJobStatus was throttled")
+	}
+
+	// Polls far faster than the limit allows, while no worker runs the job
+	waited := make(chan error, 1)
+	go func() { waited <- WaitForJob(addr, DEFAULT_JOB, 5*time.Millisecond, 10*time.Second) }()
+	time.Sleep(200 * time.Millisecond)
+	startWorker(t, master, nil)
+	if err := <-waited; err != nil {
+		t.Fatalf("WaitForJob: %v", err)
+	}
+	if throttledCount(master, "Master.WaitDone", THROTTLE_RATE) == 0 {
+		t.Fatal("no WaitDone was throttled")
+	}
+	status, err := GetJobStatus(addr, DEFAULT_JOB)
+	if err != nil || status.Phase != PHASE_DONE {
+		t.Fatalf("status after the wait: %v, %v, want %v", status.Phase, err, PHASE_DONE)
+	}
+}
+
+func TestSchedulerProgressesUnderRegistrationFlood(t *testing.T) {
+	contents := []string{"a b", "b c", "c d", "d e", "e f", "f g"}
+	master := startMaster(t, writeInputs(t, contents...), 2,
+		WithRateLimit("Master.RegisterWorker", RateLimit{Rate: 20, Burst: 20}),
+		WithMaxInflight(16))
+	startWorker(t, master, nil)
+	waitFor(t, 5*time.Second, "the worker to register", func() bool {
+		master.mu.Lock()
+		defer master.mu.Unlock()
+		return len(master.workers) == 1
+	})
+
+	// A script registering in a loop from many goroutines
+	// With a version master refuses, so the flood adds no workers
+	addr := master.Addr().String()
+	stop := make(chan struct{})
+	var flooders sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		flooders.Add(1)
+		go func() {
+			defer flooders.Done()
+			transport := NewRPCTransport(nil)
+			defer transport.Close()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				transport.Call(ctx, addr, "Master.RegisterWorker", &RegisterSend{
+					Version: PROTOCOL_VERSION + 1,
+					Addr:    "localhost:1",
+					Slots:   1,
+				}, &RegisterReply{})
+				cancel()
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		flooders.Wait()
+	}()
+
+	if err := waitJob(t, master, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+	if throttledCount(master, "Master.RegisterWorker", THROTTLE_RATE) == 0 {
+		t.Fatal("no registration of the flood was throttled")
+	}
+}
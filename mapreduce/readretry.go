@@ -0,0 +1,120 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Retry of transient errors reading the input of map tasks
+
+package mapreduce
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+)
+
+// The default number of times a map attempt reads its input again
+// After a transient error, before it fails
+const READ_RETRIES = 4
+
+// The default wait before the first retry, doubled for every retry after it
+// Up to READ_MAX_BACKOFF
+const READ_BACKOFF = 100 * time.Millisecond
+const READ_MAX_BACKOFF = 5 * time.Second
+
+// Return true if reading again cannot fix the error
+// The input does not exist, cannot be read by the worker, or is not a file
+// Other errors are transient, e.g. a timeout or a reset connection of a network
+// File system, unless they tell otherwise with a false Temporary
+// So a reader of a remote store returns a Temporary error for a 5xx reply
+func permanentReadError(err error) bool {
+	if os.IsNotExist(err) || os.IsPermission(err) {
+		return true
+	}
+	// Errno tells too few errors Temporary, so it is matched by value instead
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EISDIR, syscall.ENOTDIR, syscall.ENAMETOOLONG, syscall.ELOOP:
+			return true
+		}
+		return false
+	}
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) {
+		return !temporary.Temporary()
+	}
+	return false
+}
+
+// Return the wait before retry number try (from 0) of a worker
+func (worker *Worker) readBackoff(try int) time.Duration {
+	backoff := worker.ReadBackoff
+	if backoff <= 0 {
+		backoff = READ_BACKOFF
+	}
+	for i := 0; i < try && backoff < READ_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > READ_MAX_BACKOFF {
+		backoff = READ_MAX_BACKOFF
+	}
+	return backoff
+}
+
+// Read the input split of a map attempt
+// Transient errors are retried with backoff up to ReadRetries times
+// Return the content, the offset in the file it starts at and the number of retries
+// Stop once the attempt is killed, returning the context error
+// A ReadInput of worker reads the whole file, which is then cut to the split
+func (worker *Worker) readInput(ctx context.Context, attempt TaskAttempt,
+	split InputSplit) ([]byte, int64, int, error) {
+	read := func(ctx context.Context) ([]byte, int64, error) {
+		if worker.ReadInput == nil {
+			if split.whole() {
+				content, err := ioutil.ReadFile(split.File)
+				return content, 0, err
+			}
+			return readSplitFile(split)
+		}
+		content, err := worker.ReadInput(ctx, split.File)
+		if err != nil || split.whole() {
+			return content, 0, err
+		}
+		return readSplit(bytes.NewReader(content), split)
+	}
+	budget := worker.ReadRetries
+	if budget == 0 {
+		budget = READ_RETRIES
+	}
+
+	for try := 0; ; try++ {
+		content, start, err := read(ctx)
+		if err == nil || permanentReadError(err) || try >= budget {
+			return content, start, try, err
+		}
+		backoff := worker.readBackoff(try)
+		worker.taskLogger(attempt).Warnf("Job %v: map task %v cannot read %v, retry in %v: %v",
+			attempt.JobId, attempt.TaskId, split, backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, 0, try, ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// Report a map attempt that cannot read its input
+// A permanent error fails the task without running it again
+func (worker *Worker) reportReadError(attempt TaskAttempt, split InputSplit,
+	retries int, err error) {
+	permanent := permanentReadError(err)
+	worker.taskLogger(attempt).Errorf("Job %v: map task %v cannot read %v after %v retries: %v",
+		attempt.JobId, attempt.TaskId, split, retries, err)
+	worker.sendFailed(attempt, TaskFailedSend{
+		Err:         fmt.Sprintf("cannot read %v: %v", split, err),
+		Permanent:   permanent,
+		ReadRetries: retries,
+	})
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// What a worker does once master stops answering its heartbeats
+
+package mapreduce
+
+import (
+	"context"
+	"time"
+)
+
+// The policies of a worker whose master is lost, see Worker.LostMaster
+const (
+	// Keep sending heartbeats with exponential backoff, and register again
+	// Once a master answers
+	LOST_MASTER_RECONNECT = "RECONNECT"
+	// Kill running tasks, stop the worker and close Done
+	LOST_MASTER_EXIT = "EXIT"
+)
+
+// The default number of heartbeats failing in a row before master is lost
+const LOST_MASTER_PROBES = 5
+
+// The max interval between heartbeats of a worker reconnecting to master
+const RECONNECT_MAX_BACKOFF = time.Minute
+
+// Return the interval before the next heartbeat
+// The interval master asks for until it is lost, then doubled after every failure
+// Up to RECONNECT_MAX_BACKOFF
+func (worker *Worker) heartbeatBackoff(failures int) time.Duration {
+	backoff := worker.heartbeatInterval()
+	for lost := failures - worker.LostMasterProbes; lost >= 0; lost-- {
+		backoff *= 2
+		if backoff >= RECONNECT_MAX_BACKOFF {
+			return RECONNECT_MAX_BACKOFF
+		}
+	}
+	return backoff
+}
+
+// Kill every running attempt, as master does not know about them
+// Return the number killed
+func (worker *Worker) killAll() int {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+
+	killed := 0
+	for attempt := range worker.tasks {
+		if worker.kill(attempt) {
+			killed++
+		}
+	}
+	return killed
+}
+
+// Register again to a master that does not know the worker
+// E.g. master restarted, or forgot the worker after failing it
+// Master has requeued or never heard of the running attempts, so they are killed
+// And the ended attempts forgotten, as a restarted master numbers attempts from 0 again
+// So a start of the new master is never taken for one delivered before
+// The killed attempts are given CallTimeout to end first
+func (worker *Worker) rejoin() {
+	killed := worker.killAll()
+	worker.Logger.Warnf("Master does not know the worker, register again and kill %v tasks",
+		killed)
+	ended := make(chan struct{})
+	go func() {
+		worker.running.Wait()
+		close(ended)
+	}()
+	select {
+	case <-ended:
+	case <-time.After(worker.CallTimeout):
+		worker.Logger.Warnf("Killed tasks still running after %v, register anyway", worker.CallTimeout)
+	}
+	worker.forgetEnded()
+
+	if err := worker.register(); err != nil {
+		worker.Logger.Errorf("Cannot register again: %v", err)
+	}
+}
+
+// Stop the worker for good once master is lost under LOST_MASTER_EXIT
+// So a supervisor can restart it
+func (worker *Worker) abandon() {
+	worker.mu.Lock()
+	worker.closing = true
+	worker.mu.Unlock()
+
+	killed := worker.killAll()
+	worker.Logger.Errorf("Master lost, stop the worker and kill %v tasks", killed)
+	ctx, cancel := context.WithTimeout(context.Background(), worker.CallTimeout)
+	defer cancel()
+	worker.stop(ctx)
+}
+
+// Stop heartbeats, stop the listener and close Done
+// Rpcs running are given until ctx is done to return, see StoppableListener
+func (worker *Worker) stop(ctx context.Context) {
+	worker.mu.Lock()
+	if worker.closed {
+		worker.mu.Unlock()
+		return
+	}
+	worker.closed = true
+	listener := worker.listener
+	worker.mu.Unlock()
+
+	if listener != nil {
+		stopListener(ctx, listener)
+	}
+	worker.transport.Close()
+	close(worker.done)
+}
+
+// Return a channel closed once the worker has stopped
+// By Shutdown, or because master is lost under LOST_MASTER_EXIT
+func (worker *Worker) Done() <-chan struct{} {
+	return worker.done
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of workers whose master stops answering
+
+package mapreduce
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Start a master of a job stalling on its only map, on port
+// Return the master, its worker, and a channel closed once the stalled attempt is killed
+func startStalledMaster(t *testing.T, port int64, setup func(worker *Worker)) (*Master, *Worker, chan struct{}) {
+	t.Helper()
+	master, err := MakeMaster(writeInputs(t, "a"), 1, port, testOptions(t)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := master.RunMaster(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shutdownMaster(master) })
+	// Only the first map stalls, later ones count words
+	stall := newStallingMap(1)
+	stall.killable = true
+	t.Cleanup(func() { stall.release(0) })
+	killed := make(chan struct{})
+	worker := startWorker(t, master, func(worker *Worker) {
+		worker.LostMasterProbes = 2
+		worker.MapContext = func(ctx context.Context, file, content string) []KeyValue {
+			kvs := stall.mapContext(ctx, file, content)
+			if ctx.Err() != nil {
+				close(killed)
+			}
+			return kvs
+		}
+		setup(worker)
+	})
+	waitFor(t, 5*time.Second, "the map assigned", func() bool {
+		_, ok := attemptRecord(master, MAP, 0, 0)
+		return ok
+	})
+	return master, worker, killed
+}
+
+func TestWorkerExitsOnceMasterIsLost(t *testing.T) {
+	master, worker, killed := startStalledMaster(t, freePort(t), func(worker *Worker) {
+		worker.LostMaster = LOST_MASTER_EXIT
+	})
+	shutdownMaster(master)
+
+	select {
+	case <-worker.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker still running after its master was lost")
+	}
+	select {
+	case <-killed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("running attempt not killed once master was lost")
+	}
+}
+
+func TestWorkerRejoinsRestartedMaster(t *testing.T) {
+	port := freePort(t)
+	old, worker, killed := startStalledMaster(t, port, func(worker *Worker) {
+		worker.LostMaster = LOST_MASTER_RECONNECT
+	})
+	shutdownMaster(old)
+	// Long enough for master to count as lost
+	time.Sleep(300 * time.Millisecond)
+
+	// The worker comes back to the new master at the same address, and runs its job
+	contents := []string{"b c b"}
+	restarted, err := MakeMaster(writeInputs(t, contents...), 1, port, testOptions(t)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.RunMaster(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shutdownMaster(restarted) })
+	select {
+	case <-killed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("attempt of the old master not killed once the worker rejoined")
+	}
+	if err := waitJob(t, restarted, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, restarted.config.OutputDir), wordCounts(contents...))
+	select {
+	case <-worker.Done():
+		t.Fatal("worker stopped instead of reconnecting")
+	default:
+	}
+}
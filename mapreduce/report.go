@@ -0,0 +1,256 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Timing records of task attempts and the summary of jobs
+
+package mapreduce
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// The results of a task attempt
+const (
+	// The attempt finished the task
+	ATTEMPT_OK = "OK"
+	// The attempt reported after the task finished or the job stopped
+	ATTEMPT_WASTE = "WASTE"
+	// The attempt was given up, e.g. its worker failed
+	ATTEMPT_FAILED = "FAILED"
+	// The attempt was killed by master, by Abort, a deadline or a skip
+	ATTEMPT_ABORTED = "ABORTED"
+)
+
+// The timing of a single task attempt
+type AttemptRecord struct {
+	JobId     JobId
+	TaskId    TaskId
+	TaskType  TaskType
+	AttemptId AttemptId
+	WorkerId  int64
+	// The time the attempt is assigned, and the time it ends
+	// Finished is zero while the attempt is running
+	Assigned time.Time
+	Finished time.Time
+	// One of the ATTEMPT results, empty while the attempt is running
+	Result string
+	// The times a map attempt read its input again after a transient error
+	ReadRetries int
+}
+
+// The records of every task attempt of master
+// Guarded by the lock of master
+type taskTimeline struct {
+	records []AttemptRecord
+	// The index in records of each attempt
+	index map[runningTask]int
+	// The log sent with TaskFailed by each attempt failing that way
+	logs map[runningTask]string
+	// The durations of the latest attempts that finished a task of each phase
+	// Oldest first, at most STRAGGLER_WINDOW, see sampled
+	finished map[jobPhase][]time.Duration
+}
+
+// Record that an attempt is assigned to the worker
+func (timeline *taskTimeline) assigned(task runningTask, workerId int64) {
+	if timeline.index == nil {
+		timeline.index = map[runningTask]int{}
+	}
+	timeline.index[task] = len(timeline.records)
+	timeline.records = append(timeline.records, AttemptRecord{
+		JobId:     task.jobId,
+		TaskId:    task.taskId,
+		TaskType:  task.taskType,
+		AttemptId: task.attemptId,
+		WorkerId:  workerId,
+		Assigned:  time.Now(),
+	})
+}
+
+// Record the result of an attempt
+// Only the first result of an attempt is kept
+func (timeline *taskTimeline) ended(task runningTask, result string) {
+	idx, ok := timeline.index[task]
+	if !ok || timeline.records[idx].Result != "" {
+		return
+	}
+	record := &timeline.records[idx]
+	record.Finished = time.Now()
+	record.Result = result
+	if result == ATTEMPT_OK {
+		timeline.sampled(jobPhase{record.JobId, record.TaskType}, record.Finished.Sub(record.Assigned))
+	}
+}
+
+// Record the input read retries an attempt reported
+func (timeline *taskTimeline) readRetried(task runningTask, retries int) {
+	if idx, ok := timeline.index[task]; ok && retries > 0 {
+		timeline.records[idx].ReadRetries = retries
+	}
+}
+
+// Record the log a failed attempt sent, see Master.TaskLog
+func (timeline *taskTimeline) captured(task runningTask, log string) {
+	if timeline.logs == nil {
+		timeline.logs = map[runningTask]string{}
+	}
+	timeline.logs[task] = log
+}
+
+// The summary of a phase of a job
+type PhaseSummary struct {
+	// The number of tasks and of attempts made for them
+	Tasks    int
+	Attempts int
+	// The attempts made beyond the first attempt of each task
+	// Of which Backups were backup copies of stragglers
+	Retries int
+	Backups int
+	// The input read retries of every attempt, see Worker.ReadRetries
+	ReadRetries int
+	// The records and bytes of the finished tasks, see TaskCounters
+	Counters TaskCounters
+	// The duration of the attempts that finished tasks
+	P50 time.Duration
+	P95 time.Duration
+	// The time from the first assignment to the last attempt ending
+	WallTime time.Duration
+}
+
+// A task skipped after it ran out of attempts, see MaxFailedTaskRatio
+type SkippedTask struct {
+	TaskId   TaskId
+	TaskType TaskType
+	// The input file of a map task, empty for a reduce task
+	InputFile string
+	// The error of the last attempt
+	Err string
+}
+
+// The summary of a job
+type JobReport struct {
+	JobId  JobId
+	Map    PhaseSummary
+	Reduce PhaseSummary
+	// The tasks left out of the output, map tasks first
+	Skipped []SkippedTask
+	// The input records skipped by finished map tasks, see SkipPolicy
+	SkippedRecords int
+	// The files found and left out walking the inputs of the job, see InputSpec
+	Inputs InputCounts
+}
+
+// Every attempt record and the summary of every job
+type Report struct {
+	Attempts []AttemptRecord
+	Jobs     []JobReport
+}
+
+// Return the p-th percentile (0 < p <= 1) of sorted durations
+// By the nearest rank, 0 if there is none
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// Summarize a phase of the job from the attempt records
+// Must be called with lock held
+func (job *jobState) summarize(taskType TaskType,
+	records []AttemptRecord) PhaseSummary {
+	statusRef, err := job.getStatusRef(taskType)
+	if err != nil {
+		return PhaseSummary{}
+	}
+	metaRef, _ := job.getMetaRef(taskType)
+	summary := PhaseSummary{Tasks: len(*statusRef), Counters: job.phaseCounters(taskType)}
+
+	var durations []time.Duration
+	var first, last time.Time
+	for _, record := range records {
+		if record.JobId != job.id || record.TaskType != taskType {
+			continue
+		}
+		summary.Attempts++
+		summary.ReadRetries += record.ReadRetries
+		if first.IsZero() || record.Assigned.Before(first) {
+			first = record.Assigned
+		}
+		if record.Finished.After(last) {
+			last = record.Finished
+		}
+		if record.Result == ATTEMPT_OK {
+			durations = append(durations, record.Finished.Sub(record.Assigned))
+		}
+	}
+
+	for _, meta := range *metaRef {
+		if meta.attempts > 1 {
+			summary.Retries += meta.attempts - 1
+		}
+		summary.Backups += len(meta.backups)
+	}
+
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+	summary.P50 = percentile(durations, 0.5)
+	summary.P95 = percentile(durations, 0.95)
+	if !last.IsZero() {
+		summary.WallTime = last.Sub(first)
+	}
+	return summary
+}
+
+// Return the attempt records and the summary of every job
+// Nothing in the result is shared with master
+func (master *Master) Report() Report {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	report := Report{
+		Attempts: append([]AttemptRecord(nil), master.timeline.records...),
+	}
+	for id := JobId(0); id < master.nextJobId; id++ {
+		job := master.jobs[id]
+		report.Jobs = append(report.Jobs, JobReport{
+			JobId:          id,
+			Map:            job.summarize(MAP, report.Attempts),
+			Reduce:         job.summarize(REDUCE, report.Attempts),
+			Skipped:        job.skippedTasks(),
+			SkippedRecords: job.skippedRecords(),
+			Inputs:         job.inputCounts,
+		})
+	}
+	return report
+}
+
+// Return the skipped tasks of the job
+// Must be called with lock held
+func (job *jobState) skippedTasks() []SkippedTask {
+	var skipped []SkippedTask
+	for _, taskType := range []TaskType{MAP, REDUCE} {
+		statusRef, _ := job.getStatusRef(taskType)
+		metaRef, _ := job.getMetaRef(taskType)
+		for idx, status := range *statusRef {
+			if status != SKIPPED {
+				continue
+			}
+			task := SkippedTask{
+				TaskId:   TaskId(idx),
+				TaskType: taskType,
+				Err:      (*metaRef)[idx].lastError,
+			}
+			if taskType == MAP {
+				task.InputFile = job.splits[idx].File
+			}
+			skipped = append(skipped, task)
+		}
+	}
+	return skipped
+}
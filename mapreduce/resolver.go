@@ -0,0 +1,195 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Finding master for workers, see Worker.Resolver
+
+package mapreduce
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tells a worker where master is
+// Consulted by StartWorker, and again once FAILOVER_PROBES heartbeats
+// In a row fail, so a worker follows master moving to another address
+// Implementations must be safe for concurrent use
+type MasterResolver interface {
+	// Return the address of master, "host:port", ":port" or a bare port
+	Resolve() (addr string, err error)
+}
+
+// A MasterResolver that can tell its address may have changed
+// Checked with every heartbeat, so the worker moves without waiting for failures
+type WatchedResolver interface {
+	MasterResolver
+	// Return true if Resolve may return another address than last time
+	Changed() bool
+}
+
+type staticResolver struct {
+	addr string
+}
+
+// Return a resolver that always returns addr
+func StaticResolver(addr string) MasterResolver {
+	return &staticResolver{addr}
+}
+
+func (resolver *staticResolver) Resolve() (string, error) {
+	return resolver.addr, nil
+}
+
+// Reads the address of master from the first line of a file
+// Which a deployment rewrites when master moves
+type fileResolver struct {
+	path string
+	mu   sync.Mutex
+	// The modification time and size of the file when last resolved
+	modTime time.Time
+	size    int64
+}
+
+// Return a resolver reading the address of master from the file at path
+// The worker resolves again once the file changes, see WatchedResolver
+func FileResolver(path string) WatchedResolver {
+	return &fileResolver{path: path}
+}
+
+func (resolver *fileResolver) Resolve() (string, error) {
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	if info, err := os.Stat(resolver.path); err == nil {
+		resolver.modTime, resolver.size = info.ModTime(), info.Size()
+	}
+	data, err := ioutil.ReadFile(resolver.path)
+	if err != nil {
+		return "", fmt.Errorf("FileResolver: %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if addr := strings.TrimSpace(line); addr != "" {
+			return addr, nil
+		}
+	}
+	return "", fmt.Errorf("FileResolver: %v holds no address", resolver.path)
+}
+
+func (resolver *fileResolver) Changed() bool {
+	info, err := os.Stat(resolver.path)
+	if err != nil {
+		return false
+	}
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	return !info.ModTime().Equal(resolver.modTime) || info.Size() != resolver.size
+}
+
+// Looks master up by a DNS SRV record
+type srvResolver struct {
+	service, proto, name string
+}
+
+// Return a resolver looking up the SRV records of service, proto and name
+// E.g. ("mapreduce", "tcp", "example.com") for _mapreduce._tcp.example.com
+// Or ("", "", name) to look name up directly
+// The record of the lowest priority wins, records of the same one by weight
+func SRVResolver(service, proto, name string) MasterResolver {
+	return &srvResolver{service, proto, name}
+}
+
+func (resolver *srvResolver) Resolve() (string, error) {
+	_, records, err := net.LookupSRV(resolver.service, resolver.proto, resolver.name)
+	if err != nil {
+		return "", fmt.Errorf("SRVResolver: %v", err)
+	}
+	if len(records) == 0 {
+		return "", fmt.Errorf("SRVResolver: no record for %v", resolver.name)
+	}
+	// LookupSRV sorts by priority and randomizes by weight
+	target := strings.TrimSuffix(records[0].Target, ".")
+	return net.JoinHostPort(target, strconv.Itoa(int(records[0].Port))), nil
+}
+
+// Alternates between a primary and a standby master, see RunStandby
+type failoverResolver struct {
+	mu    sync.Mutex
+	addrs [2]string
+	// The number of times Resolve was called
+	calls int
+}
+
+// Return a resolver returning primary first
+// And the other master every time the worker resolves again
+// So a worker that loses its master switches to the standby and back
+func FailoverResolver(primary, standby string) MasterResolver {
+	return &failoverResolver{addrs: [2]string{primary, standby}}
+}
+
+func (resolver *failoverResolver) Resolve() (string, error) {
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	addr := resolver.addrs[resolver.calls%2]
+	resolver.calls++
+	return addr, nil
+}
+
+// Ask the resolver of the worker where master is, and switch to it
+// Return true if master moved, the worker must then register again
+// A worker without a resolver stays with its master
+func (worker *Worker) resolveMaster() (bool, error) {
+	if worker.resolver == nil {
+		return false, nil
+	}
+	addr, err := worker.resolver.Resolve()
+	if err != nil {
+		return false, err
+	}
+	addr, err = parseAddr(addr)
+	if err != nil {
+		return false, fmt.Errorf("bad master address: %v", err)
+	}
+
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	if addr == worker.masterAddr {
+		return false, nil
+	}
+	worker.masterAddr = addr
+	return true, nil
+}
+
+// Return the host:port of the master the worker follows
+func (worker *Worker) MasterAddr() string {
+	addr, _ := worker.master()
+	return addr
+}
+
+// Return true if the resolver of the worker may point elsewhere by now
+func (worker *Worker) resolverChanged() bool {
+	watched, ok := worker.resolver.(WatchedResolver)
+	return ok && watched.Changed()
+}
+
+// Resolve master again and register to it if it moved
+// Running tasks keep going and report to the new master
+// Ended ones are forgotten, as the new master numbers attempts anew
+func (worker *Worker) followMaster() {
+	moved, err := worker.resolveMaster()
+	if err != nil {
+		worker.Logger.Warnf("Cannot resolve master: %v", err)
+		return
+	}
+	if !moved {
+		return
+	}
+	addr, _ := worker.master()
+	worker.Logger.Warnf("Master moved, switch to %v", addr)
+	worker.forgetEnded()
+	if err := worker.register(); err != nil {
+		worker.Logger.Errorf("Cannot register to %v: %v", addr, err)
+	}
+}
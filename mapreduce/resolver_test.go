@@ -0,0 +1,195 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of workers finding master through a resolver
+
+package mapreduce
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A resolver whose address the test moves by hand
+type movingResolver struct {
+	mu   sync.Mutex
+	addr string
+}
+
+func (resolver *movingResolver) Resolve() (string, error) {
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	return resolver.addr, nil
+}
+
+func (resolver *movingResolver) move(addr string) {
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	resolver.addr = addr
+}
+
+// A resolver that cannot find master
+type failingResolver struct{}
+
+func (failingResolver) Resolve() (string, error) {
+	return "", errors.New("no master")
+}
+
+// Start a master of the job of files whose first map stalls
+// And a worker of it finding master through the resolver made of its address
+// Return once the stalled attempt is assigned
+func startStalledJob(t *testing.T, files []string,
+	resolver func(addr string) MasterResolver) (*Master, *Worker, *stallingMap) {
+	t.Helper()
+	master := startMaster(t, files, 1)
+	stall := newStallingMap(1)
+	stall.killable = true
+	worker := startWorker(t, master, func(worker *Worker) {
+		worker.Slots = 2
+		worker.MapContext = stall.mapContext
+		worker.Resolver = resolver(master.Addr().String())
+	})
+	waitFor(t, 5*time.Second, "the map assigned", func() bool {
+		_, ok := attemptRecord(master, MAP, 0, 0)
+		return ok
+	})
+	return master, worker, stall
+}
+
+// Return true if master has a worker registered
+func hasWorkers(master *Master) bool {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	return len(master.workers) != 0
+}
+
+// Let the stalled map go once the worker registered with moved
+// Then wait for moved to run the job of contents
+func finishMovedJob(t *testing.T, moved *Master, worker *Worker, stall *stallingMap,
+	contents []string) {
+	t.Helper()
+	waitFor(t, 5*time.Second, "the worker registered with the moved master", func() bool {
+		return hasWorkers(moved)
+	})
+	if addr, want := worker.MasterAddr(), moved.Addr().String(); addr != want {
+		t.Fatalf("worker follows %v, want %v", addr, want)
+	}
+	// The running attempt keeps going and reports to the moved master
+	stall.release(0)
+	if err := waitJob(t, moved, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, moved.config.OutputDir), wordCounts(contents...))
+}
+
+// Write the address of master to path, as a deployment moving it does
+func writeAddr(t *testing.T, path string, master *Master) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(master.Addr().String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The address may be as long as the last one, so the change must show in the time
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWorkerFollowsRotatedAddressFile(t *testing.T) {
+	contents := []string{"a b a", "b c b"}
+	files := writeInputs(t, contents...)
+	path := filepath.Join(t.TempDir(), "master")
+	_, worker, stall := startStalledJob(t, files, func(addr string) MasterResolver {
+		if err := ioutil.WriteFile(path, []byte(addr+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return FileResolver(path)
+	})
+
+	// The job moves to another master while the first one keeps running
+	moved := startMaster(t, files, 1)
+	writeAddr(t, path, moved)
+	finishMovedJob(t, moved, worker, stall, contents)
+}
+
+func TestWorkerResolvesAgainOnceMasterFails(t *testing.T) {
+	contents := []string{"c d c", "d e"}
+	files := writeInputs(t, contents...)
+	resolver := &movingResolver{}
+	first, worker, stall := startStalledJob(t, files, func(addr string) MasterResolver {
+		resolver.move(addr)
+		return resolver
+	})
+
+	// The resolver is not watched, so the worker only asks it again once heartbeats fail
+	moved := startMaster(t, files, 1)
+	resolver.move(moved.Addr().String())
+	time.Sleep(300 * time.Millisecond)
+	if hasWorkers(moved) {
+		t.Fatal("worker moved while its master still answers")
+	}
+	shutdownMaster(first)
+	finishMovedJob(t, moved, worker, stall, contents)
+}
+
+func TestStartWorkerNeedsResolvableMaster(t *testing.T) {
+	dir := t.TempDir()
+	empty := writeFile(t, dir, "empty", "\n\n")
+	resolvers := map[string]MasterResolver{
+		"failing": failingResolver{},
+		"missing": FileResolver(filepath.Join(dir, "missing")),
+		"empty":   FileResolver(empty),
+		"bad":     StaticResolver("localhost:port"),
+	}
+	for name, resolver := range resolvers {
+		t.Run(name, func(t *testing.T) {
+			worker := MakeWorker(0, "localhost:1234", wcMap, wcReduce)
+			worker.Logger = quietLogger{}
+			worker.Resolver = resolver
+			if err := worker.StartWorker(); err == nil {
+				shutdownWorker(worker)
+				t.Fatal("worker started without a master")
+			}
+		})
+	}
+}
+
+func TestResolvedAddressParsed(t *testing.T) {
+	worker := MakeWorker(0, "", wcMap, wcReduce)
+	worker.resolver = StaticResolver("7000")
+	if moved, err := worker.resolveMaster(); err != nil || !moved {
+		t.Fatalf("resolve a bare port: moved %v, %v", moved, err)
+	}
+	if addr := worker.MasterAddr(); addr != "localhost:7000" {
+		t.Fatalf("master at %v, want localhost:7000", addr)
+	}
+	// The same address again is no move
+	worker.resolver = StaticResolver(":7000")
+	if moved, err := worker.resolveMaster(); err != nil || moved {
+		t.Fatalf("resolve the same address: moved %v, %v", moved, err)
+	}
+}
+
+func TestFileResolverChanged(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "master", "localhost:7000\nignored\n")
+	resolver := FileResolver(path)
+	if addr, err := resolver.Resolve(); err != nil || addr != "localhost:7000" {
+		t.Fatalf("resolve %q, %v, want the first line", addr, err)
+	}
+	if resolver.Changed() {
+		t.Fatal("file changed before it was written again")
+	}
+	if err := ioutil.WriteFile(path, []byte("localhost:7001\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !resolver.Changed() {
+		t.Fatal("file written again not changed")
+	}
+	if addr, _ := resolver.Resolve(); !strings.HasSuffix(addr, ":7001") || resolver.Changed() {
+		t.Fatalf("resolve %q after the change", addr)
+	}
+}
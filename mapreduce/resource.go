@@ -0,0 +1,103 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Resource usage of worker hosts, sent with heartbeats and used to rank workers
+
+package mapreduce
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A sample of the host a worker runs on
+// A value that cannot be read on the host is -1
+type ResourceSample struct {
+	Time time.Time
+	CPUs int
+	// The load average over the last minute
+	LoadAverage float64
+	// The bytes of memory available, and of disk free in the map dir
+	FreeMemory int64
+	FreeDisk   int64
+}
+
+// Sample the resources of this host, with the free disk of mapDir
+// Which is created by the first map task, until then its disk is the working dir
+func sampleResources(mapDir string) ResourceSample {
+	dir := mapDir
+	if _, err := os.Stat(dir); err != nil {
+		dir = "."
+	}
+	return ResourceSample{
+		Time:        time.Now(),
+		CPUs:        runtime.NumCPU(),
+		LoadAverage: loadAverage(),
+		FreeMemory:  freeMemory(),
+		FreeDisk:    freeDisk(dir),
+	}
+}
+
+// Return the load average over the last minute from /proc/loadavg
+func loadAverage() float64 {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return -1
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return -1
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return -1
+	}
+	return load
+}
+
+// Return the bytes of available memory from /proc/meminfo
+func freeMemory() int64 {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return -1
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return -1
+			}
+			return kb * 1024
+		}
+	}
+	return -1
+}
+
+// Return how well suited the host of a sample is to take a task
+// The idle CPUs, available memory and free disk in GB, weighted by config
+// Values that are unknown count as 0
+func (config *MasterConfig) resourceScore(sample ResourceSample) float64 {
+	score := 0.0
+	if sample.LoadAverage >= 0 && float64(sample.CPUs) > sample.LoadAverage {
+		score += config.CPUWeight * (float64(sample.CPUs) - sample.LoadAverage)
+	}
+	if sample.FreeMemory > 0 {
+		score += config.MemoryWeight * float64(sample.FreeMemory) / (1 << 30)
+	}
+	if sample.FreeDisk > 0 {
+		score += config.DiskWeight * float64(sample.FreeDisk) / (1 << 30)
+	}
+	return score
+}
+
+// Return true if workers are ranked by their resources
+func (config *MasterConfig) resourceWeighted() bool {
+	return config.CPUWeight > 0 || config.MemoryWeight > 0 || config.DiskWeight > 0
+}
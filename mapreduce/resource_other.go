@@ -0,0 +1,11 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Free disk space on hosts without statfs
+
+//go:build !linux && !darwin
+
+package mapreduce
+
+// Free disk space is unknown here
+func freeDisk(dir string) int64 {
+	return -1
+}
@@ -0,0 +1,20 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Free disk space on hosts with statfs
+
+//go:build linux || darwin
+
+package mapreduce
+
+import (
+	"syscall"
+)
+
+// Return the bytes free for unprivileged users on the disk holding dir
+// Return -1 if dir does not exist
+func freeDisk(dir string) int64 {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return -1
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize)
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Resuming a job from the intermediate files of an earlier run
+
+package mapreduce
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Read the manifest of map task id in dir
+// Return the size of each partition, and false if the manifest does not
+// Describe a complete set of intermediate files for the job
+func (job *jobState) readManifest(dir string, id TaskId) ([]int64, bool) {
+	data, err := ioutil.ReadFile(
+		filepath.Join(dir, filepath.Base(manifestName(MAP_DIR, job.id, int(id)))))
+	if err != nil {
+		return nil, false
+	}
+	var manifest MapManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, false
+	}
+	if manifest.JobId != job.id || manifest.TaskId != id ||
+		manifest.InputFile != job.splits[id].File || manifest.Offset != job.splits[id].Offset ||
+		manifest.Length != job.splits[id].Length ||
+		len(manifest.PartitionBytes) != job.nReduce {
+		return nil, false
+	}
+
+	// Every partition must be there with the size it was written with
+	for reduceId, size := range manifest.PartitionBytes {
+		name := filepath.Base(intermediateName(MAP_DIR, job.id, int(id), reduceId))
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil || info.Size() != size {
+			return nil, false
+		}
+	}
+	return manifest.PartitionBytes, true
+}
+
+// Mark map tasks with a valid manifest in dir as finished
+// So only the missing ones are scheduled
+// A map-only job writes no intermediate files and is not resumed
+// Must be called with lock held
+func (job *jobState) resume(dir string) {
+	if job.nReduce == 0 {
+		return
+	}
+
+	resumed := 0
+	for id := TaskId(0); int(id) < job.nMap; id++ {
+		partitionBytes, ok := job.readManifest(dir, id)
+		if !ok {
+			continue
+		}
+		for reduceId, size := range partitionBytes {
+			job.partitionBytes[reduceId] += size
+		}
+		job.setTaskStatus(id, MAP, FINISHED)
+		job.mapFinishedCount++
+		resumed++
+	}
+	if job.phaseFinished(MAP) {
+		job.orderReduceQueue()
+	}
+
+	job.master.config.Logger.Infof("Job %v: resumed %v of %v map tasks from %v",
+		job.id, resumed, job.nMap, dir)
+}
@@ -0,0 +1,48 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of resuming jobs from the intermediate files of an earlier run
+
+package mapreduce
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestResumeRunsMapsWithoutManifest(t *testing.T) {
+	contents := []string{"a b", "b c", "c d", "d e"}
+	files := writeInputs(t, contents...)
+	mapDir := t.TempDir()
+	// The first run keeps its intermediate files, as a crashed one would
+	first := startMaster(t, files, 2, WithMapDir(mapDir), WithKeepIntermediate())
+	startWorker(t, first, nil)
+	if err := waitJob(t, first, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	shutdownMaster(first)
+	for _, id := range []int{1, 3} {
+		if err := os.Remove(filepath.Join(mapDir, filepath.Base(manifestName(MAP_DIR, DEFAULT_JOB, id)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	master := startMaster(t, files, 2, WithMapDir(mapDir), WithResume(mapDir))
+	startWorker(t, master, nil)
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+	var ran []int
+	for _, record := range master.Report().Attempts {
+		if record.TaskType == MAP {
+			ran = append(ran, int(record.TaskId))
+		}
+	}
+	sort.Ints(ran)
+	if want := []int{1, 3}; !reflect.DeepEqual(ran, want) {
+		t.Fatalf("map tasks %v ran on resume, want %v", ran, want)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Retrying idempotent rpcs with exponential backoff and jitter
+
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// The default tries of an idempotent rpc, and the backoff between them
+const CALL_TRIES = 3
+const CALL_BACKOFF = 50 * time.Millisecond
+const CALL_MAX_BACKOFF = time.Second
+
+// Whether an rpc can be sent again without changing what it does
+// The caller of CallRetry must say which, so state-changing rpcs
+// Such as Master.TaskFinished are never sent twice by accident
+type Idempotency int
+
+const (
+	NOT_IDEMPOTENT Idempotency = 0
+	// E.g. Worker.StartMap and Worker.StartReduce, keyed by attempt id
+	// Worker.KillTask, Worker.IsOnline and Master.Heartbeat
+	IDEMPOTENT Idempotency = 1
+)
+
+type idempotencyKey struct{}
+
+// Return a copy of ctx marking the rpc called with it as idempotency
+// So a pooled transport may send an IDEMPOTENT rpc again over a new connection
+// If the one it was sent over breaks, see clientPool.Call
+func ContextWithIdempotency(ctx context.Context, idempotency Idempotency) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, idempotency)
+}
+
+// Return the idempotency ctx marks, NOT_IDEMPOTENT if it marks none
+func IdempotencyFrom(ctx context.Context) Idempotency {
+	idempotency, _ := ctx.Value(idempotencyKey{}).(Idempotency)
+	return idempotency
+}
+
+// How an idempotent rpc is retried
+type RetryPolicy struct {
+	// The tries in total, including the first, 1 never retries
+	Tries int
+	// The wait before the first retry, doubled before each one after it
+	// Up to MaxBackoff, with up to half of it added at random
+	// So peers retrying at the same time spread out
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Return the policy of CALL_TRIES, CALL_BACKOFF and CALL_MAX_BACKOFF
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Tries:      CALL_TRIES,
+		Backoff:    CALL_BACKOFF,
+		MaxBackoff: CALL_MAX_BACKOFF,
+	}
+}
+
+// Return an error if the policy cannot be used
+func (policy RetryPolicy) check() error {
+	if policy.Tries < 1 {
+		return errors.New("tries must be positive")
+	}
+	if policy.Backoff < 0 || policy.MaxBackoff < policy.Backoff {
+		return errors.New("backoff must be within [0, max backoff]")
+	}
+	return nil
+}
+
+// Return the wait before retry number try, counting from 1
+func (policy RetryPolicy) backoff(try int) time.Duration {
+	wait := policy.Backoff
+	for i := 1; i < try && wait < policy.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > policy.MaxBackoff {
+		wait = policy.MaxBackoff
+	}
+	if wait > 1 {
+		wait += time.Duration(rand.Int63n(int64(wait/2) + 1))
+	}
+	return wait
+}
+
+// Call rpcName like Call, each try giving up after timeout
+// An IDEMPOTENT rpc is tried again by policy while the peer cannot be reached
+// Or does not answer in time, but not once its method returns an error
+// A NOT_IDEMPOTENT rpc is tried once
+// Stop retrying once ctx is done, and return the error of the last try
+func CallRetry(ctx context.Context, idempotency Idempotency, policy RetryPolicy,
+	timeout time.Duration, addr string, rpcName string,
+	args interface{}, reply interface{}) error {
+	return retryCall(ctx, idempotency, policy, func() error {
+		try, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return Call(try, addr, rpcName, args, reply)
+	})
+}
+
+// Run call until it succeeds or fails for good, see CallRetry
+func retryCall(ctx context.Context, idempotency Idempotency, policy RetryPolicy,
+	call func() error) error {
+	tries := policy.Tries
+	if idempotency != IDEMPOTENT || tries < 1 {
+		tries = 1
+	}
+	var err error
+	for try := 0; try < tries; try++ {
+		if try > 0 {
+			timer := time.NewTimer(policy.backoff(try))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+		err = call()
+		if err == nil || !(errors.Is(err, ErrUnreachable) || errors.Is(err, ErrTimeout)) ||
+			ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// Call an idempotent rpc on the worker at addr over its connection
+// Each try giving up after timeout, and retried by DispatchRetry
+func (master *Master) callRetry(timeout time.Duration, addr string, rpcName string,
+	args interface{}, reply interface{}) error {
+	ctx := ContextWithIdempotency(context.Background(), IDEMPOTENT)
+	return retryCall(ctx, IDEMPOTENT, master.config.DispatchRetry, func() error {
+		err := master.callContext(ctx, timeout, addr, rpcName, args, reply)
+		if err != nil {
+			master.config.Logger.Debugf("Retry: %v", err)
+		}
+		return err
+	})
+}
+
+// Retry idempotent rpcs master sends to workers by policy
+// Pass Tries 1 to disable retries
+func WithDispatchRetry(policy RetryPolicy) Option {
+	return func(config *MasterConfig) error {
+		if err := policy.check(); err != nil {
+			return fmt.Errorf("WithDispatchRetry: %v", err)
+		}
+		config.DispatchRetry = policy
+		return nil
+	}
+}
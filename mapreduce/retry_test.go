@@ -0,0 +1,119 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of retrying idempotent rpcs
+
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// A call that cannot reach its peer the first failures times, counting its tries
+func flakyCall(failures int, tries *int) func() error {
+	return func() error {
+		*tries++
+		if *tries <= failures {
+			return &CallError{ErrUnreachable, "Worker.StartMap", "localhost:1", errors.New("refused")}
+		}
+		return nil
+	}
+}
+
+func TestRetryUntilTheCallGoesThrough(t *testing.T) {
+	policy := RetryPolicy{Tries: 4, Backoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond}
+	tries := 0
+	if err := retryCall(context.Background(), IDEMPOTENT, policy, flakyCall(2, &tries)); err != nil {
+		t.Fatal(err)
+	}
+	if tries != 3 {
+		t.Fatalf("tried %v times, want 3", tries)
+	}
+
+	// Giving up after Tries, with the error of the last try
+	tries = 0
+	err := retryCall(context.Background(), IDEMPOTENT, policy, flakyCall(10, &tries))
+	if !errors.Is(err, ErrUnreachable) || tries != 4 {
+		t.Fatalf("tried %v times and returned %v, want 4 tries", tries, err)
+	}
+}
+
+func TestNotIdempotentCallIsTriedOnce(t *testing.T) {
+	policy := RetryPolicy{Tries: 4, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	tries := 0
+	err := retryCall(context.Background(), NOT_IDEMPOTENT, policy, flakyCall(2, &tries))
+	if !errors.Is(err, ErrUnreachable) || tries != 1 {
+		t.Fatalf("tried %v times and returned %v, want one try", tries, err)
+	}
+}
+
+func TestRetryStopsOnceCancelled(t *testing.T) {
+	policy := RetryPolicy{Tries: 10, Backoff: time.Hour, MaxBackoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	tries, start := 0, time.Now()
+	err := retryCall(ctx, IDEMPOTENT, policy, flakyCall(10, &tries))
+	if !errors.Is(err, ErrUnreachable) || tries != 1 {
+		t.Fatalf("tried %v times and returned %v, want one try", tries, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("returned %v after the cancel", elapsed)
+	}
+}
+
+func TestBackoffDoublesWithJitter(t *testing.T) {
+	policy := RetryPolicy{Tries: 10, Backoff: 10 * time.Millisecond, MaxBackoff: 40 * time.Millisecond}
+	bounds := []time.Duration{10, 20, 40, 40, 40}
+	for idx, base := range bounds {
+		try := idx + 1
+		base *= time.Millisecond
+		jittered := false
+		for i := 0; i < 100; i++ {
+			wait := policy.backoff(try)
+			if wait < base || wait > base+base/2 {
+				t.Fatalf("backoff of try %v is %v, want within [%v, %v]", try, wait, base, base+base/2)
+			}
+			jittered = jittered || wait != base
+		}
+		if !jittered {
+			t.Errorf("backoff of try %v is always %v", try, base)
+		}
+	}
+}
+
+func TestBadRetryPolicyRefused(t *testing.T) {
+	for _, policy := range []RetryPolicy{
+		{Tries: 0},
+		{Tries: 2, Backoff: -time.Millisecond},
+		{Tries: 2, Backoff: time.Second, MaxBackoff: time.Millisecond},
+	} {
+		if _, err := MakeMaster(writeInputs(t, "a"), 1, 0, WithDispatchRetry(policy)); err == nil {
+			t.Errorf("policy %+v accepted", policy)
+		}
+	}
+}
+
+func TestDispatchRetriedOnFlakyWorker(t *testing.T) {
+	policy := RetryPolicy{Tries: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	master, cluster := startFakeCluster(t, writeInputs(t, "a"), 1, WithDispatchRetry(policy))
+	// Paused, so nothing is dispatched before the worker is flaky
+	if err := master.PauseJob(&JobControlSend{}, &GeneralReply{}); err != nil {
+		t.Fatal(err)
+	}
+	workerId := cluster.addWorker(t, 1)
+	cluster.setFlaky(workerId, 2)
+	if err := master.ResumeJob(&JobControlSend{}, &GeneralReply{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := waitJob(t, master, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// The start that failed twice went through on its third try, the attempt lives on
+	for _, attempt := range cluster.startedAttempts() {
+		if attempt.AttemptId != 0 {
+			t.Fatalf("started %+v, want only first attempts", attempt)
+		}
+	}
+}
@@ -1,23 +1,34 @@
 package mapreduce
 
-// Function that control the workflow of distributor
+// Function that control the workflow of a job
 // Finish map task, then goes to reduce task
-func schedule(master *Master) {
-    // Run thread to periodically check available workers to assign tasks
-    go master.checkAvailableWorkerForTask(MAP)
+// Every loop stops once the job halts, so Shutdown can wait for them
+func schedule(master *Master, job *jobState) {
+    // Run thread to check available workers to assign tasks
+    // In pull mode workers ask for tasks themselves
+    if !master.config.PullMode {
+        master.goLoop(func() { master.checkAvailableWorkerForTask(job, MAP) })
+    }
 
-    // Run thread to periodically remove unavailable worker
-    //go master.removeUnavailableWorker(MAP)
+    // Run thread to periodically reassign timeout tasks
+    master.goLoop(func() { master.checkTimeoutTask(job, MAP) })
 
     // Wait for map to be finished
-    WaitUntil(master.MapFinished)
+    master.waitPhase(job, MAP)
 
-    //// Run thread to periodically check available workers to assign reduce tasks
-    //go master.checkAvailableWorkerForTask(REDUCE)
-    //
-    //// Run thread to periodically remote unavailable worker
-    //go master.removeUnavailableWorker(REDUCE)
-    //
-    //// Wait for reduce to be finished
-    //WaitUntil(master.ReduceFinished)
+    // A map-only job has no reduce phase
+    if job.nReduce == 0 {
+        return
+    }
+
+    // Run thread to check available workers to assign reduce tasks
+    if !master.config.PullMode {
+        master.goLoop(func() { master.checkAvailableWorkerForTask(job, REDUCE) })
+    }
+
+    // Run thread to periodically reassign timeout reduce tasks
+    master.goLoop(func() { master.checkTimeoutTask(job, REDUCE) })
+
+    // Wait for reduce to be finished
+    master.waitPhase(job, REDUCE)
 }
@@ -0,0 +1,293 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Shuffle of intermediate files from the worker that wrote them to reducers
+
+package mapreduce
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// The return type of rpc for an intermediate file that does not exist
+const MISSING_OUTPUT = "MISSING_OUTPUT"
+
+// The number of times a reducer tries to fetch a partition from a worker
+// That cannot be reached, waiting DURATION between tries
+const FETCH_RETRIES = 3
+
+// Returned by readCommitted for a partition with no complete manifest
+// Or whose size differs from the manifest, e.g. it was cut short
+var errUncommitted = errors.New("partition not committed")
+
+type FetchPartitionSend struct {
+	JobId     JobId
+	MapTaskId TaskId
+	Partition TaskId
+	// The secret of the job, shared by every worker
+	Secret string
+	// The compression the reducer decodes, nil for none
+	Compression *CompressionPolicy
+}
+
+type FetchPartitionReply struct {
+	// The partition in Encoding, empty from workers that compress nothing
+	Data     []byte
+	Encoding string
+	Err      Err
+}
+
+// Sent by a reducer that cannot read the output of a map task
+type MapOutputMissingSend struct {
+	Term  int64
+	JobId JobId
+	// The map task, and the worker its output was read from
+	MapTaskId TaskId
+	Producer  int64
+	// The attempt of the reduce task that gives up
+	ReduceTaskId TaskId
+	AttemptId    AttemptId
+	WorkerId     int64
+	Token        string
+}
+
+// Read a partition of a map task from dir, the map dir of the worker
+// Only trusted once the manifest of the map task is complete
+// And lists the size the file has, otherwise return errUncommitted
+func readCommitted(dir string, jobId JobId, mapId, partition int) ([]byte, error) {
+	data, err := ioutil.ReadFile(manifestName(dir, jobId, mapId))
+	if os.IsNotExist(err) {
+		return nil, errUncommitted
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest MapManifest
+	if err := json.Unmarshal(data, &manifest); err != nil ||
+		partition >= len(manifest.PartitionBytes) {
+		return nil, errUncommitted
+	}
+
+	data, err = ioutil.ReadFile(intermediateName(dir, jobId, mapId, partition))
+	if os.IsNotExist(err) {
+		return nil, errUncommitted
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != manifest.PartitionBytes[partition] {
+		return nil, errUncommitted
+	}
+	return data, nil
+}
+
+// rpc used by reducers to read a partition of a map task run by this worker
+// Reply MISSING_OUTPUT if the intermediate file is not committed
+// Return error if the worker has DisableShuffle set
+// And ErrAuth if the reducer does not have the secret of the worker
+func (worker *Worker) FetchPartition(args *FetchPartitionSend,
+	reply *FetchPartitionReply) error {
+	if err := worker.checkSecret(args.Secret); err != nil {
+		return err
+	}
+	if worker.DisableShuffle {
+		return errors.New("FetchPartition: shuffle disabled")
+	}
+	data, err := readCommitted(worker.mapDir(), args.JobId, int(args.MapTaskId), int(args.Partition))
+	if err == errUncommitted {
+		reply.Err = MISSING_OUTPUT
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("FetchPartition: %v", err)
+	}
+	reply.Data, reply.Encoding = args.Compression.encode(data)
+	reply.Err = OK
+	return nil
+}
+
+// Read the partition of the reduce task written by map task mapId
+// From MAP_DIR if the map ran on this worker or its worker is unknown
+// Otherwise from the worker that ran it, retried if it cannot be reached
+// Return the partition, and the bytes it took on the wire, 0 if read locally
+// Return false if the partition cannot be read
+func (worker *Worker) readPartition(args *ReduceStartSend, mapId int) ([]byte, int64, bool) {
+	var producer int64
+	var addr string
+	if mapId < len(args.MapWorkers) && mapId < len(args.MapAddrs) {
+		producer, addr = args.MapWorkers[mapId], args.MapAddrs[mapId]
+	}
+	if producer == 0 || addr == "" || producer == worker.id {
+		data, err := readCommitted(worker.taskMapDir(args.MapDir), args.JobId, mapId, int(args.TaskId))
+		return data, 0, err == nil
+	}
+
+	send := FetchPartitionSend{
+		JobId:       args.JobId,
+		MapTaskId:   TaskId(mapId),
+		Partition:   args.TaskId,
+		Secret:      worker.Secret,
+		Compression: args.Compression,
+	}
+	for try := 0; try < FETCH_RETRIES; try++ {
+		if try > 0 {
+			time.Sleep(DURATION)
+		}
+		reply := FetchPartitionReply{}
+		err := worker.call(worker.CallTimeout, addr, "Worker.FetchPartition", &send, &reply)
+		if errors.Is(err, ErrRemote) {
+			// The producer is up but cannot serve the partition, e.g. shuffle is disabled
+			worker.Logger.Warnf("Map task %v: %v", mapId, err)
+			return nil, 0, false
+		}
+		if err != nil {
+			continue
+		}
+		if reply.Err != OK {
+			return nil, 0, false
+		}
+		data, err := decodePayload(reply.Data, reply.Encoding)
+		if err != nil {
+			worker.Logger.Warnf("Map task %v: %v", mapId, err)
+			return nil, 0, false
+		}
+		return data, int64(len(reply.Data)), true
+	}
+	return nil, 0, false
+}
+
+// Tell master the output of map task mapId cannot be read
+// So master runs the map task again and requeues the reduce task
+func (worker *Worker) reportMissing(args *ReduceStartSend, mapId int) {
+	send := MapOutputMissingSend{
+		JobId:        args.JobId,
+		MapTaskId:    TaskId(mapId),
+		ReduceTaskId: args.TaskId,
+		AttemptId:    args.AttemptId,
+		WorkerId:     worker.id,
+		Token:        worker.sessionToken(),
+	}
+	if mapId < len(args.MapWorkers) {
+		send.Producer = args.MapWorkers[mapId]
+	}
+	worker.endTask(args.attempt())
+	_, term := worker.master()
+	send.Term = term
+	replied, err := worker.callMaster("Master.MapOutputMissing", &send)
+	if err != nil {
+		worker.Logger.Warnf("Cannot report missing map output: %v", err)
+	}
+	worker.reportRefused(args.attempt(), replied)
+}
+
+// rpc that lets a reducer report the output of a map task as missing
+// The map task runs again unless it already has since the reducer was started
+// A reducer that read from a shared MAP_DIR reports no producer
+// And the map task runs again if it is finished
+// The attempt of the reducer is given up, so the reduce task is requeued
+func (master *Master) MapOutputMissing(args *MapOutputMissingSend,
+	reply *GeneralReply) error {
+	if !master.admit("Master.MapOutputMissing", reply) {
+		return nil
+	}
+	defer master.release()
+	if err := master.enter(); err != nil {
+		return err
+	}
+	defer master.inflight.Done()
+
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	if err := master.checkTerm(args.Term); err != nil {
+		return err
+	}
+
+	job := master.getJob(args.JobId)
+	if job == nil {
+		reply.Err = BAD_JOB_ID
+		return nil
+	}
+	if args.MapTaskId < 0 || int(args.MapTaskId) >= job.nMap ||
+		args.ReduceTaskId < 0 || int(args.ReduceTaskId) >= job.nReduce {
+		reply.Err = BAD_TASK_ID
+		return nil
+	}
+	if _, ok := master.workers[args.WorkerId]; !ok {
+		reply.Err = UNKNOWN_WORKER
+		return nil
+	}
+	if !master.checkToken(args.WorkerId, args.Token) {
+		reply.Err = AUTH
+		return nil
+	}
+	if job.aborted || master.aborted {
+		reply.Err = ABORTED
+		return nil
+	}
+
+	reduce := runningTask{
+		jobId:     args.JobId,
+		taskId:    args.ReduceTaskId,
+		taskType:  REDUCE,
+		attemptId: args.AttemptId,
+	}
+	if !master.removeWorkerTask(args.WorkerId, reduce) {
+		if job.halted() {
+			reply.Err = WASTE
+		} else {
+			reply.Err = MISMATCH
+		}
+		return nil
+	}
+	master.updateWorkerStatus(args.WorkerId)
+
+	if job.halted() {
+		reply.Err = WASTE
+		return nil
+	}
+
+	master.config.Logger.Warnf("Job %v: reduce task %v cannot read map task %v from worker %v",
+		job.id, args.ReduceTaskId, args.MapTaskId, args.Producer)
+	meta := &job.mapMeta[args.MapTaskId]
+	if job.mapStatus[args.MapTaskId] == FINISHED &&
+		(meta.outputWorker == args.Producer || args.Producer == 0) {
+		job.reopenMap(args.MapTaskId)
+	}
+	job.dropAttempt(args.ReduceTaskId, REDUCE, args.AttemptId, "missing map output")
+
+	reply.Err = OK
+	return nil
+}
+
+// Run a finished map task again because its output is lost
+// The map phase is scheduled again if it had finished
+// Reduce tasks are not assigned until it finishes again
+// Must be called with lock held
+func (job *jobState) reopenMap(id TaskId) {
+	master := job.master
+	master.config.Logger.Warnf("Job %v: output of MAP task %v is lost, run it again",
+		job.id, id)
+
+	wasFinished := job.phaseFinished(MAP)
+	meta := &job.mapMeta[id]
+	for reduceId, size := range meta.partitionBytes {
+		job.partitionBytes[reduceId] -= size
+	}
+	meta.partitionBytes = nil
+	meta.outputWorker = 0
+	meta.skippedRecords = 0
+	meta.counters = TaskCounters{}
+	job.mapFinishedCount--
+	job.setTaskStatus(id, MAP, UNPROCESSED)
+
+	if wasFinished && master.running {
+		if !master.config.PullMode {
+			master.goLoop(func() { master.checkAvailableWorkerForTask(job, MAP) })
+		}
+		master.goLoop(func() { master.checkTimeoutTask(job, MAP) })
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of reading the committed output of map tasks
+
+package mapreduce
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Write the manifest of map task mapId of the default job in dir
+func writeManifest(t *testing.T, dir string, mapId int, partitionBytes ...int64) {
+	t.Helper()
+	data, err := json.Marshal(&MapManifest{JobId: DEFAULT_JOB, TaskId: TaskId(mapId),
+		PartitionBytes: partitionBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(manifestName(dir, DEFAULT_JOB, mapId), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadCommittedTrustsOnlyManifest(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("{\"Key\":\"a\",\"Value\":\"1\"}\n")
+	write := func(mapId int, data []byte) {
+		if err := ioutil.WriteFile(intermediateName(dir, DEFAULT_JOB, mapId, 0), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Committed
+	write(0, content)
+	writeManifest(t, dir, 0, int64(len(content)))
+	// Renamed, but the writer crashed before the manifest
+	write(1, content)
+	// Cut short by a writer that crashed mid-file, after an older manifest
+	write(2, content[:len(content)/2])
+	writeManifest(t, dir, 2, int64(len(content)))
+	// The manifest lists no such partition
+	write(3, content)
+	writeManifest(t, dir, 3)
+	// The manifest itself is cut short
+	write(4, content)
+	if err := ioutil.WriteFile(manifestName(dir, DEFAULT_JOB, 4), []byte("{\"Partition"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := readCommitted(dir, DEFAULT_JOB, 0, 0); err != nil || string(data) != string(content) {
+		t.Errorf("committed file read %q, %v", data, err)
+	}
+	for mapId := 1; mapId <= 4; mapId++ {
+		if data, err := readCommitted(dir, DEFAULT_JOB, mapId, 0); err != errUncommitted {
+			t.Errorf("map %v read %q, %v, want errUncommitted", mapId, data, err)
+		}
+	}
+}
+
+func TestMapCrashingMidWriteLeavesNoFile(t *testing.T) {
+	contents := []string{"a b c d e f a b"}
+	master := startMaster(t, writeInputs(t, contents...), 2, WithKeepIntermediate())
+	var calls int32
+	startWorker(t, master, func(worker *Worker) {
+		// Every pair is spilled on its own, so the first attempt wrote some when it dies
+		worker.SpillBytes = 1
+		worker.Combiner = func(key string, values []string) string {
+			if atomic.AddInt32(&calls, 1) == 3 {
+				panic("crash mid-file")
+			}
+			return sumValues(key, values)
+		}
+		worker.ReduceContext = func(ctx context.Context, key string, values []string) string {
+			return sumValues(key, values)
+		}
+	})
+
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+	if record, _ := attemptRecord(master, MAP, 0, 0); record.Result != ATTEMPT_FAILED {
+		t.Fatalf("first attempt %+v, want it failed mid-write", record)
+	}
+	mapDir := master.config.MapDir
+	if temps, _ := filepath.Glob(filepath.Join(mapDir, IRP+"-tmp-*")); len(temps) != 0 {
+		t.Errorf("temp files %v left by the attempts", temps)
+	}
+	for partition := 0; partition < 2; partition++ {
+		if _, err := readCommitted(mapDir, DEFAULT_JOB, 0, partition); err != nil {
+			t.Errorf("partition %v of the retry not committed: %v", partition, err)
+		}
+	}
+	if _, err := os.Stat(manifestName(mapDir, DEFAULT_JOB, 0)); err != nil {
+		t.Errorf("no manifest of the retry: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Skipping the records a map function panics on instead of failing the task
+
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// How map attempts treat the records their map function panics on
+// See JobSpec.SkipBadRecords
+// With a policy, the map function is called once per line of the input
+// With the input file as key and the line without its newline as value
+// A line it panics on is skipped, and the attempt goes on with the next one
+type SkipPolicy struct {
+	// The attempt fails once it skips more than MaxRecords records
+	// Or more than MaxFraction of its records, 0 means no limit
+	MaxRecords  int
+	MaxFraction float64
+	// If LogRecords is true, the offset of every skipped record is logged
+	LogRecords bool
+}
+
+// Return error if the limits of the policy are invalid
+func (policy *SkipPolicy) validate() error {
+	if policy.MaxRecords < 0 {
+		return errors.New("SkipPolicy: MaxRecords must not be negative")
+	}
+	if policy.MaxFraction < 0 || policy.MaxFraction >= 1 {
+		return errors.New("SkipPolicy: MaxFraction must be within [0, 1)")
+	}
+	return nil
+}
+
+// Return true if skipping skipped of total records is more than the policy allows
+func (policy *SkipPolicy) exceeded(skipped, total int) bool {
+	if policy.MaxRecords > 0 && skipped > policy.MaxRecords {
+		return true
+	}
+	return policy.MaxFraction > 0 && float64(skipped) > policy.MaxFraction*float64(total)
+}
+
+// Run the map function on every line of content, skipping the lines it panics on
+// Content starts at offset start of the input file, see InputSplit
+// Return the pairs of the other lines and the number of lines skipped
+// Return a *userPanic once more lines are skipped than the policy allows
+// Stop early and return nothing once the attempt is killed
+func (worker *Worker) callMapRecords(ctx context.Context, attempt TaskAttempt,
+	args *MapStartSend, content string, start int64) ([]KeyValue, int, *userPanic) {
+	policy := args.SkipBadRecords
+	logger := worker.taskLogger(attempt)
+
+	records := strings.SplitAfter(content, "\n")
+	if records[len(records)-1] == "" {
+		records = records[:len(records)-1]
+	}
+	var kvs []KeyValue
+	skipped, offset := 0, start
+	for idx, record := range records {
+		if idx%PROGRESS_RECORDS == 0 && worker.isKilled(attempt) {
+			return nil, skipped, nil
+		}
+		result, p := worker.callMap(ctx, args.InputFile, strings.TrimSuffix(record, "\n"))
+		if p == nil {
+			kvs = append(kvs, result...)
+			offset += int64(len(record))
+			continue
+		}
+
+		skipped++
+		if policy.LogRecords {
+			logger.Warnf("Job %v: map task %v skips the record at offset %v of %v: %v",
+				args.JobId, args.TaskId, offset, args.InputFile, p.value)
+		}
+		if policy.exceeded(skipped, len(records)) {
+			return nil, skipped, &userPanic{
+				value: fmt.Sprintf("%v of %v records are bad, the last at offset %v: %v",
+					skipped, len(records), offset, p.value),
+				stack: p.stack,
+			}
+		}
+		offset += int64(len(record))
+	}
+	return kvs, skipped, nil
+}
+
+// Return the records skipped by the map tasks of the job that finished
+// Must be called with lock held
+func (job *jobState) skippedRecords() int {
+	total := 0
+	for _, meta := range job.mapMeta {
+		total += meta.skippedRecords
+	}
+	return total
+}
@@ -0,0 +1,79 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of skipping the records a map function panics on
+
+package mapreduce
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Word count of content, panicking on every line holding "poison"
+func poisonedMap(ctx context.Context, file, content string) []KeyValue {
+	if strings.Contains(content, "poison") {
+		panic("bad record")
+	}
+	return wcMap(file, content)
+}
+
+// Run the word count of contents with policy, returning its master once the job ends
+func runPoisoned(t *testing.T, contents []string, policy SkipPolicy,
+	logger Logger) (*Master, error) {
+	t.Helper()
+	master := startMaster(t, writeInputs(t, contents...), 2,
+		WithSkipBadRecords(policy), WithMaxTaskAttempts(1))
+	startWorker(t, master, func(worker *Worker) {
+		worker.MapContext = poisonedMap
+		if logger != nil {
+			worker.Logger = logger
+		}
+	})
+	return master, waitJob(t, master, 10*time.Second)
+}
+
+func TestSkipsPoisonousRecords(t *testing.T) {
+	contents := []string{"a b\npoison a\nc a\n", "b poison\nb c", "d\n"}
+	logger := &recordLogger{}
+	master, err := runPoisoned(t, contents, SkipPolicy{MaxRecords: 1, LogRecords: true}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts("a b\nc a", "b c", "d"))
+	jobs := master.Report().Jobs
+	if len(jobs) != 1 || jobs[0].SkippedRecords != 2 {
+		t.Fatalf("report %+v, want 2 skipped records", jobs)
+	}
+	// The second line of the first input starts at offset 4
+	if !logger.contains("skips the record at offset 4 of") ||
+		!logger.contains("skips the record at offset 0 of") {
+		t.Errorf("offsets of skipped records not logged: %v", logger.lines)
+	}
+}
+
+func TestTooManyBadRecordsFailTheTask(t *testing.T) {
+	limits := map[string]SkipPolicy{
+		"records":  {MaxRecords: 1},
+		"fraction": {MaxFraction: 0.5},
+	}
+	for name, policy := range limits {
+		t.Run(name, func(t *testing.T) {
+			contents := []string{"a\npoison\npoison\nb\n"}
+			if name == "fraction" {
+				contents = []string{"a\npoison b\npoison\npoison c\n"}
+			}
+			if _, err := runPoisoned(t, contents, policy, nil); err == nil {
+				t.Fatal("job with too many bad records succeeded")
+			}
+		})
+	}
+}
+
+func TestBadRecordWithoutPolicyFailsTheTask(t *testing.T) {
+	master := startMaster(t, writeInputs(t, "a\npoison\n"), 1, WithMaxTaskAttempts(1))
+	startWorker(t, master, func(worker *Worker) { worker.MapContext = poisonedMap })
+	if err := waitJob(t, master, 10*time.Second); err == nil {
+		t.Fatal("job with a bad record and no skip policy succeeded")
+	}
+}
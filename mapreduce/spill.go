@@ -0,0 +1,338 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Bounded buffer of map output, spilled to disk and merged per partition
+
+package mapreduce
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The default bytes of map output an attempt buffers before spilling
+const SPILL_BYTES = 64 << 20
+
+// The max number of runs merged at once, see mergeRuns
+const MERGE_FAN_IN = 64
+
+// The map output of an attempt, buffered per partition
+// Once the buffered keys and values reach the budget
+// Every partition is written to a numbered spill file in the attempt dir
+type spillBuffer struct {
+	worker *Worker
+	dir    string
+	budget int
+	// The pairs of each partition not spilled yet, and their bytes in total
+	parts [][]KeyValue
+	size  int
+	// The spill files of each partition, in the order they are written
+	spills [][]string
+	count  int
+	// The pairs written to spills and partitions, after the combiner
+	records int
+}
+
+// Create the buffer of an attempt writing spills to dir
+func (worker *Worker) newSpillBuffer(dir string, nReduce int) *spillBuffer {
+	budget := worker.SpillBytes
+	if budget <= 0 {
+		budget = SPILL_BYTES
+	}
+	return &spillBuffer{
+		worker: worker,
+		dir:    dir,
+		budget: budget,
+		parts:  make([][]KeyValue, nReduce),
+		spills: make([][]string, nReduce),
+	}
+}
+
+// Buffer a pair in its partition, spilling every partition once the budget is hit
+// Return a *userPanic if the combiner panics
+func (buffer *spillBuffer) add(kv KeyValue) error {
+	id := iHash(kv.Key) % len(buffer.parts)
+	buffer.parts[id] = append(buffer.parts[id], kv)
+	buffer.size += len(kv.Key) + len(kv.Value)
+	if buffer.size >= buffer.budget {
+		return buffer.spill()
+	}
+	return nil
+}
+
+// Return the pairs of a partition as written to a spill
+// Combined if the worker has a combiner, which also sorts them by key
+// Otherwise sorted if SortSpills is set
+func (buffer *spillBuffer) prepare(kvs []KeyValue) ([]KeyValue, error) {
+	if buffer.worker.Combiner != nil {
+		combined, p := buffer.worker.combine(kvs)
+		if p != nil {
+			return nil, p
+		}
+		return combined, nil
+	}
+	if buffer.worker.SortSpills {
+		sort.SliceStable(kvs, func(i, j int) bool {
+			return kvs[i].Key < kvs[j].Key
+		})
+	}
+	return kvs, nil
+}
+
+// Write every buffered partition to a new spill file and empty the buffer
+func (buffer *spillBuffer) spill() error {
+	for id, kvs := range buffer.parts {
+		if len(kvs) == 0 {
+			continue
+		}
+		kvs, err := buffer.prepare(kvs)
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(buffer.dir, fmt.Sprintf("spill-%v-%v", buffer.count, id))
+		if err := writeSpill(name, kvs); err != nil {
+			return err
+		}
+		buffer.records += len(kvs)
+		buffer.spills[id] = append(buffer.spills[id], name)
+		buffer.parts[id] = nil
+	}
+	buffer.count++
+	buffer.size = 0
+	return nil
+}
+
+// Write pairs to a spill file, one json object per line
+func writeSpill(name string, kvs []KeyValue) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("cannot create spill: %v", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for idx := range kvs {
+		if err := encoder.Encode(&kvs[idx]); err != nil {
+			return fmt.Errorf("cannot write spill: %v", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("cannot write spill: %v", err)
+	}
+	return nil
+}
+
+// Write each partition to its file in files
+// A partition that never spilled is written straight from the buffer
+// Otherwise what is left is spilled, and the spills are merged
+// By key if the spills are sorted, or one after another if not
+// Return a *userPanic if the combiner panics
+func (buffer *spillBuffer) finish(files []*os.File) error {
+	if buffer.count > 0 {
+		if err := buffer.spill(); err != nil {
+			return err
+		}
+	}
+
+	sorted := buffer.worker.Combiner != nil || buffer.worker.SortSpills
+	for id, file := range files {
+		writer := bufio.NewWriter(file)
+		var err error
+		switch {
+		case buffer.count == 0:
+			err = buffer.writeBuffered(id, writer)
+		case sorted:
+			err = mergeSpills(buffer.spills[id], writer)
+		default:
+			err = concatSpills(buffer.spills[id], writer)
+		}
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the buffered pairs of a partition that never spilled
+func (buffer *spillBuffer) writeBuffered(id int, writer io.Writer) error {
+	kvs, err := buffer.prepare(buffer.parts[id])
+	if err != nil {
+		return err
+	}
+	buffer.records += len(kvs)
+	encoder := json.NewEncoder(writer)
+	for idx := range kvs {
+		if err := encoder.Encode(&kvs[idx]); err != nil {
+			return fmt.Errorf("cannot encode result: %v", err)
+		}
+	}
+	return nil
+}
+
+// Copy the spills of a partition one after another
+func concatSpills(names []string, writer io.Writer) error {
+	for _, name := range names {
+		file, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("cannot read spill: %v", err)
+		}
+		_, err = io.Copy(writer, file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("cannot read spill: %v", err)
+		}
+	}
+	return nil
+}
+
+// Merge the sorted spills of a partition into a single sorted stream
+// Pairs with the same key keep the order of the spills
+func mergeSpills(names []string, writer io.Writer) error {
+	encoder := json.NewEncoder(writer)
+	return mergeRuns(names, func(kv *KeyValue) error {
+		if err := encoder.Encode(kv); err != nil {
+			return fmt.Errorf("cannot encode result: %v", err)
+		}
+		return nil
+	})
+}
+
+// Pass every pair of the sorted runs to emit in key order
+// Pairs with the same key keep the order of the runs
+// At most MERGE_FAN_IN runs are open at once, more are merged in passes
+// Each pass merges groups of consecutive runs into a run next to the first of the group
+// Stop at the first error of emit or of reading a run and return it
+func mergeRuns(names []string, emit func(kv *KeyValue) error) error {
+	for pass := 0; len(names) > MERGE_FAN_IN; pass++ {
+		var merged []string
+		for start := 0; start < len(names); start += MERGE_FAN_IN {
+			end := start + MERGE_FAN_IN
+			if end > len(names) {
+				end = len(names)
+			}
+			name := names[start] + ".merged"
+			if err := mergeTo(name, names[start:end]); err != nil {
+				return err
+			}
+			merged = append(merged, name)
+		}
+		// The runs of earlier passes are no longer needed, the first ones belong to the caller
+		if pass > 0 {
+			for _, name := range names {
+				os.Remove(name)
+			}
+		}
+		names = merged
+	}
+	return mergeGroup(names, emit)
+}
+
+// Merge the sorted runs into a new sorted run
+func mergeTo(name string, names []string) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("cannot create run: %v", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	if err := mergeSpills(names, writer); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("cannot write run: %v", err)
+	}
+	return nil
+}
+
+// The next pair of a run being merged
+type mergeHead struct {
+	kv      KeyValue
+	run     int
+	name    string
+	decoder *json.Decoder
+}
+
+// Read the next pair of the run, return false once it is exhausted
+func (head *mergeHead) next() (bool, error) {
+	var kv KeyValue
+	err := head.decoder.Decode(&kv)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot read run %v: %v", filepath.Base(head.name), err)
+	}
+	head.kv = kv
+	return true, nil
+}
+
+// The heads of the runs being merged, the least key first
+// The head of the earlier run first if keys are equal
+type mergeHeap []*mergeHead
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].kv.Key != h[j].kv.Key {
+		return h[i].kv.Key < h[j].kv.Key
+	}
+	return h[i].run < h[j].run
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeHead)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	head := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return head
+}
+
+// Pass every pair of the runs, opened all at once, to emit in key order
+func mergeGroup(names []string, emit func(kv *KeyValue) error) error {
+	heads := make(mergeHeap, 0, len(names))
+	for idx, name := range names {
+		file, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("cannot read run: %v", err)
+		}
+		defer file.Close()
+		head := &mergeHead{
+			run:     idx,
+			name:    name,
+			decoder: json.NewDecoder(bufio.NewReader(file)),
+		}
+		ok, err := head.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heads = append(heads, head)
+		}
+	}
+
+	heap.Init(&heads)
+	for len(heads) > 0 {
+		head := heads[0]
+		if err := emit(&head.kv); err != nil {
+			return err
+		}
+		ok, err := head.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&heads, 0)
+		} else {
+			heap.Pop(&heads)
+		}
+	}
+	return nil
+}
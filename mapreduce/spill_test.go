@@ -0,0 +1,123 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of buffering map output and spilling it to disk
+
+package mapreduce
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Return the pairs of a spill or intermediate file, in file order
+func readPairs(t *testing.T, name string) []KeyValue {
+	t.Helper()
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var kvs []KeyValue
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		var kv KeyValue
+		if err := decoder.Decode(&kv); err != nil {
+			t.Fatal(err)
+		}
+		kvs = append(kvs, kv)
+	}
+	return kvs
+}
+
+// Buffer kvs in nReduce partitions with a worker set up by setup, and finish
+// Return the buffer and the pairs written to each partition
+func spillPairs(t *testing.T, kvs []KeyValue, nReduce int,
+	setup func(worker *Worker)) (*spillBuffer, [][]KeyValue) {
+	t.Helper()
+	worker := &Worker{}
+	setup(worker)
+	dir := t.TempDir()
+	buffer := worker.newSpillBuffer(dir, nReduce)
+	for _, kv := range kvs {
+		if err := buffer.add(kv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := createTemps(dir, nReduce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := buffer.finish(files); err != nil {
+		t.Fatal(err)
+	}
+	parts := make([][]KeyValue, nReduce)
+	for id, file := range files {
+		file.Close()
+		parts[id] = readPairs(t, file.Name())
+	}
+	return buffer, parts
+}
+
+// Return kvs sorted by key then value
+func sortedPairs(kvs []KeyValue) []KeyValue {
+	sorted := append([]KeyValue(nil), kvs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Key != sorted[j].Key {
+			return sorted[i].Key < sorted[j].Key
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+	return sorted
+}
+
+func TestTinySpillBudgetWritesSameOutput(t *testing.T) {
+	var kvs []KeyValue
+	for i := 0; i < 500; i++ {
+		kvs = append(kvs, KeyValue{Key: "k" + strconv.Itoa(i*7%53), Value: strconv.Itoa(i)})
+	}
+	_, want := spillPairs(t, kvs, 3, func(worker *Worker) {})
+
+	for _, sortSpills := range []bool{false, true} {
+		buffer, got := spillPairs(t, kvs, 3, func(worker *Worker) {
+			worker.SpillBytes = 16
+			worker.SortSpills = sortSpills
+		})
+		if buffer.count < 100 {
+			t.Errorf("sorted %v: %v spills, want one every few pairs", sortSpills, buffer.count)
+		}
+		if buffer.records != len(kvs) {
+			t.Errorf("sorted %v: %v records written, want %v", sortSpills, buffer.records, len(kvs))
+		}
+		for id := range want {
+			if !reflect.DeepEqual(sortedPairs(got[id]), sortedPairs(want[id])) {
+				t.Errorf("sorted %v: partition %v holds other pairs than without spills", sortSpills, id)
+			}
+			switch {
+			case !sortSpills && !reflect.DeepEqual(got[id], want[id]):
+				t.Errorf("partition %v not in the order of the map output", id)
+			case sortSpills && !sort.SliceIsSorted(got[id], func(i, j int) bool {
+				return got[id][i].Key < got[id][j].Key
+			}):
+				t.Errorf("partition %v not sorted by key", id)
+			}
+		}
+	}
+}
+
+func TestTinySpillBudgetJob(t *testing.T) {
+	contents := []string{"a b a c d e f g", "b b c a h i", "d a a j k l"}
+	master := startMaster(t, writeInputs(t, contents...), 3)
+	startWorker(t, master, func(worker *Worker) {
+		worker.SpillBytes = 4
+		worker.SortSpills = true
+	})
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+}
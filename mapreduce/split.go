@@ -0,0 +1,160 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Splitting large input files into byte ranges, each read by its own map task
+
+package mapreduce
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// The default most bytes of an input file a map task reads
+// Larger files are split into ranges of this size, see WithSplitSize
+const SPLIT_SIZE = 64 << 20
+
+// A byte range of an input file, read by one map task
+// The task reads the lines starting within the range
+// So it reads past the end of the range to finish its last line
+// And skips a line the range starts in the middle of, which the task before reads
+type InputSplit struct {
+	File   string
+	Offset int64
+	// 0 reads to the end of the file
+	Length int64
+}
+
+// Return true if the split is a whole file
+func (split InputSplit) whole() bool {
+	return split.Offset == 0 && split.Length == 0
+}
+
+func (split InputSplit) String() string {
+	if split.whole() {
+		return split.File
+	}
+	return fmt.Sprintf("%v [%v, %v)", split.File, split.Offset, split.Offset+split.Length)
+}
+
+// Return the splits of files, one per splitSize bytes of each
+// A file no larger than splitSize, or one that cannot be stat, is a single split
+// So is every file if splitSize is 0
+func PlanSplits(files []string, splitSize int64) []InputSplit {
+	var splits []InputSplit
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if splitSize <= 0 || err != nil || !info.Mode().IsRegular() || info.Size() <= splitSize {
+			splits = append(splits, InputSplit{File: file})
+			continue
+		}
+		for offset := int64(0); offset < info.Size(); offset += splitSize {
+			length := splitSize
+			if offset+length > info.Size() {
+				length = info.Size() - offset
+			}
+			splits = append(splits, InputSplit{File: file, Offset: offset, Length: length})
+		}
+	}
+	return splits
+}
+
+// Return the split the task reads
+func (args *MapStartSend) split() InputSplit {
+	return InputSplit{File: args.InputFile, Offset: args.Offset, Length: args.Length}
+}
+
+// Return an error if a split cannot be read
+func (split InputSplit) validate() error {
+	if split.File == "" {
+		return errors.New("split without file")
+	}
+	if split.Offset < 0 || split.Length < 0 {
+		return fmt.Errorf("split %v has a negative offset or length", split)
+	}
+	return nil
+}
+
+// Return the hosts holding the file of each split
+// By the hosts holding each of files, see JobSpec.InputLocations
+func splitLocations(files []string, locations [][]string, splits []InputSplit) [][]string {
+	if len(locations) == 0 {
+		return nil
+	}
+	byFile := make(map[string][]string)
+	for idx, file := range files {
+		if _, ok := byFile[file]; !ok && idx < len(locations) {
+			byFile[file] = locations[idx]
+		}
+	}
+	result := make([][]string, len(splits))
+	for idx, split := range splits {
+		result[idx] = byFile[split.File]
+	}
+	return result
+}
+
+// Read the lines of split from r
+// Return them, and the offset in the file of the first one
+func readSplit(r io.ReaderAt, split InputSplit) ([]byte, int64, error) {
+	end := int64(math.MaxInt64)
+	if split.Length > 0 {
+		end = split.Offset + split.Length
+	}
+	start := split.Offset
+	if start > 0 {
+		// A line starts at the offset only if the byte before it ends one
+		start--
+	}
+	reader := bufio.NewReader(io.NewSectionReader(r, start, math.MaxInt64-start))
+	if start < split.Offset {
+		skipped, err := reader.ReadBytes('\n')
+		start += int64(len(skipped))
+		if err == io.EOF {
+			return nil, start, nil
+		}
+		if err != nil {
+			return nil, start, err
+		}
+	}
+
+	var content bytes.Buffer
+	for position := start; position < end; {
+		line, err := reader.ReadBytes('\n')
+		content.Write(line)
+		position += int64(len(line))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, start, err
+		}
+	}
+	return content.Bytes(), start, nil
+}
+
+// Read the lines of split from the file at its path
+func readSplitFile(split InputSplit) ([]byte, int64, error) {
+	file, err := os.Open(split.File)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	return readSplit(file, split)
+}
+
+// Split each input file larger than size into byte ranges of size
+// One map task reads each range, see InputSplit, 0 never splits
+// Jobs setting JobSpec.Splits keep their own
+func WithSplitSize(size int64) Option {
+	return func(config *MasterConfig) error {
+		if size < 0 {
+			return fmt.Errorf("WithSplitSize: %v is negative", size)
+		}
+		config.SplitSize = size
+		return nil
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of splitting input files into byte ranges
+
+package mapreduce
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Read every split of content planned with splitSize, failing the test on error
+// Return the lines each reads and the offset each starts at
+func readSplits(t *testing.T, content string, splitSize int64) ([]string, []int64) {
+	t.Helper()
+	file := writeInputs(t, content)[0]
+	var lines []string
+	var starts []int64
+	for _, split := range PlanSplits([]string{file}, splitSize) {
+		read, start, err := readSplit(strings.NewReader(content), split)
+		if err != nil {
+			t.Fatalf("read %v: %v", split, err)
+		}
+		lines = append(lines, string(read))
+		starts = append(starts, start)
+	}
+	return lines, starts
+}
+
+func TestPlanSplits(t *testing.T) {
+	files := writeInputs(t, "0123456789", "abc")
+	missing := files[1] + ".missing"
+
+	got := PlanSplits(append(files, missing), 4)
+	want := []InputSplit{
+		{File: files[0], Offset: 0, Length: 4},
+		{File: files[0], Offset: 4, Length: 4},
+		{File: files[0], Offset: 8, Length: 2},
+		{File: files[1]},
+		{File: missing},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("planned %v, want %v", got, want)
+	}
+	// 0 never splits
+	got = PlanSplits(files, 0)
+	want = []InputSplit{{File: files[0]}, {File: files[1]}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("planned %v, want %v", got, want)
+	}
+}
+
+func TestSplitBoundaryOnNewline(t *testing.T) {
+	// The second split starts right after a newline, so at the start of a line
+	lines, starts := readSplits(t, "ab\ncd\nef\n", 3)
+	if want := []string{"ab\n", "cd\n", "ef\n"}; !reflect.DeepEqual(lines, want) {
+		t.Fatalf("read %q, want %q", lines, want)
+	}
+	if want := []int64{0, 3, 6}; !reflect.DeepEqual(starts, want) {
+		t.Fatalf("started at %v, want %v", starts, want)
+	}
+
+	// The first split ends on a newline, which it reads, and nothing after it
+	lines, _ = readSplits(t, "abc\nde\n", 4)
+	if want := []string{"abc\n", "de\n"}; !reflect.DeepEqual(lines, want) {
+		t.Fatalf("read %q, want %q", lines, want)
+	}
+}
+
+func TestLineLongerThanSeveralSplits(t *testing.T) {
+	long := strings.Repeat("x", 30)
+	lines, starts := readSplits(t, "ab\n"+long+"\ncd\n", 4)
+
+	// The split the long line starts in reads it whole
+	// Those it runs through read nothing, and the one it ends in reads from the next line
+	want := make([]string, 10)
+	want[0] = "ab\n" + long + "\n"
+	want[8] = "cd\n"
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("read %q, want %q", lines, want)
+	}
+	if starts[8] != int64(len(want[0])) {
+		t.Fatalf("split after the long line started at %v, want %v", starts[8], len(want[0]))
+	}
+}
+
+func TestFileWithoutTrailingNewline(t *testing.T) {
+	lines, _ := readSplits(t, "ab\ncd\nlast", 4)
+	if want := []string{"ab\ncd\n", "last", ""}; !reflect.DeepEqual(lines, want) {
+		t.Fatalf("read %q, want %q", lines, want)
+	}
+	// A split starting inside the unfinished last line reads nothing
+	lines, _ = readSplits(t, "ab\nlonger", 4)
+	if want := []string{"ab\nlonger", "", ""}; !reflect.DeepEqual(lines, want) {
+		t.Fatalf("read %q, want %q", lines, want)
+	}
+}
+
+func TestSplitsReadEveryLineOnce(t *testing.T) {
+	for _, content := range []string{
+		"",
+		"\n",
+		"a",
+		"a\n\n\nb\n",
+		"one two\nthree\n" + strings.Repeat("long ", 20) + "\nfour",
+		strings.Repeat("ab\n", 10),
+	} {
+		for size := int64(1); size <= int64(len(content))+1; size++ {
+			lines, starts := readSplits(t, content, size)
+			if got := strings.Join(lines, ""); got != content {
+				t.Fatalf("splits of %v bytes of %q read %q", size, content, got)
+			}
+			for idx, start := range starts {
+				if !strings.HasPrefix(content[start:], lines[idx]) {
+					t.Fatalf("split %v of %v bytes of %q read %q, not what is at %v",
+						idx, size, content, lines[idx], start)
+				}
+			}
+		}
+	}
+}
+
+func TestReadInputCutToSplit(t *testing.T) {
+	contents := []string{"a b\nc d\ne f\n", "g\nh i"}
+	master := startMaster(t, writeInputs(t, contents...), 2, WithSplitSize(4))
+
+	var mu sync.Mutex
+	reads := map[string]int{}
+	startWorker(t, master, func(worker *Worker) {
+		worker.ReadInput = func(ctx context.Context, path string) ([]byte, error) {
+			mu.Lock()
+			reads[path]++
+			mu.Unlock()
+			return ioutil.ReadFile(path)
+		}
+	})
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+
+	// Each split reads the whole file through ReadInput
+	mu.Lock()
+	defer mu.Unlock()
+	total := 0
+	for _, count := range reads {
+		total += count
+	}
+	if total < 5 {
+		t.Fatalf("ReadInput called %v times, want once per split of 5", total)
+	}
+}
+
+func TestWordCountWithTinySplits(t *testing.T) {
+	contents := []string{
+		"the quick brown fox\njumps over\nthe lazy dog\n",
+		strings.Repeat("x", 20) + "\nshort y\nz",
+		"no newline at all",
+	}
+	master := startMaster(t, writeInputs(t, contents...), 3, WithSplitSize(3))
+	startWorker(t, master, nil)
+	startWorker(t, master, nil)
+	if err := waitJob(t, master, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	if nMap := master.jobs[DEFAULT_JOB].nMap; nMap <= len(contents) {
+		t.Fatalf("job of tiny splits has %v map tasks, want more than its %v files",
+			nMap, len(contents))
+	}
+}
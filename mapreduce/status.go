@@ -0,0 +1,278 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Live state of master served as JSON over http
+
+package mapreduce
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The state of a registered worker
+type WorkerReport struct {
+	Id     int64
+	Status string
+	// The host the worker runs on, and the host:port master reaches it at
+	Host string
+	Addr string
+	// The task attempts the worker is running
+	Tasks         []TaskAttempt
+	LastHeartbeat time.Time
+	Stats         WorkerStats
+	// The resources of its host in the last heartbeat
+	Resources ResourceSample
+	// The counters of its cache of side files in the last heartbeat
+	Cache CacheStats
+	// True once the autoscaler terminates the worker
+	Retiring bool
+	// The state of the circuit to the worker, e.g. CIRCUIT_OPEN
+	// Unlike BLACKLISTED it closes by itself once the worker answers again
+	Circuit string
+}
+
+// The performance of a registered worker since it registers
+type WorkerStats struct {
+	WorkerId int64
+	// The number of attempts the worker has reported
+	// And of those accepted as the result of their task
+	Reported  int
+	Completed int
+	// The number of task failures attributed to the worker
+	// Timeouts, failed dispatches and attempts lost when it fails
+	Failures int
+	// The total and average time of the reported attempts
+	BusyTime        time.Duration
+	AverageDuration time.Duration
+	// The time a task is last assigned to the worker, zero if never
+	LastAssigned time.Time
+}
+
+// Return the stats of the worker
+// Must be called with lock held
+func (master *Master) workerStats(workerId int64) WorkerStats {
+	registry := master.workers[workerId]
+	stats := WorkerStats{
+		WorkerId:     workerId,
+		Reported:     registry.reported,
+		Completed:    registry.completed,
+		Failures:     registry.failures,
+		BusyTime:     registry.busyTime,
+		LastAssigned: registry.lastAssigned,
+	}
+	if registry.reported > 0 {
+		stats.AverageDuration = registry.busyTime / time.Duration(registry.reported)
+	}
+	return stats
+}
+
+// Return the stats of every registered worker in registration order
+// Nothing in the result is shared with master
+func (master *Master) WorkerStats() []WorkerStats {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	var result []WorkerStats
+	for _, port := range master.workerOrder {
+		result = append(result, master.workerStats(port))
+	}
+	return result
+}
+
+// The state of a single task
+type TaskReport struct {
+	JobId    JobId
+	TaskId   TaskId
+	TaskType string
+	Status   string
+	// The number of times the task has been dispatched
+	Attempts int
+	// The worker of the latest attempt, -1 if never assigned
+	Worker int64
+	// The time the task has been processing, or took once finished
+	Duration time.Duration
+	// The fraction done reported by a processing task
+	// And the time it last grew, zero if the task has reported none
+	Progress     float64
+	LastProgress time.Time
+	// The path of the log of the latest failed attempt, see serveTaskLog
+	// Empty if no attempt has failed
+	LogURL string `json:",omitempty"`
+	// The records and bytes of the attempt that finished the task
+	Counters TaskCounters
+}
+
+// A snapshot of master served by /status
+type StatusReport struct {
+	Progress Progress
+	Workers  []WorkerReport
+	Tasks    []TaskReport
+	// The records and bytes of the finished tasks of each job
+	Jobs []JobCounters
+	// The connections of master to workers, nil unless its transport pools them
+	Connections *PoolStats `json:",omitempty"`
+}
+
+// Return the name of a worker status
+func workerStatusName(status WorkerStatus) string {
+	switch status {
+	case AVAILABLE:
+		return "AVAILABLE"
+	case RUNNING:
+		return "RUNNING"
+	case FAILED:
+		return "FAILED"
+	case BLACKLISTED:
+		return "BLACKLISTED"
+	}
+	return "UNKNOWN"
+}
+
+// Return the name of a task status
+func taskStatusName(status int) string {
+	switch status {
+	case UNPROCESSED:
+		return "UNPROCESSED"
+	case PROCESSING:
+		return "PROCESSING"
+	case FINISHED:
+		return "FINISHED"
+	case TASK_FAILED:
+		return "TASK_FAILED"
+	case SKIPPED:
+		return "SKIPPED"
+	}
+	return "UNKNOWN"
+}
+
+// Return the name of a task type
+func taskTypeName(taskType TaskType) string {
+	switch taskType {
+	case MAP:
+		return "MAP"
+	case REDUCE:
+		return "REDUCE"
+	}
+	return "UNKNOWN"
+}
+
+// Return a snapshot of progress, workers and tasks of every job
+// Nothing in the result is shared with master
+func (master *Master) Status() StatusReport {
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	var jobs []*jobState
+	for id := JobId(0); id < master.nextJobId; id++ {
+		jobs = append(jobs, master.jobs[id])
+	}
+	report := StatusReport{Progress: master.progress(jobs, master.startTime)}
+
+	for _, port := range master.workerOrder {
+		registry := master.workers[port]
+		worker := WorkerReport{
+			Id:            port,
+			Status:        workerStatusName(registry.status),
+			Host:          registry.host,
+			Addr:          registry.addr,
+			LastHeartbeat: registry.lastHeartbeat,
+			Stats:         master.workerStats(port),
+			Resources:     registry.resources,
+			Cache:         registry.cache,
+			Retiring:      registry.retiring,
+			Circuit:       master.breaker.state(registry.addr),
+		}
+		for _, task := range registry.tasks {
+			worker.Tasks = append(worker.Tasks, TaskAttempt{
+				JobId:     task.jobId,
+				TaskId:    task.taskId,
+				TaskType:  task.taskType,
+				AttemptId: task.attemptId,
+			})
+		}
+		report.Workers = append(report.Workers, worker)
+	}
+
+	for _, job := range jobs {
+		report.Jobs = append(report.Jobs, job.counters())
+		for _, taskType := range []TaskType{MAP, REDUCE} {
+			statusRef, _ := job.getStatusRef(taskType)
+			metaRef, _ := job.getMetaRef(taskType)
+			for idx, status := range *statusRef {
+				meta := (*metaRef)[idx]
+				task := TaskReport{
+					JobId:    job.id,
+					TaskId:   TaskId(idx),
+					TaskType: taskTypeName(taskType),
+					Status:   taskStatusName(status),
+					Attempts: meta.attempts,
+					Worker:   -1,
+				}
+				if meta.attempts > 0 {
+					task.Worker = meta.worker
+					task.LogURL = master.taskLogURL(job.id, TaskId(idx), taskType, meta.attempts)
+				}
+				switch status {
+				case PROCESSING:
+					task.Duration = time.Since(meta.startTime)
+					if !meta.progressTime.IsZero() {
+						task.Progress = meta.progress
+						task.LastProgress = meta.progressTime
+					}
+				case FINISHED:
+					task.Duration = meta.duration
+					task.Counters = meta.counters
+				}
+				report.Tasks = append(report.Tasks, task)
+			}
+		}
+	}
+
+	if stats, ok := master.poolStats(); ok {
+		report.Connections = &stats
+	}
+	return report
+}
+
+// Serve the status report as JSON
+func (master *Master) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(master.Status())
+}
+
+// Listen on HTTPPort for the http server of diagnostics
+// On the host of ListenAddr if set, so diagnostics are no more exposed than rpcs
+// Return nil if diagnostics are disabled
+func (master *Master) listenHTTP() (net.Listener, error) {
+	if master.config.HTTPPort == 0 {
+		return nil, nil
+	}
+	host := ""
+	if master.config.ListenAddr != "" {
+		host, _, _ = net.SplitHostPort(master.config.ListenAddr)
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.FormatInt(master.config.HTTPPort, 10)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot serve http: %w", err)
+	}
+	return listener, nil
+}
+
+// Start the http server of diagnostics on listener
+// Must be called with lock held
+func (master *Master) startHTTP(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", master.serveStatus)
+	// Task logs may hold the records of the job
+	mux.HandleFunc("/tasklog", master.requireSecret(master.serveTaskLog))
+	if master.metrics != nil {
+		mux.HandleFunc("/metrics", master.serveMetrics)
+	}
+	master.handleDebug(mux)
+
+	master.httpServer = &http.Server{Handler: mux}
+	go master.httpServer.Serve(listener)
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of the http server of diagnostics
+
+package mapreduce
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// Return a port of localhost that is free for now
+func freePort(t *testing.T) int64 {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return int64(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestStatusServesJobState(t *testing.T) {
+	master := makeMaster(t, writeInputs(t, "a", "b"), 1)
+	workerId := registerWorker(t, master, 1)
+	assignMap(master, workerId)
+
+	recorder := httptest.NewRecorder()
+	master.serveStatus(recorder, httptest.NewRequest("GET", "/status", nil))
+	if ct := recorder.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("content type %q, want application/json", ct)
+	}
+	var status map[string]json.RawMessage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"Progress", "Workers", "Tasks"} {
+		if _, ok := status[key]; !ok {
+			t.Errorf("status has no %v", key)
+		}
+	}
+	var workers []map[string]interface{}
+	var tasks []map[string]interface{}
+	if err := json.Unmarshal(status["Workers"], &workers); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(status["Tasks"], &tasks); err != nil {
+		t.Fatal(err)
+	}
+	if len(workers) != 1 {
+		t.Fatalf("status has %v workers, want 1", len(workers))
+	}
+	for _, key := range []string{"Id", "Status", "Tasks", "LastHeartbeat"} {
+		if _, ok := workers[0][key]; !ok {
+			t.Errorf("worker has no %v", key)
+		}
+	}
+	if len(tasks) == 0 {
+		t.Fatal("status has no task")
+	}
+	for _, key := range []string{"TaskId", "TaskType", "Status", "Attempts", "Worker", "Duration"} {
+		if _, ok := tasks[0][key]; !ok {
+			t.Errorf("task has no %v", key)
+		}
+	}
+	if tasks[0]["Status"] != "PROCESSING" || tasks[0]["Worker"] != float64(workerId) {
+		t.Errorf("task %v, want map task 0 processing on worker %v", tasks[0], workerId)
+	}
+}
+
+func TestHTTPListensOnHostOfListenAddr(t *testing.T) {
+	port := freePort(t)
+	master := startMaster(t, writeInputs(t, "a"), 1, WithListenAddr("127.0.0.1:0"), WithHTTPPort(port))
+
+	resp, err := http.Get("http://127.0.0.1:" + strconv.FormatInt(port, 10) + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status replied %v", resp.Status)
+	}
+	// Another loopback address can take the port, as it is not bound on every interface
+	other, err := net.Listen("tcp", "127.0.0.2:"+strconv.FormatInt(port, 10))
+	if err != nil {
+		t.Fatalf("http listener of master %v bound beyond 127.0.0.1: %v", master.Addr(), err)
+	}
+	other.Close()
+}
+
+func TestRunMasterReturnsHTTPListenError(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	port := int64(taken.Addr().(*net.TCPAddr).Port)
+	master, err := MakeMaster(writeInputs(t, "a"), 1, 0,
+		testOptions(t, WithListenAddr("127.0.0.1:0"), WithHTTPPort(port))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := master.RunMaster(); err == nil {
+		shutdownMaster(master)
+		t.Fatal("RunMaster served http on a port in use")
+	}
+	// Nothing was left listening, so it runs once the port is free
+	taken.Close()
+	if err := master.RunMaster(); err != nil {
+		t.Fatal(err)
+	}
+	shutdownMaster(master)
+}
+
+// Return the status code of a GET of path on the http listener at port
+// Sending secret as a bearer token unless it is empty
+func httpStatus(t *testing.T, port int64, path, secret string) int {
+	t.Helper()
+	req, err := http.NewRequest("GET", "http://127.0.0.1:"+strconv.FormatInt(port, 10)+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestDiagnosticsRequireSecret(t *testing.T) {
+	port := freePort(t)
+	startMaster(t, writeInputs(t, "a"), 1, WithListenAddr("127.0.0.1:0"),
+		WithHTTPPort(port), WithSecret("s3cret"))
+	tests := []struct {
+		path   string
+		secret string
+		want   int
+	}{
+		{"/debug/pprof/", "", http.StatusUnauthorized},
+		{"/debug/pprof/cmdline", "wrong", http.StatusUnauthorized},
+		{"/tasklog?job=0&type=MAP&task=0&attempt=0", "", http.StatusUnauthorized},
+		{"/debug/pprof/", "s3cret", http.StatusOK},
+		{"/debug/pprof/cmdline", "s3cret", http.StatusOK},
+		// No attempt has logged, but the request is let through
+		{"/tasklog?job=0&type=MAP&task=0&attempt=0", "s3cret", http.StatusNotFound},
+		{"/status", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		if got := httpStatus(t, port, test.path, test.secret); got != test.want {
+			t.Errorf("GET %v with secret %q replied %v, want %v", test.path, test.secret, got, test.want)
+		}
+	}
+}
+
+func TestDiagnosticsOpenWithoutSecret(t *testing.T) {
+	port := freePort(t)
+	startMaster(t, writeInputs(t, "a"), 1, WithListenAddr("127.0.0.1:0"), WithHTTPPort(port))
+	if got := httpStatus(t, port, "/debug/pprof/", ""); got != http.StatusOK {
+		t.Fatalf("GET /debug/pprof/ replied %v, want %v", got, http.StatusOK)
+	}
+}
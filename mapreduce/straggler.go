@@ -0,0 +1,157 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Detection of tasks running far longer than their phase usually takes
+
+package mapreduce
+
+import (
+	"sort"
+	"time"
+)
+
+// The default multiple of the median duration of finished tasks
+// Beyond which a running task is reported as a straggler
+const STRAGGLER_FACTOR = 3.0
+
+// The number of latest attempts that finished a task of a phase
+// Whose median duration stragglers of the phase are measured against
+const STRAGGLER_WINDOW = 100
+
+// The tasks of a phase of a job, e.g. the map tasks of job 0
+type jobPhase struct {
+	jobId    JobId
+	taskType TaskType
+}
+
+// A task running far longer than the finished tasks of its phase
+type StragglerWarning struct {
+	JobId    JobId
+	TaskId   TaskId
+	TaskType TaskType
+	// The worker of the latest attempt
+	WorkerId int64
+	// The time the task has been processing
+	Age time.Duration
+	// The median duration of finished tasks in the phase
+	// And the age beyond which a task is a straggler
+	Median    time.Duration
+	Threshold time.Duration
+	// Age divided by Median
+	Ratio float64
+	// The fraction done reported by the task, 0 if none
+	Progress float64
+}
+
+// Log a straggler warning, used when no callback is configured
+func (master *Master) logStraggler(warning StragglerWarning) {
+	master.config.Logger.Warnf("Straggler job=%v task=%v type=%v worker=%v "+
+		"age=%v median=%v threshold=%v ratio=%.1f progress=%.0f%%",
+		warning.JobId, warning.TaskId, taskTypeName(warning.TaskType),
+		warning.WorkerId, warning.Age, warning.Median, warning.Threshold,
+		warning.Ratio, 100*warning.Progress)
+}
+
+// Keep the duration of an attempt that finished a task of the phase
+// The oldest is dropped once the phase has STRAGGLER_WINDOW
+func (timeline *taskTimeline) sampled(phase jobPhase, duration time.Duration) {
+	if timeline.finished == nil {
+		timeline.finished = map[jobPhase][]time.Duration{}
+	}
+	samples := timeline.finished[phase]
+	if len(samples) == STRAGGLER_WINDOW {
+		copy(samples, samples[1:])
+		samples = samples[:STRAGGLER_WINDOW-1]
+	}
+	timeline.finished[phase] = append(samples, duration)
+}
+
+// Return the median duration of the latest attempts that finished a task of the phase
+// Return false if none has
+func (timeline *taskTimeline) medianDuration(phase jobPhase) (time.Duration, bool) {
+	samples := timeline.finished[phase]
+	if len(samples) == 0 {
+		return 0, false
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	return sorted[len(sorted)/2], true
+}
+
+// Return the warnings of new stragglers in the phase of the job
+// Measured against the median of the latest STRAGGLER_WINDOW finished attempts
+// Nothing is reported before a task of the phase has finished
+// A task is reported once
+// Must be called with lock held
+func (master *Master) findStragglers(job *jobState,
+	taskType TaskType) []StragglerWarning {
+	median, ok := master.timeline.medianDuration(jobPhase{job.id, taskType})
+	if !ok {
+		return nil
+	}
+	threshold := time.Duration(float64(median) * master.config.StragglerFactor)
+
+	var result []StragglerWarning
+	statusRef, err := job.getStatusRef(taskType)
+	if err != nil {
+		return nil
+	}
+	metaRef, _ := job.getMetaRef(taskType)
+	for idx, status := range *statusRef {
+		meta := &(*metaRef)[idx]
+		if status != PROCESSING || meta.stragglerWarned {
+			continue
+		}
+		age := time.Since(meta.startTime)
+		if age <= threshold {
+			continue
+		}
+		meta.stragglerWarned = true
+
+		warning := StragglerWarning{
+			JobId:     job.id,
+			TaskId:    TaskId(idx),
+			TaskType:  taskType,
+			WorkerId:  meta.worker,
+			Age:       age,
+			Median:    median,
+			Threshold: threshold,
+			Progress:  meta.progress,
+		}
+		if median > 0 {
+			warning.Ratio = float64(age) / float64(median)
+		}
+		result = append(result, warning)
+	}
+	return result
+}
+
+// Periodically report running tasks that take StragglerFactor times
+// The median duration of finished tasks in the same phase
+// The callback is invoked outside the lock
+func (master *Master) checkStragglers() {
+	for master.isActive() {
+		master.mu.Lock()
+		var warnings []StragglerWarning
+		for id := JobId(0); id < master.nextJobId; id++ {
+			job := master.jobs[id]
+			if job.done() {
+				continue
+			}
+			warnings = append(warnings, master.findStragglers(job, MAP)...)
+			warnings = append(warnings, master.findStragglers(job, REDUCE)...)
+		}
+		callback := master.config.OnStraggler
+		master.mu.Unlock()
+
+		for _, warning := range warnings {
+			if callback != nil {
+				callback(warning)
+			} else {
+				master.logStraggler(warning)
+			}
+		}
+
+		time.Sleep(master.config.SchedulerTick)
+	}
+}
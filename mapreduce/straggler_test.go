@@ -0,0 +1,101 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of reporting tasks running far longer than their phase usually takes
+
+package mapreduce
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStragglerWindowKeepsLatestOfEachPhase(t *testing.T) {
+	var timeline taskTimeline
+	maps := jobPhase{DEFAULT_JOB, MAP}
+	if _, ok := timeline.medianDuration(maps); ok {
+		t.Fatal("median of a phase without a finished attempt")
+	}
+
+	// Slow attempts first, then a window of fast ones pushes them out
+	for i := 0; i < STRAGGLER_WINDOW; i++ {
+		timeline.sampled(maps, time.Second)
+	}
+	for i := 0; i < STRAGGLER_WINDOW/2+1; i++ {
+		timeline.sampled(maps, 10*time.Millisecond)
+	}
+	if n := len(timeline.finished[maps]); n != STRAGGLER_WINDOW {
+		t.Fatalf("kept %v samples, want %v", n, STRAGGLER_WINDOW)
+	}
+	if median, _ := timeline.medianDuration(maps); median != 10*time.Millisecond {
+		t.Fatalf("median %v, want that of the latest attempts", median)
+	}
+
+	// Other phases and jobs keep their own
+	timeline.sampled(jobPhase{DEFAULT_JOB, REDUCE}, time.Minute)
+	timeline.sampled(jobPhase{DEFAULT_JOB + 1, MAP}, time.Hour)
+	if median, _ := timeline.medianDuration(jobPhase{DEFAULT_JOB, REDUCE}); median != time.Minute {
+		t.Fatalf("reduce median %v, want %v", median, time.Minute)
+	}
+	if median, _ := timeline.medianDuration(maps); median != 10*time.Millisecond {
+		t.Fatalf("map median %v after other phases finished attempts", median)
+	}
+}
+
+func TestOnlyFinishedAttemptsSampled(t *testing.T) {
+	var timeline taskTimeline
+	for idx, result := range []string{ATTEMPT_OK, ATTEMPT_WASTE, ATTEMPT_FAILED, ATTEMPT_ABORTED} {
+		task := runningTask{DEFAULT_JOB, TaskId(idx), MAP, 0}
+		timeline.assigned(task, 1)
+		timeline.ended(task, result)
+		// Only the first result of an attempt counts
+		timeline.ended(task, ATTEMPT_OK)
+	}
+	if n := len(timeline.finished[jobPhase{DEFAULT_JOB, MAP}]); n != 1 {
+		t.Fatalf("sampled %v attempts, want the one that finished its task", n)
+	}
+}
+
+func TestStragglerReported(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	var mu sync.Mutex
+	var warnings []StragglerWarning
+	master := startMaster(t, writeInputs(t, "slow", "a", "b", "c"), 1,
+		WithStragglerWarning(2, func(warning StragglerWarning) {
+			mu.Lock()
+			defer mu.Unlock()
+			warnings = append(warnings, warning)
+		}))
+	for i := 0; i < 2; i++ {
+		startWorker(t, master, func(worker *Worker) {
+			worker.MapContext = func(ctx context.Context, file, content string) []KeyValue {
+				if content == "slow" {
+					select {
+					case <-release:
+					case <-ctx.Done():
+					}
+				}
+				return wcMap(file, content)
+			}
+		})
+	}
+
+	waitFor(t, 5*time.Second, "a straggler warning", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(warnings) > 0
+	})
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	// Reported once
+	if len(warnings) != 1 {
+		t.Fatalf("warnings %+v, want one", warnings)
+	}
+	warning := warnings[0]
+	if warning.TaskId != 0 || warning.TaskType != MAP || warning.Age <= warning.Threshold ||
+		warning.Ratio < 2 {
+		t.Fatalf("warning %+v, want map task 0 past twice the median", warning)
+	}
+}
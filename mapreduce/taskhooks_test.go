@@ -0,0 +1,197 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of the Setup and Cleanup hooks of the attempts of a worker
+
+package mapreduce
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The Setup and Cleanup calls of a worker, by attempt
+type hookRecorder struct {
+	mu       sync.Mutex
+	infos    map[TaskAttempt]TaskInfo
+	setups   map[TaskAttempt]int
+	cleanups map[TaskAttempt]int
+	// If set, Setup panics for the attempts it returns true for
+	panics func(info TaskInfo) bool
+}
+
+func newHookRecorder() *hookRecorder {
+	return &hookRecorder{
+		infos:    make(map[TaskAttempt]TaskInfo),
+		setups:   make(map[TaskAttempt]int),
+		cleanups: make(map[TaskAttempt]int),
+	}
+}
+
+func infoAttempt(info TaskInfo) TaskAttempt {
+	return TaskAttempt{info.JobId, info.TaskId, info.TaskType, info.AttemptId}
+}
+
+func (hooks *hookRecorder) setup(ctx context.Context, info TaskInfo) {
+	hooks.mu.Lock()
+	hooks.infos[infoAttempt(info)] = info
+	hooks.setups[infoAttempt(info)]++
+	panics := hooks.panics
+	hooks.mu.Unlock()
+	if panics != nil && panics(info) {
+		panic("setup failed")
+	}
+}
+
+func (hooks *hookRecorder) cleanup(info TaskInfo) {
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	hooks.cleanups[infoAttempt(info)]++
+}
+
+// Install the hooks on worker
+func (hooks *hookRecorder) install(worker *Worker) {
+	worker.Setup = hooks.setup
+	worker.Cleanup = hooks.cleanup
+}
+
+// Return the number of attempts set up of taskType
+func (hooks *hookRecorder) attempts(taskType TaskType) int {
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	n := 0
+	for attempt := range hooks.setups {
+		if attempt.TaskType == taskType {
+			n++
+		}
+	}
+	return n
+}
+
+// Fail the test unless every attempt set up was set up and cleaned up once
+// Waiting for the attempts killed to clean up
+func (hooks *hookRecorder) check(t *testing.T) {
+	t.Helper()
+	waitFor(t, 5*time.Second, "every attempt to clean up", func() bool {
+		hooks.mu.Lock()
+		defer hooks.mu.Unlock()
+		return len(hooks.cleanups) == len(hooks.setups)
+	})
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	for attempt, n := range hooks.setups {
+		if n != 1 || hooks.cleanups[attempt] != 1 {
+			t.Errorf("attempt %+v set up %v times and cleaned up %v times, want once",
+				attempt, n, hooks.cleanups[attempt])
+		}
+	}
+}
+
+func TestHooksSeeTheirTask(t *testing.T) {
+	files := writeInputs(t, "a b", "b c", "c d")
+	hooks := newHookRecorder()
+	master := startMaster(t, files, 2)
+	startWorker(t, master, hooks.install)
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	hooks.check(t)
+
+	if hooks.attempts(MAP) != 3 || hooks.attempts(REDUCE) != 2 {
+		t.Fatalf("set up %v map and %v reduce attempts, want 3 and 2",
+			hooks.attempts(MAP), hooks.attempts(REDUCE))
+	}
+	for attempt, info := range hooks.infos {
+		switch {
+		case attempt.JobId != DEFAULT_JOB:
+			t.Errorf("attempt %+v of another job", attempt)
+		case info.TaskType == MAP && (info.Partitions != 2 || info.InputFile != files[info.TaskId]):
+			t.Errorf("map task %v sees %v partitions of %q, want 2 of %q", info.TaskId,
+				info.Partitions, info.InputFile, files[info.TaskId])
+		case info.TaskType == REDUCE && (info.Partitions != 3 || info.InputFile != ""):
+			t.Errorf("reduce task %v sees %v partitions of %q, want 3 of none", info.TaskId,
+				info.Partitions, info.InputFile)
+		}
+	}
+}
+
+func TestCleanupRunsOnceWhenUserCodePanics(t *testing.T) {
+	contents := []string{"a b a"}
+	hooks := newHookRecorder()
+	master := startMaster(t, writeInputs(t, contents...), 1)
+	startWorker(t, master, func(worker *Worker) {
+		hooks.install(worker)
+		// The first attempt of each task panics, the retry succeeds
+		worker.MapContext = func(ctx context.Context, file, content string) []KeyValue {
+			if hooks.attempts(MAP) == 1 {
+				panic("map failed")
+			}
+			return wcMap(file, content)
+		}
+		worker.ReduceContext = func(ctx context.Context, key string, values []string) string {
+			if hooks.attempts(REDUCE) == 1 {
+				panic("reduce failed")
+			}
+			return wcReduce(key, values)
+		}
+	})
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+	hooks.check(t)
+	if hooks.attempts(MAP) != 2 || hooks.attempts(REDUCE) != 2 {
+		t.Errorf("set up %v map and %v reduce attempts, want 2 of each",
+			hooks.attempts(MAP), hooks.attempts(REDUCE))
+	}
+}
+
+func TestCleanupRunsOnceWhenSetupPanics(t *testing.T) {
+	contents := []string{"a b a"}
+	hooks := newHookRecorder()
+	hooks.panics = func(info TaskInfo) bool { return info.AttemptId == 0 }
+	master := startMaster(t, writeInputs(t, contents...), 1)
+	startWorker(t, master, hooks.install)
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+	hooks.check(t)
+	if hooks.attempts(MAP) != 2 || hooks.attempts(REDUCE) != 2 {
+		t.Errorf("set up %v map and %v reduce attempts, want 2 of each",
+			hooks.attempts(MAP), hooks.attempts(REDUCE))
+	}
+}
+
+func TestCleanupRunsOnceWhenAttemptIsKilled(t *testing.T) {
+	contents := []string{"a b a"}
+	hooks := newHookRecorder()
+	// Not blacklisting the only worker for the two timeouts
+	master := startMaster(t, writeInputs(t, contents...), 1, WithTaskTimeout(300*time.Millisecond),
+		WithBlacklist(3, time.Minute, time.Second))
+	startWorker(t, master, func(worker *Worker) {
+		hooks.install(worker)
+		// The first attempt of each task runs until the timeout kills it
+		worker.MapContext = func(ctx context.Context, file, content string) []KeyValue {
+			if hooks.attempts(MAP) == 1 {
+				<-ctx.Done()
+			}
+			return wcMap(file, content)
+		}
+		worker.ReduceContext = func(ctx context.Context, key string, values []string) string {
+			if hooks.attempts(REDUCE) == 1 {
+				<-ctx.Done()
+			}
+			return wcReduce(key, values)
+		}
+	})
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+	hooks.check(t)
+	if hooks.attempts(MAP) != 2 || hooks.attempts(REDUCE) != 2 {
+		t.Errorf("set up %v map and %v reduce attempts, want 2 of each",
+			hooks.attempts(MAP), hooks.attempts(REDUCE))
+	}
+}
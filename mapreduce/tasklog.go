@@ -0,0 +1,244 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Log lines of task attempts, captured by workers and served through master
+
+package mapreduce
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The default max bytes of log kept for each attempt, the newest lines win
+const TASK_LOG_BYTES = 64 << 10
+
+// The number of attempts a worker keeps the log of, running or ended
+const TASK_LOGS_KEPT = 64
+
+// The return type of FetchTaskLog for an attempt without a log
+const NO_TASK_LOG = "NO_TASK_LOG"
+
+// Returned by TaskLog if no log of the attempt can be found
+var ErrNoTaskLog = errors.New("mapreduce: no log of the task attempt")
+
+type FetchTaskLogSend struct {
+	Attempt TaskAttempt
+	Token   string
+}
+
+type FetchTaskLogReply struct {
+	Log string
+	Err Err
+}
+
+// The tail of the log of an attempt
+type taskLog struct {
+	data  []byte
+	limit int
+}
+
+// Append a line, dropping whole lines from the front once over the limit
+func (log *taskLog) write(line string) {
+	log.data = append(log.data, line...)
+	over := len(log.data) - log.limit
+	if over <= 0 {
+		return
+	}
+	if idx := bytes.IndexByte(log.data[over:], '\n'); idx >= 0 {
+		over += idx + 1
+	}
+	log.data = append([]byte(nil), log.data[over:]...)
+}
+
+// A Logger of an attempt
+// Every line goes to the Logger of the worker, and to the log of the attempt
+// Debug lines are captured even if the worker drops them
+type attemptLogger struct {
+	worker  *Worker
+	attempt TaskAttempt
+}
+
+// Return the Logger of an attempt
+func (worker *Worker) taskLogger(attempt TaskAttempt) Logger {
+	return &attemptLogger{worker: worker, attempt: attempt}
+}
+
+func (logger *attemptLogger) Debugf(format string, args ...interface{}) {
+	logger.worker.Logger.Debugf(format, args...)
+	logger.capture("DEBUG", format, args)
+}
+
+func (logger *attemptLogger) Infof(format string, args ...interface{}) {
+	logger.worker.Logger.Infof(format, args...)
+	logger.capture("INFO", format, args)
+}
+
+func (logger *attemptLogger) Warnf(format string, args ...interface{}) {
+	logger.worker.Logger.Warnf(format, args...)
+	logger.capture("WARN", format, args)
+}
+
+func (logger *attemptLogger) Errorf(format string, args ...interface{}) {
+	logger.worker.Logger.Errorf(format, args...)
+	logger.capture("ERROR", format, args)
+}
+
+// Append a line to the log of the attempt, if it is still kept
+func (logger *attemptLogger) capture(level, format string, args []interface{}) {
+	line := fmt.Sprintf("%v %v %v\n", time.Now().Format("2006/01/02 15:04:05"),
+		level, fmt.Sprintf(format, args...))
+
+	worker := logger.worker
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	if log, ok := worker.logs[logger.attempt]; ok {
+		log.write(line)
+	}
+}
+
+// Start the log of an attempt, dropping the oldest once TASK_LOGS_KEPT are kept
+// Must be called with lock held
+func (worker *Worker) startTaskLog(attempt TaskAttempt) {
+	limit := worker.TaskLogBytes
+	if limit <= 0 {
+		limit = TASK_LOG_BYTES
+	}
+	if _, ok := worker.logs[attempt]; !ok {
+		worker.logOrder = append(worker.logOrder, attempt)
+	}
+	worker.logs[attempt] = &taskLog{limit: limit}
+	for len(worker.logOrder) > TASK_LOGS_KEPT {
+		delete(worker.logs, worker.logOrder[0])
+		worker.logOrder = worker.logOrder[1:]
+	}
+}
+
+// Return the log of an attempt, empty if it is not kept
+func (worker *Worker) taskLogTail(attempt TaskAttempt) string {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	if log, ok := worker.logs[attempt]; ok {
+		return string(log.data)
+	}
+	return ""
+}
+
+// rpc used by master to read the log of an attempt, see Master.TaskLog
+// Reply NO_TASK_LOG if the worker no longer keeps it
+func (worker *Worker) FetchTaskLog(args *FetchTaskLogSend,
+	reply *FetchTaskLogReply) error {
+	if err := worker.checkToken(args.Token); err != nil {
+		return err
+	}
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+
+	log, ok := worker.logs[args.Attempt]
+	if !ok {
+		reply.Err = NO_TASK_LOG
+		return nil
+	}
+	reply.Log = string(log.data)
+	reply.Err = OK
+	return nil
+}
+
+// Return the log of an attempt
+// The log sent with TaskFailed if the attempt failed that way
+// Otherwise it is fetched from the worker the attempt was assigned to
+// Return ErrNoTaskLog if the attempt is unknown or its worker dropped the log
+func (master *Master) TaskLog(attempt TaskAttempt) (string, error) {
+	task := runningTask{
+		jobId:     attempt.JobId,
+		taskId:    attempt.TaskId,
+		taskType:  attempt.TaskType,
+		attemptId: attempt.AttemptId,
+	}
+
+	master.mu.Lock()
+	if log, ok := master.timeline.logs[task]; ok {
+		master.mu.Unlock()
+		return log, nil
+	}
+	idx, ok := master.timeline.index[task]
+	if !ok {
+		master.mu.Unlock()
+		return "", ErrNoTaskLog
+	}
+	workerId := master.timeline.records[idx].WorkerId
+	registry, ok := master.workers[workerId]
+	if !ok {
+		master.mu.Unlock()
+		return "", fmt.Errorf("TaskLog: worker %v unknown", workerId)
+	}
+	addr := registry.addr
+	send := FetchTaskLogSend{Attempt: attempt, Token: registry.token}
+	master.mu.Unlock()
+
+	// Outside the lock, the worker may be slow
+	reply := FetchTaskLogReply{}
+	if err := master.call(master.config.CallTimeout, addr, "Worker.FetchTaskLog", &send, &reply); err != nil {
+		return "", fmt.Errorf("TaskLog: worker %v: %w", workerId, err)
+	}
+	if reply.Err != OK {
+		return "", ErrNoTaskLog
+	}
+	return reply.Log, nil
+}
+
+// Return the path /tasklog serves the log of the latest failed attempt of a task
+// Empty if no attempt of the task failed
+// Must be called with lock held
+func (master *Master) taskLogURL(jobId JobId, taskId TaskId, taskType TaskType,
+	attempts int) string {
+	for id := attempts - 1; id >= 0; id-- {
+		task := runningTask{jobId: jobId, taskId: taskId, taskType: taskType, attemptId: AttemptId(id)}
+		idx, ok := master.timeline.index[task]
+		if !ok || master.timeline.records[idx].Result != ATTEMPT_FAILED {
+			continue
+		}
+		return fmt.Sprintf("/tasklog?job=%v&type=%v&task=%v&attempt=%v",
+			jobId, taskTypeName(taskType), taskId, id)
+	}
+	return ""
+}
+
+// Serve the log of an attempt as text
+// E.g. /tasklog?job=0&type=MAP&task=3&attempt=1
+func (master *Master) serveTaskLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	jobId, err1 := strconv.Atoi(query.Get("job"))
+	taskId, err2 := strconv.Atoi(query.Get("task"))
+	attemptId, err3 := strconv.Atoi(query.Get("attempt"))
+	taskType := TaskType(-1)
+	switch query.Get("type") {
+	case "MAP":
+		taskType = MAP
+	case "REDUCE":
+		taskType = REDUCE
+	}
+	if err1 != nil || err2 != nil || err3 != nil || taskType == -1 {
+		http.Error(w, "want job, type (MAP or REDUCE), task and attempt", http.StatusBadRequest)
+		return
+	}
+
+	log, err := master.TaskLog(TaskAttempt{
+		JobId:     JobId(jobId),
+		TaskId:    TaskId(taskId),
+		TaskType:  taskType,
+		AttemptId: AttemptId(attemptId),
+	})
+	if err == ErrNoTaskLog {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(log))
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// TLS of the rpc traffic between master, workers and clients
+
+package mapreduce
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// The name certificates are checked against when none is set in the config
+// The same for every peer, so one certificate serves whatever host it is dialed at
+const TLS_SERVER_NAME = "localhost"
+
+// Load the certificate and key of a peer, and the CA its peers are signed by
+// The config serves rpcs and dials peers, verifying both ends with the CA
+// So the certificate must be valid for server and client authentication
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load certificate: %v", err)
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in CA %v", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Return the config a peer dials with, naming TLS_SERVER_NAME if it names none
+// Return nil for plain TCP
+func clientTLS(config *tls.Config) *tls.Config {
+	if config == nil || config.ServerName != "" {
+		return config
+	}
+	config = config.Clone()
+	config.ServerName = TLS_SERVER_NAME
+	return config
+}
+
+// Serve and send rpcs over TLS, see LoadTLSConfig
+// Every worker, standby and client of master must use TLS as well
+func WithTLS(certFile, keyFile, caFile string) Option {
+	return func(config *MasterConfig) error {
+		tlsConfig, err := LoadTLSConfig(certFile, keyFile, caFile)
+		if err != nil {
+			return fmt.Errorf("WithTLS: %v", err)
+		}
+		config.TLS = tlsConfig
+		return nil
+	}
+}
+
+// Serve and send rpcs over TLS with a ready-made config
+// It must have a certificate, and the roots that sign the workers
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(config *MasterConfig) error {
+		if tlsConfig == nil || len(tlsConfig.Certificates) == 0 &&
+			tlsConfig.GetCertificate == nil {
+			return errors.New("WithTLSConfig: config has no certificate")
+		}
+		config.TLS = tlsConfig
+		return nil
+	}
+}
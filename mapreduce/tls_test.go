@@ -0,0 +1,154 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of the rpc traffic over TLS
+
+package mapreduce
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write a self-signed CA and a certificate it signs for TLS_SERVER_NAME to dir
+// Valid for server and client authentication, as LoadTLSConfig needs
+// Return the files of the certificate, its key and the CA
+func writeCerts(t *testing.T, dir string) (string, string, string) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: TLS_SERVER_NAME},
+		DNSNames:     []string{TLS_SERVER_NAME},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(name, kind string, der []byte) string {
+		return writeFile(t, dir, name, string(pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})))
+	}
+	return encode("cert.pem", "CERTIFICATE", certDer), encode("key.pem", "EC PRIVATE KEY", keyDer),
+		encode("ca.pem", "CERTIFICATE", caDer)
+}
+
+// Start a master of contents over TLS with the certificates written to a new dir
+func startTLSMaster(t *testing.T, contents []string) (*Master, string, string, string) {
+	t.Helper()
+	certFile, keyFile, caFile := writeCerts(t, t.TempDir())
+	master := startMaster(t, writeInputs(t, contents...), 2, WithTLS(certFile, keyFile, caFile))
+	return master, certFile, keyFile, caFile
+}
+
+func TestJobOverTLS(t *testing.T) {
+	contents := []string{"a b a", "b c"}
+	master, certFile, keyFile, caFile := startTLSMaster(t, contents)
+	config, err := LoadTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startWorker(t, master, func(worker *Worker) { worker.TLS = config })
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+
+	// Clients dial over TLS as well
+	status := JobStatus{}
+	err = CallTLS(context.Background(), config, master.Addr().String(), "Master.GetJobStatus",
+		&JobStatusSend{JobId: DEFAULT_JOB}, &status)
+	if err != nil || status.Err != OK {
+		t.Fatalf("job status over TLS: %v, %v", status.Err, err)
+	}
+}
+
+func TestPlaintextRejectedUnderTLS(t *testing.T) {
+	master, _, _, _ := startTLSMaster(t, []string{"a"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := Call(ctx, master.Addr().String(), "Master.GetJobStatus",
+		&JobStatusSend{JobId: DEFAULT_JOB}, &JobStatus{})
+	if err == nil {
+		t.Fatal("plaintext client served under TLS")
+	}
+	if errors.Is(err, ErrRemote) {
+		t.Fatalf("plaintext request reached the method: %v", err)
+	}
+
+	// A plaintext worker never registers, however often its heartbeats try
+	startWorker(t, master, nil)
+	time.Sleep(300 * time.Millisecond)
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	if len(master.workers) != 0 {
+		t.Fatal("plaintext worker registered under TLS")
+	}
+}
+
+func TestCertificateOfAnotherCARejected(t *testing.T) {
+	master, _, _, _ := startTLSMaster(t, []string{"a"})
+	otherCert, otherKey, otherCA := writeCerts(t, t.TempDir())
+	config, err := LoadTLSConfig(otherCert, otherKey, otherCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = CallTLS(ctx, config, master.Addr().String(), "Master.GetJobStatus",
+		&JobStatusSend{JobId: DEFAULT_JOB}, &JobStatus{})
+	if err == nil || errors.Is(err, ErrRemote) {
+		t.Fatalf("client of another CA got %v, want a failed handshake", err)
+	}
+}
+
+func TestLoadTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := writeCerts(t, dir)
+	if _, err := LoadTLSConfig(certFile, keyFile, filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("missing CA accepted")
+	}
+	if _, err := LoadTLSConfig(certFile, caFile, caFile); err == nil {
+		t.Error("CA accepted as key")
+	}
+	if _, err := LoadTLSConfig(certFile, keyFile, keyFile); err == nil {
+		t.Error("key accepted as CA")
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// The transport master and workers serve and send rpcs over
+
+package mapreduce
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+)
+
+// Serves the rpcs of master or a worker, and sends its rpcs to peers
+// Peers are named by host:port, and rpcs by service and method, e.g. "Worker.StartMap"
+// With the argument and reply structs of this package
+// Every peer of a master must use the same transport
+type Transport interface {
+	// Serve the exported methods of rcvr as service name on addr, a host:port
+	// Where port 0 picks a free port, the Addr of the returned listener tells which
+	// Running the interceptors the transport was made with, if any
+	// Until the returned listener is closed, which frees addr to be listened on again
+	Listen(name string, rcvr interface{}, addr string) (net.Listener, error)
+	// Call rpcName on the peer at addr, giving up once ctx is done
+	// Sending the request id ctx carries if it can, see ContextWithRequestId
+	// Return a *CallError like Call
+	Call(ctx context.Context, addr string, rpcName string,
+		args interface{}, reply interface{}) error
+	// Drop any connection to the peer at addr, e.g. once it is forgotten
+	Forget(addr string)
+	// Drop every connection, calls afterwards may still be made
+	Close()
+}
+
+// The default transport, gob over net/rpc with a connection per peer
+// Every rpc carries a request id, see ContextWithRequestId
+// Or JSON-RPC or another codec instead of gob, see WireCodec
+type rpcTransport struct {
+	tls     *tls.Config
+	codec   WireCodec
+	clients *clientPool
+	// Run around every rpc sent and served, see Interceptor
+	interceptors []Interceptor
+	// Told of a listener whose accept loop failed for good, nil to ignore it
+	serveFailed func(error)
+	// Told of responses its server cannot encode, nil to log to stderr
+	logger Logger
+}
+
+// Return the net/rpc transport, over TLS with tlsConfig unless it is nil
+// Running interceptors around every rpc it sends and serves
+// Pinging idle connections by DefaultKeepalivePolicy
+func NewRPCTransport(tlsConfig *tls.Config, interceptors ...Interceptor) Transport {
+	return NewRPCTransportCodec(tlsConfig, GobCodec(), interceptors...)
+}
+
+// Return the net/rpc transport like NewRPCTransport, encoding rpcs with codec
+func NewRPCTransportCodec(tlsConfig *tls.Config, codec WireCodec,
+	interceptors ...Interceptor) Transport {
+	return newRPCTransport(tlsConfig, codec, DefaultKeepalivePolicy(), interceptors...)
+}
+
+// Return the net/rpc transport like NewRPCTransportCodec, pinging by keepalive
+// A nil codec is GobCodec
+func newRPCTransport(tlsConfig *tls.Config, codec WireCodec, keepalive KeepalivePolicy,
+	interceptors ...Interceptor) *rpcTransport {
+	if codec == nil {
+		codec = GobCodec()
+	}
+	return &rpcTransport{tls: tlsConfig, codec: codec,
+		clients: newClientPool(tlsConfig, codec, keepalive), interceptors: interceptors}
+}
+
+func (transport *rpcTransport) Listen(name string, rcvr interface{},
+	addr string) (net.Listener, error) {
+	server, listener, err := CreateServerAddr(rcvr, addr, name, transport.tls)
+	if err != nil {
+		return nil, err
+	}
+	return goServe(name, server, listener, transport.codec, transport.interceptors,
+		transport.logger, transport.serveFailed), nil
+}
+
+// The request id ctx carries is sent with the rpc, or a new one
+func (transport *rpcTransport) Call(ctx context.Context, addr string, rpcName string,
+	args interface{}, reply interface{}) error {
+	requestId := RequestIdFrom(ctx)
+	if requestId == "" {
+		requestId = newRequestId()
+		ctx = ContextWithRequestId(ctx, requestId)
+	}
+	info := newRPCInfo(rpcName, addr, requestId, args)
+	info.Reply = reply
+	envelope := &rpcEnvelope{rpcMeta{requestId}, args}
+	return interceptCall(ctx, transport.interceptors, info, func(ctx context.Context) error {
+		return transport.clients.Call(ctx, addr, rpcName, envelope, reply)
+	})
+}
+
+func (transport *rpcTransport) Forget(addr string) {
+	transport.clients.forget(addr)
+}
+
+func (transport *rpcTransport) Close() {
+	transport.clients.close()
+}
+
+func (transport *rpcTransport) PoolStats() PoolStats {
+	return transport.clients.Stats()
+}
+
+// Serve and send rpcs over transport instead of net/rpc
+// Workers must set the same transport, see Worker.Transport
+// TLS is then up to transport, WithTLS is ignored
+func WithTransport(transport Transport) Option {
+	return func(config *MasterConfig) error {
+		if transport == nil {
+			return errors.New("WithTransport: nil transport")
+		}
+		config.Transport = transport
+		return nil
+	}
+}
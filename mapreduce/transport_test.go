@@ -0,0 +1,84 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of running jobs over the transports master and workers can use
+
+package mapreduce
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A transport counting what is sent over the one it wraps
+type countingTransport struct {
+	Transport
+	mu     sync.Mutex
+	listen int
+	calls  map[string]int
+}
+
+func newCountingTransport(transport Transport) *countingTransport {
+	return &countingTransport{Transport: transport, calls: map[string]int{}}
+}
+
+func (transport *countingTransport) Listen(name string, rcvr interface{},
+	addr string) (net.Listener, error) {
+	transport.mu.Lock()
+	transport.listen++
+	transport.mu.Unlock()
+	return transport.Transport.Listen(name, rcvr, addr)
+}
+
+func (transport *countingTransport) Call(ctx context.Context, addr string, rpcName string,
+	args interface{}, reply interface{}) error {
+	transport.mu.Lock()
+	transport.calls[rpcName]++
+	transport.mu.Unlock()
+	return transport.Transport.Call(ctx, addr, rpcName, args, reply)
+}
+
+func (transport *countingTransport) count(rpcName string) int {
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	return transport.calls[rpcName]
+}
+
+func TestWordCountOverEveryTransport(t *testing.T) {
+	transports := map[string]func() Transport{
+		"gob":     func() Transport { return NewRPCTransport(nil) },
+		"jsonrpc": func() Transport { return NewRPCTransportCodec(nil, JSONCodec()) },
+	}
+	contents := []string{"a b a", "b c", "c d a"}
+	for name, newTransport := range transports {
+		t.Run(name, func(t *testing.T) {
+			masterTransport := newCountingTransport(newTransport())
+			workerTransport := newCountingTransport(newTransport())
+			master := startMaster(t, writeInputs(t, contents...), 2, WithTransport(masterTransport))
+			startWorker(t, master, func(worker *Worker) { worker.Transport = workerTransport })
+			if err := waitJob(t, master, 10*time.Second); err != nil {
+				t.Fatal(err)
+			}
+			checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+
+			// Every rpc went over the transports set
+			if masterTransport.listen != 1 || workerTransport.listen != 1 {
+				t.Errorf("master listened %v times and the worker %v, want once each",
+					masterTransport.listen, workerTransport.listen)
+			}
+			if masterTransport.count("Worker.StartMap") == 0 ||
+				workerTransport.count("Master.RegisterWorker") == 0 ||
+				workerTransport.count("Master.TaskFinished") == 0 {
+				t.Errorf("rpcs sent around the transports: master %v, worker %v",
+					masterTransport.calls, workerTransport.calls)
+			}
+		})
+	}
+}
+
+func TestTransportOfMasterRequired(t *testing.T) {
+	if _, err := MakeMaster(writeInputs(t, "a"), 1, 0, WithTransport(nil)); err == nil {
+		t.Fatal("nil transport accepted")
+	}
+}
@@ -0,0 +1,325 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Write-ahead log of master state, replayed by RecoverMaster
+
+package mapreduce
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// The kinds of records in the write-ahead log
+const (
+	// A job is submitted
+	WAL_SUBMIT = "SUBMIT"
+	// A task changes status
+	WAL_TASK = "TASK"
+	// A worker registers
+	WAL_WORKER = "WORKER"
+	// A master starts writing with a term
+	WAL_TERM = "TERM"
+)
+
+// The max length of a single record, longer ones mean a corrupt log
+const WAL_MAX_RECORD = 64 << 20
+
+// A single record of the write-ahead log
+// Stored as a 4 byte big-endian length followed by the record in json
+type walRecord struct {
+	Kind string
+
+	// The job of SUBMIT, with the output directory resolved
+	Spec *JobSpec `json:",omitempty"`
+
+	// The task of TASK and its new status
+	JobId    JobId
+	TaskId   TaskId
+	TaskType TaskType
+	Status   int
+	// The number of attempts made before the change, and of those given up
+	Attempts int
+	Failures int `json:",omitempty"`
+	// The error of the last attempt of a TASK_FAILED or SKIPPED task
+	Err string `json:",omitempty"`
+
+	// The worker of WORKER, and the worker holding the output of a FINISHED task
+	// And the host:port master reaches it at
+	// Port is set instead in logs written before workers had addresses
+	// And is 0 in logs written before workers had ids, which were their ports
+	WorkerId int64
+	Host     string `json:",omitempty"`
+	Addr     string `json:",omitempty"`
+	Port     int64  `json:",omitempty"`
+	Slots    int
+	// The session token of the worker, so it is still accepted after recovery
+	Token string `json:",omitempty"`
+
+	// The term of TERM
+	Term int64
+}
+
+// The write-ahead log master appends to
+type wal struct {
+	file *os.File
+	// Fsync after every record
+	sync bool
+}
+
+// Open the log at path for appending
+// The log is truncated unless it is being recovered
+func openWAL(path string, sync, truncate bool) (*wal, error) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if truncate {
+		flag |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open log: %v", err)
+	}
+	return &wal{file: file, sync: sync}, nil
+}
+
+// Append a record, and fsync it if required
+func (writer *wal) append(record walRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+
+	if _, err := writer.file.Write(buf); err != nil {
+		return err
+	}
+	if writer.sync {
+		return writer.file.Sync()
+	}
+	return nil
+}
+
+// Close the log
+func (writer *wal) close() error {
+	return writer.file.Close()
+}
+
+// Read every record of the log at path
+// Return them and the offset where the last complete one ends
+// A truncated record at the end, left by a crash during append, is ignored
+// It is cut off at that offset before the log is appended to again
+func readWAL(path string) ([]walRecord, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot open log: %v", err)
+	}
+	defer file.Close()
+
+	var records []walRecord
+	var offset int64
+	reader := bufio.NewReader(file)
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return records, offset, nil
+			}
+			return nil, 0, err
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > WAL_MAX_RECORD {
+			return nil, 0, fmt.Errorf("corrupt log: record of %v bytes", size)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return records, offset, nil
+			}
+			return nil, 0, err
+		}
+
+		var record walRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, 0, fmt.Errorf("corrupt log: %v", err)
+		}
+		records = append(records, record)
+		offset += int64(len(header)) + int64(size)
+	}
+}
+
+// Append a record to the log of master if enabled
+// A failed append is logged, master keeps running without it
+// Must be called with lock held
+func (master *Master) logRecord(record walRecord) {
+	if master.wal == nil {
+		return
+	}
+	if err := master.wal.append(record); err != nil {
+		master.config.Logger.Errorf("Cannot append to write-ahead log: %v", err)
+	}
+}
+
+// Create a master from the write-ahead log at path
+// Jobs and workers are restored, finished tasks are not run again
+// Tasks that were processing are scheduled again once RunMaster is called
+// The term is bumped past every term in the log, which fences the old master
+// The options are applied as in MakeMaster, and the log is appended to
+func RecoverMaster(path string, port int64, options ...Option) (*Master, error) {
+	records, complete, err := readWAL(path)
+	if err != nil {
+		return nil, fmt.Errorf("RecoverMaster: %v", err)
+	}
+
+	master, err := newMaster(port, options)
+	if err != nil {
+		return nil, err
+	}
+	master.config.WALPath = path
+
+	master.mu.Lock()
+	defer master.mu.Unlock()
+
+	for idx, record := range records {
+		if err := master.replay(record); err != nil {
+			return nil, fmt.Errorf("RecoverMaster: record %v: %v", idx, err)
+		}
+	}
+	for id := JobId(0); id < master.nextJobId; id++ {
+		master.jobs[id].restore()
+	}
+	master.term++
+
+	// Records appended after a torn one would never be read back
+	if err := os.Truncate(path, complete); err != nil {
+		return nil, fmt.Errorf("RecoverMaster: cannot cut the torn record off the log: %v", err)
+	}
+	master.wal, err = openWAL(path, master.config.WALSync, false)
+	if err != nil {
+		return nil, fmt.Errorf("RecoverMaster: %v", err)
+	}
+	master.logRecord(walRecord{Kind: WAL_TERM, Term: master.term})
+	master.config.Logger.Infof("Recovered %v jobs and %v workers from %v",
+		master.nextJobId, len(master.workers), path)
+	return master, nil
+}
+
+// Apply a record of the log to master
+// Task status is only set here, counters and queues are fixed by restore
+// Must be called with lock held
+func (master *Master) replay(record walRecord) error {
+	switch record.Kind {
+	case WAL_SUBMIT:
+		if record.Spec == nil {
+			return errors.New("submit without job")
+		}
+		plan, err := master.planJob(*record.Spec)
+		if err != nil {
+			return err
+		}
+		master.submit(plan)
+		return nil
+
+	case WAL_TASK:
+		job := master.getJob(record.JobId)
+		if job == nil {
+			return ErrUnknownJob
+		}
+		statusRef, err := job.getStatusRef(record.TaskType)
+		if err != nil {
+			return err
+		}
+		if record.TaskId < 0 || int(record.TaskId) >= len(*statusRef) {
+			return fmt.Errorf("task id %v out of range", record.TaskId)
+		}
+		metaRef, _ := job.getMetaRef(record.TaskType)
+		meta := &(*metaRef)[record.TaskId]
+		(*statusRef)[record.TaskId] = record.Status
+		meta.attempts = record.Attempts
+		meta.failures = record.Failures
+		if record.Status == PROCESSING {
+			// The attempt started by the change
+			meta.attempts++
+		}
+		meta.lastError = record.Err
+		if record.Status == FINISHED {
+			meta.outputWorker = record.WorkerId
+		}
+		return nil
+
+	case WAL_WORKER:
+		if _, ok := master.workers[record.WorkerId]; !ok {
+			master.workerOrder = append(master.workerOrder, record.WorkerId)
+		}
+		// Failed by the heartbeat check if it is gone
+		addr := record.Addr
+		if addr == "" && record.Port != 0 {
+			addr = joinAddr("localhost", record.Port)
+		} else if addr == "" {
+			addr = joinAddr("localhost", record.WorkerId)
+		}
+		master.workers[record.WorkerId] = &WorkerRegistry{
+			slots:         record.Slots,
+			host:          record.Host,
+			addr:          addr,
+			lastHeartbeat: time.Now(),
+			token:         record.Token,
+		}
+		master.updateWorkerStatus(record.WorkerId)
+		return nil
+
+	case WAL_TERM:
+		if record.Term > master.term {
+			master.term = record.Term
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown record kind %q", record.Kind)
+}
+
+// Rebuild the counters, queues and failure of a job after replay
+// Processing tasks lost their attempts with the old master, so they are unprocessed
+// Must be called with lock held
+func (job *jobState) restore() {
+	for _, taskType := range []TaskType{MAP, REDUCE} {
+		statusRef, _ := job.getStatusRef(taskType)
+		metaRef, _ := job.getMetaRef(taskType)
+		queueRef, _ := job.getQueueRef(taskType)
+
+		finished, skipped := 0, 0
+		*queueRef = nil
+		for idx, status := range *statusRef {
+			switch status {
+			case FINISHED:
+				finished++
+			case SKIPPED:
+				skipped++
+			case TASK_FAILED:
+				if job.failure == nil {
+					job.failure = &JobFailure{
+						JobId:    job.id,
+						TaskId:   TaskId(idx),
+						TaskType: taskType,
+						Err:      (*metaRef)[idx].lastError,
+					}
+					if taskType == MAP {
+						job.failure.InputFile = job.splits[idx].File
+					}
+				}
+			default:
+				(*statusRef)[idx] = UNPROCESSED
+				*queueRef = append(*queueRef, TaskId(idx))
+			}
+		}
+
+		if taskType == MAP {
+			job.mapFinishedCount, job.mapSkippedCount = finished, skipped
+		} else {
+			job.reduceFinishedCount, job.reduceSkippedCount = finished, skipped
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of recovering master from its write-ahead log
+
+package mapreduce
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRecoverMasterKeepsFinishedMaps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.wal")
+	crashed := makeMaster(t, writeInputs(t, "a", "b", "c", "d"), 1, WithWAL(path, true))
+	t.Cleanup(func() { shutdownMaster(crashed) })
+	workerId := registerWorker(t, crashed, 2)
+	for i := 0; i < 2; i++ {
+		taskId, attemptId := assignMap(crashed, workerId)
+		if reply := finishAttempt(crashed, workerId, MAP, taskId, attemptId); reply != OK {
+			t.Fatalf("finish map task %v: %v", taskId, reply)
+		}
+	}
+	// The process dies with map task 2 running
+	if taskId, _ := assignMap(crashed, workerId); taskId != 2 {
+		t.Fatalf("assigned task %v, want task 2", taskId)
+	}
+
+	cluster := newFakeCluster(1)
+	master, err := RecoverMaster(path, 0, testOptions(t, cluster.options()...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster.master = master
+	master.mu.Lock()
+	status := append([]int(nil), master.jobs[DEFAULT_JOB].mapStatus...)
+	master.mu.Unlock()
+	if status[0] != FINISHED || status[1] != FINISHED || status[2] == FINISHED || status[3] == FINISHED {
+		t.Fatalf("recovered map status %v, want tasks 0 and 1 finished only", status)
+	}
+	if err := master.RunMaster(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shutdownMaster(master) })
+	cluster.addWorker(t, 1)
+
+	if err := waitJob(t, master, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, attempt := range cluster.startedAttempts() {
+		if attempt.TaskType == MAP && attempt.TaskId < 2 {
+			t.Errorf("finished map task %v run again after recovery", attempt.TaskId)
+		}
+	}
+}
+
+func TestRecoverMasterIgnoresTruncatedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.wal")
+	crashed := makeMaster(t, writeInputs(t, "a"), 1, WithWAL(path, true))
+	shutdownMaster(crashed)
+	// A crash in the middle of an append leaves a length without its record
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 1, 0, '{'})
+	file.Close()
+
+	recovered, err := RecoverMaster(path, 0, testOptions(t)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finished, err := recovered.PhaseFinished(DEFAULT_JOB, MAP); err != nil || finished {
+		shutdownMaster(recovered)
+		t.Fatalf("recovered job: map finished %v, %v, want it unfinished", finished, err)
+	}
+	// Logged after the torn record, so lost unless it was cut off
+	workerId := registerWorker(t, recovered, 1)
+	shutdownMaster(recovered)
+
+	master, err := RecoverMaster(path, 0, testOptions(t)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdownMaster(master)
+	master.mu.Lock()
+	defer master.mu.Unlock()
+	if master.term != 2 {
+		t.Fatalf("recovered twice with term %v, want 2", master.term)
+	}
+	if _, ok := master.workers[workerId]; !ok {
+		t.Fatalf("worker registered after the first recovery lost")
+	}
+}
+
+func TestShutdownLogsEveryReportItReplied(t *testing.T) {
+	const nMap = 40
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "master.wal")
+	eventsPath := filepath.Join(dir, "events.jsonl")
+	contents := make([]string, nMap)
+	for idx := range contents {
+		contents[idx] = "word"
+	}
+	master := makeMaster(t, writeInputs(t, contents...), 1,
+		WithWAL(walPath, true), WithEventLog(eventsPath))
+	workerId := registerWorker(t, master, nMap)
+	var attempts []AttemptId
+	for i := 0; i < nMap; i++ {
+		taskId, attemptId := assignMap(master, workerId)
+		if taskId != TaskId(i) {
+			t.Fatalf("assigned task %v, want task %v", taskId, i)
+		}
+		attempts = append(attempts, attemptId)
+	}
+
+	// Reports queue up on the lock ahead of Shutdown
+	// So they get in, then take the lock again while Shutdown runs
+	replies := make([]Err, nMap)
+	var wg sync.WaitGroup
+	master.mu.Lock()
+	for i := 0; i < nMap; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			replies[i] = finishAttempt(master, workerId, MAP, TaskId(i), attempts[i])
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	shutdown := make(chan struct{})
+	go func() {
+		shutdownMaster(master)
+		close(shutdown)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	master.mu.Unlock()
+	<-shutdown
+	wg.Wait()
+
+	// Each report replied to has its event, and its record if it finished the task
+	events, err := ReadEvents(eventsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := map[TaskId]Err{}
+	for _, event := range events {
+		if event.Kind == EVENT_FINISHED || event.Kind == EVENT_WASTE {
+			logged[event.TaskId] = event.Result
+		}
+	}
+	recovered, err := RecoverMaster(walPath, 0, testOptions(t)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdownMaster(recovered)
+	recovered.mu.Lock()
+	defer recovered.mu.Unlock()
+	for i, reply := range replies {
+		if reply == "" {
+			continue
+		}
+		if logged[TaskId(i)] != reply {
+			t.Errorf("map task %v was replied %v, event log has %q", i, reply, logged[TaskId(i)])
+		}
+		if reply == OK && recovered.jobs[DEFAULT_JOB].mapStatus[i] != FINISHED {
+			t.Errorf("map task %v was replied OK but is not finished after recovery", i)
+		}
+	}
+}
@@ -1,11 +1,20 @@
 package mapreduce
 
 import (
+    "bytes"
+    "context"
+    "crypto/tls"
     "encoding/json"
+    "errors"
+    "fmt"
+    "io"
     "io/ioutil"
-    "log"
+    "net"
     "os"
+    "runtime/debug"
+    "sort"
     "sync"
+    "time"
 )
 
 const (
@@ -13,143 +22,1704 @@ const (
     REDUCE = 1
 )
 
+// Instructions replied by Master.RequestTask
+const (
+    RUN  = "RUN"
+    WAIT = "WAIT"
+    DONE = "DONE"
+)
+
+// Every message between master and worker carries a term of master
+// Sent by master, its own term, and sent by worker, the newest term it has seen
 type RegisterSend struct {
-    Port int64
+    Term int64
+    // The protocol the worker speaks, see PROTOCOL_VERSION
+    Version int
+    // The id of the worker, 0 to let master pick one
+    // And the host:port master reaches it at, see Worker.AdvertiseAddr
+    // Whose host master fills in if it is empty or unspecified, see reachableAddr
+    WorkerId int64
+    Addr     string
+    Slots    int
+    Host     string
+    // The SHA-256 of the plugin the worker has loaded, empty if none
+    Plugin       string
+    Capabilities Capabilities
+    // The secret of the job, see Worker.Secret
+    Secret string
+    // The address the registration came from, not sent, see peerObserved
+    peer string
 }
 
-type TaskFinishedSend struct {
-    TaskId   TaskId
-    TaskType TaskType
+type DeregisterSend struct {
+    Term     int64
     WorkerId int64
+    Token    string
+}
+
+// Returned by Shutdown of a worker already shut down
+// And by the rpc starting a task once the worker is shutting down
+var ErrWorkerClosed = errors.New("mapreduce: worker shut down")
+
+// Returned by the rpc starting a task once every slot of the worker is taken
+var ErrNoFreeSlot = errors.New("mapreduce: no free slot on worker")
+
+// Returned by startTask for an attempt the worker is running or has run
+// Master retries dispatches, so the rpc starting it succeeds without a second run
+var errDuplicateAttempt = errors.New("attempt already delivered")
+
+type TaskFinishedSend struct {
+    Term      int64
+    JobId     JobId
+    TaskId    TaskId
+    TaskType  TaskType
+    AttemptId AttemptId
+    WorkerId  int64
+    // The session token of the worker, see Worker.Secret
+    Token string
+    // The bytes written to each reduce partition by a map task
+    PartitionBytes []int64
+    // The input records a map task skipped, see SkipPolicy
+    SkippedRecords int
+    // The times a map task read its input again after a transient error
+    ReadRetries int
+    // The records and bytes the attempt read and wrote
+    Counters TaskCounters
+}
+
+// Sent by a worker whose attempt cannot finish, e.g. the user function panics
+type TaskFailedSend struct {
+    Term      int64
+    JobId     JobId
+    TaskId    TaskId
+    TaskType  TaskType
+    AttemptId AttemptId
+    WorkerId  int64
+    Token     string
+    // The panic message, and the stack of the goroutine that panicked
+    Err   string
+    Stack string
+    // The tail of the log of the attempt, see TaskLogBytes
+    Log string
+    // If Permanent is true, running the task again cannot help
+    // E.g. its input file does not exist, see permanentReadError
+    Permanent bool
+    // The times a map task read its input again after a transient error
+    ReadRetries int
+}
+
+// The panic of a user function, recovered by the worker
+type userPanic struct {
+    value interface{}
+    stack []byte
+}
+
+func (p *userPanic) Error() string {
+    return fmt.Sprintf("panic: %v", p.value)
+}
+
+// Written by a map task next to its intermediate files once they are committed
+// Read by a master started with WithResume
+type MapManifest struct {
+    JobId     JobId
+    TaskId    TaskId
+    InputFile string
+    // The byte range of InputFile the task read, see InputSplit
+    Offset int64 `json:",omitempty"`
+    Length int64 `json:",omitempty"`
+    // The size of each intermediate file, one per reduce task
+    PartitionBytes []int64
 }
 
 type MapStartSend struct {
+    Term int64
+    // The session token master issued the worker, see Worker.Secret
+    Token     string
+    JobId     JobId
     InputFile string
+    // The byte range of InputFile the task reads, see InputSplit
+    Offset    int64
+    Length    int64
     TaskId    TaskId
+    AttemptId AttemptId
     ReduceNum int
+    // If MapOnly is true, the job has no reduce phase
+    // The map task writes its output to OutputDir directly
+    MapOnly   bool
+    OutputDir string
+    // Where intermediate files go, see WorkerConfig.MapDir
+    // Sent with the task too, as it may arrive before the reply of registration
+    MapDir string
+    // The policy of skipping bad records, nil fails at the first one
+    SkipBadRecords *SkipPolicy
+    // The lease master grants the attempt, 0 if there is none
+    Lease time.Duration
+    // The side files of the job, see JobSpec.CacheFiles
+    CacheFiles []CacheFile
+    // When master gives up on the dispatch, zero for a task pulled by the worker
+    Deadline RpcDeadline
+    // The request that carried the task, not sent, see requestTagged
+    requestId string
 }
 
 type ReduceStartSend struct {
+    Term      int64
+    Token     string
+    JobId     JobId
+    TaskId    TaskId
+    AttemptId AttemptId
+    MapNum    int
+    OutputDir string
+    // Where intermediate files of this worker are, see MapStartSend.MapDir
+    MapDir string
+    // The map tasks skipped after failing, which left no intermediate file
+    SkippedMaps []TaskId
+    // The worker holding the output of each map task, see readPartition
+    // And the host:port it serves the output at
+    MapWorkers []int64
+    MapAddrs   []string
+    // The compression producers encode partitions by, nil for none
+    Compression *CompressionPolicy
+    // The lease master grants the attempt, 0 if there is none
+    Lease time.Duration
+    // The side files of the job, see JobSpec.CacheFiles
+    CacheFiles []CacheFile
+    // When master gives up on the dispatch, see MapStartSend.Deadline
+    Deadline  RpcDeadline
+    requestId string
+}
+
+func (args *MapStartSend) setRequestId(id string) {
+    args.requestId = id
+}
+
+func (args *ReduceStartSend) setRequestId(id string) {
+    args.requestId = id
+}
+
+// A single attempt of a task
+type TaskAttempt struct {
+    JobId     JobId
+    TaskId    TaskId
+    TaskType  TaskType
+    AttemptId AttemptId
+}
+
+// The attempt passed to the Setup and Cleanup hooks of a worker
+type TaskInfo struct {
+    JobId     JobId
+    TaskId    TaskId
+    TaskType  TaskType
+    AttemptId AttemptId
+    // The number of partitions a map task writes, or a reduce task reads
+    Partitions int
+    // The input file of a map task, empty for reduce
+    InputFile string
+    // The local copy of each side file of the job, by its path on master
+    CacheFiles map[string]string
+}
+
+type KillTaskSend struct {
+    Attempt TaskAttempt
+    Token   string
+}
+
+type HeartbeatSend struct {
+    Term     int64
+    WorkerId int64
+    Token    string
+    // The task attempts the worker is running
+    Tasks []TaskAttempt
+    // The progress of the attempts that have made any
+    Progress []TaskProgress
+    // The resources of the host of the worker
+    Resources ResourceSample
+    // The counters of the cache of the worker
+    Cache CacheStats
+    // When the worker gives up on the heartbeat
+    Deadline RpcDeadline
+}
+
+// The fraction of an attempt done so far, from 0 to 1
+// A map attempt counts the records written, a reduce attempt the partitions read
+// And then the keys reduced
+type TaskProgress struct {
+    Attempt  TaskAttempt
+    Fraction float64
+}
+
+type RequestTaskSend struct {
+    Term     int64
+    WorkerId int64
+    Token    string
+}
+
+type RequestTaskReply struct {
+    Instruction string
+    TaskType    TaskType
+    MapArgs     MapStartSend
+    ReduceArgs  ReduceStartSend
+    // The backoff master suggests, set with RETRY_LATER
+    RetryAfter time.Duration
 }
 
 type Worker struct {
     // The lock
     mu sync.Mutex
 
-    // The address (port) of master and worker
+    // The port the worker listens on, and the host:port of master
+    // The master is resolved again on failover, see Worker.Resolver
     port       int64
-    masterPort int64
+    masterAddr string
+    // The address the worker listens on, set by StartWorker
+    listenAddr string
+    // Resolver, or one alternating with StandbyAddr, nil to keep masterAddr
+    resolver MasterResolver
+    // The id the worker registers with, kept across registrations
+    // So master tells it apart from another worker on the same port
+    id int64
+
+    // The newest term of master the worker has seen
+    // Tasks dispatched by an older term are rejected
+    term int64
+
+    // The session token master issued on the last registration
+    // Sent with the rpcs of the worker, and expected in those of master
+    token string
+    // Closed once the registration in flight has stored the token of its reply
+    // Nil if none is in flight, see beginRegistration
+    registering chan struct{}
+
+    // Set once master tells the worker it is draining, see Master.Drain
+    // Master is going away then, so the worker no longer fails over
+    drained bool
 
     // User-defined map & reduce function
+    // Replaced by those of the plugin master hands out, see installPlugin
     fMap    func(string, string) []KeyValue
     fReduce func(string, []string) string
+    // The SHA-256 of the loaded plugin, empty if none
+    plugin string
+
+    // Task attempts the worker is running
+    // Mapped to true once the attempt is killed by master
+    tasks map[TaskAttempt]bool
+    // The cancel functions of the contexts running attempts pass to
+    // MapContext and ReduceContext, called once the attempt is killed
+    cancels map[TaskAttempt]context.CancelFunc
+    // The progress of running attempts, sent with heartbeats
+    progress map[TaskAttempt]float64
+    // The leases of running attempts, renewed by heartbeats
+    leases map[TaskAttempt]workerLease
+    // The logs of recent attempts, oldest first in logOrder
+    logs     map[TaskAttempt]*taskLog
+    logOrder []TaskAttempt
+    // The time the dispatch of each running attempt expires, see RpcDeadline.expiry
+    expiries map[TaskAttempt]time.Time
+    // The outcome of ended attempts a start may still arrive for, oldest first in endedOrder
+    ended      map[TaskAttempt]endedAttempt
+    endedOrder []TaskAttempt
+    // The side files fetched from master, with their own lock
+    cache fileCache
+    // The attempts accepted and not yet ended, waited for by Shutdown
+    running sync.WaitGroup
+
+    // The listener of the rpc server, closed by Shutdown
+    listener net.Listener
+    // The configuration master sent on registration, see WorkerConfig
+    settings WorkerConfig
+
+    // The transport of rpcs, replaced by Worker.Transport in StartWorker
+    // Its connections to master and to other workers closed by Shutdown
+    transport Transport
+    // Set by Shutdown once no new task is accepted
+    // And once the worker has deregistered, which stops every loop
+    closing bool
+    closed  bool
+    // Closed once the worker has stopped, see Done
+    done chan struct{}
+
+    // The host the worker runs on, matched against input location hints
+    // Default to the hostname of the machine
+    // Must be set before StartWorker
+    Host string
+
+    // The number of tasks the worker runs at the same time
+    // Each task runs in its own goroutine and is reported independently
+    // Must be set before StartWorker
+    Slots int
+
+    // If PullMode is true, worker asks master for tasks
+    // Through Master.RequestTask instead of waiting for dispatch
+    // Must be set before StartWorker
+    PullMode bool
+
+    // Where the worker writes its log
+    // Default to a Logger writing to stderr
+    Logger Logger
+
+    // The max bytes of log kept for each attempt, default to TASK_LOG_BYTES
+    // The lines the worker logs about an attempt are also kept with it
+    // Sent with TaskFailed, and served by FetchTaskLog
+    // Must be set before StartWorker
+    TaskLogBytes int
+
+    // The bytes of keys and values a map attempt buffers in memory
+    // Before it spills them to a file, default to SPILL_BYTES
+    // If SortSpills is true, each spill is sorted by key
+    // And the spills merged, so every intermediate file is sorted by key
+    // Must be set before StartWorker
+    SpillBytes int
+    SortSpills bool
+
+    // The bytes of keys and values a reduce attempt holds in memory
+    // Beyond that its input is sorted on disk, see runBuffer
+    // Default to REDUCE_MEMORY
+    // Must be set before StartWorker
+    ReduceMemory int
+
+    // An optional combiner, run on the output of each map attempt
+    // Each time a partition is spilled or written to its intermediate file
+    // It takes the values of a key and returns the single value written for it
+    // So reduce must give the same result on combined values, e.g. a sum
+    // Not used by map-only jobs
+    // Must be set before StartWorker
+    Combiner func(string, []string) string
+
+    // What the worker does once LostMasterProbes heartbeats in a row fail
+    // LOST_MASTER_RECONNECT (the default) or LOST_MASTER_EXIT
+    // Default LostMasterProbes to LOST_MASTER_PROBES
+    // Must be set before StartWorker
+    LostMaster       string
+    LostMasterProbes int
+
+    // If DisableShuffle is true, the worker does not serve its map output
+    // Reducers read it from MAP_DIR instead, which must then be shared
+    // Must be set before StartWorker
+    DisableShuffle bool
+
+    // Optional map and reduce functions taking the context of the attempt
+    // Used instead of the functions of MakeWorker or a plugin if set
+    // The context is cancelled once the attempt is killed
+    // So a long running function can return early, its result is discarded
+    // Must be set before StartWorker
+    MapContext    func(ctx context.Context, file, content string) []KeyValue
+    ReduceContext func(ctx context.Context, key string, values []string) string
+
+    // Optional hooks around the user functions of each attempt
+    // Setup runs before the first record, with the context of the attempt
+    // Cleanup runs once after the last record, or once the attempt
+    // Is killed or panics, if Setup has run (even if it panicked)
+    // A panic in Setup fails the attempt, one in Cleanup is only logged
+    // Attempts run at the same time in different slots call them concurrently
+    // Replaced by those of a plugin that exports them
+    // Must be set before StartWorker
+    Setup   func(ctx context.Context, info TaskInfo)
+    Cleanup func(info TaskInfo)
 
-    // Task id assigned to worker
-    taskId int
+    // The directory plugins from master are cached in, by content
+    // Default to PLUGIN_DIR
+    // Must be set before StartWorker
+    PluginDir string
+
+    // The number of times a map attempt reads its input again after a
+    // Transient error, waiting ReadBackoff before the first retry and twice
+    // As long before each one after it, see permanentReadError
+    // Default to READ_RETRIES and READ_BACKOFF, a negative ReadRetries never retries
+    // Must be set before StartWorker
+    ReadRetries int
+    ReadBackoff time.Duration
+
+    // Optional reader of the input files of map tasks, e.g. from a remote store
+    // Default to read a local or shared path
+    // Must be set before StartWorker
+    ReadInput func(ctx context.Context, path string) ([]byte, error)
+
+    // The directory side files of jobs are cached in, and its max bytes
+    // Least recently used files are removed once the cache is over the limit
+    // Default to CACHE_DIR and CACHE_BYTES
+    // Must be set before StartWorker
+    CacheDir   string
+    CacheBytes int64
+
+    // The max duration of an rpc to master or another worker
+    // And of a heartbeat, after which it counts as failed
+    // Default to CALL_TIMEOUT and PROBE_TIMEOUT
+    // Must be set before StartWorker
+    CallTimeout  time.Duration
+    ProbeTimeout time.Duration
+
+    // How far the clocks of master and the worker may be apart
+    // When it declines a dispatch that arrived after its deadline, see RpcDeadline
+    // Default to MAX_CLOCK_SKEW
+    // Must be set before StartWorker
+    MaxClockSkew time.Duration
+
+    // If TLS is set, the worker serves and sends rpcs over TLS with it
+    // Master and the other workers must as well, see LoadTLSConfig
+    // Must be set before StartWorker
+    TLS *tls.Config
+
+    // The transport of rpcs, nil for net/rpc over TLS if TLS is set
+    // It must be the one master uses, see WithTransport
+    // Must be set before StartWorker
+    Transport Transport
+
+    // Run around every rpc of the default transport, after logging at debug level
+    // Ignored if Transport is set, see Interceptor
+    // Must be set before StartWorker
+    Interceptors []Interceptor
+
+    // The codec of the default transport, nil for GobCodec
+    // It must be the one master uses, see WithCodec
+    // Ignored if Transport is set
+    // Must be set before StartWorker
+    Codec WireCodec
+
+    // How the default transport pings its idle connections to master and workers
+    // Default to DefaultKeepalivePolicy, Idle 0 never pings, see KeepalivePolicy
+    // Ignored if Transport is set
+    // Must be set before StartWorker
+    Keepalive KeepalivePolicy
+
+    // If Secret is set, the worker presents it to register, see WithSecret
+    // And accepts rpcs only from the master that registered it, and workers with Secret
+    // Must be set before StartWorker
+    Secret string
+
+    // The host:port of the standby master, empty if there is none
+    // The worker switches to it and registers again, once FAILOVER_PROBES
+    // Heartbeats in a row fail, see RunStandby and FailoverResolver
+    // Must be set before StartWorker
+    StandbyAddr string
+
+    // The host:port the worker listens on, empty for every interface
+    // And the port passed to MakeWorker. Port 0 picks a free port, see Port
+    // Must be set before StartWorker
+    ListenAddr string
+
+    // The host:port master and other workers reach the worker at
+    // E.g. the public address of a NAT forwarding to ListenAddr
+    // Default to the port the worker listens on, at the host master sees
+    // Its registration come from, see RegisterSend.Addr
+    // Must be set before StartWorker
+    AdvertiseAddr string
+
+    // If Resolver is set, the worker asks it where master is on start
+    // And again once FAILOVER_PROBES heartbeats in a row fail, or it changes
+    // Instead of keeping the address passed to MakeWorker, see MasterResolver
+    // Must be set before StartWorker, StandbyAddr is then ignored
+    Resolver MasterResolver
 }
 
 // Instantiate Worker object
-func MakeWorker(port, masterPort int64,
+func MakeWorker(port int64, masterAddr string,
     fMap func(string, string) []KeyValue,
     fReduce func(string, []string) string) *Worker {
     worker := Worker{}
 
     // Init ports
     worker.port = port
-    worker.masterPort = masterPort
+    worker.masterAddr = masterAddr
+    worker.settings = defaultWorkerConfig()
+    worker.id = newWorkerId()
 
     worker.fMap = fMap
     worker.fReduce = fReduce
 
+    worker.tasks = map[TaskAttempt]bool{}
+    worker.cancels = map[TaskAttempt]context.CancelFunc{}
+    worker.leases = map[TaskAttempt]workerLease{}
+    worker.progress = map[TaskAttempt]float64{}
+    worker.logs = map[TaskAttempt]*taskLog{}
+    worker.expiries = map[TaskAttempt]time.Time{}
+    worker.ended = map[TaskAttempt]endedAttempt{}
+    worker.Slots = 1
+    worker.SpillBytes = SPILL_BYTES
+    worker.LostMaster = LOST_MASTER_RECONNECT
+    worker.LostMasterProbes = LOST_MASTER_PROBES
+    worker.done = make(chan struct{})
+    worker.transport = NewRPCTransport(nil)
+    worker.CallTimeout = CALL_TIMEOUT
+    worker.ProbeTimeout = PROBE_TIMEOUT
+    worker.MaxClockSkew = MAX_CLOCK_SKEW
+    worker.Keepalive = DefaultKeepalivePolicy()
+    worker.ReduceMemory = REDUCE_MEMORY
+    worker.Host, _ = os.Hostname()
+    worker.Logger = NewStdLogger()
+
     return &worker
 }
 
-func createTemps(num int) []*os.File {
-    var tempFile *os.File
+// Create num temp files under dir
+// So they can be atomically renamed to their final names in dir
+// Nothing is left behind on error
+func createTemps(dir string, num int) ([]*os.File, error) {
     var result []*os.File
-    var err error
 
+    os.MkdirAll(dir, 0755)
     for i := 0; i < num; i++ {
-        tempFile, err = ioutil.TempFile("", "distributor")
+        tempFile, err := ioutil.TempFile(dir, "distributor")
         if err != nil {
-            log.Fatal("Cannot Create Temp File")
+            removeTemps(result)
+            return nil, fmt.Errorf("cannot create temp file: %v", err)
         }
         result = append(result, tempFile)
     }
-    return result
+    return result, nil
 }
 
-func createEnc(files []*os.File) []*json.Encoder {
-    var tempEnc *json.Encoder
-    var result []*json.Encoder
-
+// Close and delete temp files
+func removeTemps(files []*os.File) {
     for _, file := range files {
-        tempEnc = json.NewEncoder(file)
-        result = append(result, tempEnc)
+        file.Close()
+        os.Remove(file.Name())
     }
-    return result
 }
 
 // Start map task
-func (worker *Worker) StartMap(args *MapStartSend, _ ArgEmpty) error {
+// Reply STALE_TERM if a newer master has dispatched tasks to the worker
+// Reply OK without starting it again if the attempt has been delivered before
+// With the Outcome it came to, see StartReply
+// Reply DEADLINE_EXCEEDED without starting it if master has given up the dispatch
+// Return ErrWorkerClosed once the worker is shutting down
+// And ErrNoFreeSlot if every slot is taken
+// Return ErrAuth if the token is not the one master issued, see Worker.Secret
+func (worker *Worker) StartMap(args *MapStartSend, reply *StartReply) error {
+    if err := worker.checkToken(args.Token); err != nil {
+        return err
+    }
+    if !worker.acceptTerm(args.Term) {
+        reply.Err = STALE_TERM
+        return nil
+    }
+    dispatched, cancel := args.Deadline.context(context.Background(), worker.MaxClockSkew)
+    defer cancel()
+    ctx, err := worker.startTask(dispatched, args.Deadline.expiry(worker.MaxClockSkew),
+        args.attempt(), args.Lease)
+    if err == errDuplicateAttempt {
+        reply.Err, reply.Outcome = OK, worker.outcome(args.attempt())
+        return nil
+    }
+    if err == errDeadlinePassed {
+        worker.declineStale(args.attempt(), args.Deadline)
+        reply.Err = DEADLINE_EXCEEDED
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    send := *args
+    go worker.doMap(ctx, &send)
+    reply.Err = OK
+    return nil
+}
+
+// Record the term of a master dispatching a task
+// Return false if the worker has seen a newer term
+func (worker *Worker) acceptTerm(term int64) bool {
+    worker.mu.Lock()
+    defer worker.mu.Unlock()
+
+    if term < worker.term {
+        return false
+    }
+    worker.term = term
+    return true
+}
+
+// Return the port the worker listens on and registers with
+// The one it got once StartWorker has returned, if given port 0
+func (worker *Worker) Port() int64 {
+    worker.mu.Lock()
+    defer worker.mu.Unlock()
+    return worker.port
+}
+
+// Return the id the worker registers with, see RegisterSend.WorkerId
+func (worker *Worker) Id() int64 {
+    return worker.id
+}
+
+// Return the address of master and the newest term the worker has seen
+func (worker *Worker) master() (string, int64) {
+    worker.mu.Lock()
+    defer worker.mu.Unlock()
+    return worker.masterAddr, worker.term
+}
+
+// Return the address the worker registers with, see AdvertiseAddr
+func (worker *Worker) advertisedAddr() string {
+    if worker.AdvertiseAddr != "" {
+        return worker.AdvertiseAddr
+    }
+    worker.mu.Lock()
+    defer worker.mu.Unlock()
+    return worker.listenAddr
+}
 
-    content, err := ioutil.ReadFile(args.InputFile)
+// Report a finished attempt to master
+func (worker *Worker) report(send *TaskFinishedSend) {
+    attempt := TaskAttempt{send.JobId, send.TaskId, send.TaskType, send.AttemptId}
+    worker.endTask(attempt)
+    _, term := worker.master()
+    send.Term = term
+    replied, err := worker.callMaster("Master.TaskFinished", send)
     if err != nil {
-        log.Fatal("Cannot Open Map Source")
+        worker.Logger.Warnf("Cannot report finished attempt: %v", err)
     }
+    worker.reportRefused(attempt, replied)
+}
 
-    tempFiles := createTemps(args.ReduceNum)
-    encoders := createEnc(tempFiles)
+// Report an attempt that panicked to master
+// So master requeues the task at once instead of waiting for it to time out
+func (worker *Worker) reportPanic(attempt TaskAttempt, p *userPanic) {
+    worker.taskLogger(attempt).Errorf("Job %v: %v task %v %v\n%s", attempt.JobId,
+        taskTypeName(attempt.TaskType), attempt.TaskId, p, p.stack)
+    worker.sendFailed(attempt, TaskFailedSend{Err: p.Error(), Stack: string(p.stack)})
+}
 
-    go func() {
-        for _, kv := range worker.fMap(args.InputFile, string(content)) {
-            id := iHash(kv.Key) % args.ReduceNum
-            if encoders[id].Encode(&kv) != nil {
-                log.Fatal("Unable To Encode Map Result")
+// Report a failed attempt to master, send tells why
+// The ids of the attempt, the token and the log tail are filled in
+func (worker *Worker) sendFailed(attempt TaskAttempt, send TaskFailedSend) {
+    worker.endTask(attempt)
+    _, term := worker.master()
+    send.Term = term
+    send.JobId = attempt.JobId
+    send.TaskId = attempt.TaskId
+    send.TaskType = attempt.TaskType
+    send.AttemptId = attempt.AttemptId
+    send.WorkerId = worker.id
+    send.Token = worker.sessionToken()
+    send.Log = worker.taskLogTail(attempt)
+    replied, err := worker.callMaster("Master.TaskFailed", &send)
+    if err != nil {
+        worker.Logger.Warnf("Cannot report failed attempt: %v", err)
+    }
+    worker.reportRefused(attempt, replied)
+}
+
+// Run the Setup hook of an attempt, recovering from a panic in it
+// Return the function running the Cleanup hook, which only runs it once
+// Called once the user functions are done, and deferred for early returns
+func (worker *Worker) setupTask(ctx context.Context, info TaskInfo) (cleanup func(), p *userPanic) {
+    worker.mu.Lock()
+    setup, clean := worker.Setup, worker.Cleanup
+    worker.mu.Unlock()
+
+    done := false
+    cleanup = func() {
+        if done || clean == nil {
+            return
+        }
+        done = true
+        defer func() {
+            if r := recover(); r != nil {
+                worker.taskLogger(TaskAttempt{info.JobId, info.TaskId, info.TaskType, info.AttemptId}).
+                    Errorf("Job %v: %v task %v Cleanup panic: %v\n%s", info.JobId,
+                        taskTypeName(info.TaskType), info.TaskId, r, debug.Stack())
             }
+        }()
+        clean(info)
+    }
+    if setup == nil {
+        return cleanup, nil
+    }
+
+    defer func() {
+        if r := recover(); r != nil {
+            p = &userPanic{value: r, stack: debug.Stack()}
         }
+    }()
+    setup(ctx, info)
+    return cleanup, nil
+}
 
-        send := TaskFinishedSend{TaskId: args.TaskId, TaskType: MAP, WorkerId: worker.port}
-        result := GeneralReply{}
+// Run the map function, recovering from a panic in it
+func (worker *Worker) callMap(ctx context.Context, file, content string) (kvs []KeyValue, p *userPanic) {
+    defer func() {
+        if r := recover(); r != nil {
+            p = &userPanic{value: r, stack: debug.Stack()}
+        }
+    }()
+    if worker.MapContext != nil {
+        return worker.MapContext(ctx, file, content), nil
+    }
+    worker.mu.Lock()
+    fMap := worker.fMap
+    worker.mu.Unlock()
+    return fMap(file, content), nil
+}
 
-        Call(worker.masterPort, "Master.TaskFinished", &send, &result)
+// Run the reduce function, recovering from a panic in it
+func (worker *Worker) callReduce(ctx context.Context, key string, values []string) (result string, p *userPanic) {
+    defer func() {
+        if r := recover(); r != nil {
+            p = &userPanic{value: r, stack: debug.Stack()}
+        }
+    }()
+    if worker.ReduceContext != nil {
+        return worker.ReduceContext(ctx, key, values), nil
+    }
+    worker.mu.Lock()
+    fReduce := worker.fReduce
+    worker.mu.Unlock()
+    return fReduce(key, values), nil
+}
 
-        if result.Err == OK {
-            for i := 0; i < args.ReduceNum; i++ {
-                name := tempFiles[i].Name()
-                tempFiles[i].Close()
-                os.Rename(
-                    name,
-                    "mapresult/"+IRP+"-"+int2str(int(args.TaskId))+"-"+int2str(i),
-                )
-            }
+// Run the combiner on the values of each key, recovering from a panic in it
+// Called on the pairs of a single partition, see spillBuffer
+// The result holds one pair per key, in key order
+func (worker *Worker) combine(kvs []KeyValue) (result []KeyValue, p *userPanic) {
+    defer func() {
+        if r := recover(); r != nil {
+            p = &userPanic{value: r, stack: debug.Stack()}
         }
     }()
 
+    values := map[string][]string{}
+    var keys []string
+    for _, kv := range kvs {
+        if _, ok := values[kv.Key]; !ok {
+            keys = append(keys, kv.Key)
+        }
+        values[kv.Key] = append(values[kv.Key], kv.Value)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+        result = append(result, KeyValue{Key: key, Value: worker.Combiner(key, values[key])})
+    }
+    return result, nil
+}
+
+// Record that the worker starts running an attempt, holding lease if positive
+// Its dispatch expires at expiry, zero if it never does, see rememberEnded
+// Return ErrWorkerClosed if the worker is shutting down and takes no new task
+// Return ErrNoFreeSlot if Slots attempts are running
+// Return errDuplicateAttempt if the attempt is running, e.g. dispatched again
+// And errDeadlinePassed once dispatched is done, master has given it up by then
+// Killed attempts that have not stopped yet take no slot, as master has freed them
+// Must be called before the attempt runs, which calls endTask once it ends
+// And marks running done once it returns
+func (worker *Worker) startTask(dispatched context.Context, expiry time.Time,
+    attempt TaskAttempt, lease time.Duration) (context.Context, error) {
+    worker.mu.Lock()
+    defer worker.mu.Unlock()
+
+    if worker.attemptOutcome(attempt) != "" {
+        return nil, errDuplicateAttempt
+    }
+    if dispatched.Err() != nil {
+        return nil, errDeadlinePassed
+    }
+    if worker.closing {
+        return nil, ErrWorkerClosed
+    }
+    running := 0
+    for _, killed := range worker.tasks {
+        if !killed {
+            running++
+        }
+    }
+    if running >= worker.Slots {
+        return nil, ErrNoFreeSlot
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    worker.tasks[attempt] = false
+    worker.cancels[attempt] = cancel
+    worker.expiries[attempt] = expiry
+    worker.grantLease(attempt, lease)
+    worker.startTaskLog(attempt)
+    worker.running.Add(1)
+    return ctx, nil
+}
+
+// Return true if master has killed the attempt
+func (worker *Worker) isKilled(attempt TaskAttempt) bool {
+    worker.mu.Lock()
+    defer worker.mu.Unlock()
+    return worker.tasks[attempt]
+}
+
+// rpc used by master to stop a running attempt
+// The attempt discards its temp files and never reports
+// Its slot is free at once, see startTask
+func (worker *Worker) KillTask(args *KillTaskSend, reply *GeneralReply) error {
+    if err := worker.checkToken(args.Token); err != nil {
+        return err
+    }
+    worker.mu.Lock()
+    defer worker.mu.Unlock()
+
+    worker.kill(args.Attempt)
+    reply.Err = OK
     return nil
 }
 
+// Mark a running attempt as killed and cancel its context
+// The attempt stops at the next record, or once its user function returns
+// Return false if the worker is not running the attempt or it is already killed
+// Must be called with lock held
+func (worker *Worker) kill(attempt TaskAttempt) bool {
+    if killed, ok := worker.tasks[attempt]; !ok || killed {
+        return false
+    }
+    worker.tasks[attempt] = true
+    worker.cancels[attempt]()
+    return true
+}
+
+// Record that the worker stops running an attempt
+// Called before the attempt reports, so its slot is free once master frees it
+// The attempt is remembered until its dispatch expires, see rememberEnded
+func (worker *Worker) endTask(attempt TaskAttempt) {
+    worker.mu.Lock()
+    defer worker.mu.Unlock()
+    if killed, ok := worker.tasks[attempt]; ok {
+        outcome := ATTEMPT_FINISHED
+        if killed {
+            outcome = ATTEMPT_KILLED
+        }
+        worker.rememberEnded(attempt, outcome)
+    }
+    if cancel, ok := worker.cancels[attempt]; ok {
+        cancel()
+        delete(worker.cancels, attempt)
+    }
+    delete(worker.tasks, attempt)
+    delete(worker.expiries, attempt)
+    delete(worker.progress, attempt)
+    delete(worker.leases, attempt)
+}
+
+// Record the fraction of an attempt done so far
+func (worker *Worker) setProgress(attempt TaskAttempt, done, total int) {
+    if total <= 0 {
+        return
+    }
+    worker.mu.Lock()
+    defer worker.mu.Unlock()
+    if _, ok := worker.tasks[attempt]; ok {
+        worker.progress[attempt] = float64(done) / float64(total)
+    }
+}
+
+// Run map task and report the result to master
+// An attempt that fails is reported with TaskFailed, so master retries it at once
+func (worker *Worker) doMap(ctx context.Context, args *MapStartSend) {
+    attempt := TaskAttempt{args.JobId, args.TaskId, MAP, args.AttemptId}
+    defer worker.running.Done()
+    defer worker.endTask(attempt)
+    logger := worker.taskLogger(attempt)
+    split := args.split()
+    logger.Debugf("Job %v: map task %v attempt %v started%v, reads %v",
+        args.JobId, args.TaskId, args.AttemptId, byRequest(args.requestId), split)
+
+    content, start, retries, err := worker.readInput(ctx, attempt, split)
+    if worker.isKilled(attempt) {
+        return
+    }
+    if err != nil {
+        worker.reportReadError(attempt, split, retries, err)
+        return
+    }
+
+    cacheFiles, release, err := worker.fetchCacheFiles(args.JobId, args.CacheFiles)
+    defer release()
+    if err != nil {
+        worker.failMap(attempt, err)
+        return
+    }
+
+    // A panic of the map function fails the attempt before any file is written
+    cleanup, p := worker.setupTask(ctx, TaskInfo{
+        JobId:      args.JobId,
+        TaskId:     args.TaskId,
+        TaskType:   MAP,
+        AttemptId:  args.AttemptId,
+        Partitions: args.ReduceNum,
+        InputFile:  args.InputFile,
+        CacheFiles: cacheFiles,
+    })
+    defer cleanup()
+    if p != nil {
+        worker.reportPanic(attempt, p)
+        return
+    }
+
+    // With a skip policy, map runs on each record and bad records are skipped
+    var kvs []KeyValue
+    skipped := 0
+    switch {
+    case len(content) == 0 && !split.whole():
+        // A split without a line of its own, e.g. one inside a long line, maps nothing
+    case args.SkipBadRecords != nil:
+        kvs, skipped, p = worker.callMapRecords(ctx, attempt, args, string(content), start)
+    default:
+        kvs, p = worker.callMap(ctx, args.InputFile, string(content))
+    }
+    cleanup()
+    if worker.isKilled(attempt) {
+        return
+    }
+    if p != nil {
+        worker.reportPanic(attempt, p)
+        return
+    }
+
+    counters := TaskCounters{
+        InputRecords: countRecords(content),
+        InputBytes:   int64(len(content)),
+    }
+    if args.MapOnly {
+        worker.doMapOnly(args, attempt, kvs, skipped, retries, counters)
+        return
+    }
+
+    // Write into the private directory of the attempt
+    // Whatever is left there when the attempt ends was never committed
+    mapDir := worker.taskMapDir(args.MapDir)
+    tempDir := attemptDir(mapDir, attempt)
+    defer os.RemoveAll(tempDir)
+    if err := os.MkdirAll(tempDir, 0755); err != nil {
+        worker.failMap(attempt, err)
+        return
+    }
+
+    // Buffer the result by partition, spilled once SpillBytes are buffered
+    // Stop between records once killed
+    buffer := worker.newSpillBuffer(tempDir, args.ReduceNum)
+    for idx, kv := range kvs {
+        if worker.isKilled(attempt) {
+            return
+        }
+        if idx%PROGRESS_RECORDS == 0 {
+            worker.setProgress(attempt, idx, len(kvs))
+        }
+        if err := buffer.add(kv); err != nil {
+            worker.failMap(attempt, err)
+            return
+        }
+    }
+    if worker.isKilled(attempt) {
+        return
+    }
+
+    tempFiles, err := createTemps(tempDir, args.ReduceNum)
+    if err != nil {
+        worker.failMap(attempt, err)
+        return
+    }
+    if err := buffer.finish(tempFiles); err != nil {
+        removeTemps(tempFiles)
+        worker.failMap(attempt, err)
+        return
+    }
+
+    // Commit the result before reporting
+    // So reduce tasks never see a finished map task without its files
+    // Every attempt of a task produces the same files
+    // So a wasted attempt only replaces them atomically with identical content
+    partitionBytes := make([]int64, args.ReduceNum)
+    counters.OutputRecords = int64(buffer.records)
+    for i := 0; i < args.ReduceNum; i++ {
+        if info, err := tempFiles[i].Stat(); err == nil {
+            partitionBytes[i] = info.Size()
+            counters.OutputBytes += info.Size()
+        }
+        name := tempFiles[i].Name()
+        tempFiles[i].Close()
+        if err := os.Rename(name, intermediateName(mapDir, args.JobId, int(args.TaskId), i)); err != nil {
+            removeTemps(tempFiles[i+1:])
+            worker.failMap(attempt, fmt.Errorf("cannot commit partition %v: %v", i, err))
+            return
+        }
+    }
+    if err := worker.writeManifest(args, mapDir, tempDir, partitionBytes); err != nil {
+        worker.failMap(attempt, err)
+        return
+    }
+    os.RemoveAll(tempDir)
+
+    send := TaskFinishedSend{
+        JobId:          args.JobId,
+        TaskId:         args.TaskId,
+        TaskType:       MAP,
+        AttemptId:      args.AttemptId,
+        WorkerId:       worker.id,
+        Token:          worker.sessionToken(),
+        PartitionBytes: partitionBytes,
+        SkippedRecords: skipped,
+        ReadRetries:    retries,
+        Counters:       counters,
+    }
+    logger.Debugf("Job %v: map task %v attempt %v wrote %v pairs",
+        args.JobId, args.TaskId, args.AttemptId, len(kvs))
+    worker.report(&send)
+}
+
+// Give up a map attempt that cannot run or write its result
+// Reported to master, with the stack if the map function or combiner panicked
+func (worker *Worker) failMap(attempt TaskAttempt, err error) {
+    if p, ok := err.(*userPanic); ok {
+        worker.reportPanic(attempt, p)
+        return
+    }
+    worker.taskLogger(attempt).Errorf("Job %v: map task %v: %v", attempt.JobId, attempt.TaskId, err)
+    worker.sendFailed(attempt, TaskFailedSend{Err: err.Error()})
+}
+
+// Give up a reduce attempt that cannot read, sort or reduce its input
+// Reported to master, with the stack if the reduce function panicked
+func (worker *Worker) failReduce(attempt TaskAttempt, err error) {
+    if p, ok := err.(*userPanic); ok {
+        worker.reportPanic(attempt, p)
+        return
+    }
+    worker.taskLogger(attempt).Errorf("Job %v: reduce task %v: %v", attempt.JobId, attempt.TaskId, err)
+    worker.sendFailed(attempt, TaskFailedSend{Err: err.Error()})
+}
+
+// Write the manifest of a map task after its intermediate files are committed
+// So a resumed master and reducers can tell the files are complete
+// See WithResume and readCommitted
+// Return an error if it cannot be committed, which fails the attempt
+func (worker *Worker) writeManifest(args *MapStartSend, mapDir, tempDir string,
+    partitionBytes []int64) error {
+    manifest := MapManifest{
+        JobId:          args.JobId,
+        TaskId:         args.TaskId,
+        InputFile:      args.InputFile,
+        Offset:         args.Offset,
+        Length:         args.Length,
+        PartitionBytes: partitionBytes,
+    }
+    data, err := json.Marshal(&manifest)
+    if err != nil {
+        return fmt.Errorf("cannot encode manifest: %v", err)
+    }
+
+    tempFiles, err := createTemps(tempDir, 1)
+    if err != nil {
+        return err
+    }
+    tempFile := tempFiles[0]
+    if _, err := tempFile.Write(data); err != nil {
+        removeTemps(tempFiles)
+        return fmt.Errorf("cannot write manifest: %v", err)
+    }
+    name := tempFile.Name()
+    tempFile.Close()
+    if err := os.Rename(name, manifestName(mapDir, args.JobId, int(args.TaskId))); err != nil {
+        return fmt.Errorf("cannot commit manifest: %v", err)
+    }
+    return nil
+}
+
+// Write the result of a map task in a map-only job as final output
+// One "key value" line per pair, in the order the map function returns them
+func (worker *Worker) doMapOnly(args *MapStartSend, attempt TaskAttempt,
+    kvs []KeyValue, skipped, retries int, counters TaskCounters) {
+    tempDir := attemptDir(args.OutputDir, attempt)
+    defer os.RemoveAll(tempDir)
+    tempFiles, err := createTemps(tempDir, 1)
+    if err != nil {
+        worker.failMap(attempt, err)
+        return
+    }
+    tempFile := tempFiles[0]
+    for _, kv := range kvs {
+        if worker.isKilled(attempt) {
+            removeTemps([]*os.File{tempFile})
+            return
+        }
+        fmt.Fprintf(tempFile, "%v %v\n", kv.Key, kv.Value)
+    }
+    if worker.isKilled(attempt) {
+        removeTemps([]*os.File{tempFile})
+        return
+    }
+
+    // Commit the output before reporting, the same as reduce
+    counters.OutputRecords = int64(len(kvs))
+    if info, err := tempFile.Stat(); err == nil {
+        counters.OutputBytes = info.Size()
+    }
+    name := tempFile.Name()
+    tempFile.Close()
+    if err := os.Rename(name, outputName(args.OutputDir, int(args.TaskId))); err != nil {
+        worker.failMap(attempt, fmt.Errorf("cannot commit output: %v", err))
+        return
+    }
+    os.RemoveAll(tempDir)
+
+    send := TaskFinishedSend{
+        JobId:          args.JobId,
+        TaskId:         args.TaskId,
+        TaskType:       MAP,
+        AttemptId:      args.AttemptId,
+        WorkerId:       worker.id,
+        Token:          worker.sessionToken(),
+        SkippedRecords: skipped,
+        ReadRetries:    retries,
+        Counters:       counters,
+    }
+    worker.report(&send)
+}
+
 // Start reduce function
-func (worker *Worker) StartReduce(args *ReduceStartSend, reply *GeneralReply) error {
+// Reply STALE_TERM if a newer master has dispatched tasks to the worker
+// Reply OK without starting it again if the attempt has been delivered before, like StartMap
+func (worker *Worker) StartReduce(args *ReduceStartSend, reply *StartReply) error {
+    if err := worker.checkToken(args.Token); err != nil {
+        return err
+    }
+    if !worker.acceptTerm(args.Term) {
+        reply.Err = STALE_TERM
+        return nil
+    }
+    dispatched, cancel := args.Deadline.context(context.Background(), worker.MaxClockSkew)
+    defer cancel()
+    ctx, err := worker.startTask(dispatched, args.Deadline.expiry(worker.MaxClockSkew),
+        args.attempt(), args.Lease)
+    if err == errDuplicateAttempt {
+        reply.Err, reply.Outcome = OK, worker.outcome(args.attempt())
+        return nil
+    }
+    if err == errDeadlinePassed {
+        worker.declineStale(args.attempt(), args.Deadline)
+        reply.Err = DEADLINE_EXCEEDED
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    send := *args
+    go worker.doReduce(ctx, &send)
+    reply.Err = OK
     return nil
 }
 
+// Run reduce task and report the result to master
+func (worker *Worker) doReduce(ctx context.Context, args *ReduceStartSend) {
+    attempt := TaskAttempt{args.JobId, args.TaskId, REDUCE, args.AttemptId}
+    defer worker.running.Done()
+    defer worker.endTask(attempt)
+    logger := worker.taskLogger(attempt)
+    logger.Debugf("Job %v: reduce task %v attempt %v started%v, reads %v map outputs",
+        args.JobId, args.TaskId, args.AttemptId, byRequest(args.requestId),
+        args.MapNum-len(args.SkippedMaps))
+
+    // Write into the private directory of the attempt, the same as map
+    tempDir := attemptDir(args.OutputDir, attempt)
+    defer os.RemoveAll(tempDir)
+    if err := os.MkdirAll(tempDir, 0755); err != nil {
+        worker.failReduce(attempt, err)
+        return
+    }
+
+    // Collect the pairs from the intermediate files of every map task
+    // That has not been skipped
+    // Sorted runs are written to disk once ReduceMemory is exceeded
+    skipped := map[int]bool{}
+    for _, id := range args.SkippedMaps {
+        skipped[int(id)] = true
+    }
+    buffer := worker.newRunBuffer(tempDir)
+    var counters TaskCounters
+    for i := 0; i < args.MapNum; i++ {
+        // Reading partitions is the first half of the attempt
+        worker.setProgress(attempt, i, 2*args.MapNum)
+        if skipped[i] {
+            continue
+        }
+        data, wire, ok := worker.readPartition(args, i)
+        if !ok {
+            logger.Errorf("Job %v: reduce task %v cannot read output of map task %v",
+                args.JobId, args.TaskId, i)
+            worker.reportMissing(args, i)
+            return
+        }
+        counters.InputBytes += int64(len(data))
+        if wire > 0 {
+            counters.UncompressedBytes += int64(len(data))
+            counters.CompressedBytes += wire
+        }
+        decoder := json.NewDecoder(bytes.NewReader(data))
+        for {
+            var kv KeyValue
+            err := decoder.Decode(&kv)
+            if err == io.EOF {
+                break
+            }
+            if err != nil {
+                worker.failReduce(attempt, fmt.Errorf("cannot decode output of map task %v: %v", i, err))
+                return
+            }
+            if err := buffer.add(kv); err != nil {
+                worker.failReduce(attempt, err)
+                return
+            }
+        }
+    }
+
+    // Reduce keys in sorted order
+    // Stop between keys once killed
+    tempFiles, err := createTemps(tempDir, 1)
+    if err != nil {
+        worker.failReduce(attempt, err)
+        return
+    }
+    tempFile := tempFiles[0]
+    cacheFiles, release, err := worker.fetchCacheFiles(args.JobId, args.CacheFiles)
+    defer release()
+    if err != nil {
+        removeTemps([]*os.File{tempFile})
+        worker.failReduce(attempt, err)
+        return
+    }
+    cleanup, p := worker.setupTask(ctx, TaskInfo{
+        JobId:      args.JobId,
+        TaskId:     args.TaskId,
+        TaskType:   REDUCE,
+        AttemptId:  args.AttemptId,
+        Partitions: args.MapNum,
+        CacheFiles: cacheFiles,
+    })
+    defer cleanup()
+    if p != nil {
+        removeTemps([]*os.File{tempFile})
+        worker.reportPanic(attempt, p)
+        return
+    }
+    keys, reduced := 0, 0
+    err = buffer.each(func(key string, values []string) error {
+        if worker.isKilled(attempt) {
+            return errKilled
+        }
+        if keys%PROGRESS_RECORDS == 0 {
+            worker.setProgress(attempt, buffer.total+reduced, 2*buffer.total)
+        }
+        keys++
+        reduced += len(values)
+        result, p := worker.callReduce(ctx, key, values)
+        if p != nil {
+            return p
+        }
+        fmt.Fprintf(tempFile, "%v %v\n", key, result)
+        return nil
+    })
+    cleanup()
+    if err != nil {
+        removeTemps([]*os.File{tempFile})
+        if err != errKilled {
+            worker.failReduce(attempt, err)
+        }
+        return
+    }
+    if worker.isKilled(attempt) {
+        removeTemps([]*os.File{tempFile})
+        return
+    }
+
+    // Commit the output before reporting, the same as map
+    counters.InputRecords = int64(buffer.total)
+    counters.OutputRecords = int64(keys)
+    if info, err := tempFile.Stat(); err == nil {
+        counters.OutputBytes = info.Size()
+    }
+    name := tempFile.Name()
+    tempFile.Close()
+    if err := os.Rename(name, outputName(args.OutputDir, int(args.TaskId))); err != nil {
+        worker.failReduce(attempt, fmt.Errorf("cannot commit output: %v", err))
+        return
+    }
+    os.RemoveAll(tempDir)
+
+    send := TaskFinishedSend{
+        JobId:     args.JobId,
+        TaskId:    args.TaskId,
+        TaskType:  REDUCE,
+        AttemptId: args.AttemptId,
+        WorkerId:  worker.id,
+        Token:     worker.sessionToken(),
+        Counters:  counters,
+    }
+    logger.Debugf("Job %v: reduce task %v attempt %v reduced %v keys",
+        args.JobId, args.TaskId, args.AttemptId, keys)
+    worker.report(&send)
+}
+
 // Start the worker
-func (worker *Worker) StartWorker() {
-    rp, listener := CreateServer(worker, worker.port, "Worker")
+// Return error if the port of the worker cannot be listened on
+// Or master cannot be resolved, see Worker.Resolver
+func (worker *Worker) StartWorker() error {
+    if worker.masterAddr != "" {
+        addr, err := parseAddr(worker.masterAddr)
+        if err != nil {
+            return fmt.Errorf("StartWorker: master: %v", err)
+        }
+        worker.masterAddr = addr
+    }
+    worker.resolver = worker.Resolver
+    if worker.resolver == nil && worker.StandbyAddr != "" {
+        worker.resolver = FailoverResolver(worker.masterAddr, worker.StandbyAddr)
+    }
+    if _, err := worker.resolveMaster(); err != nil {
+        return fmt.Errorf("StartWorker: %v", err)
+    }
+    if err := worker.Keepalive.check(); err != nil {
+        return fmt.Errorf("StartWorker: Keepalive: %v", err)
+    }
+    if worker.MaxClockSkew < 0 {
+        return fmt.Errorf("StartWorker: MaxClockSkew %v is negative", worker.MaxClockSkew)
+    }
+
+    transport := worker.Transport
+    if transport == nil {
+        interceptors := append([]Interceptor{LogInterceptor(worker.Logger)}, worker.Interceptors...)
+        rpcTransport := newRPCTransport(worker.TLS, worker.Codec, worker.Keepalive, interceptors...)
+        rpcTransport.serveFailed = func(err error) {
+            worker.Logger.Errorf("Stopped serving: %v", err)
+        }
+        rpcTransport.logger = worker.Logger
+        transport = rpcTransport
+    }
+    worker.transport = transport
 
     // Run worker server concurrently
-    go RunServer("Worker", rp, listener)
+    listener, err := transport.Listen("Worker", worker, listenAddr(worker.ListenAddr, worker.port))
+    if err != nil {
+        return fmt.Errorf("StartWorker: %w", err)
+    }
+    worker.mu.Lock()
+    worker.listener = listener
+    // Register with the port it got, e.g. for port 0
+    if port := listenerPort(listener); port != 0 {
+        worker.port = port
+    }
+    worker.listenAddr = listener.Addr().String()
+    worker.mu.Unlock()
+
+    if err := worker.register(); err != nil {
+        worker.stop(context.Background())
+        return err
+    }
 
-    Call(
-        worker.masterPort,
-        "Master.RegisterWorker",
-        &RegisterSend{worker.port},
-        &GeneralReply{},
-    )
+    go worker.sendHeartbeats()
+
+    // Every slot pulls its own tasks
+    if worker.PullMode {
+        for i := 0; i < worker.Slots; i++ {
+            go worker.pullTasks()
+        }
+    }
+    return nil
+}
+
+// Register the worker to master
+// If master replies PLUGIN_REQUIRED, install its plugin and register again
+// Return error if master refuses the worker or the plugin cannot be installed
+// An unreachable or overloaded master is left to heartbeats, which register again
+func (worker *Worker) register() error {
+    addr, term := worker.master()
+    throttled := 0
+    for {
+        worker.mu.Lock()
+        loaded := worker.plugin
+        worker.mu.Unlock()
+
+        reply := RegisterReply{}
+        registered := worker.beginRegistration()
+        err := worker.call(
+            worker.CallTimeout,
+            addr,
+            "Master.RegisterWorker",
+            &RegisterSend{
+                Term:         term,
+                Version:      PROTOCOL_VERSION,
+                WorkerId:     worker.id,
+                Addr:         worker.advertisedAddr(),
+                Slots:        worker.Slots,
+                Host:         worker.Host,
+                Plugin:       loaded,
+                Capabilities: worker.capabilities(),
+                Secret:       worker.Secret,
+            },
+            &reply,
+        )
+        if err == nil && reply.Err == OK {
+            worker.mu.Lock()
+            worker.token = reply.Token
+            worker.mu.Unlock()
+        }
+        registered()
+        if err != nil {
+            worker.Logger.Warnf("Cannot register: %v", err)
+            return nil
+        }
+        if wait, ok := reply.backoff(); ok {
+            if throttled++; throttled >= RETRY_LATER_TRIES {
+                worker.Logger.Warnf("Cannot register: %v", ErrOverloaded)
+                return nil
+            }
+            time.Sleep(wait)
+            continue
+        }
+        if reply.Err == AUTH {
+            worker.Logger.Errorf("Master refuses the secret of the worker")
+            return fmt.Errorf("register: %w", ErrAuth)
+        }
+        if reply.Err == OK {
+            worker.configure(reply.Config)
+        }
+        if reply.Err == INCOMPATIBLE && reply.Rejection != nil {
+            worker.Logger.Errorf("Master refuses the worker: %v", reply.Rejection)
+            return fmt.Errorf("register: %w", reply.Rejection)
+        }
+        if reply.Err != PLUGIN_REQUIRED {
+            return nil
+        }
+        if reply.Plugin.Sha256 == loaded {
+            return fmt.Errorf("register: master rejects plugin %v", loaded)
+        }
+        if err := worker.installPlugin(addr, reply.Plugin); err != nil {
+            worker.Logger.Errorf("Cannot install plugin %v: %v", reply.Plugin.Name, err)
+            return fmt.Errorf("register: %v", err)
+        }
+    }
+}
+
+// Periodically tell master the worker is alive and what it is running
+// Resolve master again after FAILOVER_PROBES failures in a row, or once the
+// Resolver changes, and follow it if it moved, e.g. to the standby
+// Once LostMasterProbes fail in a row, master is lost
+// The worker stops or backs off as LostMaster says
+// Register again if master replies it does not know the worker
+// A heartbeat master turns away with RETRY_LATER is sent again after its backoff
+func (worker *Worker) sendHeartbeats() {
+    failures, lost := 0, 0
+    for {
+        worker.mu.Lock()
+        if worker.closed {
+            worker.mu.Unlock()
+            return
+        }
+        send := HeartbeatSend{Term: worker.term, WorkerId: worker.id, Token: worker.token}
+        for attempt := range worker.tasks {
+            send.Tasks = append(send.Tasks, attempt)
+        }
+        for attempt, fraction := range worker.progress {
+            send.Progress = append(send.Progress, TaskProgress{attempt, fraction})
+        }
+        addr := worker.masterAddr
+        drained := worker.drained
+        worker.mu.Unlock()
+        send.Resources = sampleResources(worker.mapDir())
+        send.Cache = worker.cacheStats()
+
+        reply := HeartbeatReply{}
+        sent := time.Now()
+        send.Deadline = newRpcDeadline(worker.ProbeTimeout)
+        // A heartbeat only renews what it reports, so it may be sent twice
+        ctx := ContextWithIdempotency(context.Background(), IDEMPOTENT)
+        err := worker.callContext(ctx, worker.ProbeTimeout, addr, "Master.Heartbeat", &send, &reply)
+        if wait, ok := reply.backoff(); err == nil && ok {
+            // Master is alive but renewed nothing, leases run down as if it failed
+            worker.renewLeases(sent, nil, nil)
+            time.Sleep(wait)
+            continue
+        }
+        if err == nil && reply.Err == DEADLINE_EXCEEDED {
+            // Master is alive but renewed nothing, as the heartbeat arrived too late
+            worker.Logger.Debugf("Heartbeat arrived after its deadline")
+            worker.renewLeases(sent, nil, nil)
+        } else if err == nil {
+            worker.renewLeases(sent, send.Tasks, &reply)
+            if lost >= worker.LostMasterProbes {
+                worker.Logger.Infof("Master %v is back after %v failed heartbeats", addr, lost)
+            }
+            failures, lost = 0, 0
+            if reply.Err == UNKNOWN_WORKER || reply.Err == AUTH {
+                worker.rejoin()
+            }
+        } else {
+            worker.Logger.Debugf("Heartbeat failed: %v", err)
+            worker.renewLeases(sent, nil, nil)
+            failures++
+            lost++
+        }
+        if failures >= FAILOVER_PROBES && worker.resolver != nil && !drained {
+            worker.followMaster()
+            failures = 0
+        } else if !drained && worker.resolverChanged() {
+            worker.followMaster()
+        }
+
+        if lost == worker.LostMasterProbes {
+            if worker.LostMaster == LOST_MASTER_EXIT {
+                worker.abandon()
+                return
+            }
+            worker.Logger.Warnf("Master lost after %v failed heartbeats, keep trying with backoff",
+                lost)
+        }
+        time.Sleep(worker.heartbeatBackoff(lost))
+    }
+}
+
+// Keep asking master for tasks until the job is done
+// Retry later if master is not reachable
+func (worker *Worker) pullTasks() {
+    for {
+        if worker.isClosing() {
+            return
+        }
+        reply := RequestTaskReply{}
+        addr, term := worker.master()
+        if err := worker.call(
+            worker.CallTimeout,
+            addr,
+            "Master.RequestTask",
+            &RequestTaskSend{Term: term, WorkerId: worker.id, Token: worker.sessionToken()},
+            &reply,
+        ); err != nil {
+            Pause()
+            continue
+        }
+
+        switch reply.Instruction {
+        case RUN:
+            switch reply.TaskType {
+            case MAP:
+                args := &reply.MapArgs
+                if !worker.acceptTerm(args.Term) {
+                    break
+                }
+                attempt := TaskAttempt{args.JobId, args.TaskId, MAP, args.AttemptId}
+                if ctx, err := worker.startTask(context.Background(), time.Time{}, attempt, args.Lease); err == nil {
+                    worker.doMap(ctx, args)
+                } else {
+                    worker.rejectPulled(attempt, err)
+                }
+            case REDUCE:
+                args := &reply.ReduceArgs
+                if !worker.acceptTerm(args.Term) {
+                    break
+                }
+                attempt := TaskAttempt{args.JobId, args.TaskId, REDUCE, args.AttemptId}
+                if ctx, err := worker.startTask(context.Background(), time.Time{}, attempt, args.Lease); err == nil {
+                    worker.doReduce(ctx, args)
+                } else {
+                    worker.rejectPulled(attempt, err)
+                }
+            }
+        case WAIT:
+            Pause()
+        case RETRY_LATER:
+            time.Sleep(reply.RetryAfter)
+        case DONE:
+            return
+        }
+    }
+}
+
+// Report a pulled attempt that startTask rejected to master
+// So master requeues the task at once instead of waiting for it to time out
+// A duplicate is running already, and master has given up one past its deadline
+func (worker *Worker) rejectPulled(attempt TaskAttempt, err error) {
+    if err == errDuplicateAttempt || err == errDeadlinePassed {
+        return
+    }
+    worker.Logger.Warnf("Job %v: cannot start pulled %v task %v: %v", attempt.JobId,
+        taskTypeName(attempt.TaskType), attempt.TaskId, err)
+    _, term := worker.master()
+    send := TaskFailedSend{
+        Term:      term,
+        JobId:     attempt.JobId,
+        TaskId:    attempt.TaskId,
+        TaskType:  attempt.TaskType,
+        AttemptId: attempt.AttemptId,
+        WorkerId:  worker.id,
+        Token:     worker.sessionToken(),
+        Err:       err.Error(),
+    }
+    if _, err := worker.callMaster("Master.TaskFailed", &send); err != nil {
+        worker.Logger.Warnf("Cannot report rejected attempt: %v", err)
+    }
 }
 
 // A function used by master to check if client is still online
 func (worker *Worker) IsOnline(_, _ *struct{}) error {
     return nil
 }
+
+// Return true once the worker is shutting down
+func (worker *Worker) isClosing() bool {
+    worker.mu.Lock()
+    defer worker.mu.Unlock()
+    return worker.closing
+}
+
+// Shut the worker down
+// Take no new task, and wait for running tasks to finish and report until ctx is done
+// Then kill the rest, and deregister so master requeues them at once
+// Instead of waiting for the heartbeat to expire
+// Finally stop heartbeats and stop the listener, answering rpcs running until ctx is done
+// Return ErrWorkerClosed if the worker is already shutting down
+func (worker *Worker) Shutdown(ctx context.Context) error {
+    worker.mu.Lock()
+    if worker.closing {
+        worker.mu.Unlock()
+        return ErrWorkerClosed
+    }
+    worker.closing = true
+    worker.mu.Unlock()
+
+    done := make(chan struct{})
+    go func() {
+        worker.running.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-ctx.Done():
+        worker.mu.Lock()
+        for attempt := range worker.tasks {
+            worker.kill(attempt)
+        }
+        killed := len(worker.tasks)
+        worker.mu.Unlock()
+        worker.Logger.Warnf("Shutdown: kill %v running tasks", killed)
+    }
+
+    _, term := worker.master()
+    if _, err := worker.callMaster("Master.DeregisterWorker",
+        &DeregisterSend{Term: term, WorkerId: worker.id, Token: worker.sessionToken()}); err != nil {
+        worker.Logger.Warnf("Shutdown: cannot deregister: %v", err)
+    }
+
+    worker.stop(ctx)
+    return nil
+}
+
+// A function used by a draining master to tell the worker it is going away
+// Running tasks still report, but the worker no longer fails over
+func (worker *Worker) Drain(args *DrainSend, reply *GeneralReply) error {
+    if err := worker.checkToken(args.Token); err != nil {
+        return err
+    }
+    worker.mu.Lock()
+    defer worker.mu.Unlock()
+
+    if args.Term < worker.term {
+        reply.Err = STALE_TERM
+        return nil
+    }
+    if !worker.drained {
+        worker.Logger.Infof("Master %v is draining", worker.masterAddr)
+        worker.drained = true
+    }
+    reply.Err = OK
+    return nil
+}
@@ -0,0 +1,430 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// Tests of running tasks on workers
+
+package mapreduce
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPullModeRunsJob(t *testing.T) {
+	contents := []string{"a b a", "c b", "a c d"}
+	master := startMaster(t, writeInputs(t, contents...), 2, WithPullMode())
+	for i := 0; i < 2; i++ {
+		startWorker(t, master, func(worker *Worker) {
+			worker.PullMode = true
+			worker.Slots = 2
+		})
+	}
+
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+}
+
+func TestRejectedPulledTaskIsReported(t *testing.T) {
+	// The only slot stays taken, so the worker cannot start the task it pulls
+	held := TaskAttempt{JobId: 99, TaskId: 0, TaskType: MAP, AttemptId: 0}
+	master := startMaster(t, writeInputs(t, "a"), 1, WithPullMode(),
+		WithMaxTaskAttempts(1), WithTaskTimeout(time.Minute))
+	startWorker(t, master, func(worker *Worker) {
+		worker.PullMode = true
+		worker.tasks[held] = false
+		worker.cancels[held] = func() {}
+	})
+
+	// Reported, it fails at once rather than after the task timeout
+	if err := waitJob(t, master, 5*time.Second); err == nil {
+		t.Fatal("job finished with its task never run")
+	}
+	if record, _ := attemptRecord(master, MAP, 0, 0); record.Result != ATTEMPT_FAILED {
+		t.Fatalf("pulled attempt %+v, want it failed", record)
+	}
+}
+
+// Return how long master takes to give up a stopped worker and the map it was running
+// The worker runs the only map and stalls, then stop stops it
+// A second worker is there to take the retry
+func recoveryLatency(t *testing.T, stop func(worker *Worker)) time.Duration {
+	t.Helper()
+	stall := newStallingMap(1)
+	stall.killable = true
+	defer stall.release(0)
+	// Without backups, the map only runs again once master gives up the worker
+	master := startMaster(t, writeInputs(t, "a b a"), 1, WithHeartbeatTTL(time.Second),
+		WithTaskTimeout(time.Minute), WithSpeculation(1, 0))
+	stopped := startWorker(t, master, func(worker *Worker) {
+		worker.MapContext = stall.mapContext
+	})
+	waitFor(t, 5*time.Second, "the map assigned", func() bool {
+		_, ok := attemptRecord(master, MAP, 0, 0)
+		return ok
+	})
+	startWorker(t, master, nil)
+
+	start := time.Now()
+	stop(stopped)
+	waitFor(t, 5*time.Second, "the worker given up", func() bool {
+		master.mu.Lock()
+		defer master.mu.Unlock()
+		registry, ok := master.workers[stopped.Id()]
+		return !ok || registry.status == FAILED
+	})
+	latency := time.Since(start)
+	if record, _ := attemptRecord(master, MAP, 0, 0); record.Result != ATTEMPT_FAILED {
+		t.Errorf("attempt of the stopped worker %+v, want it failed", record)
+	}
+	if err := waitJob(t, master, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	return latency
+}
+
+func TestDeregisteredWorkerRecoversFasterThanKilled(t *testing.T) {
+	deregistered := recoveryLatency(t, func(worker *Worker) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := worker.Shutdown(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// Killed hard, the worker stops without a word to master
+	killed := recoveryLatency(t, func(worker *Worker) {
+		worker.mu.Lock()
+		worker.closing = true
+		worker.mu.Unlock()
+		worker.stop(context.Background())
+	})
+
+	if deregistered > 500*time.Millisecond {
+		t.Errorf("worker given up %v after it deregistered, want it at once", deregistered)
+	}
+	if killed < time.Second/2 || killed < 2*deregistered {
+		t.Errorf("worker given up %v after it was killed and %v after it deregistered, "+
+			"want the kill to wait for the heartbeat ttl", killed, deregistered)
+	}
+}
+
+func TestMapThatCannotWriteIsReportedFailed(t *testing.T) {
+	// Intermediate files cannot be written under a regular file
+	blocked := writeFile(t, t.TempDir(), "blocked", "")
+	master := startMaster(t, writeInputs(t, "a"), 1, WithMapDir(blocked),
+		WithMaxTaskAttempts(2), WithTaskTimeout(time.Minute))
+	startWorker(t, master, nil)
+
+	// Reported, each attempt fails at once rather than after the task timeout
+	err := waitJob(t, master, 5*time.Second)
+	if err == nil {
+		t.Fatal("job finished without its intermediate files")
+	}
+	for attemptId := AttemptId(0); attemptId < 2; attemptId++ {
+		if record, _ := attemptRecord(master, MAP, 0, attemptId); record.Result != ATTEMPT_FAILED {
+			t.Errorf("attempt %v %+v, want it failed", attemptId, record)
+		}
+	}
+}
+
+func TestReduceThatCannotWriteIsReportedFailed(t *testing.T) {
+	// Output cannot be written under a regular file
+	blocked := writeFile(t, t.TempDir(), "blocked", "")
+	master := startMaster(t, writeInputs(t, "a"), 1, WithOutputDir(blocked),
+		WithMaxTaskAttempts(2), WithTaskTimeout(time.Minute))
+	startWorker(t, master, nil)
+
+	// Reported, each attempt fails at once rather than after the task timeout
+	err := waitJob(t, master, 5*time.Second)
+	if err == nil {
+		t.Fatal("job finished without its output")
+	}
+	for attemptId := AttemptId(0); attemptId < 2; attemptId++ {
+		if record, _ := attemptRecord(master, REDUCE, 0, attemptId); record.Result != ATTEMPT_FAILED {
+			t.Errorf("attempt %v %+v, want it failed", attemptId, record)
+		}
+	}
+}
+
+func TestAttemptThatCannotCommitIsReportedFailed(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		nReduce  int
+		taskType TaskType
+		// The file the attempt commits, given the map and output directories
+		committed func(mapDir, outputDir string) string
+	}{
+		{"partition", 1, MAP, func(mapDir, _ string) string { return intermediateName(mapDir, DEFAULT_JOB, 0, 0) }},
+		{"manifest", 1, MAP, func(mapDir, _ string) string { return manifestName(mapDir, DEFAULT_JOB, 0) }},
+		{"map-only output", 0, MAP, func(_, outputDir string) string { return outputName(outputDir, 0) }},
+		{"reduce output", 1, REDUCE, func(_, outputDir string) string { return outputName(outputDir, 0) }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mapDir, outputDir := t.TempDir(), t.TempDir()
+			// A file cannot be renamed over a directory that is not empty
+			writeFile(t, test.committed(mapDir, outputDir), "blocked", "")
+			master := startMaster(t, writeInputs(t, "a"), test.nReduce, WithMapDir(mapDir),
+				WithOutputDir(outputDir), WithMaxTaskAttempts(2), WithTaskTimeout(time.Minute))
+			startWorker(t, master, nil)
+
+			if err := waitJob(t, master, 5*time.Second); err == nil {
+				t.Fatal("job finished without committing")
+			}
+			for attemptId := AttemptId(0); attemptId < 2; attemptId++ {
+				if record, _ := attemptRecord(master, test.taskType, 0, attemptId); record.Result != ATTEMPT_FAILED {
+					t.Errorf("attempt %v %+v, want it failed", attemptId, record)
+				}
+			}
+		})
+	}
+}
+
+// Sum the values of key, so counts combined on the map side add up
+func sumValues(key string, values []string) string {
+	sum := 0
+	for _, value := range values {
+		n, _ := strconv.Atoi(value)
+		sum += n
+	}
+	return strconv.Itoa(sum)
+}
+
+// Run word count on contents, summing counts, with combiner if not nil
+// Return the output and the counters of the job
+func runWordCount(t *testing.T, contents []string,
+	combiner func(string, []string) string) (map[string]string, JobCounters) {
+	t.Helper()
+	master := startMaster(t, writeInputs(t, contents...), 2)
+	startWorker(t, master, func(worker *Worker) {
+		worker.ReduceContext = func(ctx context.Context, key string, values []string) string {
+			return sumValues(key, values)
+		}
+		worker.Combiner = combiner
+	})
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	status := JobStatus{}
+	if err := master.GetJobStatus(&JobStatusSend{JobId: DEFAULT_JOB}, &status); err != nil {
+		t.Fatal(err)
+	}
+	return readOutput(t, master.config.OutputDir), status.Counters
+}
+
+func TestCombinerShrinksMapOutput(t *testing.T) {
+	contents := []string{"a b a c a b", "b b c a", "d a a"}
+	plain, plainCounters := runWordCount(t, contents, nil)
+	combined, combinedCounters := runWordCount(t, contents, sumValues)
+
+	checkCounts(t, plain, wordCounts(contents...))
+	checkCounts(t, combined, plain)
+	// One pair per word of the inputs without the combiner, per distinct word with it
+	if plainCounters.Map.OutputRecords != 13 || combinedCounters.Map.OutputRecords != 3+3+2 {
+		t.Errorf("map wrote %v records with the combiner and %v without, want 8 and 13",
+			combinedCounters.Map.OutputRecords, plainCounters.Map.OutputRecords)
+	}
+	if combinedCounters.Map.OutputBytes >= plainCounters.Map.OutputBytes {
+		t.Errorf("map wrote %v bytes with the combiner, %v without", combinedCounters.Map.OutputBytes,
+			plainCounters.Map.OutputBytes)
+	}
+}
+
+func TestWorkerRunsTasksInEverySlot(t *testing.T) {
+	var contents []string
+	for i := 0; i < 20; i++ {
+		contents = append(contents, "a b c "+strconv.Itoa(i))
+	}
+	var mu sync.Mutex
+	running, most := 0, 0
+	master := startMaster(t, writeInputs(t, contents...), 4)
+	startWorker(t, master, func(worker *Worker) {
+		worker.Slots = 4
+		worker.MapContext = func(ctx context.Context, file, content string) []KeyValue {
+			mu.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			mu.Unlock()
+			// Long enough for the other slots to start
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return wcMap(file, content)
+		}
+	})
+
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+	mu.Lock()
+	defer mu.Unlock()
+	if most != 4 {
+		t.Fatalf("at most %v maps ran at the same time, want 4", most)
+	}
+}
+
+func TestKilledAttemptOutputNeverVisible(t *testing.T) {
+	contents := []string{"a b a"}
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	var killed int32
+	master := startMaster(t, writeInputs(t, contents...), 1, WithTaskTimeout(300*time.Millisecond),
+		WithEventLog(path), WithKeepIntermediate())
+	worker := startWorker(t, master, func(worker *Worker) {
+		worker.MapContext = func(ctx context.Context, file, content string) []KeyValue {
+			if atomic.AddInt32(&killed, 1) > 1 {
+				return wcMap(file, content)
+			}
+			// Killed by the timeout, but returns a result all the same
+			<-ctx.Done()
+			return []KeyValue{{Key: "zombie", Value: "1"}}
+		}
+	})
+
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, readOutput(t, master.config.OutputDir), wordCounts(contents...))
+	// Give the killed attempt time to report, were it to
+	time.Sleep(100 * time.Millisecond)
+	for _, kv := range readPairs(t, intermediateName(master.config.MapDir, DEFAULT_JOB, 0, 0)) {
+		if kv.Key == "zombie" {
+			t.Fatal("output of the killed attempt committed")
+		}
+	}
+	worker.mu.Lock()
+	running := len(worker.tasks)
+	worker.mu.Unlock()
+	if running != 0 {
+		t.Errorf("worker holds %v slots once the job is done", running)
+	}
+	if temps, _ := filepath.Glob(filepath.Join(master.config.MapDir, IRP+"-tmp-*")); len(temps) != 0 {
+		t.Errorf("temp files %v of the killed attempt left", temps)
+	}
+	shutdownMaster(master)
+	events, err := ReadEvents(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		if event.TaskType == MAP && event.AttemptId == 0 &&
+			(event.Kind == EVENT_FINISHED || event.Kind == EVENT_WASTE) {
+			t.Errorf("killed attempt reported: %+v", event)
+		}
+	}
+}
+
+func TestStartDeliveredThriceRunsOnce(t *testing.T) {
+	// Record the start master sends, so it can be delivered again
+	var mu sync.Mutex
+	var start *MapStartSend
+	master := startMaster(t, writeInputs(t, "a b"), 1, WithInterceptors(Interceptor{
+		Call: func(ctx context.Context, info *RPCInfo, next func(ctx context.Context) error) error {
+			if args, ok := info.Args.(*MapStartSend); ok {
+				mu.Lock()
+				copied := *args
+				start = &copied
+				mu.Unlock()
+			}
+			return next(ctx)
+		},
+	}))
+	var runs int32
+	worker := startWorker(t, master, func(worker *Worker) {
+		worker.MapContext = func(ctx context.Context, file, content string) []KeyValue {
+			atomic.AddInt32(&runs, 1)
+			return wcMap(file, content)
+		}
+	})
+
+	// The attempt has ended and master has heard of it
+	if err := waitJob(t, master, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	args := start
+	mu.Unlock()
+	if args == nil {
+		t.Fatal("master sent no StartMap")
+	}
+	// Delivered twice more, as by retries whose replies were lost
+	for i := 0; i < 2; i++ {
+		reply := StartReply{}
+		err := Call(context.Background(), worker.listener.Addr().String(), "Worker.StartMap", args, &reply)
+		if err != nil || reply.Err != OK || reply.Outcome != ATTEMPT_FINISHED {
+			t.Fatalf("start delivered again: %+v, %v, want %v with outcome %v",
+				reply, err, OK, ATTEMPT_FINISHED)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if runs := atomic.LoadInt32(&runs); runs != 1 {
+		t.Fatalf("map function ran %v times, want once", runs)
+	}
+}
+
+func TestEndedAttemptForgottenOnceItsDispatchExpires(t *testing.T) {
+	worker := MakeWorker(0, "localhost:1", wcMap, wcReduce)
+	kept := TaskAttempt{DEFAULT_JOB, 0, MAP, 0}
+	expired := TaskAttempt{DEFAULT_JOB, 1, MAP, 0}
+	forever := TaskAttempt{DEFAULT_JOB, 2, MAP, 0}
+	for attempt, expiry := range map[TaskAttempt]time.Time{
+		kept:    time.Now().Add(time.Minute),
+		expired: time.Now().Add(-time.Second),
+		forever: {},
+	} {
+		if _, err := worker.startTask(context.Background(), expiry, attempt, 0); err != nil {
+			t.Fatal(err)
+		}
+		worker.endTask(attempt)
+	}
+
+	for attempt, want := range map[TaskAttempt]string{
+		kept:    ATTEMPT_FINISHED,
+		expired: "",
+		forever: ATTEMPT_FINISHED,
+	} {
+		if got := worker.outcome(attempt); got != want {
+			t.Errorf("outcome of %+v is %q, want %q", attempt, got, want)
+		}
+	}
+}
+
+func TestEndedAttemptForgottenWhenMasterDoesNotKnowWorker(t *testing.T) {
+	master := startMaster(t, writeInputs(t, "a b"), 1)
+	// The worker stays off the job, so only the attempts of the test run
+	master.PauseScheduling()
+	worker := startWorker(t, master, func(worker *Worker) {
+		worker.Slots = 2
+	})
+	reported := TaskAttempt{DEFAULT_JOB, 0, MAP, 0}
+	refused := TaskAttempt{DEFAULT_JOB, 1, MAP, 0}
+	for _, attempt := range []TaskAttempt{reported, refused} {
+		if _, err := worker.startTask(context.Background(), time.Time{}, attempt, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	worker.report(&TaskFinishedSend{JobId: DEFAULT_JOB, TaskId: 0, TaskType: MAP,
+		WorkerId: worker.id, Token: worker.sessionToken()})
+
+	// The second ends once the worker switched to a master it has not registered with
+	moved := startMaster(t, writeInputs(t, "c d", "e"), 1)
+	worker.mu.Lock()
+	worker.masterAddr = moved.Addr().String()
+	worker.mu.Unlock()
+	worker.report(&TaskFinishedSend{JobId: DEFAULT_JOB, TaskId: 1, TaskType: MAP,
+		WorkerId: worker.id, Token: worker.sessionToken()})
+
+	if got := worker.outcome(reported); got != ATTEMPT_FINISHED {
+		t.Errorf("outcome of the reported attempt is %q, want %q", got, ATTEMPT_FINISHED)
+	}
+	// A start of it from the moved master runs
+	if got := worker.outcome(refused); got != "" {
+		t.Errorf("outcome of the attempt master does not know of is %q, want it forgotten", got)
+	}
+}
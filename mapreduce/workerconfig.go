@@ -0,0 +1,150 @@
+// Copyright 2020 NeoClear. All rights reserved.
+// The configuration of master a worker follows, sent on registration
+
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// What a worker takes from master every time it registers
+// So it follows the configuration master runs with, not defaults of its own
+// A worker registering again once master restarts picks up what changed
+type WorkerConfig struct {
+	// The oldest job still running and its number of reduce tasks
+	// JobId is -1 if no job is running, each task carries its own anyway
+	JobId     JobId
+	ReduceNum int
+	// Where the worker writes intermediate files, see WithMapDir
+	// And where reduce tasks write output unless their job sets its own
+	MapDir    string
+	OutputDir string
+	// How often the worker sends heartbeats, see WithHeartbeatInterval
+	// And how long master waits for one before failing the worker
+	HeartbeatInterval time.Duration
+	HeartbeatTTL      time.Duration
+	// The compression of jobs without their own policy
+	// Nil for none, or if the worker cannot decode its codec
+	Compression *CompressionPolicy
+}
+
+// Return the configuration a worker follows until it registers
+func defaultWorkerConfig() WorkerConfig {
+	return WorkerConfig{
+		JobId:             -1,
+		MapDir:            MAP_DIR,
+		OutputDir:         REDUCE_DIR,
+		HeartbeatInterval: HEARTBEAT_INTERVAL,
+		HeartbeatTTL:      HEARTBEAT_TTL,
+	}
+}
+
+// Return the configuration sent to a worker registering with capabilities
+// Must be called with lock held
+func (master *Master) workerConfig(capabilities Capabilities) WorkerConfig {
+	config := WorkerConfig{
+		JobId:             -1,
+		MapDir:            master.config.MapDir,
+		OutputDir:         master.config.OutputDir,
+		HeartbeatInterval: master.config.HeartbeatInterval,
+		HeartbeatTTL:      master.config.HeartbeatTTL,
+		Compression:       master.config.Compression.acceptedBy(capabilities.Compression),
+	}
+	for id := JobId(0); id < master.nextJobId; id++ {
+		if job, ok := master.jobs[id]; ok && !job.halted() {
+			config.JobId, config.ReduceNum = id, job.nReduce
+			break
+		}
+	}
+	return config
+}
+
+// Return the configuration the worker follows, as master last sent it
+func (worker *Worker) Config() WorkerConfig {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	return worker.settings
+}
+
+// Follow the configuration master sent on registration
+// Attempts already running keep the directory they started with
+// A field master leaves unset keeps its default
+func (worker *Worker) configure(config WorkerConfig) {
+	defaults := defaultWorkerConfig()
+	if config.MapDir == "" {
+		config.MapDir = defaults.MapDir
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = defaults.HeartbeatInterval
+	}
+	worker.mu.Lock()
+	old := worker.settings
+	worker.settings = config
+	worker.mu.Unlock()
+
+	if old.MapDir != config.MapDir || old.HeartbeatInterval != config.HeartbeatInterval {
+		worker.Logger.Infof("Master sets map dir %v, heartbeat every %v, ttl %v",
+			config.MapDir, config.HeartbeatInterval, config.HeartbeatTTL)
+	}
+}
+
+// Return the directory the worker writes intermediate files to
+func (worker *Worker) mapDir() string {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	return worker.settings.MapDir
+}
+
+// Return dir, the map dir a task came with, or the one of the worker if it is empty
+func (worker *Worker) taskMapDir(dir string) string {
+	if dir != "" {
+		return dir
+	}
+	return worker.mapDir()
+}
+
+// Return the interval between heartbeats master asks for
+func (worker *Worker) heartbeatInterval() time.Duration {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	return worker.settings.HeartbeatInterval
+}
+
+// Tell workers to write intermediate files to dir instead of MAP_DIR
+// Relative to the directory each worker runs in
+func WithMapDir(dir string) Option {
+	return func(config *MasterConfig) error {
+		if dir == "" {
+			return errors.New("WithMapDir: empty directory")
+		}
+		config.MapDir = dir
+		return nil
+	}
+}
+
+// Tell workers to send a heartbeat every interval instead of HEARTBEAT_INTERVAL
+// HeartbeatTTL and TaskLease must still allow for it, see WithHeartbeatTTL
+func WithHeartbeatInterval(interval time.Duration) Option {
+	return func(config *MasterConfig) error {
+		if interval <= 0 {
+			return fmt.Errorf("WithHeartbeatInterval: %v is not positive", interval)
+		}
+		config.HeartbeatInterval = interval
+		return nil
+	}
+}
+
+// Return error if the heartbeat interval is too long for HeartbeatTTL or TaskLease
+// Checked once every option is applied, as they may come in any order
+func (config *MasterConfig) checkHeartbeat() error {
+	if config.HeartbeatTTL < config.HeartbeatInterval {
+		return fmt.Errorf("WithHeartbeatTTL: ttl must not be shorter than the heartbeat interval %v",
+			config.HeartbeatInterval)
+	}
+	if config.TaskLease != 0 && config.TaskLease < 2*config.HeartbeatInterval {
+		return fmt.Errorf("WithTaskLease: lease must be at least %v", 2*config.HeartbeatInterval)
+	}
+	return nil
+}